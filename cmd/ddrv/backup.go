@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	dp "github.com/forscht/ddrv/internal/dataprovider"
+	"github.com/forscht/ddrv/pkg/ddrv"
+)
+
+// BackupConfig configures scheduled snapshots of the dataprovider uploaded to discord
+type BackupConfig struct {
+	// Channel is the channel snapshots are uploaded to, it must not be one of the ddrv channels
+	Channel string `mapstructure:"channel"`
+	// Interval is how often a snapshot is taken, 0 disables the job
+	Interval time.Duration `mapstructure:"interval"`
+	// Keep is the number of snapshots kept in the channel, defaults to dp.DefaultBackupKeep
+	Keep int `mapstructure:"keep"`
+}
+
+// runBackup implements the backup command, it takes a snapshot once and exits
+func runBackup(driver *ddrv.Driver, cfg BackupConfig, args []string) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	channel := fs.String("channel", cfg.Channel, "channel the snapshot is uploaded to")
+	keep := fs.Int("keep", cfg.Keep, "number of snapshots kept in the channel")
+	_ = fs.Parse(args)
+
+	if err := backup(driver, dp.BackupOptions{Channel: *channel, Keep: *keep}); err != nil {
+		log.Fatal().Str("c", "backup").Err(err).Msg("failed to back up dataprovider")
+	}
+	os.Exit(0)
+}
+
+// runRestore implements the restore command, it lists snapshots of the backup channel,
+// or replaces the dataprovider with the snapshot with given id, and exits.
+func runRestore(driver *ddrv.Driver, cfg BackupConfig, args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	channel := fs.String("channel", cfg.Channel, "channel snapshots are read from")
+	_ = fs.Parse(args)
+
+	ctx := context.Background()
+	if fs.NArg() == 0 {
+		snapshots, err := dp.Snapshots(ctx, driver, *channel)
+		if err != nil {
+			log.Fatal().Str("c", "restore").Err(err).Msg("failed to list snapshots")
+		}
+		for _, s := range snapshots {
+			fmt.Printf("%s\t%s\t%s\t%d\n", s.Id, s.Provider, s.Created.Local().Format(time.RFC3339), s.Size)
+		}
+		os.Exit(0)
+	}
+	s, err := dp.Restore(ctx, driver, *channel, fs.Arg(0))
+	if err != nil {
+		log.Fatal().Str("c", "restore").Err(err).Msg("failed to restore snapshot")
+	}
+	log.Info().Str("c", "restore").Str("id", s.Id).Int64("size", s.Size).Msg("restored snapshot")
+	os.Exit(0)
+}
+
+// scheduleBackup periodically uploads snapshots of the dataprovider
+func scheduleBackup(driver *ddrv.Driver, cfg BackupConfig) {
+	if cfg.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := backup(driver, dp.BackupOptions{Channel: cfg.Channel, Keep: cfg.Keep}); err != nil {
+			log.Error().Str("c", "backup").Err(err).Msg("failed to back up dataprovider")
+		}
+	}
+}
+
+func backup(driver *ddrv.Driver, opts dp.BackupOptions) error {
+	started := time.Now()
+	s, err := dp.Backup(context.Background(), driver, opts)
+	if s != nil {
+		log.Info().Str("c", "backup").
+			Str("id", s.Id).
+			Int64("size", s.Size).
+			Dur("took", time.Since(started)).
+			Msg("uploaded snapshot")
+	}
+	return err
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	dp "github.com/forscht/ddrv/internal/dataprovider"
+	"github.com/forscht/ddrv/pkg/ddrv"
+)
+
+// GCConfig configures the scheduled garbage collection of orphaned messages
+type GCConfig struct {
+	// Interval is how often channels are scanned for orphaned messages, 0 disables the job
+	Interval time.Duration `mapstructure:"interval"`
+	// Grace is how old a message must be before it is collected, defaults to dp.DefaultGCGrace
+	Grace time.Duration `mapstructure:"grace"`
+	// DryRun only logs orphaned messages and sparse packfiles without deleting or rewriting them
+	DryRun bool `mapstructure:"dry_run"`
+	// Sparse is the share of a packfile used by files below which it is rewritten, defaults to dp.DefaultGCSparse
+	Sparse float64 `mapstructure:"sparse"`
+}
+
+// runGC implements the gc command, it collects orphaned messages once and exits
+func runGC(driver *ddrv.Driver, backup string, args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only report orphaned messages without deleting them")
+	grace := fs.Duration("grace", dp.DefaultGCGrace, "skip messages younger than grace, uploads may still be in flight")
+	sparse := fs.Float64("sparse", dp.DefaultGCSparse, "rewrite packfiles whose share used by files is below sparse")
+	_ = fs.Parse(args)
+
+	report, err := collectGarbage(driver, dp.GCOptions{Channels: fs.Args(), Backup: backup, Grace: *grace, DryRun: *dryRun, Sparse: *sparse})
+	if err != nil {
+		log.Fatal().Str("c", "gc").Err(err).Msg("failed to collect garbage")
+	}
+	if *dryRun {
+		for _, orphan := range report.Orphans {
+			log.Info().Str("c", "gc").Int64("mid", orphan.MId).Int("size", orphan.Size).Str("url", orphan.URL).Msg("orphaned message")
+		}
+	}
+	os.Exit(0)
+}
+
+// scheduleGC periodically deletes orphaned messages from discord
+func scheduleGC(driver *ddrv.Driver, cfg GCConfig, backup string) {
+	if cfg.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := collectGarbage(driver, dp.GCOptions{Backup: backup, Grace: cfg.Grace, DryRun: cfg.DryRun, Sparse: cfg.Sparse}); err != nil {
+			log.Error().Str("c", "gc").Err(err).Msg("failed to collect garbage")
+		}
+	}
+}
+
+func collectGarbage(driver *ddrv.Driver, opts dp.GCOptions) (*dp.GCReport, error) {
+	report, err := dp.CollectGarbage(context.Background(), driver, opts)
+	if report != nil {
+		log.Info().Str("c", "gc").
+			Int("channels", report.Channels).
+			Int("scanned", report.Scanned).
+			Int("young", report.Young).
+			Int("orphans", len(report.Orphans)).
+			Int64("size", report.Size).
+			Int("deleted", report.Deleted).
+			Int("sparse", report.Sparse).
+			Int("repacked", report.Repacked).
+			Int64("unused", report.Unused).
+			Bool("dry_run", opts.DryRun).
+			Msg("garbage collection finished")
+	}
+	return report, err
+}
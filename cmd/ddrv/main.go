@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 	"time"
 
 	zl "github.com/rs/zerolog"
@@ -21,17 +24,23 @@ import (
 
 // Config represents the entire configuration as defined in the YAML file.
 type Config struct {
-	Ddrv struct {
-		Tokens    []string `mapstructure:"token"`
-		TokenType int      `mapstructure:"token_type"`
-		Channels  []string `mapstructure:"channels"`
-		ChunkSize int      `mapstructure:"chunk_size"`
-		Nitro     bool     `mapstructure:"nitro"`
-	} `mapstructure:"ddrv"`
+	Ddrv ddrv.Config `mapstructure:"ddrv"`
 
 	Dataprovider struct {
 		Bolt     boltdb.Config   `mapstructure:"boltdb"`
 		Postgres postgres.Config `mapstructure:"postgres"`
+		// SessionTTL is how long an upload session can stay inactive before it is
+		// removed along with its messages, defaults to defaultSessionTTL.
+		SessionTTL time.Duration `mapstructure:"session_ttl"`
+		// DeletionInterval is how often messages of removed and truncated files are
+		// deleted from discord, defaults to defaultDeletionInterval.
+		DeletionInterval time.Duration `mapstructure:"deletion_interval"`
+		// GC deletes messages no file references, e.g. chunks of failed uploads.
+		GC GCConfig `mapstructure:"gc"`
+		// Backup uploads snapshots of the dataprovider to a dedicated channel.
+		Backup BackupConfig `mapstructure:"backup"`
+		// Refresh renews attachment links in background before they expire.
+		Refresh RefreshConfig `mapstructure:"refresh"`
 	} `mapstructure:"dataprovider"`
 
 	Frontend struct {
@@ -42,13 +51,29 @@ type Config struct {
 
 var config Config
 
+const defaultSessionTTL = 24 * time.Hour
+
+const defaultDeletionInterval = time.Minute
+
 var (
 	showVersion = flag.Bool("version", false, "print version information and exit")
 	debugMode   = flag.Bool("debug", false, "enable debug logs")
 	configFile  = flag.String("config", "", "path to ddrv configuration file")
 )
 
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n\nCommands:\n", os.Args[0])
+	fmt.Fprintf(flag.CommandLine.Output(), "  gc [-dry-run] [-grace duration] [-sparse ratio] [channel...]\n\tdelete messages no file references, rewrite sparse packfiles and exit\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  scrub [-full] [-mark] [-interval duration]\n\tverify every stored chunk can be read, report damaged files and exit\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  recover [-dry-run] [channel...]\n\trebuild files from manifests of chunk messages into the dataprovider and exit\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  backup [-channel id] [-keep n]\n\tupload a snapshot of the dataprovider to the backup channel and exit\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  restore [-channel id] [snapshot]\n\tlist snapshots of the backup channel, or replace the dataprovider with the snapshot, and exit\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  salt\n\tprint a new random encryption salt and exit\n\nFlags:\n")
+	flag.PrintDefaults()
+}
+
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 
 	// Check if a version flag is set
@@ -67,11 +92,18 @@ func main() {
 		zl.SetGlobalLevel(zl.DebugLevel)
 	}
 
+	// Generate an encryption salt, no config is needed
+	if flag.Arg(0) == "salt" {
+		runSalt()
+	}
+
 	// Load config file
 	initConfig()
+	// Encryption needs a salt
+	checkSalt()
 
 	// Create a ddrv driver
-	driver, err := ddrv.New((*ddrv.Config)(&config.Ddrv))
+	driver, err := ddrv.New(&config.Ddrv)
 	if err != nil {
 		log.Fatal().Err(err).Str("c", "main").Msg("failed to open ddrv driver")
 	}
@@ -88,18 +120,96 @@ func main() {
 		log.Fatal().Str("c", "main").Msg("dataprovider config is missing")
 	}
 	dp.Load(provider)
+	// Chunk index lives in data provider
+	if config.Ddrv.Dedup {
+		driver.Lookup = dp.Lookup
+	}
+
+	switch flag.Arg(0) {
+	case "":
+	case "gc":
+		runGC(driver, config.Dataprovider.Backup.Channel, flag.Args()[1:])
+	case "scrub":
+		runScrub(driver, flag.Args()[1:])
+	case "recover":
+		runRecover(driver, flag.Args()[1:])
+	case "backup":
+		runBackup(driver, config.Dataprovider.Backup, flag.Args()[1:])
+	case "restore":
+		runRestore(driver, config.Dataprovider.Backup, flag.Args()[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Remove abandoned upload sessions
+	go sweepSessions(config.Dataprovider.SessionTTL)
+	// Delete messages of removed files
+	go processDeletions(driver, config.Dataprovider.DeletionInterval)
+	// Delete orphaned messages
+	go scheduleGC(driver, config.Dataprovider.GC, config.Dataprovider.Backup.Channel)
+	// Upload snapshots of the dataprovider
+	go scheduleBackup(driver, config.Dataprovider.Backup)
+	// Refresh links which expire soon
+	go scheduleRefresh(driver, config.Dataprovider.Refresh)
 
 	errCh := make(chan error)
 	// Create and start ftp server
 	go func() { errCh <- ftp.Serv(driver, &config.Frontend.FTP) }()
 	// Create and start http server
 	go func() { errCh <- http.Serv(driver, &config.Frontend.HTTP) }()
+	// Stop on interrupt
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() { <-sigCh; errCh <- nil }()
 
-	if err = <-errCh; err != nil {
+	err = <-errCh
+	// Small files waiting in the open packfile are uploaded and committed before exiting
+	if cerr := driver.Close(); cerr != nil {
+		log.Error().Str("c", "main").Err(cerr).Msg("failed to close ddrv driver")
+	}
+	_ = provider.Close()
+	if err != nil {
 		log.Fatal().Str("c", "main").Err(err).Msgf("ddrv crashed")
 	}
 }
 
+// sweepSessions periodically removes upload sessions inactive for longer than ttl
+func sweepSessions(ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = defaultSessionTTL
+	}
+	interval := ttl / 4
+	if interval > time.Hour {
+		interval = time.Hour
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for ; true; <-ticker.C {
+		if err := dp.SweepSessions(ttl); err != nil {
+			log.Error().Str("c", "main").Err(err).Msg("failed to sweep upload sessions")
+		}
+	}
+}
+
+// processDeletions periodically deletes messages queued for deletion from discord
+func processDeletions(driver *ddrv.Driver, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultDeletionInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for ; true; <-ticker.C {
+		deleted, err := dp.ProcessDeletions(context.Background(), driver)
+		if err != nil {
+			log.Error().Str("c", "main").Err(err).Msg("failed to delete queued messages")
+		}
+		if deleted > 0 {
+			log.Info().Str("c", "main").Int("count", deleted).Msg("deleted messages of removed files")
+		}
+	}
+}
+
 func initConfig() {
 	// Setup config
 	viper.SetConfigName("config")
@@ -116,12 +226,49 @@ func initConfig() {
 	// Bind env
 	_ = viper.BindEnv("ddrv.token", "TOKEN")
 	_ = viper.BindEnv("ddrv.token_type", "TOKEN_TYPE")
+	_ = viper.BindEnv("ddrv.token_cooldown", "TOKEN_COOLDOWN")
 	_ = viper.BindEnv("ddrv.channels", "CHANNELS")
+	_ = viper.BindEnv("ddrv.webhooks", "WEBHOOKS")
+	_ = viper.BindEnv("ddrv.replicas", "REPLICAS")
+	_ = viper.BindEnv("ddrv.data_shards", "DATA_SHARDS")
+	_ = viper.BindEnv("ddrv.parity_shards", "PARITY_SHARDS")
+	_ = viper.BindEnv("ddrv.store_dir", "STORE_DIR")
+	_ = viper.BindEnv("ddrv.bulk_delete", "BULK_DELETE")
 	_ = viper.BindEnv("ddrv.nitro", "NITRO")
 	_ = viper.BindEnv("ddrv.chunk_size", "CHUNK_SIZE")
+	_ = viper.BindEnv("ddrv.attachments", "ATTACHMENTS")
+	_ = viper.BindEnv("ddrv.pack_threshold", "PACK_THRESHOLD")
+	_ = viper.BindEnv("ddrv.pack_delay", "PACK_DELAY")
+	_ = viper.BindEnv("ddrv.api_url", "API_URL")
+	_ = viper.BindEnv("ddrv.cdn_hosts", "CDN_HOSTS")
+	_ = viper.BindEnv("ddrv.proxy", "PROXY")
+	_ = viper.BindEnv("ddrv.passphrase", "PASSPHRASE")
+	_ = viper.BindEnv("ddrv.cipher", "CIPHER")
+	_ = viper.BindEnv("ddrv.salt", "SALT")
+	_ = viper.BindEnv("ddrv.salt_file", "SALT_FILE")
+	_ = viper.BindEnv("ddrv.dedup", "DEDUP")
+	_ = viper.BindEnv("ddrv.retry.max_attempts", "RETRY_MAX_ATTEMPTS")
+	_ = viper.BindEnv("ddrv.retry.min_backoff", "RETRY_MIN_BACKOFF")
+	_ = viper.BindEnv("ddrv.retry.max_backoff", "RETRY_MAX_BACKOFF")
+	_ = viper.BindEnv("ddrv.prefetch", "PREFETCH")
+	_ = viper.BindEnv("ddrv.prefetch_memory", "PREFETCH_MEMORY")
+	_ = viper.BindEnv("ddrv.spool_dir", "SPOOL_DIR")
+	_ = viper.BindEnv("ddrv.memory_buffer", "MEMORY_BUFFER")
 
 	_ = viper.BindEnv("dataprovider.boltdb.db_path", "BOLTDB_DB_PATH")
 	_ = viper.BindEnv("dataprovider.postgres.db_url", "POSTGRES_DB_URL")
+	_ = viper.BindEnv("dataprovider.session_ttl", "SESSION_TTL")
+	_ = viper.BindEnv("dataprovider.deletion_interval", "DELETION_INTERVAL")
+	_ = viper.BindEnv("dataprovider.gc.interval", "GC_INTERVAL")
+	_ = viper.BindEnv("dataprovider.gc.grace", "GC_GRACE")
+	_ = viper.BindEnv("dataprovider.gc.dry_run", "GC_DRY_RUN")
+	_ = viper.BindEnv("dataprovider.gc.sparse", "GC_SPARSE")
+	_ = viper.BindEnv("dataprovider.backup.channel", "BACKUP_CHANNEL")
+	_ = viper.BindEnv("dataprovider.backup.interval", "BACKUP_INTERVAL")
+	_ = viper.BindEnv("dataprovider.backup.keep", "BACKUP_KEEP")
+	_ = viper.BindEnv("dataprovider.refresh.interval", "REFRESH_INTERVAL")
+	_ = viper.BindEnv("dataprovider.refresh.window", "REFRESH_WINDOW")
+	_ = viper.BindEnv("dataprovider.refresh.budget", "REFRESH_BUDGET")
 
 	_ = viper.BindEnv("frontend.ftp.addr", "FTP_ADDR")
 	_ = viper.BindEnv("frontend.ftp.username", "FTP_USERNAME")
@@ -141,3 +288,23 @@ func initConfig() {
 		log.Fatal().Str("c", "config").Err(err).Msg("failed to decode config into struct")
 	}
 }
+
+// checkSalt stops ddrv if a passphrase is set without a salt, the encryption key can not be derived without it
+func checkSalt() {
+	if config.Ddrv.Passphrase == "" || config.Ddrv.Salt != "" || config.Ddrv.SaltFile != "" {
+		return
+	}
+	log.Fatal().Str("c", "config").Msg("passphrase is set without an encryption salt. Generate one with `ddrv salt` " +
+		"and set it as ddrv.salt (env SALT), or write it to a file and set ddrv.salt_file (env SALT_FILE). " +
+		"Keep it safe along with the passphrase, files can not be read without it")
+}
+
+// runSalt prints a new random encryption salt and exits
+func runSalt() {
+	salt, err := ddrv.NewSalt()
+	if err != nil {
+		log.Fatal().Str("c", "main").Err(err).Msg("failed to generate encryption salt")
+	}
+	fmt.Println(salt)
+	os.Exit(0)
+}
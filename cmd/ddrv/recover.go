@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+
+	"github.com/rs/zerolog/log"
+
+	dp "github.com/forscht/ddrv/internal/dataprovider"
+	"github.com/forscht/ddrv/pkg/ddrv"
+)
+
+// runRecover implements the recover command, it rebuilds files from manifests of chunk messages
+// into the configured dataprovider and exits.
+func runRecover(driver *ddrv.Driver, args []string) {
+	fs := flag.NewFlagSet("recover", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only report recoverable files without creating them")
+	_ = fs.Parse(args)
+
+	report, err := dp.Recover(context.Background(), driver, dp.RecoverOptions{Channels: fs.Args(), DryRun: *dryRun})
+	if report != nil {
+		for _, p := range report.Recovered {
+			log.Info().Str("c", "recover").Str("path", p).Bool("dry_run", *dryRun).Msg("recovered file")
+		}
+		for _, p := range report.Incomplete {
+			log.Warn().Str("c", "recover").Str("path", p).Msg("file has missing chunks")
+		}
+		for _, p := range report.Existing {
+			log.Warn().Str("c", "recover").Str("path", p).Msg("file already exists")
+		}
+		log.Info().Str("c", "recover").
+			Int("messages", report.Messages).
+			Int("chunks", report.Chunks).
+			Int("unreadable", report.Unreadable).
+			Int("recovered", len(report.Recovered)).
+			Int("incomplete", len(report.Incomplete)).
+			Int("existing", len(report.Existing)).
+			Msg("recovery finished")
+	}
+	if err != nil {
+		log.Fatal().Str("c", "recover").Err(err).Msg("failed to recover files")
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	dp "github.com/forscht/ddrv/internal/dataprovider"
+	"github.com/forscht/ddrv/pkg/ddrv"
+)
+
+// RefreshConfig configures the background refresh of attachment links before they expire
+type RefreshConfig struct {
+	// Interval is how often nodes are scanned for expiring links, 0 disables the job
+	Interval time.Duration `mapstructure:"interval"`
+	// Window is how long before their expiry links are refreshed, defaults to dp.DefaultRefreshWindow
+	Window time.Duration `mapstructure:"window"`
+	// Budget is the maximum number of nodes refreshed per run, defaults to dp.DefaultRefreshBudget
+	Budget int `mapstructure:"budget"`
+}
+
+// scheduleRefresh periodically refreshes links of nodes which expire soon
+func scheduleRefresh(driver *ddrv.Driver, cfg RefreshConfig) {
+	if cfg.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for ; true; <-ticker.C {
+		refreshed, err := dp.RefreshExpiring(context.Background(), driver, dp.RefreshOptions{Window: cfg.Window, Budget: cfg.Budget})
+		if err != nil {
+			log.Error().Str("c", "refresh").Err(err).Msg("failed to refresh expiring links")
+		}
+		if refreshed > 0 {
+			log.Info().Str("c", "refresh").Int("count", refreshed).Msg("refreshed expiring links")
+		}
+	}
+}
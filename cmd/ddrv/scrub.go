@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+
+	"github.com/rs/zerolog/log"
+
+	dp "github.com/forscht/ddrv/internal/dataprovider"
+	"github.com/forscht/ddrv/pkg/ddrv"
+)
+
+// runScrub implements the scrub command, it verifies every stored chunk once and exits
+// with status 1 if damaged files were found.
+func runScrub(driver *ddrv.Driver, args []string) {
+	fs := flag.NewFlagSet("scrub", flag.ExitOnError)
+	full := fs.Bool("full", false, "read whole chunks and verify checksums instead of reading the end of every chunk")
+	mark := fs.Bool("mark", false, "mark damaged files in the dataprovider")
+	interval := fs.Duration("interval", dp.DefaultScrubInterval, "pause between reads")
+	_ = fs.Parse(args)
+
+	report, err := dp.Scrub(context.Background(), driver, dp.ScrubOptions{Interval: *interval, Full: *full, Mark: *mark})
+	if err != nil {
+		log.Fatal().Str("c", "scrub").Err(err).Msg("failed to scrub")
+	}
+	for _, r := range report.Damaged {
+		log.Error().Str("c", "scrub").Str("id", r.Id).Str("path", r.Path).Strs("errors", r.Errors).Msg("damaged file")
+	}
+	for _, r := range report.Degraded {
+		log.Warn().Str("c", "scrub").Str("id", r.Id).Str("path", r.Path).Strs("errors", r.Errors).Msg("degraded file")
+	}
+	for _, r := range report.Skipped {
+		log.Warn().Str("c", "scrub").Str("id", r.Id).Str("path", r.Path).Strs("errors", r.Errors).Msg("skipped file")
+	}
+	log.Info().Str("c", "scrub").
+		Int("files", report.Files).
+		Int("messages", report.Messages).
+		Int("failed", report.Failed).
+		Int("damaged", len(report.Damaged)).
+		Int("degraded", len(report.Degraded)).
+		Int("skipped", len(report.Skipped)).
+		Dur("took", report.Finished.Sub(report.Started)).
+		Msg("scrub finished")
+	if len(report.Damaged) > 0 {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,243 @@
+package dataprovider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/forscht/ddrv/pkg/ddrv"
+)
+
+// DefaultBackupKeep is the number of snapshots kept in the backup channel
+const DefaultBackupKeep = 7
+
+// snapshotLayout formats the creation time in snapshot ids
+const snapshotLayout = "20060102T150405.000Z"
+
+// BackupOptions configures Backup
+type BackupOptions struct {
+	Channel string // Channel snapshots are uploaded to, it must not be one of the channels of the driver
+	Keep    int    // Number of snapshots kept in the channel, defaults to DefaultBackupKeep
+}
+
+// Snapshot is a copy of the metadata stored in the backup channel. Snapshots are found by manifests
+// of their chunks, so they can be listed and restored without the metadata.
+type Snapshot struct {
+	Id       string    `json:"id"`
+	Provider string    `json:"provider"` // Name of the provider the snapshot was taken from
+	Created  time.Time `json:"created"`
+	Size     int64     `json:"size"`
+
+	nodes    []ddrv.Node // Chunks in order, nil if the snapshot is incomplete
+	messages []ddrv.Node // Every message of the snapshot
+}
+
+func BackupTo(w io.Writer) error {
+	log.Debug().Str("c", "dataprovider").Msg("BACKUP")
+	return provider.Backup(w)
+}
+
+func RestoreFrom(r io.Reader) error {
+	log.Debug().Str("c", "dataprovider").Msg("RESTORE")
+	return provider.Restore(r)
+}
+
+// Backup takes a snapshot of the metadata and uploads it to the backup channel. Once the snapshot
+// is uploaded, snapshots older than the opts.Keep newest ones and leftovers of failed backups are deleted.
+// The snapshot is spooled to a temporary file first, so the size of the snapshot is known to its manifests.
+func Backup(ctx context.Context, driver *ddrv.Driver, opts BackupOptions) (*Snapshot, error) {
+	if err := checkBackupChannel(ctx, driver, opts.Channel); err != nil {
+		return nil, err
+	}
+	keep := opts.Keep
+	if keep <= 0 {
+		keep = DefaultBackupKeep
+	}
+	f, err := os.CreateTemp("", "ddrv-backup-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err = BackupTo(f); err != nil {
+		return nil, err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	created := time.Now().UTC()
+	s := &Snapshot{Id: Name() + "-" + created.Format(snapshotLayout), Provider: Name(), Created: created, Size: size}
+	wctx := ddrv.WithChannel(ddrv.WithManifest(ctx, s.Id, "", 0, size), opts.Channel)
+	// Chunks of snapshots must not be shared with files, they would be deleted along with them
+	d := *driver
+	d.Lookup = nil
+	w := d.NewWriterContext(wctx, func(chunk ddrv.Node) { s.nodes = append(s.nodes, chunk) })
+	_, err = io.Copy(w, f)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// Chunks of a failed backup are removed by the next one if they can not be deleted now
+		_ = driver.DeleteNodesContext(context.Background(), s.nodes)
+		return nil, err
+	}
+	return s, prune(ctx, driver, opts.Channel, keep)
+}
+
+// Snapshots returns complete snapshots of the backup channel, newest first
+func Snapshots(ctx context.Context, driver *ddrv.Driver, channel string) ([]*Snapshot, error) {
+	if err := checkBackupChannel(ctx, driver, channel); err != nil {
+		return nil, err
+	}
+	complete, _, err := snapshots(ctx, driver, channel)
+	return complete, err
+}
+
+// Restore replaces the metadata with the snapshot with given id. The snapshot must be taken from the same
+// kind of provider. It must not be called while requests are served.
+func Restore(ctx context.Context, driver *ddrv.Driver, channel, id string) (*Snapshot, error) {
+	all, err := Snapshots(ctx, driver, channel)
+	if err != nil {
+		return nil, err
+	}
+	var s *Snapshot
+	for _, snapshot := range all {
+		if snapshot.Id == id {
+			s = snapshot
+		}
+	}
+	if s == nil {
+		return nil, fmt.Errorf("snapshot %s : %w", id, ErrNotExist)
+	}
+	if s.Provider != Name() {
+		return nil, fmt.Errorf("snapshot %s is taken from %s and can not be restored to %s", id, s.Provider, Name())
+	}
+	reader, err := driver.NewReaderContext(ctx, s.nodes, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return s, RestoreFrom(reader)
+}
+
+func checkBackupChannel(ctx context.Context, driver *ddrv.Driver, channel string) error {
+	if driver.Rest == nil {
+		return errors.New("backups need chunks stored on discord")
+	}
+	if channel == "" {
+		return errors.New("backup channel is not configured")
+	}
+	// gc and recover scan the channels of the driver, snapshots would be taken for orphans or files
+	channels, err := dataChannels(ctx, driver)
+	if err != nil {
+		return err
+	}
+	for _, channelId := range channels {
+		if channelId == channel {
+			return fmt.Errorf("backup channel %s must not be one of the data channels", channel)
+		}
+	}
+	return nil
+}
+
+// dataChannels returns ids of the channels chunks are uploaded to, directly or through webhooks
+func dataChannels(ctx context.Context, driver *ddrv.Driver) ([]string, error) {
+	hooks, err := driver.Rest.WebhookChannelsContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up webhook channels : %w", err)
+	}
+	channels := driver.Rest.Channels()
+	seen := make(map[string]bool, len(channels))
+	for _, channelId := range channels {
+		seen[channelId] = true
+	}
+	for _, channelId := range hooks {
+		if !seen[channelId] {
+			seen[channelId] = true
+			channels = append(channels, channelId)
+		}
+	}
+	return channels, nil
+}
+
+// snapshots returns complete and incomplete snapshots of the channel, newest first
+func snapshots(ctx context.Context, driver *ddrv.Driver, channel string) ([]*Snapshot, []*Snapshot, error) {
+	files := make(map[string]map[int64]*recoveredWrite)
+	err := scanChannel(ctx, driver.Rest, channel, func(chunks []ddrv.Node, manifests []ddrv.Manifest, err error) {
+		if err != nil {
+			log.Warn().Str("c", "backup").Err(err).Msg("failed to read manifest")
+			return
+		}
+		for i := range chunks {
+			addChunk(files, chunks[i], manifests[i])
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	var complete, incomplete []*Snapshot
+	for id, writes := range files {
+		name, stamp, ok := strings.Cut(id, "-")
+		created, err := time.Parse(snapshotLayout, stamp)
+		if !ok || err != nil {
+			continue
+		}
+		s := &Snapshot{Id: id, Provider: name, Created: created}
+		// Every write of the id is an attempt to upload the snapshot, the newest one counts
+		var newest *recoveredWrite
+		for _, w := range writes {
+			s.messages = append(s.messages, w.messages()...)
+			if newest == nil || w.manifest.Write > newest.manifest.Write {
+				newest = w
+			}
+		}
+		nodes, ok := newest.nodes()
+		if size, _ := newest.size(); ok && len(writes) == 1 && size == newest.manifest.Size {
+			s.Size, s.nodes = size, nodes
+			complete = append(complete, s)
+		} else {
+			incomplete = append(incomplete, s)
+		}
+	}
+	newestFirst := func(snapshots []*Snapshot) {
+		sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Created.After(snapshots[j].Created) })
+	}
+	newestFirst(complete)
+	newestFirst(incomplete)
+	return complete, incomplete, nil
+}
+
+// prune deletes snapshots older than the keep newest ones and incomplete snapshots older than the newest one,
+// younger incomplete snapshots may still be uploaded.
+func prune(ctx context.Context, driver *ddrv.Driver, channel string, keep int) error {
+	complete, incomplete, err := snapshots(ctx, driver, channel)
+	if err != nil || len(complete) == 0 {
+		return err
+	}
+	var messages []ddrv.Node
+	for i, s := range complete {
+		if i >= keep {
+			messages = append(messages, s.messages...)
+		}
+	}
+	for _, s := range incomplete {
+		if s.Created.Before(complete[0].Created) {
+			messages = append(messages, s.messages...)
+		}
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	return driver.DeleteNodesContext(ctx, messages)
+}
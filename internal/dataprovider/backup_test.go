@@ -0,0 +1,76 @@
+package dataprovider_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	dp "github.com/forscht/ddrv/internal/dataprovider"
+	"github.com/forscht/ddrv/pkg/ddrv"
+	"github.com/forscht/ddrv/pkg/ddrv/ddrvtest"
+)
+
+func TestBackup(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	cfg := s.Config(4096, "1", "2")
+	cfg.Passphrase = "secret"
+	driver := newDriver(t, cfg)
+	defer load(t, driver, "").Close()
+	ctx := context.Background()
+	opts := dp.BackupOptions{Channel: "9", Keep: 2}
+
+	if _, err := dp.Backup(ctx, driver, dp.BackupOptions{Channel: "1"}); err == nil {
+		t.Fatal("Backup() to a data channel succeeded")
+	}
+	cfg = s.Config(4096, "1")
+	cfg.Webhooks = []string{s.Webhook("5")}
+	if _, err := dp.Backup(ctx, newDriver(t, cfg), dp.BackupOptions{Channel: "5"}); err == nil {
+		t.Fatal("Backup() to a webhook channel succeeded")
+	}
+	a := put(t, driver, "/a.bin", bytes.Repeat([]byte("a"), 1000))
+	first, err := dp.Backup(ctx, driver, opts)
+	if err != nil {
+		t.Fatalf("Backup() error = %v", err)
+	}
+	put(t, driver, "/b.bin", bytes.Repeat([]byte("b"), 1000))
+	if _, err = dp.Backup(ctx, driver, opts); err != nil {
+		t.Fatalf("Backup() error = %v", err)
+	}
+	rm(t, "/a.bin")
+
+	// Restoring the first snapshot brings back a.bin and forgets b.bin
+	if _, err = dp.Restore(ctx, driver, "9", first.Id); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	if _, err = dp.Stat("/b.bin"); !errors.Is(err, dp.ErrNotExist) {
+		t.Errorf("Stat(/b.bin) after restore error = %v, want ErrNotExist", err)
+	}
+	check(t, driver, a.Id, bytes.Repeat([]byte("a"), 1000), "read of restored a.bin")
+
+	// Older snapshots are pruned
+	time.Sleep(2 * time.Millisecond)
+	third, err := dp.Backup(ctx, driver, opts)
+	if err != nil {
+		t.Fatalf("Backup() error = %v", err)
+	}
+	snapshots, err := dp.Snapshots(ctx, driver, "9")
+	if err != nil {
+		t.Fatalf("Snapshots() error = %v", err)
+	}
+	if len(snapshots) != 2 || snapshots[0].Id != third.Id || snapshots[0].Size != third.Size || snapshots[1].Id == first.Id {
+		t.Errorf("Snapshots() = %+v, want the 2 newest snapshots", snapshots)
+	}
+	if _, err = dp.Restore(ctx, driver, "9", first.Id); !errors.Is(err, dp.ErrNotExist) {
+		t.Errorf("Restore() of a pruned snapshot error = %v, want ErrNotExist", err)
+	}
+	for _, m := range s.Messages("9") {
+		msg := ddrv.Message{Id: m.Id, Content: m.Content, Attachments: []ddrv.Node{{URL: m.Attachments[0].URL, Size: m.Attachments[0].Size}}}
+		_, manifests, err := driver.Rest.Chunks(&msg)
+		if err != nil || len(manifests) != 1 || (manifests[0].File != snapshots[0].Id && manifests[0].File != snapshots[1].Id) {
+			t.Errorf("backup channel holds message %s of a pruned snapshot, manifests %+v, error %v", m.Id, manifests, err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package boltdb
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// Backup writes a copy of the database file to w from a read transaction, so the copy is consistent
+// while the provider keeps serving requests.
+func (bfp *Provider) Backup(w io.Writer) error {
+	return bfp.db.View(func(tx *bbolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
+// Restore replaces the database file with the snapshot read from r. The snapshot is written next to
+// the database and opened once before it replaces the database, so a broken snapshot leaves it untouched.
+func (bfp *Provider) Restore(r io.Reader) error {
+	tmp := bfp.path + ".restore"
+	defer os.Remove(tmp)
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	db, err := bbolt.Open(tmp, 0666, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	err = db.View(func(tx *bbolt.Tx) error {
+		if tx.Bucket([]byte("fs")) == nil {
+			return errors.New("snapshot is not a ddrv database")
+		}
+		return nil
+	})
+	if err == nil {
+		// Snapshots of older versions miss buckets added since
+		err = initDb(db)
+	}
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err = bfp.db.Close(); err != nil {
+		return err
+	}
+	renameErr := os.Rename(tmp, bfp.path)
+	// The database is opened again even if the snapshot could not replace it
+	if db, err = bbolt.Open(bfp.path, 0666, nil); err != nil {
+		return err
+	}
+	bfp.db = db
+	return renameErr
+}
@@ -3,6 +3,7 @@ package boltdb
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/gob"
 	"path"
 	"path/filepath"
@@ -33,6 +34,24 @@ func deserializeNode(node *ddrv.Node, data []byte) {
 	}
 }
 
+// midKey returns the refs bucket key of a message id
+func midKey(mid int64) []byte {
+	return itob(uint64(mid))
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func btoi(b []byte) uint64 {
+	if len(b) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
 func serializeFile(file dp.File) []byte {
 	var buffer bytes.Buffer
 	enc := gob.NewEncoder(&buffer)
@@ -59,6 +78,48 @@ func deserializeFile(data []byte) *dp.File {
 	return file
 }
 
+func serializeSession(session dp.Session) []byte {
+	var buffer bytes.Buffer
+	enc := gob.NewEncoder(&buffer)
+	err := enc.Encode(session)
+	if err != nil {
+		log.Fatal().Str("c", "boltdb provider").Err(err).Msg("failed to serialize session")
+	}
+	return buffer.Bytes()
+}
+
+func deserializeSession(data []byte) *dp.Session {
+	session := new(dp.Session)
+	buffer := bytes.NewBuffer(data)
+	dec := gob.NewDecoder(buffer)
+	err := dec.Decode(session)
+	if err != nil {
+		log.Fatal().Str("c", "boltdb provider").Err(err).Msg("failed to deserialize session")
+	}
+	return session
+}
+
+func serializeDamage(damage dp.Damage) []byte {
+	var buffer bytes.Buffer
+	enc := gob.NewEncoder(&buffer)
+	err := enc.Encode(damage)
+	if err != nil {
+		log.Fatal().Str("c", "boltdb provider").Err(err).Msg("failed to serialize damage")
+	}
+	return buffer.Bytes()
+}
+
+func deserializeDamage(data []byte) *dp.Damage {
+	damage := new(dp.Damage)
+	buffer := bytes.NewBuffer(data)
+	dec := gob.NewDecoder(buffer)
+	err := dec.Decode(damage)
+	if err != nil {
+		log.Fatal().Str("c", "boltdb provider").Err(err).Msg("failed to deserialize damage")
+	}
+	return damage
+}
+
 func decodep(id string) string {
 	decoded, err := base64.StdEncoding.DecodeString(id)
 	if err != nil {
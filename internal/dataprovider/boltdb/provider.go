@@ -2,6 +2,7 @@ package boltdb
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"math/rand"
@@ -22,6 +23,7 @@ const RootDirPath = "/"
 
 type Provider struct {
 	db     *bbolt.DB
+	path   string
 	sg     *snowflake.Node
 	driver *ddrv.Driver
 	locker *locker.Locker
@@ -37,16 +39,7 @@ func New(driver *ddrv.Driver, cfg *Config) dp.DataProvider {
 		log.Fatal().Str("c", "boltdb").Err(err).Msg("failed to open db")
 	}
 	// Initialize the filesystem root
-	err = db.Update(func(tx *bbolt.Tx) error {
-		if _, err = tx.CreateBucketIfNotExists([]byte("fs")); err != nil {
-			return err
-		}
-		if _, err = tx.CreateBucketIfNotExists([]byte("nodes")); err != nil {
-			return err
-		}
-		rootData := serializeFile(dp.File{Name: "/", Dir: true, MTime: time.Now()})
-		return tx.Bucket([]byte("fs")).Put([]byte(RootDirPath), rootData)
-	})
+	err = initDb(db)
 	if err != nil {
 		log.Fatal().Str("c", "boltdb").Err(err).Msg("failed to init db")
 	}
@@ -56,7 +49,70 @@ func New(driver *ddrv.Driver, cfg *Config) dp.DataProvider {
 	}
 	log.Info().Str("c", "boltdb").Str("path", cfg.DbPath).Msg("initialized boltdb as dataprovider")
 
-	return &Provider{db, sg, driver, locker.New()}
+	return &Provider{db, cfg.DbPath, sg, driver, locker.New()}
+}
+
+// initDb creates buckets missing in db and the filesystem root
+func initDb(db *bbolt.DB) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		var err error
+		if _, err = tx.CreateBucketIfNotExists([]byte("fs")); err != nil {
+			return err
+		}
+		if _, err = tx.CreateBucketIfNotExists([]byte("nodes")); err != nil {
+			return err
+		}
+		// hashes indexes nodes by checksum for deduplication,
+		// refs counts how many nodes point at each message id
+		if _, err = tx.CreateBucketIfNotExists([]byte("hashes")); err != nil {
+			return err
+		}
+		if _, err = tx.CreateBucketIfNotExists([]byte("refs")); err != nil {
+			return err
+		}
+		// sessions holds upload sessions, session_nodes holds a bucket of recorded nodes per session
+		if _, err = tx.CreateBucketIfNotExists([]byte("sessions")); err != nil {
+			return err
+		}
+		if _, err = tx.CreateBucketIfNotExists([]byte("session_nodes")); err != nil {
+			return err
+		}
+		// deletions queues nodes whose messages are deleted from discord in background
+		if _, err = tx.CreateBucketIfNotExists([]byte("deletions")); err != nil {
+			return err
+		}
+		// retries holds failed attempts and the next attempt of queued messages which failed to delete
+		if _, err = tx.CreateBucketIfNotExists([]byte("retries")); err != nil {
+			return err
+		}
+		// refresh_retries holds failed attempts and the next attempt of messages whose links failed to refresh
+		if _, err = tx.CreateBucketIfNotExists([]byte("refresh_retries")); err != nil {
+			return err
+		}
+		// leases holds messages of nodes found by checksum which are reused by writes not committed yet
+		if _, err = tx.CreateBucketIfNotExists([]byte("leases")); err != nil {
+			return err
+		}
+		// parity counts how many nodes point at each parity shard message, counts of older databases are rebuilt
+		if tx.Bucket([]byte("parity")) == nil {
+			if _, err = tx.CreateBucket([]byte("parity")); err != nil {
+				return err
+			}
+			if err = countParity(tx); err != nil {
+				return err
+			}
+		}
+		// damaged holds files marked damaged by scrub, keyed by path like nodes
+		if _, err = tx.CreateBucketIfNotExists([]byte("damaged")); err != nil {
+			return err
+		}
+		// digests holds the SHA-256 of files written in one go, keyed by path like nodes
+		if _, err = tx.CreateBucketIfNotExists([]byte("digests")); err != nil {
+			return err
+		}
+		rootData := serializeFile(dp.File{Name: "/", Dir: true, MTime: time.Now()})
+		return tx.Bucket([]byte("fs")).Put([]byte(RootDirPath), rootData)
+	})
 }
 
 func (bfp *Provider) Name() string {
@@ -146,44 +202,47 @@ func (bfp *Provider) Delete(id, parent string) error {
 	return bfp.Rm(p)
 }
 
+// GetNodes reads nodes of the file and refreshes their expired links. Links are refreshed outside of
+// transactions, so writes are not blocked while discord is queried, and stored with UpdateNodes checks.
 func (bfp *Provider) GetNodes(id string) ([]ddrv.Node, error) {
 	bfp.locker.Acquire(id)
 	defer bfp.locker.Release(id)
 	var nodes []ddrv.Node
-	expired := make([]*ddrv.Node, 0)
-	currentTimestamp := int(time.Now().Unix())
-	err := bfp.db.Update(func(tx *bbolt.Tx) error {
+	err := bfp.db.View(func(tx *bbolt.Tx) error {
 		// Get the bucket for the specific file
 		nodesBucket := tx.Bucket([]byte("nodes"))
 		bucket := nodesBucket.Bucket([]byte(decodep(id)))
 		if bucket == nil {
 			return nil
 		}
-		if err := bucket.ForEach(func(k, v []byte) error {
+		return bucket.ForEach(func(k, v []byte) error {
 			var node ddrv.Node
 			deserializeNode(&node, v)
-			if currentTimestamp > node.Ex {
-				expired = append(expired, &node)
-			}
 			nodes = append(nodes, node)
 			return nil
-		}); err != nil {
-			return err
-		}
-		if err := bfp.driver.UpdateNodes(expired); err != nil {
-			return err
-		}
-		for _, node := range expired {
-			data := serializeNode(*node)
-			key := []byte(fmt.Sprintf("%d", node.NId))
-			if err := bucket.Put(key, data); err != nil {
-				return err
-			}
-		}
-		return nil
+		})
 	})
-
-	return nodes, err
+	if err != nil {
+		return nil, err
+	}
+	expired := make([]*ddrv.Node, 0)
+	currentTimestamp := int(time.Now().Unix())
+	for i := range nodes {
+		if nodes[i].Expired(currentTimestamp) {
+			expired = append(expired, &nodes[i])
+		}
+	}
+	if len(expired) == 0 {
+		return nodes, nil
+	}
+	if err = bfp.driver.UpdateNodes(expired); err != nil {
+		return nil, err
+	}
+	refreshed := make([]ddrv.Node, len(expired))
+	for i, node := range expired {
+		refreshed[i] = *node
+	}
+	return nodes, bfp.updateNodes(id, refreshed)
 }
 
 func (bfp *Provider) CreateNodes(id string, nodes []ddrv.Node) error {
@@ -197,14 +256,23 @@ func (bfp *Provider) CreateNodes(id string, nodes []ddrv.Node) error {
 		if err != nil {
 			return err
 		}
+		// The digest does not cover the appended nodes
+		if err = tx.Bucket([]byte("digests")).Delete([]byte(decodep(id))); err != nil {
+			return err
+		}
 		for _, node := range nodes {
 			seq := bfp.sg.Generate()
 			node.NId = seq.Int64()
 			file.Size += int64(node.Size)
+			leased := node.Leased
+			node.Leased = false
 			data := serializeNode(node)
 			if err = bucket.Put(seq.Bytes(), data); err != nil {
 				return err
 			}
+			if err = ref(tx, node, leased); err != nil {
+				return err
+			}
 		}
 		data := serializeFile(*file)
 		fs := tx.Bucket([]byte("fs"))
@@ -215,13 +283,584 @@ func (bfp *Provider) CreateNodes(id string, nodes []ddrv.Node) error {
 // Truncate Removes all nodes for file if nodes found, does not return error if nodes not found
 func (bfp *Provider) Truncate(id string) error {
 	return bfp.db.Update(func(tx *bbolt.Tx) error {
-		nodes := tx.Bucket([]byte("nodes"))
-		err := nodes.DeleteBucket([]byte(decodep(id)))
-		if errors.Is(err, bbolt.ErrBucketNotFound) {
+		return deleteNodes(tx, []byte(decodep(id)))
+	})
+}
+
+// GetNodeByHash returns the node indexed by checksum and leases its message in the same transaction,
+// so the message is not deleted if the last file pointing at it is removed before the write is committed.
+func (bfp *Provider) GetNodeByHash(hash string, size int) (*ddrv.Node, error) {
+	var node *ddrv.Node
+	err := bfp.db.Update(func(tx *bbolt.Tx) error {
+		node = indexed(tx, hash)
+		if node == nil || node.Size != size {
+			return dp.ErrNotExist
+		}
+		node.Leased = true
+		return lease(tx, node.MId)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// ref increments reference counts of the node message and of the parity shards of its stripe,
+// and indexes the node by checksum. leased releases the lease the write referencing the node took on its message.
+func ref(tx *bbolt.Tx, node ddrv.Node, leased bool) error {
+	refs := tx.Bucket([]byte("refs"))
+	key := midKey(node.MId)
+	if err := refs.Put(key, itob(btoi(refs.Get(key))+1)); err != nil {
+		return err
+	}
+	// A deduplicated chunk may be referenced again before its message is deleted
+	if err := unqueue(tx, key); err != nil {
+		return err
+	}
+	if leased {
+		if err := release(tx, node.MId); err != nil {
+			return err
+		}
+	}
+	if node.Stripe != nil {
+		parity := tx.Bucket([]byte("parity"))
+		for _, p := range node.Stripe.Parity {
+			pkey := midKey(p.MId)
+			if err := parity.Put(pkey, itob(btoi(parity.Get(pkey))+1)); err != nil {
+				return err
+			}
+			if err := unqueue(tx, pkey); err != nil {
+				return err
+			}
+		}
+	}
+	if node.Hash != "" && indexed(tx, node.Hash) == nil {
+		return tx.Bucket([]byte("hashes")).Put([]byte(node.Hash), serializeNode(node))
+	}
+	return nil
+}
+
+// lease keeps the message from deletion until a node pointing at it is referenced, or dp.LookupLease passed.
+// Leases are values of 16 bytes, the number of writes holding the lease followed by its unix expiry time.
+func lease(tx *bbolt.Tx, mid int64) error {
+	leases := tx.Bucket([]byte("leases"))
+	key := midKey(mid)
+	holders, expires := leaseOf(leases.Get(key))
+	// Writes holding an expired lease are not waited for anymore
+	if expires <= time.Now().Unix() {
+		holders = 0
+	}
+	value := make([]byte, 16)
+	binary.BigEndian.PutUint64(value, holders+1)
+	binary.BigEndian.PutUint64(value[8:], uint64(time.Now().Add(dp.LookupLease).Unix()))
+	return leases.Put(key, value)
+}
+
+// release releases a lease of the message once a write holding it references the message
+func release(tx *bbolt.Tx, mid int64) error {
+	leases := tx.Bucket([]byte("leases"))
+	key := midKey(mid)
+	data := leases.Get(key)
+	if data == nil {
+		return nil
+	}
+	if holders, _ := leaseOf(data); holders > 1 {
+		value := bytes.Clone(data)
+		binary.BigEndian.PutUint64(value, holders-1)
+		return leases.Put(key, value)
+	}
+	return leases.Delete(key)
+}
+
+// leased reports whether a write not committed yet may still reference the message
+func leased(tx *bbolt.Tx, mid int64) bool {
+	holders, expires := leaseOf(tx.Bucket([]byte("leases")).Get(midKey(mid)))
+	return holders > 0 && expires > time.Now().Unix()
+}
+
+func leaseOf(data []byte) (holders uint64, expires int64) {
+	if len(data) != 16 {
+		return 0, 0
+	}
+	return binary.BigEndian.Uint64(data), int64(binary.BigEndian.Uint64(data[8:]))
+}
+
+// countParity counts references of parity shard messages by nodes of files and sessions
+func countParity(tx *bbolt.Tx) error {
+	parity := tx.Bucket([]byte("parity"))
+	count := func(_, v []byte) error {
+		var node ddrv.Node
+		deserializeNode(&node, v)
+		if node.Stripe == nil {
+			return nil
+		}
+		for _, p := range node.Stripe.Parity {
+			key := midKey(p.MId)
+			if err := parity.Put(key, itob(btoi(parity.Get(key))+1)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, name := range []string{"nodes", "session_nodes"} {
+		parent := tx.Bucket([]byte(name))
+		if err := parent.ForEach(func(k, _ []byte) error {
+			if bucket := parent.Bucket(k); bucket != nil {
+				return bucket.ForEach(count)
+			}
 			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexed returns the node indexed by checksum, or nil if there is none. Nodes sharing a message with other
+// chunks stay indexed once the message is released by another node, they are ignored as their message is deleted.
+func indexed(tx *bbolt.Tx, hash string) *ddrv.Node {
+	data := tx.Bucket([]byte("hashes")).Get([]byte(hash))
+	if data == nil {
+		return nil
+	}
+	node := new(ddrv.Node)
+	deserializeNode(node, data)
+	if tx.Bucket([]byte("refs")).Get(midKey(node.MId)) == nil {
+		return nil
+	}
+	return node
+}
+
+// unref decrements reference counts of the node message and of the parity shards of its stripe, it returns
+// the messages no file points at anymore. A released node is returned without its stripe and removed from
+// checksum index, parity shards are returned on their own once no chunk of their stripe is referenced.
+func unref(tx *bbolt.Tx, node ddrv.Node) ([]ddrv.Node, error) {
+	var released []ddrv.Node
+	if node.Stripe != nil {
+		parity := tx.Bucket([]byte("parity"))
+		for _, p := range node.Stripe.Parity {
+			key := midKey(p.MId)
+			if count := btoi(parity.Get(key)); count > 1 {
+				if err := parity.Put(key, itob(count-1)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if err := parity.Delete(key); err != nil {
+				return nil, err
+			}
+			released = append(released, p)
+		}
+	}
+	refs := tx.Bucket([]byte("refs"))
+	key := midKey(node.MId)
+	if count := btoi(refs.Get(key)); count > 1 {
+		return released, refs.Put(key, itob(count-1))
+	}
+	if err := refs.Delete(key); err != nil {
+		return nil, err
+	}
+	chunk := node
+	chunk.Stripe = nil
+	released = append(released, chunk)
+	if node.Hash == "" {
+		return released, nil
+	}
+	hashes := tx.Bucket([]byte("hashes"))
+	if data := hashes.Get([]byte(node.Hash)); data != nil {
+		var stored ddrv.Node
+		deserializeNode(&stored, data)
+		if stored.MId == node.MId && stored.Att == node.Att && packOffset(stored) == packOffset(node) {
+			return released, hashes.Delete([]byte(node.Hash))
+		}
+	}
+	return released, nil
+}
+
+// unqueue drops the message from the deletion queue along with its failed attempts
+func unqueue(tx *bbolt.Tx, key []byte) error {
+	if err := tx.Bucket([]byte("deletions")).Delete(key); err != nil {
+		return err
+	}
+	return tx.Bucket([]byte("retries")).Delete(key)
+}
+
+// queueDeletions queues released messages for deletion
+func queueDeletions(tx *bbolt.Tx, released []ddrv.Node) error {
+	deletions := tx.Bucket([]byte("deletions"))
+	for _, node := range released {
+		if err := deletions.Put(midKey(node.MId), serializeNode(node)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// packOffset returns the offset of the node in its packfile, or -1 if it is not packed
+func packOffset(node ddrv.Node) int {
+	if node.Pack == nil {
+		return -1
+	}
+	return node.Pack.Offset
+}
+
+// deleteNodes removes nodes bucket of the file and releases references of its nodes,
+// nodes no file points at anymore are queued for deletion. Does not return error if nodes not found
+func deleteNodes(tx *bbolt.Tx, key []byte) error {
+	if err := tx.Bucket([]byte("damaged")).Delete(key); err != nil {
+		return err
+	}
+	if err := tx.Bucket([]byte("digests")).Delete(key); err != nil {
+		return err
+	}
+	nodes := tx.Bucket([]byte("nodes"))
+	bucket := nodes.Bucket(key)
+	if bucket == nil {
+		return nil
+	}
+	if err := bucket.ForEach(func(k, v []byte) error {
+		var node ddrv.Node
+		deserializeNode(&node, v)
+		released, err := unref(tx, node)
+		if err != nil {
+			return err
 		}
+		return queueDeletions(tx, released)
+	}); err != nil {
 		return err
+	}
+	return nodes.DeleteBucket(key)
+}
+
+func (bfp *Provider) PendingDeletions(limit int) ([]ddrv.Node, error) {
+	var nodes []ddrv.Node
+	err := bfp.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket([]byte("deletions")).Cursor()
+		for k, v := c.First(); k != nil && len(nodes) < limit; k, v = c.Next() {
+			var node ddrv.Node
+			deserializeNode(&node, v)
+			if leased(tx, node.MId) || parked(tx, "retries", node.MId) {
+				continue
+			}
+			nodes = append(nodes, node)
+		}
+		return nil
 	})
+	return nodes, err
+}
+
+func (bfp *Provider) CompleteDeletions(mids []int64) error {
+	return bfp.db.Update(func(tx *bbolt.Tx) error {
+		leases := tx.Bucket([]byte("leases"))
+		for _, mid := range mids {
+			if err := unqueue(tx, midKey(mid)); err != nil {
+				return err
+			}
+			// Expired leases and failed refreshes of deleted messages are dropped
+			if err := leases.Delete(midKey(mid)); err != nil {
+				return err
+			}
+			if err := tx.Bucket([]byte("refresh_retries")).Delete(midKey(mid)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (bfp *Provider) FailDeletions(mids []int64) error {
+	return bfp.db.Update(func(tx *bbolt.Tx) error {
+		deletions, retries := tx.Bucket([]byte("deletions")), tx.Bucket([]byte("retries"))
+		for _, mid := range mids {
+			key := midKey(mid)
+			// Messages referenced again meanwhile are not queued anymore
+			if deletions.Get(key) == nil {
+				continue
+			}
+			if err := fail(retries, key, dp.DeletionBackoff); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// FailRefreshes parks messages whose links failed to refresh, ExpiringNodes skips their nodes until the backoff passed
+func (bfp *Provider) FailRefreshes(mids []int64) error {
+	return bfp.db.Update(func(tx *bbolt.Tx) error {
+		retries := tx.Bucket([]byte("refresh_retries"))
+		for _, mid := range mids {
+			if err := fail(retries, midKey(mid), dp.RefreshBackoff); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// fail counts a failed attempt of the message in the retries bucket and postpones its next attempt by backoff
+func fail(retries *bbolt.Bucket, key []byte, backoff func(attempts int) time.Duration) error {
+	attempts, _ := retryOf(retries.Get(key))
+	value := make([]byte, 16)
+	binary.BigEndian.PutUint64(value, attempts+1)
+	binary.BigEndian.PutUint64(value[8:], uint64(time.Now().Add(backoff(int(attempts+1))).Unix()))
+	return retries.Put(key, value)
+}
+
+// parked reports whether an attempt on the message recorded in the retries bucket failed and is not due to be retried yet
+func parked(tx *bbolt.Tx, bucket string, mid int64) bool {
+	_, retry := retryOf(tx.Bucket([]byte(bucket)).Get(midKey(mid)))
+	return retry > time.Now().Unix()
+}
+
+func retryOf(data []byte) (attempts uint64, retry int64) {
+	if len(data) != 16 {
+		return 0, 0
+	}
+	return binary.BigEndian.Uint64(data), int64(binary.BigEndian.Uint64(data[8:]))
+}
+
+func (bfp *Provider) MessageIds() (map[int64]bool, error) {
+	ids := make(map[int64]bool)
+	add := func(k, v []byte) error {
+		var node ddrv.Node
+		deserializeNode(&node, v)
+		for _, mid := range node.MessageIds() {
+			ids[mid] = true
+		}
+		return nil
+	}
+	err := bfp.db.View(func(tx *bbolt.Tx) error {
+		// nodes and session_nodes hold a bucket of nodes per file or session
+		for _, name := range []string{"nodes", "session_nodes"} {
+			parent := tx.Bucket([]byte(name))
+			if err := parent.ForEach(func(k, v []byte) error {
+				if bucket := parent.Bucket(k); bucket != nil {
+					return bucket.ForEach(add)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket([]byte("deletions")).ForEach(add)
+	})
+	return ids, err
+}
+
+// errLimit stops iterations over buckets once enough items are collected
+var errLimit = errors.New("limit reached")
+
+func (bfp *Provider) ExpiringNodes(before int, limit int) (map[string][]ddrv.Node, error) {
+	expiring := make(map[string][]ddrv.Node)
+	count := 0
+	err := bfp.db.View(func(tx *bbolt.Tx) error {
+		parent := tx.Bucket([]byte("nodes"))
+		return parent.ForEach(func(k, _ []byte) error {
+			bucket := parent.Bucket(k)
+			if bucket == nil {
+				return nil
+			}
+			id := encodep(string(k))
+			return bucket.ForEach(func(_, v []byte) error {
+				var node ddrv.Node
+				deserializeNode(&node, v)
+				if !node.Expired(before) || parked(tx, "refresh_retries", node.MId) {
+					return nil
+				}
+				if count == limit {
+					return errLimit
+				}
+				expiring[id] = append(expiring[id], node)
+				count++
+				return nil
+			})
+		})
+	})
+	if errors.Is(err, errLimit) {
+		err = nil
+	}
+	return expiring, err
+}
+
+// UpdateNodes stores refreshed links of nodes of the file
+func (bfp *Provider) UpdateNodes(id string, nodes []ddrv.Node) error {
+	bfp.locker.Acquire(id)
+	defer bfp.locker.Release(id)
+	return bfp.updateNodes(id, nodes)
+}
+
+// updateNodes stores refreshed links of nodes of the file, the caller holds the lock of the file.
+// Nodes were read in an earlier transaction, nodes which were removed, rewritten or refreshed
+// with newer links meanwhile are skipped.
+func (bfp *Provider) updateNodes(id string, nodes []ddrv.Node) error {
+	return bfp.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte("nodes")).Bucket([]byte(decodep(id)))
+		if bucket == nil {
+			return nil
+		}
+		retries := tx.Bucket([]byte("refresh_retries"))
+		now := int(time.Now().Unix())
+		for _, node := range nodes {
+			key := []byte(fmt.Sprintf("%d", node.NId))
+			data := bucket.Get(key)
+			if data == nil {
+				continue
+			}
+			var stored ddrv.Node
+			deserializeNode(&stored, data)
+			if stored.MId != node.MId || stored.Att != node.Att || stored.Is > node.Is {
+				continue
+			}
+			if err := bucket.Put(key, serializeNode(node)); err != nil {
+				return err
+			}
+			// Failed refreshes of messages whose links were refreshed meanwhile are forgotten
+			if !node.Expired(now) {
+				if err := retries.Delete(midKey(node.MId)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// PackedNodes returns packed nodes of files and of their upload sessions, ranges recorded by sessions are in use as well
+func (bfp *Provider) PackedNodes() (map[string][]ddrv.Node, error) {
+	packed := make(map[string][]ddrv.Node)
+	err := bfp.db.View(func(tx *bbolt.Tx) error {
+		sessions := tx.Bucket([]byte("sessions"))
+		for _, name := range []string{"nodes", "session_nodes"} {
+			parent := tx.Bucket([]byte(name))
+			if err := parent.ForEach(func(k, _ []byte) error {
+				bucket := parent.Bucket(k)
+				if bucket == nil {
+					return nil
+				}
+				id := encodep(string(k))
+				if name == "session_nodes" {
+					data := sessions.Get(k)
+					if data == nil {
+						return nil
+					}
+					id = deserializeSession(data).File
+				}
+				return bucket.ForEach(func(_, v []byte) error {
+					var node ddrv.Node
+					deserializeNode(&node, v)
+					if node.Pack != nil {
+						packed[id] = append(packed[id], node)
+					}
+					return nil
+				})
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return packed, err
+}
+
+// RepackNodes points nodes of files and upload sessions at copies of their ranges. References of every moved node
+// are released before the copies are referenced, so the copies are indexed by checksum in place of the ranges they replace.
+func (bfp *Provider) RepackNodes(copies map[int64]map[int]ddrv.Node) error {
+	type move struct {
+		bucket   *bbolt.Bucket
+		key      []byte
+		old, new ddrv.Node
+	}
+	return bfp.db.Update(func(tx *bbolt.Tx) error {
+		var moves []move
+		for _, name := range []string{"nodes", "session_nodes"} {
+			parent := tx.Bucket([]byte(name))
+			if err := parent.ForEach(func(k, _ []byte) error {
+				bucket := parent.Bucket(k)
+				if bucket == nil {
+					return nil
+				}
+				return bucket.ForEach(func(key, v []byte) error {
+					var node ddrv.Node
+					deserializeNode(&node, v)
+					if node.Pack == nil {
+						return nil
+					}
+					if c, ok := copies[node.MId][node.Pack.Offset]; ok {
+						c.NId = node.NId
+						moves = append(moves, move{bucket, bytes.Clone(key), node, c})
+					}
+					return nil
+				})
+			}); err != nil {
+				return err
+			}
+		}
+		for _, m := range moves {
+			if err := m.bucket.Put(m.key, serializeNode(m.new)); err != nil {
+				return err
+			}
+			released, err := unref(tx, m.old)
+			if err != nil {
+				return err
+			}
+			if err = queueDeletions(tx, released); err != nil {
+				return err
+			}
+		}
+		for _, m := range moves {
+			if err := ref(tx, m.new, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (bfp *Provider) SetDigest(id, digest string) error {
+	key := []byte(decodep(id))
+	return bfp.db.Update(func(tx *bbolt.Tx) error {
+		if tx.Bucket([]byte("fs")).Get(key) == nil {
+			return dp.ErrNotExist
+		}
+		return tx.Bucket([]byte("digests")).Put(key, []byte(digest))
+	})
+}
+
+func (bfp *Provider) GetDigest(id string) (string, error) {
+	var digest string
+	err := bfp.db.View(func(tx *bbolt.Tx) error {
+		digest = string(tx.Bucket([]byte("digests")).Get([]byte(decodep(id))))
+		return nil
+	})
+	return digest, err
+}
+
+func (bfp *Provider) MarkDamaged(id, reason string) error {
+	key := []byte(decodep(id))
+	return bfp.db.Update(func(tx *bbolt.Tx) error {
+		damaged := tx.Bucket([]byte("damaged"))
+		if reason == "" {
+			return damaged.Delete(key)
+		}
+		if tx.Bucket([]byte("fs")).Get(key) == nil {
+			return dp.ErrNotExist
+		}
+		return damaged.Put(key, serializeDamage(dp.Damage{Reason: reason, Marked: time.Now()}))
+	})
+}
+
+func (bfp *Provider) DamagedFiles() ([]*dp.Damage, error) {
+	files := make([]*dp.Damage, 0)
+	err := bfp.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte("damaged")).ForEach(func(k, v []byte) error {
+			damage := deserializeDamage(v)
+			damage.Id = encodep(string(k))
+			files = append(files, damage)
+			return nil
+		})
+	})
+	return files, err
 }
 
 func (bfp *Provider) Stat(p string) (*dp.File, error) {
@@ -306,7 +945,6 @@ func (bfp *Provider) Rm(p string) error {
 	p = path.Clean(p)
 	return bfp.db.Update(func(tx *bbolt.Tx) error {
 		fs := tx.Bucket([]byte("fs"))
-		nodes := tx.Bucket([]byte("nodes"))
 		// Check if the directory exists
 		data := fs.Get([]byte(p))
 		if data == nil {
@@ -320,11 +958,7 @@ func (bfp *Provider) Rm(p string) error {
 		// if the file is not directory then remove nodes and return
 		file := deserializeFile(data)
 		if !file.Dir {
-			err := nodes.DeleteBucket([]byte(decodep(file.Id)))
-			if errors.Is(err, bbolt.ErrBucketNotFound) {
-				return nil
-			}
-			return err
+			return deleteNodes(tx, []byte(decodep(file.Id)))
 		}
 		// Delete all children in the directory
 		prefix := []byte(p + "/")
@@ -337,8 +971,7 @@ func (bfp *Provider) Rm(p string) error {
 			if err := fs.Delete(f); err != nil {
 				return err
 			}
-			err := nodes.DeleteBucket(f)
-			if err != nil && !errors.Is(err, bbolt.ErrBucketNotFound) {
+			if err := deleteNodes(tx, f); err != nil {
 				return err
 			}
 		}
@@ -413,6 +1046,18 @@ func (bfp *Provider) RenameBucket(tx *bbolt.Tx, oldp, newp string) error {
 			return err
 		}
 	}
+	// Damage marks and digests follow the file
+	for _, name := range []string{"damaged", "digests"} {
+		b := tx.Bucket([]byte(name))
+		if data := b.Get([]byte(oldp)); data != nil {
+			if err := b.Put([]byte(newp), bytes.Clone(data)); err != nil {
+				return err
+			}
+			if err := b.Delete([]byte(oldp)); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
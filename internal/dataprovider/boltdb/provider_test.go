@@ -0,0 +1,120 @@
+package boltdb_test
+
+import (
+	"crypto/rand"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	dp "github.com/forscht/ddrv/internal/dataprovider"
+	"github.com/forscht/ddrv/internal/dataprovider/boltdb"
+	"github.com/forscht/ddrv/pkg/ddrv"
+	"github.com/forscht/ddrv/pkg/ddrv/ddrvtest"
+)
+
+// roundTripFunc implements http.RoundTripper with a function
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// load loads a bolt provider stored in a temporary directory
+func load(t *testing.T, driver *ddrv.Driver) dp.DataProvider {
+	t.Helper()
+	provider := boltdb.New(driver, &boltdb.Config{DbPath: filepath.Join(t.TempDir(), "ddrv.db")})
+	dp.Load(provider)
+	return provider
+}
+
+// put creates the file at path with size random bytes and returns it with its nodes
+func put(t *testing.T, driver *ddrv.Driver, p string, size int) (*dp.File, []ddrv.Node) {
+	t.Helper()
+	data := make([]byte, size)
+	_, _ = rand.Read(data)
+	if err := dp.Touch(p); err != nil {
+		t.Fatal(err)
+	}
+	file, err := dp.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nodes []ddrv.Node
+	w := driver.NewWriter(func(chunk ddrv.Node) { nodes = append(nodes, chunk) })
+	if _, err = w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = dp.CreateNodes(file.Id, nodes); err != nil {
+		t.Fatal(err)
+	}
+	return file, nodes
+}
+
+func TestGetNodesRefreshOutsideTransaction(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	started, release := make(chan struct{}), make(chan struct{})
+	var block sync.Once
+	cfg := s.Config(1024, "1")
+	// The first refresh request waits until the test releases it
+	cfg.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(req.URL.Path, "/refresh-urls") {
+			block.Do(func() {
+				close(started)
+				<-release
+			})
+		}
+		return http.DefaultTransport.RoundTrip(req)
+	})
+	driver, err := ddrv.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer load(t, driver).Close()
+
+	s.SetTTL(-time.Second)
+	file, _ := put(t, driver, "/a.bin", 2500)
+	s.SetTTL(24 * time.Hour)
+
+	type result struct {
+		nodes []ddrv.Node
+		err   error
+	}
+	done := make(chan result)
+	go func() {
+		nodes, err := dp.GetNodes(file.Id)
+		done <- result{nodes, err}
+	}()
+	<-started
+	// Writes are not blocked while links are refreshed
+	mkdir := make(chan error)
+	go func() { mkdir <- dp.Mkdir("/docs") }()
+	select {
+	case err = <-mkdir:
+		if err != nil {
+			t.Errorf("Mkdir() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Mkdir() is blocked by refresh of GetNodes")
+	}
+	close(release)
+	r := <-done
+	if r.err != nil || len(r.nodes) != 3 {
+		t.Fatalf("GetNodes() = %d nodes, %v, want 3 nodes", len(r.nodes), r.err)
+	}
+	now := int(time.Now().Unix())
+	for _, node := range r.nodes {
+		if node.Expired(now) {
+			t.Errorf("GetNodes() returned node %d with expired link", node.MId)
+		}
+	}
+	if expiring, err := dp.ExpiringNodes(time.Now(), 100); err != nil || len(expiring) != 0 {
+		t.Errorf("ExpiringNodes() after GetNodes = %v, %v, want refreshed links stored", expiring, err)
+	}
+}
@@ -0,0 +1,172 @@
+package boltdb
+
+import (
+	"bytes"
+	"time"
+
+	"go.etcd.io/bbolt"
+
+	dp "github.com/forscht/ddrv/internal/dataprovider"
+	"github.com/forscht/ddrv/pkg/ddrv"
+)
+
+func (bfp *Provider) CreateSession(fid string) (*dp.Session, error) {
+	session := dp.Session{Id: bfp.sg.Generate().String(), File: fid, MTime: time.Now()}
+	err := bfp.db.Update(func(tx *bbolt.Tx) error {
+		data := tx.Bucket([]byte("fs")).Get([]byte(decodep(fid)))
+		if data == nil || deserializeFile(data).Dir {
+			return dp.ErrNotExist
+		}
+		return tx.Bucket([]byte("sessions")).Put([]byte(session.Id), serializeSession(session))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (bfp *Provider) GetSession(id string) (*dp.Session, error) {
+	var session *dp.Session
+	err := bfp.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket([]byte("sessions")).Get([]byte(id))
+		if data == nil {
+			return dp.ErrNotExist
+		}
+		session = deserializeSession(data)
+		return nil
+	})
+	return session, err
+}
+
+// GetFileSession returns the most recently active session of the file
+func (bfp *Provider) GetFileSession(fid string) (*dp.Session, error) {
+	var session *dp.Session
+	err := bfp.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte("sessions")).ForEach(func(k, v []byte) error {
+			s := deserializeSession(v)
+			if s.File == fid && (session == nil || s.MTime.After(session.MTime)) {
+				session = s
+			}
+			return nil
+		})
+	})
+	if err == nil && session == nil {
+		err = dp.ErrNotExist
+	}
+	return session, err
+}
+
+func (bfp *Provider) AppendSession(id string, node ddrv.Node) error {
+	return bfp.db.Update(func(tx *bbolt.Tx) error {
+		sessions := tx.Bucket([]byte("sessions"))
+		data := sessions.Get([]byte(id))
+		if data == nil {
+			return dp.ErrNotExist
+		}
+		session := deserializeSession(data)
+		bucket, err := tx.Bucket([]byte("session_nodes")).CreateBucketIfNotExists([]byte(id))
+		if err != nil {
+			return err
+		}
+		seq := bfp.sg.Generate()
+		node.NId = seq.Int64()
+		leased := node.Leased
+		node.Leased = false
+		if err = bucket.Put(seq.Bytes(), serializeNode(node)); err != nil {
+			return err
+		}
+		// Recorded chunks are referenced, so they are not deleted while the upload is in progress
+		if err = ref(tx, node, leased); err != nil {
+			return err
+		}
+		session.Size += int64(node.Size)
+		session.MTime = time.Now()
+		return sessions.Put([]byte(id), serializeSession(*session))
+	})
+}
+
+// CommitSession appends recorded nodes to the file and removes the session
+func (bfp *Provider) CommitSession(id string) error {
+	return bfp.db.Update(func(tx *bbolt.Tx) error {
+		sessions := tx.Bucket([]byte("sessions"))
+		data := sessions.Get([]byte(id))
+		if data == nil {
+			return dp.ErrNotExist
+		}
+		session := deserializeSession(data)
+		p := decodep(session.File)
+		fs := tx.Bucket([]byte("fs"))
+		fileData := fs.Get([]byte(p))
+		if fileData == nil {
+			return dp.ErrNotExist
+		}
+		file := deserializeFile(fileData)
+		nodes, err := tx.Bucket([]byte("nodes")).CreateBucketIfNotExists([]byte(p))
+		if err != nil {
+			return err
+		}
+		sessionNodes := tx.Bucket([]byte("session_nodes"))
+		if bucket := sessionNodes.Bucket([]byte(id)); bucket != nil {
+			// Node keys are snowflakes generated after existing nodes of the file, so order is preserved
+			if err = bucket.ForEach(func(k, v []byte) error {
+				return nodes.Put(bytes.Clone(k), bytes.Clone(v))
+			}); err != nil {
+				return err
+			}
+			if err = sessionNodes.DeleteBucket([]byte(id)); err != nil {
+				return err
+			}
+		}
+		// The digest does not cover the appended nodes
+		if err = tx.Bucket([]byte("digests")).Delete([]byte(p)); err != nil {
+			return err
+		}
+		file.Size += session.Size
+		file.MTime = time.Now()
+		if err = fs.Put([]byte(p), serializeFile(*file)); err != nil {
+			return err
+		}
+		return sessions.Delete([]byte(id))
+	})
+}
+
+// DeleteSession removes the session and its nodes, nodes whose messages are not referenced anymore are queued for deletion
+func (bfp *Provider) DeleteSession(id string) error {
+	return bfp.db.Update(func(tx *bbolt.Tx) error {
+		sessions := tx.Bucket([]byte("sessions"))
+		if sessions.Get([]byte(id)) == nil {
+			return dp.ErrNotExist
+		}
+		sessionNodes := tx.Bucket([]byte("session_nodes"))
+		if bucket := sessionNodes.Bucket([]byte(id)); bucket != nil {
+			if err := bucket.ForEach(func(k, v []byte) error {
+				var node ddrv.Node
+				deserializeNode(&node, v)
+				released, err := unref(tx, node)
+				if err != nil {
+					return err
+				}
+				return queueDeletions(tx, released)
+			}); err != nil {
+				return err
+			}
+			if err := sessionNodes.DeleteBucket([]byte(id)); err != nil {
+				return err
+			}
+		}
+		return sessions.Delete([]byte(id))
+	})
+}
+
+func (bfp *Provider) StaleSessions(before time.Time) ([]*dp.Session, error) {
+	var sessions []*dp.Session
+	err := bfp.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte("sessions")).ForEach(func(k, v []byte) error {
+			if session := deserializeSession(v); session.MTime.Before(before) {
+				sessions = append(sessions, session)
+			}
+			return nil
+		})
+	})
+	return sessions, err
+}
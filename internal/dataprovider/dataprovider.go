@@ -1,6 +1,9 @@
 package dataprovider
 
 import (
+	"errors"
+	"io"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -19,7 +22,21 @@ type DataProvider interface {
 	Delete(id, parent string) error
 	GetNodes(id string) ([]ddrv.Node, error)
 	CreateNodes(id string, nodes []ddrv.Node) error
+	// GetNodeByHash returns a node with given checksum and size. Its message is leased along with the lookup,
+	// so it is not deleted before the write reusing the node references it, or LookupLease passed. The node is
+	// returned with Leased set, CreateNodes and AppendSession release the lease only for nodes with Leased set.
+	GetNodeByHash(hash string, size int) (*ddrv.Node, error)
+	// ExpiringNodes returns up to limit nodes with a link expiring before unix time before, by file id.
+	// UpdateNodes stores refreshed links of nodes returned by ExpiringNodes. FailRefreshes parks messages
+	// whose links failed to refresh, ExpiringNodes skips their nodes until RefreshBackoff of their failed attempts passed.
+	ExpiringNodes(before int, limit int) (map[string][]ddrv.Node, error)
+	UpdateNodes(fid string, nodes []ddrv.Node) error
+	FailRefreshes(mids []int64) error
 	Truncate(id string) error
+	// SetDigest stores the SHA-256 of the content of a file written in one go. Digests are removed whenever
+	// nodes are added to or removed from the file, GetDigest returns an empty digest for files without one.
+	SetDigest(fid, digest string) error
+	GetDigest(fid string) (string, error)
 	Stat(path string) (*File, error)
 	Ls(path string, limit int, offset int) ([]*File, error)
 	Touch(path string) error
@@ -27,6 +44,37 @@ type DataProvider interface {
 	Rm(path string) error
 	Mv(name, newname string) error
 	CHTime(path string, time time.Time) error
+	// Upload sessions, DeleteSession queues nodes no file or session points at anymore for deletion
+	CreateSession(fid string) (*Session, error)
+	GetSession(id string) (*Session, error)
+	GetFileSession(fid string) (*Session, error)
+	AppendSession(id string, node ddrv.Node) error
+	CommitSession(id string) error
+	DeleteSession(id string) error
+	StaleSessions(before time.Time) ([]*Session, error)
+	// Deletion queue, nodes whose messages no file or session points at anymore are queued
+	// when files are removed or truncated. PendingDeletions drops nodes which are referenced again
+	// and skips nodes whose messages are leased by GetNodeByHash. FailDeletions parks nodes whose messages
+	// failed to delete, PendingDeletions skips them until DeletionBackoff of their failed attempts passed.
+	PendingDeletions(limit int) ([]ddrv.Node, error)
+	CompleteDeletions(mids []int64) error
+	FailDeletions(mids []int64) error
+	// MessageIds returns ids of every message referenced by nodes of files, upload sessions
+	// and the deletion queue, including messages of replicas and parity shards
+	MessageIds() (map[int64]bool, error)
+	// PackedNodes returns nodes of files and upload sessions stored in packfiles, by file id. RepackNodes points nodes
+	// of files and upload sessions at copies of their ranges, copies are keyed by packfile message id and offset of the
+	// range in the packfile. Packfiles no node points at anymore are queued for deletion.
+	PackedNodes() (map[string][]ddrv.Node, error)
+	RepackNodes(copies map[int64]map[int]ddrv.Node) error
+	// Damaged files found by scrub, MarkDamaged with empty reason clears the mark.
+	// Marks are removed along with the nodes of the file.
+	MarkDamaged(fid, reason string) error
+	DamagedFiles() ([]*Damage, error)
+	// Backup writes a consistent snapshot of the metadata to w while requests are served. Restore replaces
+	// the metadata with a snapshot written by Backup of the same provider, no requests may be served meanwhile.
+	Backup(w io.Writer) error
+	Restore(r io.Reader) error
 	Close() error
 }
 
@@ -42,6 +90,23 @@ func Get(id, parent string) (*File, error) {
 	return provider.Get(id, parent)
 }
 
+// Path returns the path of the file by walking up its parents
+func Path(id string) (string, error) {
+	var names []string
+	for {
+		file, err := Get(id, "")
+		if err != nil {
+			return "", err
+		}
+		if file.Parent == "" {
+			break
+		}
+		names = append([]string{file.Name}, names...)
+		id = string(file.Parent)
+	}
+	return "/" + strings.Join(names, "/"), nil
+}
+
 func GetChild(id string) ([]*File, error) {
 	log.Debug().Str("c", "dataprovider").Str("id", id).Msg("GET_CHILD")
 	return provider.GetChild(id)
@@ -72,11 +137,35 @@ func CreateNodes(fid string, nodes []ddrv.Node) error {
 	return provider.CreateNodes(fid, nodes)
 }
 
+func GetNodeByHash(hash string, size int) (*ddrv.Node, error) {
+	log.Debug().Str("c", "dataprovider").Str("hash", hash).Int("size", size).Msg("GET_NODE_BY_HASH")
+	return provider.GetNodeByHash(hash, size)
+}
+
+// Lookup implements ddrv.LookupFunc on top of the loaded provider
+func Lookup(hash string, size int) (*ddrv.Node, error) {
+	node, err := GetNodeByHash(hash, size)
+	if errors.Is(err, ErrNotExist) {
+		return nil, nil
+	}
+	return node, err
+}
+
 func Truncate(fid string) error {
 	log.Debug().Str("c", "dataprovider").Str("fid", fid).Msg("TRUNCATE")
 	return provider.Truncate(fid)
 }
 
+func SetDigest(fid, digest string) error {
+	log.Debug().Str("c", "dataprovider").Str("fid", fid).Str("digest", digest).Msg("SET_DIGEST")
+	return provider.SetDigest(fid, digest)
+}
+
+func GetDigest(fid string) (string, error) {
+	log.Debug().Str("c", "dataprovider").Str("fid", fid).Msg("GET_DIGEST")
+	return provider.GetDigest(fid)
+}
+
 func Stat(path string) (*File, error) {
 	log.Debug().Str("c", "dataprovider").Str("path", path).Msg("STAT")
 	return provider.Stat(path)
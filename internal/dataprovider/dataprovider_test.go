@@ -0,0 +1,112 @@
+package dataprovider_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"path/filepath"
+	"testing"
+
+	dp "github.com/forscht/ddrv/internal/dataprovider"
+	"github.com/forscht/ddrv/internal/dataprovider/boltdb"
+	"github.com/forscht/ddrv/pkg/ddrv"
+)
+
+func newDriver(t *testing.T, cfg *ddrv.Config) *ddrv.Driver {
+	t.Helper()
+	driver, err := ddrv.New(cfg)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	return driver
+}
+
+// load loads a bolt provider stored in a temporary directory unless a path is given
+func load(t *testing.T, driver *ddrv.Driver, path string) dp.DataProvider {
+	t.Helper()
+	if path == "" {
+		path = filepath.Join(t.TempDir(), "ddrv.db")
+	}
+	provider := boltdb.New(driver, &boltdb.Config{DbPath: path})
+	dp.Load(provider)
+	return provider
+}
+
+func randBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// put creates the file at path with data the way the api does, chunk messages carry manifests of the file
+func put(t *testing.T, driver *ddrv.Driver, p string, data []byte) *dp.File {
+	t.Helper()
+	if err := dp.Mkdir(filepath.Dir(p)); err != nil {
+		t.Fatal(err)
+	}
+	if err := dp.Touch(p); err != nil {
+		t.Fatal(err)
+	}
+	file, err := dp.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is written for empty files, like files of upload sessions before the first write
+	if len(data) == 0 {
+		return file
+	}
+	var nodes []ddrv.Node
+	ctx := ddrv.WithManifest(context.Background(), file.Id, p, 0, 0)
+	w := driver.NewWriterContext(ctx, func(chunk ddrv.Node) { nodes = append(nodes, chunk) })
+	if _, err = w.Write(data); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err = dp.CreateNodes(file.Id, nodes); err != nil {
+		t.Fatalf("CreateNodes() error = %v", err)
+	}
+	return file
+}
+
+// get reads the file with the given id
+func get(t *testing.T, driver *ddrv.Driver, id string) []byte {
+	t.Helper()
+	nodes, err := dp.GetNodes(id)
+	if err != nil {
+		t.Fatalf("GetNodes() error = %v", err)
+	}
+	r, err := driver.NewReader(nodes, 0)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	return data
+}
+
+// check reports whether the file with the given id holds data
+func check(t *testing.T, driver *ddrv.Driver, id string, data []byte, what string) {
+	t.Helper()
+	if got := get(t, driver, id); !bytes.Equal(got, data) {
+		t.Errorf("%s returned %d bytes, want %d equal bytes", what, len(got), len(data))
+	}
+}
+
+func rm(t *testing.T, p string) {
+	t.Helper()
+	if err := dp.Rm(p); err != nil {
+		t.Fatalf("Rm(%s) error = %v", p, err)
+	}
+}
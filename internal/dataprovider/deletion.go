@@ -0,0 +1,112 @@
+package dataprovider
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/forscht/ddrv/pkg/ddrv"
+)
+
+// LookupLease is how long a message of a node found by checksum is kept from deletion, it covers writes
+// which reuse the node and are not committed yet. Leases of committed writes are released right away.
+const LookupLease = 24 * time.Hour
+
+// deletionBatch is the number of queued nodes deleted at once, a bulk delete request per channel
+const deletionBatch = ddrv.MaxBulkDelete
+
+// DeletionRetry is how long deletion of a message is postponed after it failed, the delay doubles
+// with every failed attempt up to MaxDeletionRetry.
+const (
+	DeletionRetry    = time.Minute
+	MaxDeletionRetry = 24 * time.Hour
+)
+
+// DeletionBackoff returns how long deletion of a message is postponed after given number of failed attempts
+func DeletionBackoff(attempts int) time.Duration {
+	return backoff(DeletionRetry, MaxDeletionRetry, attempts)
+}
+
+// backoff returns delay doubled for every failed attempt after the first one, up to max
+func backoff(delay, max time.Duration, attempts int) time.Duration {
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+func PendingDeletions(limit int) ([]ddrv.Node, error) {
+	log.Debug().Str("c", "dataprovider").Int("limit", limit).Msg("PENDING_DELETIONS")
+	return provider.PendingDeletions(limit)
+}
+
+func CompleteDeletions(mids []int64) error {
+	log.Debug().Str("c", "dataprovider").Int("count", len(mids)).Msg("COMPLETE_DELETIONS")
+	return provider.CompleteDeletions(mids)
+}
+
+func FailDeletions(mids []int64) error {
+	log.Debug().Str("c", "dataprovider").Int("count", len(mids)).Msg("FAIL_DELETIONS")
+	return provider.FailDeletions(mids)
+}
+
+// ProcessDeletions deletes messages of queued nodes from discord until no queued node is due.
+// Nodes stay queued until their messages are deleted, so deletion resumes after a failure or restart.
+// Nodes whose messages fail to delete are parked and retried with backoff, they do not hold up other nodes.
+func ProcessDeletions(ctx context.Context, driver *ddrv.Driver) (int, error) {
+	var deleted int
+	for {
+		nodes, err := PendingDeletions(deletionBatch)
+		if err != nil || len(nodes) == 0 {
+			return deleted, err
+		}
+		done, failed, err := deleteBatch(ctx, driver, nodes)
+		if err != nil {
+			return deleted, err
+		}
+		if len(done) > 0 {
+			if err = CompleteDeletions(done); err != nil {
+				return deleted, err
+			}
+		}
+		if len(failed) > 0 {
+			if err = FailDeletions(failed); err != nil {
+				return deleted, err
+			}
+		}
+		deleted += len(done)
+	}
+}
+
+// deleteBatch deletes messages of nodes and returns ids of nodes whose messages are deleted and of nodes
+// whose messages failed to delete. A failed batch is split in halves until the failing nodes are found,
+// messages deleted by a failed attempt are not found anymore, which counts as deleted.
+func deleteBatch(ctx context.Context, driver *ddrv.Driver, nodes []ddrv.Node) (done, failed []int64, err error) {
+	err = driver.DeleteNodesContext(ctx, nodes)
+	if ctx.Err() != nil {
+		return nil, nil, ctx.Err()
+	}
+	if err == nil {
+		for _, node := range nodes {
+			done = append(done, node.MId)
+		}
+		return done, nil, nil
+	}
+	if len(nodes) == 1 {
+		log.Warn().Str("c", "dataprovider").Int64("mid", nodes[0].MId).Err(err).Msg("failed to delete message, retrying later")
+		return nil, []int64{nodes[0].MId}, nil
+	}
+	half := len(nodes) / 2
+	for _, part := range [][]ddrv.Node{nodes[:half], nodes[half:]} {
+		d, f, err := deleteBatch(ctx, driver, part)
+		if err != nil {
+			return nil, nil, err
+		}
+		done, failed = append(done, d...), append(failed, f...)
+	}
+	return done, failed, nil
+}
@@ -0,0 +1,230 @@
+package dataprovider_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dp "github.com/forscht/ddrv/internal/dataprovider"
+	"github.com/forscht/ddrv/pkg/ddrv"
+	"github.com/forscht/ddrv/pkg/ddrv/ddrvtest"
+)
+
+func TestDeletions(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	driver := newDriver(t, s.Config(1024, "1"))
+	driver.Lookup = dp.Lookup
+	dbPath := filepath.Join(t.TempDir(), "ddrv.db")
+	provider := load(t, driver, dbPath)
+
+	data := randBytes(t, 5000)
+	put(t, driver, "/docs/a.bin", data)
+	shared := put(t, driver, "/b.bin", data)
+	put(t, driver, "/docs/c.bin", randBytes(t, 3000))
+	if got := len(s.Messages("1")); got != 8 {
+		t.Fatalf("%d messages after upload, want 8", got)
+	}
+
+	// Messages are deleted in background, chunks still referenced by b.bin are kept
+	rm(t, "/docs")
+	if got := len(s.Messages("1")); got != 8 {
+		t.Fatalf("%d messages right after removal, want 8", got)
+	}
+	// The queue survives restarts
+	_ = provider.Close()
+	provider = load(t, driver, dbPath)
+	defer provider.Close()
+	deleted, err := dp.ProcessDeletions(context.Background(), driver)
+	if err != nil {
+		t.Fatalf("ProcessDeletions() error = %v", err)
+	}
+	if deleted != 3 || len(s.Messages("1")) != 5 {
+		t.Errorf("deleted %d messages and %d are left, want 3 deleted and 5 left", deleted, len(s.Messages("1")))
+	}
+	check(t, driver, shared.Id, data, "read of file sharing deleted chunks")
+
+	rm(t, "/b.bin")
+	if deleted, err = dp.ProcessDeletions(context.Background(), driver); err != nil || deleted != 5 {
+		t.Errorf("ProcessDeletions() = %d, %v, want 5 deleted", deleted, err)
+	}
+	if got := len(s.Messages("1")); got != 0 {
+		t.Errorf("%d messages left, want 0", got)
+	}
+}
+
+func TestLookupLease(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	driver := newDriver(t, s.Config(1024, "1"))
+	driver.Lookup = dp.Lookup
+	defer load(t, driver, "").Close()
+
+	data := randBytes(t, 1000)
+	a := put(t, driver, "/a.bin", data)
+	nodes, err := dp.GetNodes(a.Id)
+	if err != nil || len(nodes) != 1 {
+		t.Fatalf("GetNodes() = %v, %v", nodes, err)
+	}
+	// A write reuses the chunk, the file holding it is removed before the write is committed
+	node, err := dp.Lookup(nodes[0].Hash, nodes[0].Size)
+	if err != nil || node == nil {
+		t.Fatalf("Lookup() = %v, %v", node, err)
+	}
+	// Another write referencing the message without a lease does not release the lease of the pending write
+	c := put(t, driver, "/c.bin", nil)
+	if err = dp.CreateNodes(c.Id, nodes); err != nil {
+		t.Fatalf("CreateNodes() error = %v", err)
+	}
+	rm(t, "/a.bin")
+	rm(t, "/c.bin")
+	if deleted, err := dp.ProcessDeletions(context.Background(), driver); err != nil || deleted != 0 {
+		t.Errorf("ProcessDeletions() = %d, %v, want leased message kept", deleted, err)
+	}
+	b := put(t, driver, "/b.bin", nil)
+	if err = dp.CreateNodes(b.Id, []ddrv.Node{*node}); err != nil {
+		t.Fatalf("CreateNodes() error = %v", err)
+	}
+	check(t, driver, b.Id, data, "read of file reusing a leased chunk")
+
+	// The lease is released once the write is committed
+	rm(t, "/b.bin")
+	if deleted, err := dp.ProcessDeletions(context.Background(), driver); err != nil || deleted != 1 {
+		t.Errorf("ProcessDeletions() = %d, %v, want 1 deleted", deleted, err)
+	}
+}
+
+func TestParityDeletions(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	channels := []string{"1", "2", "3", "4", "5"}
+	cfg := s.Config(1024, channels...)
+	cfg.DataShards, cfg.ParityShards = 3, 2
+	driver := newDriver(t, cfg)
+	driver.Lookup = dp.Lookup
+	defer load(t, driver, "").Close()
+	messages := func() (n int) {
+		for _, channel := range channels {
+			n += len(s.Messages(channel))
+		}
+		return n
+	}
+
+	data := randBytes(t, 3000)
+	put(t, driver, "/a.bin", data)
+	// b.bin shares the chunks of a.bin, its stripe has parity shards of its own
+	b := put(t, driver, "/b.bin", data)
+	if got := messages(); got != 7 {
+		t.Fatalf("%d messages after upload, want 7", got)
+	}
+
+	// Parity shards of a.bin are released with it, the shared chunks are kept
+	rm(t, "/a.bin")
+	if deleted, err := dp.ProcessDeletions(context.Background(), driver); err != nil || deleted != 2 {
+		t.Errorf("ProcessDeletions() = %d, %v, want 2 deleted", deleted, err)
+	}
+	check(t, driver, b.Id, data, "read of file sharing deleted chunks")
+
+	rm(t, "/b.bin")
+	if deleted, err := dp.ProcessDeletions(context.Background(), driver); err != nil || deleted != 5 {
+		t.Errorf("ProcessDeletions() = %d, %v, want 5 deleted", deleted, err)
+	}
+	if got := messages(); got != 0 {
+		t.Errorf("%d messages left, want 0", got)
+	}
+}
+
+func TestPackedDeletions(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	cfg := s.Config(1024, "1")
+	cfg.Attachments = 5
+	driver := newDriver(t, cfg)
+	driver.Lookup = dp.Lookup
+	defer load(t, driver, "").Close()
+
+	data := randBytes(t, 5000)
+	put(t, driver, "/a.bin", data)
+	// b.bin shares the first two chunks of the message holding a.bin
+	shared := append(append([]byte(nil), data[:2048]...), randBytes(t, 1000)...)
+	b := put(t, driver, "/b.bin", shared)
+	if got := len(s.Messages("1")); got != 2 {
+		t.Fatalf("%d messages after upload, want 2", got)
+	}
+
+	// The message is kept as long as any of its chunks is referenced
+	rm(t, "/a.bin")
+	if deleted, err := dp.ProcessDeletions(context.Background(), driver); err != nil || deleted != 0 {
+		t.Errorf("ProcessDeletions() = %d, %v, want 0 deleted", deleted, err)
+	}
+	check(t, driver, b.Id, shared, "read of file sharing a packed message")
+
+	rm(t, "/b.bin")
+	if deleted, err := dp.ProcessDeletions(context.Background(), driver); err != nil || deleted != 2 {
+		t.Errorf("ProcessDeletions() = %d, %v, want 2 deleted", deleted, err)
+	}
+	if got := len(s.Messages("1")); got != 0 {
+		t.Fatalf("%d messages left, want 0", got)
+	}
+
+	// Chunks of deleted messages are not reused
+	a := put(t, driver, "/a.bin", data)
+	if got := len(s.Messages("1")); got != 1 {
+		t.Errorf("%d messages after upload, want 1", got)
+	}
+	check(t, driver, a.Id, data, "read")
+}
+
+func TestFailedDeletions(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	driver := newDriver(t, s.Config(1024, "1", "2"))
+	dbPath := filepath.Join(t.TempDir(), "ddrv.db")
+	provider := load(t, driver, dbPath)
+
+	put(t, driver, "/a.bin", randBytes(t, 4000))
+	if got := len(s.Messages("1")) + len(s.Messages("2")); got != 4 {
+		t.Fatalf("%d messages after upload, want 4", got)
+	}
+	// Messages of a channel the token lost access to can not be deleted
+	s.Deny("2")
+	rm(t, "/a.bin")
+	deleted, err := dp.ProcessDeletions(context.Background(), driver)
+	if err != nil {
+		t.Fatalf("ProcessDeletions() error = %v", err)
+	}
+	if deleted != 2 || len(s.Messages("1")) != 0 || len(s.Messages("2")) != 2 {
+		t.Errorf("deleted %d messages and %d, %d are left, want 2 deleted and 0, 2 left", deleted, len(s.Messages("1")), len(s.Messages("2")))
+	}
+
+	// Failed messages are parked across restarts, they stay queued without holding up the queue
+	_ = provider.Close()
+	provider = load(t, driver, dbPath)
+	defer provider.Close()
+	if pending, err := dp.PendingDeletions(100); err != nil || len(pending) != 0 {
+		t.Errorf("PendingDeletions() = %d nodes, %v, want parked nodes skipped", len(pending), err)
+	}
+	ids, err := dp.MessageIds()
+	if err != nil || len(ids) != 2 {
+		t.Errorf("MessageIds() = %v, %v, want 2 queued messages", ids, err)
+	}
+	put(t, newDriver(t, s.Config(1024, "1")), "/b.bin", randBytes(t, 1000))
+	rm(t, "/b.bin")
+	if deleted, err = dp.ProcessDeletions(context.Background(), driver); err != nil || deleted != 1 {
+		t.Errorf("ProcessDeletions() = %d, %v, want 1 deleted", deleted, err)
+	}
+}
+
+func TestDeletionBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1:  dp.DeletionRetry,
+		2:  2 * dp.DeletionRetry,
+		4:  8 * dp.DeletionRetry,
+		20: dp.MaxDeletionRetry,
+	} {
+		if got := dp.DeletionBackoff(attempts); got != want {
+			t.Errorf("DeletionBackoff(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package dataprovider_test
+
+import (
+	"errors"
+	"testing"
+
+	dp "github.com/forscht/ddrv/internal/dataprovider"
+	"github.com/forscht/ddrv/pkg/ddrv/ddrvtest"
+)
+
+func TestDigest(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	driver := newDriver(t, s.Config(1024, "1"))
+	defer load(t, driver, "").Close()
+
+	digest := func(id, want, what string) {
+		t.Helper()
+		got, err := dp.GetDigest(id)
+		if err != nil {
+			t.Fatalf("GetDigest() error = %v", err)
+		}
+		if got != want {
+			t.Errorf("digest %s = %q, want %q", what, got, want)
+		}
+	}
+	set := func(id string) {
+		t.Helper()
+		if err := dp.SetDigest(id, "abc"); err != nil {
+			t.Fatalf("SetDigest() error = %v", err)
+		}
+	}
+
+	file := put(t, driver, "/a/b.bin", randBytes(t, 1500))
+	digest(file.Id, "", "of a file without digest")
+	set(file.Id)
+	digest(file.Id, "abc", "after SetDigest()")
+
+	// The digest follows the file when it is moved
+	err := dp.Mv("/a/b.bin", "/a/c.bin")
+	if err != nil {
+		t.Fatalf("Mv() error = %v", err)
+	}
+	// Ids of bolt files are derived from their path
+	if file, err = dp.Stat("/a/c.bin"); err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	digest(file.Id, "abc", "after Mv()")
+
+	// It does not cover appended nodes
+	nodes, _ := dp.GetNodes(file.Id)
+	if err := dp.CreateNodes(file.Id, nodes[:1]); err != nil {
+		t.Fatalf("CreateNodes() error = %v", err)
+	}
+	digest(file.Id, "", "after CreateNodes()")
+
+	// Nor truncated content
+	set(file.Id)
+	if err := dp.Truncate(file.Id); err != nil {
+		t.Fatalf("Truncate() error = %v", err)
+	}
+	digest(file.Id, "", "after Truncate()")
+
+	rm(t, "/a/c.bin")
+	if err = dp.SetDigest(file.Id, "abc"); !errors.Is(err, dp.ErrNotExist) {
+		t.Errorf("SetDigest() of removed file error = %v, want %v", err, dp.ErrNotExist)
+	}
+}
@@ -0,0 +1,215 @@
+package dataprovider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/forscht/ddrv/pkg/ddrv"
+)
+
+// DefaultGCGrace is how old a message must be before the garbage collector considers it,
+// uploads in flight record their chunks once the file is written.
+const DefaultGCGrace = 24 * time.Hour
+
+// DefaultGCSparse is the share of a packfile used by files below which the garbage collector rewrites it
+const DefaultGCSparse = 0.5
+
+// GCOptions configures CollectGarbage
+type GCOptions struct {
+	Channels []string      // Channels to scan, defaults to the channels of the driver and its webhooks
+	Backup   string        // Backup channel, it holds snapshots which are not referenced by the provider
+	Grace    time.Duration // Messages younger than Grace are skipped, defaults to DefaultGCGrace
+	DryRun   bool          // Report orphans and sparse packfiles without deleting or rewriting them
+	// Sparse is the share of a packfile used by files below which it is rewritten, defaults to DefaultGCSparse
+	Sparse float64
+}
+
+// GCReport is the result of CollectGarbage
+type GCReport struct {
+	Channels int         `json:"channels"` // Number of scanned channels
+	Scanned  int         `json:"scanned"`  // Number of scanned messages
+	Young    int         `json:"young"`    // Chunk messages skipped because of the grace period
+	Orphans  []ddrv.Node `json:"orphans"`  // Chunk messages no file, session or deletion points at
+	Deleted  int         `json:"deleted"`  // Number of deleted orphans, 0 in dry-run mode
+	Size     int64       `json:"size"`     // Total size of orphans in bytes
+	Sparse   int         `json:"sparse"`   // Number of sparse packfiles
+	Repacked int         `json:"repacked"` // Number of rewritten sparse packfiles, 0 in dry-run mode
+	Unused   int64       `json:"unused"`   // Bytes of sparse packfiles no file uses anymore
+}
+
+func MessageIds() (map[int64]bool, error) {
+	log.Debug().Str("c", "dataprovider").Msg("MESSAGE_IDS")
+	return provider.MessageIds()
+}
+
+func PackedNodes() (map[string][]ddrv.Node, error) {
+	log.Debug().Str("c", "dataprovider").Msg("PACKED_NODES")
+	return provider.PackedNodes()
+}
+
+func RepackNodes(copies map[int64]map[int]ddrv.Node) error {
+	log.Debug().Str("c", "dataprovider").Int("packfiles", len(copies)).Msg("REPACK_NODES")
+	return provider.RepackNodes(copies)
+}
+
+// CollectGarbage pages through channels and finds chunk messages which are not referenced by the provider,
+// e.g. chunks of failed uploads. Messages not uploaded by ddrv are never touched. Orphans are deleted
+// unless opts.DryRun is set. Packfiles which are mostly unused once their files are removed are rewritten
+// with the ranges still in use, the old packfiles are deleted in background like removed files.
+func CollectGarbage(ctx context.Context, driver *ddrv.Driver, opts GCOptions) (*GCReport, error) {
+	if driver.Rest == nil {
+		return nil, errors.New("garbage collection needs chunks stored on discord")
+	}
+	channels := opts.Channels
+	if len(channels) == 0 {
+		var err error
+		if channels, err = dataChannels(ctx, driver); err != nil {
+			return nil, err
+		}
+	}
+	if len(channels) == 0 {
+		return nil, errors.New("no channels to collect garbage from")
+	}
+	for _, channelId := range channels {
+		// Snapshot messages look like orphaned chunks
+		if opts.Backup != "" && channelId == opts.Backup {
+			return nil, fmt.Errorf("backup channel %s can not be garbage collected", channelId)
+		}
+	}
+	grace := opts.Grace
+	if grace <= 0 {
+		grace = DefaultGCGrace
+	}
+	// Messages are listed after known ids are loaded, anything uploaded meanwhile is within grace period
+	known, err := MessageIds()
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-grace)
+	report := &GCReport{Channels: len(channels), Orphans: make([]ddrv.Node, 0)}
+	var pending []ddrv.Node
+	remove := func() error {
+		if opts.DryRun || len(pending) == 0 {
+			return nil
+		}
+		if err := driver.DeleteNodesContext(ctx, pending); err != nil {
+			return err
+		}
+		report.Deleted += len(pending)
+		pending = pending[:0]
+		return nil
+	}
+	var messages []ddrv.Message
+	for _, channelId := range channels {
+		var before int64
+		for {
+			messages = messages[:0]
+			// Messages are returned newest first
+			if err = driver.Rest.GetMessagesContext(ctx, channelId, before, "before", &messages); err != nil {
+				return report, err
+			}
+			if len(messages) == 0 {
+				break
+			}
+			for _, msg := range messages {
+				mid, err := strconv.ParseInt(msg.Id, 10, 64)
+				if err != nil {
+					return report, err
+				}
+				before = mid
+				report.Scanned++
+				if !msg.IsChunk() || known[mid] {
+					continue
+				}
+				if ddrv.SnowflakeTime(mid).After(cutoff) {
+					report.Young++
+					continue
+				}
+				// Deleting the message deletes every chunk it holds
+				orphan := ddrv.Node{URL: msg.Attachments[0].URL, MId: mid}
+				for _, att := range msg.Attachments {
+					orphan.Size += att.Size
+				}
+				report.Orphans = append(report.Orphans, orphan)
+				report.Size += int64(orphan.Size)
+				pending = append(pending, orphan)
+			}
+			if len(pending) >= ddrv.MaxBulkDelete {
+				if err = remove(); err != nil {
+					return report, err
+				}
+			}
+		}
+	}
+	if err = remove(); err != nil {
+		return report, err
+	}
+	return report, repack(ctx, driver, opts, cutoff, report)
+}
+
+// repack rewrites packfiles older than cutoff whose share used by files is below opts.Sparse
+func repack(ctx context.Context, driver *ddrv.Driver, opts GCOptions, cutoff time.Time, report *GCReport) error {
+	sparse := opts.Sparse
+	if sparse <= 0 {
+		sparse = DefaultGCSparse
+	}
+	packed, err := PackedNodes()
+	if err != nil {
+		return err
+	}
+	type packfile struct {
+		size   int
+		ranges map[int]int // offset -> size of ranges used by files
+		nodes  []ddrv.Node
+	}
+	packfiles := make(map[int64]*packfile)
+	for _, nodes := range packed {
+		for _, node := range nodes {
+			p, ok := packfiles[node.MId]
+			if !ok {
+				p = &packfile{size: node.Pack.Size, ranges: make(map[int]int)}
+				packfiles[node.MId] = p
+			}
+			p.ranges[node.Pack.Offset] = node.Size
+			p.nodes = append(p.nodes, node)
+		}
+	}
+	copies := make(map[int64]map[int]ddrv.Node)
+	for mid, p := range packfiles {
+		used := 0
+		for _, size := range p.ranges {
+			used += size
+		}
+		// Files of young packfiles may still be in flight
+		if float64(used) >= sparse*float64(p.size) || ddrv.SnowflakeTime(mid).After(cutoff) {
+			continue
+		}
+		report.Sparse++
+		report.Unused += int64(p.size - used)
+		if opts.DryRun {
+			continue
+		}
+		moved, rerr := driver.Repack(ctx, p.nodes)
+		if rerr != nil {
+			// Packfiles rewritten so far are still recorded
+			err = rerr
+			break
+		}
+		copies[mid] = make(map[int]ddrv.Node)
+		for i, node := range p.nodes {
+			copies[mid][node.Pack.Offset] = moved[i]
+		}
+		report.Repacked++
+	}
+	if len(copies) > 0 {
+		if rerr := RepackNodes(copies); rerr != nil {
+			return rerr
+		}
+	}
+	return err
+}
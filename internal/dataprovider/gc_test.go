@@ -0,0 +1,234 @@
+package dataprovider_test
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	dp "github.com/forscht/ddrv/internal/dataprovider"
+	"github.com/forscht/ddrv/pkg/ddrv"
+	"github.com/forscht/ddrv/pkg/ddrv/ddrvtest"
+)
+
+func TestGC(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	driver := newDriver(t, s.Config(1024, "1"))
+	defer load(t, driver, "").Close()
+
+	data := randBytes(t, 2500)
+	kept := put(t, driver, "/a.bin", data)
+	put(t, driver, "/b.bin", data[:1000])
+	// Queued for deletion, not an orphan
+	rm(t, "/b.bin")
+	// Chunks of failed uploads and messages not sent by ddrv
+	s.AddMessage("1", "", ddrvtest.File{Name: "0b9fd1a8-5c0e-4f3a-9d43-2a7c1d2e3f40", Data: []byte("orphan")})
+	s.AddMessage("1", "", ddrvtest.File{Name: "6f1e2d3c-4b5a-4978-8695-a4b3c2d1e0f9", Data: []byte("orphan")})
+	s.AddMessage("1", "hello", ddrvtest.File{Name: "0c1d2e3f-4a5b-4c6d-8e7f-8091a2b3c4d5", Data: []byte("note")})
+	s.AddMessage("1", "", ddrvtest.File{Name: "photo.png", Data: []byte("png")})
+	if got := len(s.Messages("1")); got != 8 {
+		t.Fatalf("%d messages, want 8", got)
+	}
+
+	// Messages within grace period are skipped
+	report, err := dp.CollectGarbage(context.Background(), driver, dp.GCOptions{Grace: time.Hour})
+	if err != nil {
+		t.Fatalf("CollectGarbage() error = %v", err)
+	}
+	if report.Scanned != 8 || report.Young != 2 || len(report.Orphans) != 0 {
+		t.Errorf("CollectGarbage() with grace scanned %d, young %d, orphans %d, want 8, 2, 0", report.Scanned, report.Young, len(report.Orphans))
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	report, err = dp.CollectGarbage(context.Background(), driver, dp.GCOptions{Grace: time.Millisecond, DryRun: true})
+	if err != nil {
+		t.Fatalf("CollectGarbage() error = %v", err)
+	}
+	if len(report.Orphans) != 2 || report.Size != 12 || report.Deleted != 0 || len(s.Messages("1")) != 8 {
+		t.Errorf("dry run found %d orphans of %d bytes and deleted %d, want 2 orphans of 12 bytes and none deleted", len(report.Orphans), report.Size, report.Deleted)
+	}
+
+	report, err = dp.CollectGarbage(context.Background(), driver, dp.GCOptions{Grace: time.Millisecond})
+	if err != nil {
+		t.Fatalf("CollectGarbage() error = %v", err)
+	}
+	if report.Deleted != 2 || len(s.Messages("1")) != 6 {
+		t.Errorf("deleted %d orphans and %d messages are left, want 2 deleted and 6 left", report.Deleted, len(s.Messages("1")))
+	}
+	check(t, driver, kept.Id, data, "read after garbage collection")
+	if deleted, err := dp.ProcessDeletions(context.Background(), driver); err != nil || deleted != 1 {
+		t.Errorf("ProcessDeletions() = %d, %v, want 1 deleted", deleted, err)
+	}
+
+	// Snapshots in the backup channel are never collected
+	s.AddMessage("9", "", ddrvtest.File{Name: "1a2b3c4d-5e6f-4a7b-8c9d-0e1f2a3b4c5d", Data: []byte("snapshot")})
+	time.Sleep(10 * time.Millisecond)
+	if _, err = dp.CollectGarbage(context.Background(), driver, dp.GCOptions{Channels: []string{"9"}, Backup: "9", Grace: time.Millisecond}); err == nil {
+		t.Error("CollectGarbage() of the backup channel succeeded")
+	}
+	if len(s.Messages("9")) != 1 {
+		t.Errorf("%d messages are left in the backup channel, want 1", len(s.Messages("9")))
+	}
+
+	// Channels of webhooks are collected
+	cfg := s.Config(1024)
+	cfg.Channels = nil
+	cfg.Webhooks = []string{s.Webhook("7")}
+	hooked := newDriver(t, cfg)
+	s.AddMessage("7", "", ddrvtest.File{Name: "2b3c4d5e-6f7a-4b8c-9d0e-1f2a3b4c5d6e", Data: []byte("orphan")})
+	time.Sleep(10 * time.Millisecond)
+	report, err = dp.CollectGarbage(context.Background(), hooked, dp.GCOptions{Grace: time.Millisecond})
+	if err != nil || report.Channels != 1 || report.Deleted != 1 || len(s.Messages("7")) != 0 {
+		t.Errorf("CollectGarbage() of webhook channel = %+v, %v, want 1 orphan deleted", report, err)
+	}
+}
+
+func TestGCRepack(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	cfg := s.Config(1024, "1")
+	cfg.PackThreshold = 512
+	driver := newDriver(t, cfg)
+	defer load(t, driver, "").Close()
+
+	// Files written together share a packfile
+	data := make([][]byte, 4)
+	files := make([]*dp.File, len(data))
+	for i := range data {
+		data[i] = randBytes(t, 200)
+		files[i] = put(t, driver, "/"+strconv.Itoa(i)+".bin", nil)
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, len(data))
+	for i := range data {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var nodes []ddrv.Node
+			w := driver.NewWriter(func(chunk ddrv.Node) { nodes = append(nodes, chunk) })
+			if _, errs[i] = w.Write(data[i]); errs[i] == nil {
+				errs[i] = w.Close()
+			}
+			if errs[i] == nil {
+				errs[i] = dp.CreateNodes(files[i].Id, nodes)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("write of file %d error = %v", i, err)
+		}
+	}
+	if got := len(s.Messages("1")); got != 1 {
+		t.Fatalf("%d messages after upload, want 1", got)
+	}
+	for i := range files[1:] {
+		rm(t, "/"+strconv.Itoa(i+1)+".bin")
+	}
+	// The packfile is kept as long as any of its files is referenced
+	if deleted, err := dp.ProcessDeletions(context.Background(), driver); err != nil || deleted != 0 {
+		t.Errorf("ProcessDeletions() = %d, %v, want 0 deleted", deleted, err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	report, err := dp.CollectGarbage(context.Background(), driver, dp.GCOptions{Grace: time.Millisecond, DryRun: true})
+	if err != nil {
+		t.Fatalf("CollectGarbage() error = %v", err)
+	}
+	if report.Sparse != 1 || report.Unused != 600 || report.Repacked != 0 || len(s.Messages("1")) != 1 {
+		t.Errorf("dry run found %d sparse packfiles with %d unused bytes and repacked %d, want 1 with 600 bytes and none repacked", report.Sparse, report.Unused, report.Repacked)
+	}
+
+	report, err = dp.CollectGarbage(context.Background(), driver, dp.GCOptions{Grace: time.Millisecond})
+	if err != nil {
+		t.Fatalf("CollectGarbage() error = %v", err)
+	}
+	if report.Repacked != 1 || len(report.Orphans) != 0 || len(s.Messages("1")) != 2 {
+		t.Errorf("repacked %d packfiles with %d orphans and %d messages, want 1 repacked, no orphans and 2 messages", report.Repacked, len(report.Orphans), len(s.Messages("1")))
+	}
+	check(t, driver, files[0].Id, data[0], "read after repack")
+	// The old packfile is released
+	if deleted, err := dp.ProcessDeletions(context.Background(), driver); err != nil || deleted != 1 {
+		t.Errorf("ProcessDeletions() = %d, %v, want 1 deleted", deleted, err)
+	}
+	check(t, driver, files[0].Id, data[0], "read after deletion of the old packfile")
+}
+
+func TestGCRepackSession(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	cfg := s.Config(1024, "1")
+	cfg.PackThreshold = 512
+	driver := newDriver(t, cfg)
+	defer load(t, driver, "").Close()
+
+	// The last file is written by an upload session which is still open while the packfile is repacked
+	data := make([][]byte, 5)
+	files := make([]*dp.File, len(data))
+	for i := range data {
+		data[i] = randBytes(t, 200)
+		files[i] = put(t, driver, "/"+strconv.Itoa(i)+".bin", nil)
+	}
+	session, err := dp.CreateSession(files[4].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, len(data))
+	for i := range data {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var nodes []ddrv.Node
+			w := driver.NewWriter(func(chunk ddrv.Node) { nodes = append(nodes, chunk) })
+			if _, errs[i] = w.Write(data[i]); errs[i] == nil {
+				errs[i] = w.Close()
+			}
+			if errs[i] != nil {
+				return
+			}
+			if i < 4 {
+				errs[i] = dp.CreateNodes(files[i].Id, nodes)
+				return
+			}
+			for _, chunk := range nodes {
+				if errs[i] = dp.AppendSession(session.Id, chunk); errs[i] != nil {
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("write of file %d error = %v", i, err)
+		}
+	}
+	if got := len(s.Messages("1")); got != 1 {
+		t.Fatalf("%d messages after upload, want 1", got)
+	}
+	for i := 1; i < 4; i++ {
+		rm(t, "/"+strconv.Itoa(i)+".bin")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	report, err := dp.CollectGarbage(context.Background(), driver, dp.GCOptions{Grace: time.Millisecond})
+	if err != nil {
+		t.Fatalf("CollectGarbage() error = %v", err)
+	}
+	if report.Repacked != 1 || report.Unused != 600 {
+		t.Errorf("repacked %d packfiles with %d unused bytes, want 1 with 600 bytes", report.Repacked, report.Unused)
+	}
+	// The old packfile is released by the session as well
+	if deleted, err := dp.ProcessDeletions(context.Background(), driver); err != nil || deleted != 1 {
+		t.Errorf("ProcessDeletions() = %d, %v, want 1 deleted", deleted, err)
+	}
+	if err = dp.CommitSession(session.Id); err != nil {
+		t.Fatalf("CommitSession() error = %v", err)
+	}
+	check(t, driver, files[0].Id, data[0], "read of repacked file")
+	check(t, driver, files[4].Id, data[4], "read of file committed after repack")
+}
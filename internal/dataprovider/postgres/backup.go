@@ -0,0 +1,116 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// snapshotRow is a line of a snapshot, a row of table t encoded by row_to_json
+type snapshotRow struct {
+	Table string          `json:"t"`
+	Row   json.RawMessage `json:"r"`
+}
+
+// snapshotTables are the exported tables in the order rows are restored, referenced rows come first.
+// fs rows are ordered by depth, so parents are restored before their children.
+var snapshotTables = []struct {
+	name  string
+	query string
+}{
+	{"fs", `
+		WITH RECURSIVE tree AS (
+		    SELECT id, 0 AS depth FROM fs WHERE parent IS NULL
+		    UNION ALL
+		    SELECT fs.id, tree.depth + 1 FROM fs JOIN tree ON fs.parent = tree.id
+		)
+		SELECT row_to_json(fs) FROM fs JOIN tree ON fs.id = tree.id ORDER BY tree.depth;
+	`},
+	{"node", `SELECT row_to_json(node) FROM node;`},
+	{"session", `SELECT row_to_json(session) FROM session;`},
+	{"session_node", `SELECT row_to_json(session_node) FROM session_node;`},
+	{"deletion", `SELECT row_to_json(deletion) FROM deletion;`},
+	{"damaged", `SELECT row_to_json(damaged) FROM damaged;`},
+	{"digest", `SELECT row_to_json(digest) FROM digest;`},
+}
+
+// Backup writes a logical export of the tables to w, one json row per line. Rows are read in a single
+// repeatable read transaction, so the export is consistent while the provider keeps serving requests.
+func (pgp *PGProvider) Backup(w io.Writer) error {
+	tx, err := pgp.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	enc := json.NewEncoder(w)
+	for _, table := range snapshotTables {
+		if err = exportTable(tx, enc, table.name, table.query); err != nil {
+			return fmt.Errorf("export %s : %w", table.name, err)
+		}
+	}
+	return tx.Commit()
+}
+
+func exportTable(tx *sql.Tx, enc *json.Encoder, table, query string) error {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row []byte
+		if err = rows.Scan(&row); err != nil {
+			return err
+		}
+		if err = enc.Encode(snapshotRow{Table: table, Row: row}); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Restore replaces the rows of every exported table with the export read from r in a single transaction.
+// Tables are truncated, so no deletions are queued for nodes which are not in the export.
+func (pgp *PGProvider) Restore(r io.Reader) error {
+	tx, err := pgp.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(`TRUNCATE fs, node, session, session_node, deletion, damaged, digest;`); err != nil {
+		return err
+	}
+	inserts := make(map[string]*sql.Stmt, len(snapshotTables))
+	for _, table := range snapshotTables {
+		stmt, err := tx.Prepare(fmt.Sprintf(`INSERT INTO %[1]s SELECT * FROM json_populate_record(NULL::%[1]s, $1);`, table.name))
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		inserts[table.name] = stmt
+	}
+	dec := json.NewDecoder(r)
+	for {
+		var row snapshotRow
+		if err = dec.Decode(&row); errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("snapshot is not a ddrv export : %w", err)
+		}
+		insert, ok := inserts[row.Table]
+		if !ok {
+			return fmt.Errorf("snapshot has rows of unknown table %s", row.Table)
+		}
+		if _, err = insert.Exec(string(row.Row)); err != nil {
+			return fmt.Errorf("restore %s : %w", row.Table, err)
+		}
+	}
+	if err = tx.QueryRow(`SELECT 1 FROM fs WHERE id=$1`, RootDirId).Scan(new(int)); err != nil {
+		return fmt.Errorf("snapshot has no root directory : %w", err)
+	}
+	return tx.Commit()
+}
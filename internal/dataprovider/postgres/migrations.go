@@ -150,4 +150,280 @@ var migrations = []migrate.Migration{
 			`DROP FUNCTION IF EXIST refresh_vfs();`,
 		}),
 	},
+	{
+		ID:   9,
+		Up:   migrate.Queries([]string{`ALTER TABLE node ADD COLUMN hash VARCHAR(64) NOT NULL DEFAULT '';`}),
+		Down: migrate.Queries([]string{`ALTER TABLE node DROP COLUMN hash;`}),
+	},
+	{
+		ID: 10,
+		Up: migrate.Queries([]string{
+			// Deduplicated chunks are shared by multiple files, so mid is no longer unique
+			`DROP INDEX IF EXISTS idx_node_mid_unique;`,
+			`CREATE INDEX IF NOT EXISTS idx_node_mid ON node(mid);`,
+			`CREATE INDEX IF NOT EXISTS idx_node_hash ON node(hash);`,
+		}),
+		Down: migrate.Queries([]string{
+			`DROP INDEX IF EXISTS idx_node_hash;`,
+			`DROP INDEX IF EXISTS idx_node_mid;`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS idx_node_mid_unique ON node(mid);`,
+		}),
+	},
+	{
+		ID: 11,
+		Up: migrate.Queries([]string{
+			// Upload sessions are not bound to fs, sessions of removed files are cleaned up by the sweeper
+			`
+				CREATE TABLE IF NOT EXISTS session
+				(
+				    id    BIGINT PRIMARY KEY NOT NULL,
+				    file  UUID               NOT NULL,
+				    size  BIGINT             NOT NULL DEFAULT 0,
+				    mtime TIMESTAMP          NOT NULL DEFAULT NOW()
+				);
+			`,
+			`CREATE INDEX IF NOT EXISTS idx_session_file ON session(file);`,
+			`
+				CREATE TABLE IF NOT EXISTS session_node
+				(
+				    id      BIGINT PRIMARY KEY NOT NULL,
+				    session BIGINT             NOT NULL,
+				    url     VARCHAR(255)       NOT NULL,
+				    size    INTEGER            NOT NULL,
+				    iv      VARCHAR(255)       NOT NULL DEFAULT '',
+				    hash    VARCHAR(64)        NOT NULL DEFAULT '',
+				    mid     BIGINT,
+				    ex      INT,
+				    "is"    INT,
+				    hm      VARCHAR(255)
+				);
+			`,
+			`CREATE INDEX IF NOT EXISTS idx_session_node_session ON session_node(session);`,
+			`CREATE INDEX IF NOT EXISTS idx_session_node_mid ON session_node(mid);`,
+		}),
+		Down: migrate.Queries([]string{
+			`DROP TABLE IF EXISTS session_node;`,
+			`DROP TABLE IF EXISTS session;`,
+		}),
+	},
+	{
+		ID: 12,
+		Up: migrate.Queries([]string{
+			`ALTER TABLE node ADD COLUMN replicas JSONB;`,
+			`ALTER TABLE session_node ADD COLUMN replicas JSONB;`,
+		}),
+		Down: migrate.Queries([]string{
+			`ALTER TABLE session_node DROP COLUMN replicas;`,
+			`ALTER TABLE node DROP COLUMN replicas;`,
+		}),
+	},
+	{
+		ID: 13,
+		Up: migrate.Queries([]string{
+			`ALTER TABLE node ADD COLUMN stripe JSONB;`,
+			`ALTER TABLE session_node ADD COLUMN stripe JSONB;`,
+		}),
+		Down: migrate.Queries([]string{
+			`ALTER TABLE session_node DROP COLUMN stripe;`,
+			`ALTER TABLE node DROP COLUMN stripe;`,
+		}),
+	},
+	{
+		ID: 14,
+		Up: migrate.Queries([]string{
+			`
+				CREATE TABLE IF NOT EXISTS deletion
+				(
+				    mid      BIGINT PRIMARY KEY NOT NULL,
+				    url      VARCHAR(255)       NOT NULL,
+				    size     INTEGER            NOT NULL,
+				    iv       VARCHAR(255)       NOT NULL DEFAULT '',
+				    hash     VARCHAR(64)        NOT NULL DEFAULT '',
+				    ex       INT,
+				    "is"     INT,
+				    hm       VARCHAR(255),
+				    replicas JSONB,
+				    stripe   JSONB,
+				    queued   TIMESTAMP          NOT NULL DEFAULT NOW()
+				);
+			`,
+			// Nodes are deleted by cascade from fs as well, so messages are queued by a trigger.
+			// Row triggers run after the statement, once every row of a message is gone.
+			`
+				CREATE OR REPLACE FUNCTION queue_deletion() RETURNS TRIGGER AS $$
+				BEGIN
+				    IF OLD.mid IS NOT NULL
+				       AND NOT EXISTS (SELECT 1 FROM node WHERE mid = OLD.mid)
+				       AND NOT EXISTS (SELECT 1 FROM session_node WHERE mid = OLD.mid) THEN
+				        INSERT INTO deletion (mid, url, size, iv, hash, ex, "is", hm, replicas, stripe)
+				        VALUES (OLD.mid, OLD.url, OLD.size, OLD.iv, OLD.hash, OLD.ex, OLD."is", OLD.hm, OLD.replicas, OLD.stripe)
+				        ON CONFLICT (mid) DO NOTHING;
+				    END IF;
+				    RETURN NULL;
+				END;
+				$$ LANGUAGE plpgsql;
+			`,
+			`CREATE TRIGGER node_deletion AFTER DELETE ON node FOR EACH ROW EXECUTE FUNCTION queue_deletion();`,
+		}),
+		Down: migrate.Queries([]string{
+			`DROP TRIGGER IF EXISTS node_deletion ON node;`,
+			`DROP FUNCTION IF EXISTS queue_deletion();`,
+			`DROP TABLE IF EXISTS deletion;`,
+		}),
+	},
+	{
+		ID: 15,
+		Up: migrate.Queries([]string{
+			`
+				CREATE TABLE IF NOT EXISTS damaged
+				(
+				    file   UUID PRIMARY KEY NOT NULL REFERENCES fs (id) ON DELETE CASCADE,
+				    reason TEXT             NOT NULL,
+				    marked TIMESTAMP        NOT NULL DEFAULT NOW()
+				);
+			`,
+		}),
+		Down: migrate.Queries([]string{
+			`DROP TABLE IF EXISTS damaged;`,
+		}),
+	},
+	{
+		ID: 16,
+		Up: migrate.Queries([]string{
+			// A message holds up to ddrv.MaxAttachments chunks, att is the index of the chunk in its message
+			`ALTER TABLE node ADD COLUMN att INT NOT NULL DEFAULT 0;`,
+			`ALTER TABLE session_node ADD COLUMN att INT NOT NULL DEFAULT 0;`,
+		}),
+		Down: migrate.Queries([]string{
+			`ALTER TABLE session_node DROP COLUMN att;`,
+			`ALTER TABLE node DROP COLUMN att;`,
+		}),
+	},
+	{
+		ID: 17,
+		Up: migrate.Queries([]string{
+			// pack locates chunks of small files in their packfile
+			`ALTER TABLE node ADD COLUMN pack JSONB;`,
+			`ALTER TABLE session_node ADD COLUMN pack JSONB;`,
+		}),
+		Down: migrate.Queries([]string{
+			`ALTER TABLE session_node DROP COLUMN pack;`,
+			`ALTER TABLE node DROP COLUMN pack;`,
+		}),
+	},
+	{
+		ID: 18,
+		Up: migrate.Queries([]string{
+			`CREATE INDEX IF NOT EXISTS idx_node_parity ON node USING GIN ((stripe->'parity') jsonb_path_ops);`,
+			`CREATE INDEX IF NOT EXISTS idx_session_node_parity ON session_node USING GIN ((stripe->'parity') jsonb_path_ops);`,
+			// Parity shards belong to every chunk of the stripe, they are queued on their own once no node points at them
+			`
+				CREATE OR REPLACE FUNCTION queue_deletion() RETURNS TRIGGER AS $$
+				DECLARE
+				    p   JSONB;
+				    ref JSONB;
+				BEGIN
+				    IF OLD.mid IS NOT NULL
+				       AND NOT EXISTS (SELECT 1 FROM node WHERE mid = OLD.mid)
+				       AND NOT EXISTS (SELECT 1 FROM session_node WHERE mid = OLD.mid) THEN
+				        INSERT INTO deletion (mid, url, size, iv, hash, ex, "is", hm, replicas)
+				        VALUES (OLD.mid, OLD.url, OLD.size, OLD.iv, OLD.hash, OLD.ex, OLD."is", OLD.hm, OLD.replicas)
+				        ON CONFLICT (mid) DO NOTHING;
+				    END IF;
+				    FOR p IN SELECT * FROM jsonb_array_elements(COALESCE(OLD.stripe->'parity', '[]')) LOOP
+				        ref := jsonb_build_array(jsonb_build_object('mid', p->'mid'));
+				        IF NOT EXISTS (SELECT 1 FROM node WHERE stripe->'parity' @> ref)
+				           AND NOT EXISTS (SELECT 1 FROM session_node WHERE stripe->'parity' @> ref) THEN
+				            INSERT INTO deletion (mid, url, size, iv, hash, ex, "is", hm)
+				            VALUES ((p->>'mid')::BIGINT, p->>'url', COALESCE((p->>'size')::INT, 0), COALESCE(p->>'Iv', ''),
+				                    COALESCE(p->>'Hash', ''), (p->>'ex')::INT, (p->>'is')::INT, p->>'hm')
+				            ON CONFLICT (mid) DO NOTHING;
+				        END IF;
+				    END LOOP;
+				    RETURN NULL;
+				END;
+				$$ LANGUAGE plpgsql;
+			`,
+		}),
+		Down: migrate.Queries([]string{
+			`
+				CREATE OR REPLACE FUNCTION queue_deletion() RETURNS TRIGGER AS $$
+				BEGIN
+				    IF OLD.mid IS NOT NULL
+				       AND NOT EXISTS (SELECT 1 FROM node WHERE mid = OLD.mid)
+				       AND NOT EXISTS (SELECT 1 FROM session_node WHERE mid = OLD.mid) THEN
+				        INSERT INTO deletion (mid, url, size, iv, hash, ex, "is", hm, replicas, stripe)
+				        VALUES (OLD.mid, OLD.url, OLD.size, OLD.iv, OLD.hash, OLD.ex, OLD."is", OLD.hm, OLD.replicas, OLD.stripe)
+				        ON CONFLICT (mid) DO NOTHING;
+				    END IF;
+				    RETURN NULL;
+				END;
+				$$ LANGUAGE plpgsql;
+			`,
+			`DROP INDEX IF EXISTS idx_session_node_parity;`,
+			`DROP INDEX IF EXISTS idx_node_parity;`,
+		}),
+	},
+	{
+		ID: 19,
+		Up: migrate.Queries([]string{
+			// lease holds messages of nodes found by checksum which are reused by writes not committed yet
+			`
+				CREATE TABLE IF NOT EXISTS lease
+				(
+				    mid     BIGINT PRIMARY KEY NOT NULL,
+				    holders INTEGER            NOT NULL,
+				    expires TIMESTAMP          NOT NULL
+				);
+			`,
+		}),
+		Down: migrate.Queries([]string{
+			`DROP TABLE IF EXISTS lease;`,
+		}),
+	},
+	{
+		ID: 20,
+		Up: migrate.Queries([]string{
+			// Messages which failed to delete are retried with backoff, retry is the next attempt
+			`ALTER TABLE deletion ADD COLUMN attempts INT NOT NULL DEFAULT 0;`,
+			`ALTER TABLE deletion ADD COLUMN retry TIMESTAMP;`,
+		}),
+		Down: migrate.Queries([]string{
+			`ALTER TABLE deletion DROP COLUMN retry;`,
+			`ALTER TABLE deletion DROP COLUMN attempts;`,
+		}),
+	},
+	{
+		ID: 21,
+		Up: migrate.Queries([]string{
+			// refresh_retry holds messages whose links failed to refresh, retry is the next attempt
+			`
+				CREATE TABLE IF NOT EXISTS refresh_retry
+				(
+				    mid      BIGINT PRIMARY KEY NOT NULL,
+				    attempts INT                NOT NULL,
+				    retry    TIMESTAMP          NOT NULL
+				);
+			`,
+		}),
+		Down: migrate.Queries([]string{
+			`DROP TABLE IF EXISTS refresh_retry;`,
+		}),
+	},
+	{
+		ID: 22,
+		Up: migrate.Queries([]string{
+			// digest holds the SHA-256 of the content of files written in one go
+			`
+				CREATE TABLE IF NOT EXISTS digest
+				(
+				    file   UUID PRIMARY KEY NOT NULL REFERENCES fs (id) ON DELETE CASCADE,
+				    sha256 VARCHAR(64)      NOT NULL
+				);
+			`,
+		}),
+		Down: migrate.Queries([]string{
+			`DROP TABLE IF EXISTS digest;`,
+		}),
+	},
 }
@@ -2,6 +2,8 @@ package postgres
 
 import (
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
@@ -174,38 +176,196 @@ func (pgp *PGProvider) GetNodes(id string) ([]ddrv.Node, error) {
 	defer pgp.locker.Release(id)
 
 	nodes := make([]ddrv.Node, 0)
-	rows, err := pgp.db.Query(`SELECT url, size, mid, ex, "is", hm FROM node where file=$1 ORDER BY id ASC`, id)
+	rows, err := pgp.db.Query(`SELECT url, size, iv, hash, mid, att, ex, "is", hm, replicas, stripe, pack FROM node where file=$1 ORDER BY id ASC`, id)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	expired := make([]*ddrv.Node, 0)
-	currentTimestamp := int(time.Now().Unix())
 	for rows.Next() {
 		var node ddrv.Node
-		err = rows.Scan(&node.URL, &node.Size, &node.MId, &node.Ex, &node.Is, &node.Hm)
+		err = rows.Scan(&node.URL, &node.Size, &node.Iv, &node.Hash, &node.MId, &node.Att, &node.Ex, &node.Is, &node.Hm, (*replicas)(&node.Replicas), stripe{&node.Stripe}, pack{&node.Pack})
 		if err != nil {
 			return nil, err
 		}
 		nodes = append(nodes, node)
-		if currentTimestamp > node.Ex {
-			expired = append(expired, &node)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	// Expired nodes are refreshed in place, so the returned nodes carry the new links
+	expired := make([]*ddrv.Node, 0)
+	currentTimestamp := int(time.Now().Unix())
+	for i := range nodes {
+		if nodes[i].Expired(currentTimestamp) {
+			expired = append(expired, &nodes[i])
 		}
 	}
 	if err = pgp.driver.UpdateNodes(expired); err != nil {
 		return nil, err
 	}
 	for _, node := range expired {
-		if _, err = pgp.db.Exec(
-			`UPDATE node SET ex=$1, "is"=$2, hm=$3 WHERE mid=$4`,
-			node.Ex, node.Is, node.Hm, node.MId,
-		); err != nil {
+		if err = pgp.updateNode(*node); err != nil {
 			return nil, err
 		}
 	}
 	return nodes, nil
 }
 
+func (pgp *PGProvider) ExpiringNodes(before int, limit int) (map[string][]ddrv.Node, error) {
+	rows, err := pgp.db.Query(`
+		SELECT file, url, size, iv, hash, mid, att, ex, "is", hm, replicas, stripe, pack
+		FROM node
+		WHERE (COALESCE(ex, 0) < $1
+		   OR EXISTS (SELECT 1 FROM jsonb_array_elements(COALESCE(replicas, '[]')) r WHERE (r->>'ex')::BIGINT < $1)
+		   OR EXISTS (SELECT 1 FROM jsonb_array_elements(COALESCE(stripe->'parity', '[]')) p WHERE (p->>'ex')::BIGINT < $1))
+		  AND NOT EXISTS (SELECT 1 FROM refresh_retry rr WHERE rr.mid = node.mid AND rr.retry > NOW())
+		ORDER BY ex
+		LIMIT $2;
+	`, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	expiring := make(map[string][]ddrv.Node)
+	for rows.Next() {
+		var fid string
+		var node ddrv.Node
+		err = rows.Scan(&fid, &node.URL, &node.Size, &node.Iv, &node.Hash, &node.MId, &node.Att, &node.Ex, &node.Is, &node.Hm, (*replicas)(&node.Replicas), stripe{&node.Stripe}, pack{&node.Pack})
+		if err != nil {
+			return nil, err
+		}
+		expiring[fid] = append(expiring[fid], node)
+	}
+	return expiring, rows.Err()
+}
+
+// UpdateNodes stores refreshed links of nodes, rows of other files sharing the chunk are updated as well
+func (pgp *PGProvider) UpdateNodes(id string, nodes []ddrv.Node) error {
+	pgp.locker.Acquire(id)
+	defer pgp.locker.Release(id)
+	for _, node := range nodes {
+		if err := pgp.updateNode(node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateNode stores refreshed links of the chunk, its replicas and the parity shards of its stripe. Only links
+// are written, rows of other files sharing a message keep their own replicas and stripe.
+func (pgp *PGProvider) updateNode(node ddrv.Node) error {
+	tx, err := pgp.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(
+		`UPDATE node SET url=$1, ex=$2, "is"=$3, hm=$4 WHERE mid=$5 AND att=$6`,
+		node.URL, node.Ex, node.Is, node.Hm, node.MId, node.Att,
+	); err != nil {
+		return err
+	}
+	// Failed refreshes of messages whose links were refreshed meanwhile are forgotten
+	if !node.Expired(int(time.Now().Unix())) {
+		if _, err = tx.Exec("DELETE FROM refresh_retry WHERE mid = $1", node.MId); err != nil {
+			return err
+		}
+	}
+	for _, r := range node.Replicas {
+		if err = updateLink(tx, updateReplicaLink, r.MId, r.Att, r.URL, r.Ex, r.Is, r.Hm); err != nil {
+			return err
+		}
+	}
+	if node.Stripe != nil {
+		for _, p := range node.Stripe.Parity {
+			if err = updateLink(tx, updateParityLink, p.MId, p.Att, p.URL, p.Ex, p.Is, p.Hm); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// mergeLink merges the refreshed link $3 into the elements of a JSONB array with message id $1 and attachment index $2
+const mergeLink = `(
+	SELECT jsonb_agg(CASE WHEN (l->>'mid')::BIGINT = $1 AND COALESCE((l->>'att')::INT, 0) = $2 THEN l || $3::JSONB ELSE l END ORDER BY i)
+	FROM jsonb_array_elements(%s) WITH ORDINALITY AS e(l, i)
+)`
+
+var (
+	// updateReplicaLink refreshes the link of a replica in every row holding it, $4 matches rows by message id
+	updateReplicaLink = `UPDATE node SET replicas=` + fmt.Sprintf(mergeLink, "replicas") + ` WHERE replicas @> $4::JSONB`
+	// updateParityLink refreshes the link of a parity shard in every row of its stripe, $4 matches rows by message id
+	updateParityLink = `UPDATE node SET stripe=jsonb_set(stripe, '{parity}', ` + fmt.Sprintf(mergeLink, "stripe->'parity'") + `) WHERE stripe->'parity' @> $4::JSONB`
+)
+
+// updateLink runs query, updateReplicaLink or updateParityLink, with the refreshed link of the attachment
+func updateLink(tx *sql.Tx, query string, mid int64, att int, url string, ex, is int, hm string) error {
+	link, err := json.Marshal(map[string]interface{}{"url": url, "ex": ex, "is": is, "hm": hm})
+	if err != nil {
+		return err
+	}
+	key, err := json.Marshal([]map[string]int64{{"mid": mid}})
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(query, mid, att, string(link), string(key))
+	return err
+}
+
+// GetNodeByHash returns a node with given checksum and size. Nodes are reference counted by rows,
+// a chunk stays referenced as long as any node row with its mid exists. The row is locked until the message
+// is leased, so the message is not queued for deletion and deleted before the write is committed.
+func (pgp *PGProvider) GetNodeByHash(hash string, size int) (*ddrv.Node, error) {
+	tx, err := pgp.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	node := new(ddrv.Node)
+	err = tx.QueryRow(
+		`SELECT url, size, iv, hash, mid, att, ex, "is", hm, replicas, stripe, pack FROM node WHERE hash=$1 AND size=$2 LIMIT 1 FOR SHARE`, hash, size,
+	).Scan(&node.URL, &node.Size, &node.Iv, &node.Hash, &node.MId, &node.Att, &node.Ex, &node.Is, &node.Hm, (*replicas)(&node.Replicas), stripe{&node.Stripe}, pack{&node.Pack})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, dp.ErrNotExist
+		}
+		return nil, err
+	}
+	// Writes holding an expired lease are not waited for anymore
+	if _, err = tx.Exec(`
+						INSERT INTO lease (mid, holders, expires) VALUES ($1, 1, $2)
+						ON CONFLICT (mid) DO UPDATE
+						SET holders = CASE WHEN lease.expires > NOW() THEN lease.holders + 1 ELSE 1 END, expires = EXCLUDED.expires
+						`, node.MId, time.Now().Add(dp.LookupLease)); err != nil {
+		return nil, err
+	}
+	node.Leased = true
+	return node, tx.Commit()
+}
+
+// releaseLeases releases the lease of the message of every leased node, writes holding them reference the messages now
+func releaseLeases(tx *sql.Tx, nodes []ddrv.Node) error {
+	var mids []int64
+	for _, node := range nodes {
+		if node.Leased {
+			mids = append(mids, node.MId)
+		}
+	}
+	if len(mids) == 0 {
+		return nil
+	}
+	if _, err := tx.Exec(`
+						UPDATE lease SET holders = lease.holders - r.n
+						FROM (SELECT mid, COUNT(*) n FROM unnest($1::BIGINT[]) mid GROUP BY mid) r
+						WHERE lease.mid = r.mid
+						`, pq.Array(mids)); err != nil {
+		return err
+	}
+	_, err := tx.Exec("DELETE FROM lease WHERE holders <= 0 AND mid = ANY($1)", pq.Array(mids))
+	return err
+}
+
 func (pgp *PGProvider) CreateNodes(fid string, nodes []ddrv.Node) error {
 	// Nothing to do if there are no nodes provided
 	if len(nodes) == 0 {
@@ -220,13 +380,13 @@ func (pgp *PGProvider) CreateNodes(fid string, nodes []ddrv.Node) error {
 
 	// Build the INSERT query with multiple values
 	var values []interface{}
-	query := `INSERT INTO node (id, file, url, size, mid, ex, "is", hm) VALUES`
+	query := `INSERT INTO node (id, file, url, size, iv, hash, mid, att, ex, "is", hm, replicas, stripe, pack) VALUES`
 	phc := 1 // placeHolderCounter
 	for _, node := range nodes {
 		id := pgp.sg.Generate()
-		query += fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d),", phc, phc+1, phc+2, phc+3, phc+4, phc+5, phc+6, phc+7)
-		values = append(values, id, fid, node.URL, node.Size, node.MId, node.Ex, node.Is, node.Hm)
-		phc += 8
+		query += fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d),", phc, phc+1, phc+2, phc+3, phc+4, phc+5, phc+6, phc+7, phc+8, phc+9, phc+10, phc+11, phc+12, phc+13)
+		values = append(values, id, fid, node.URL, node.Size, node.Iv, node.Hash, node.MId, node.Att, node.Ex, node.Is, node.Hm, replicas(node.Replicas), stripe{&node.Stripe}, pack{&node.Pack})
+		phc += 14
 	}
 	// Remove the last comma and execute the query
 	query = query[:len(query)-1]
@@ -234,6 +394,13 @@ func (pgp *PGProvider) CreateNodes(fid string, nodes []ddrv.Node) error {
 	if _, err = tx.Exec(query, values...); err != nil {
 		return err
 	}
+	if err = releaseLeases(tx, nodes); err != nil {
+		return err
+	}
+	// The digest does not cover the appended nodes
+	if _, err = tx.Exec("DELETE FROM digest WHERE file=$1", fid); err != nil {
+		return err
+	}
 
 	// Update mtime every time something is written on file
 	if _, err = tx.Exec(`
@@ -255,9 +422,254 @@ func (pgp *PGProvider) Truncate(fid string) error {
 	if _, err := pgp.db.Exec("DELETE FROM node WHERE file=$1", fid); err != nil {
 		return err
 	}
+	// Damaged nodes are gone, so is the content of the digest
+	if _, err := pgp.db.Exec("DELETE FROM damaged WHERE file=$1", fid); err != nil {
+		return err
+	}
+	if _, err := pgp.db.Exec("DELETE FROM digest WHERE file=$1", fid); err != nil {
+		return err
+	}
 	return pgp.refresh()
 }
 
+func (pgp *PGProvider) SetDigest(fid, digest string) error {
+	_, err := pgp.db.Exec(`
+						INSERT INTO digest (file, sha256) VALUES ($1, $2)
+						ON CONFLICT (file) DO UPDATE SET sha256 = EXCLUDED.sha256
+						`, fid, digest)
+	if err != nil && pqErrToOs(err) == nil { // file was removed meanwhile
+		return dp.ErrNotExist
+	}
+	return pqErrToOs(err)
+}
+
+func (pgp *PGProvider) GetDigest(fid string) (string, error) {
+	var digest string
+	err := pgp.db.QueryRow("SELECT sha256 FROM digest WHERE file=$1", fid).Scan(&digest)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return digest, err
+}
+
+// PendingDeletions returns queued nodes, nodes of messages which are referenced again are dropped from the queue
+func (pgp *PGProvider) PendingDeletions(limit int) ([]ddrv.Node, error) {
+	if _, err := pgp.db.Exec(`
+						DELETE FROM deletion d
+						WHERE EXISTS (SELECT 1 FROM node WHERE node.mid = d.mid)
+						OR EXISTS (SELECT 1 FROM session_node sn WHERE sn.mid = d.mid)
+						OR EXISTS (SELECT 1 FROM node WHERE node.stripe->'parity' @> jsonb_build_array(jsonb_build_object('mid', d.mid)))
+						OR EXISTS (SELECT 1 FROM session_node sn WHERE sn.stripe->'parity' @> jsonb_build_array(jsonb_build_object('mid', d.mid)))
+						`); err != nil {
+		return nil, err
+	}
+	// Messages leased by writes which are not committed yet and messages parked after a failed attempt are skipped
+	rows, err := pgp.db.Query(`
+						SELECT url, size, iv, hash, mid, ex, "is", hm, replicas, stripe FROM deletion d
+						WHERE NOT EXISTS (SELECT 1 FROM lease l WHERE l.mid = d.mid AND l.holders > 0 AND l.expires > NOW())
+						AND (d.retry IS NULL OR d.retry <= NOW())
+						ORDER BY queued, mid LIMIT $1
+						`, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	nodes := make([]ddrv.Node, 0)
+	for rows.Next() {
+		var node ddrv.Node
+		if err = rows.Scan(&node.URL, &node.Size, &node.Iv, &node.Hash, &node.MId, &node.Ex, &node.Is, &node.Hm, (*replicas)(&node.Replicas), stripe{&node.Stripe}); err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, rows.Err()
+}
+
+func (pgp *PGProvider) CompleteDeletions(mids []int64) error {
+	if _, err := pgp.db.Exec("DELETE FROM deletion WHERE mid = ANY($1)", pq.Array(mids)); err != nil {
+		return err
+	}
+	// Expired leases and failed refreshes of deleted messages are dropped
+	if _, err := pgp.db.Exec("DELETE FROM lease WHERE mid = ANY($1)", pq.Array(mids)); err != nil {
+		return err
+	}
+	_, err := pgp.db.Exec("DELETE FROM refresh_retry WHERE mid = ANY($1)", pq.Array(mids))
+	return err
+}
+
+func (pgp *PGProvider) FailDeletions(mids []int64) error {
+	tx, err := pgp.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, mid := range mids {
+		var attempts int
+		err = tx.QueryRow("UPDATE deletion SET attempts = attempts + 1 WHERE mid = $1 RETURNING attempts", mid).Scan(&attempts)
+		// Messages referenced again meanwhile are not queued anymore
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec("UPDATE deletion SET retry = $2 WHERE mid = $1", mid, time.Now().Add(dp.DeletionBackoff(attempts))); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// FailRefreshes parks messages whose links failed to refresh, ExpiringNodes skips their nodes until the backoff passed
+func (pgp *PGProvider) FailRefreshes(mids []int64) error {
+	tx, err := pgp.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, mid := range mids {
+		var attempts int
+		if err = tx.QueryRow(`
+			INSERT INTO refresh_retry (mid, attempts, retry) VALUES ($1, 1, NOW())
+			ON CONFLICT (mid) DO UPDATE SET attempts = refresh_retry.attempts + 1
+			RETURNING attempts
+		`, mid).Scan(&attempts); err != nil {
+			return err
+		}
+		if _, err = tx.Exec("UPDATE refresh_retry SET retry = $2 WHERE mid = $1", mid, time.Now().Add(dp.RefreshBackoff(attempts))); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (pgp *PGProvider) MessageIds() (map[int64]bool, error) {
+	rows, err := pgp.db.Query(`
+						SELECT mid, replicas, stripe FROM node WHERE mid IS NOT NULL
+						UNION ALL SELECT mid, replicas, stripe FROM session_node
+						UNION ALL SELECT mid, replicas, stripe FROM deletion
+						`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make(map[int64]bool)
+	for rows.Next() {
+		var node ddrv.Node
+		if err = rows.Scan(&node.MId, (*replicas)(&node.Replicas), stripe{&node.Stripe}); err != nil {
+			return nil, err
+		}
+		for _, mid := range node.MessageIds() {
+			ids[mid] = true
+		}
+	}
+	return ids, rows.Err()
+}
+
+// PackedNodes returns packed nodes of files and of their upload sessions, ranges recorded by sessions are in use as well
+func (pgp *PGProvider) PackedNodes() (map[string][]ddrv.Node, error) {
+	rows, err := pgp.db.Query(`
+						SELECT file, url, size, iv, hash, mid, att, ex, "is", hm, replicas, stripe, pack FROM node WHERE pack IS NOT NULL
+						UNION ALL
+						SELECT s.file, sn.url, sn.size, sn.iv, sn.hash, sn.mid, sn.att, sn.ex, sn."is", sn.hm, sn.replicas, sn.stripe, sn.pack
+						FROM session_node sn JOIN session s ON s.id = sn.session WHERE sn.pack IS NOT NULL
+						`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	packed := make(map[string][]ddrv.Node)
+	for rows.Next() {
+		var fid string
+		var node ddrv.Node
+		err = rows.Scan(&fid, &node.URL, &node.Size, &node.Iv, &node.Hash, &node.MId, &node.Att, &node.Ex, &node.Is, &node.Hm, (*replicas)(&node.Replicas), stripe{&node.Stripe}, pack{&node.Pack})
+		if err != nil {
+			return nil, err
+		}
+		packed[fid] = append(packed[fid], node)
+	}
+	return packed, rows.Err()
+}
+
+// RepackNodes points nodes of files and upload sessions at the copies of their ranges in a single transaction. Rows are
+// updated instead of deleted, so messages of packfiles no row points at anymore are queued for deletion here instead
+// of by the trigger.
+func (pgp *PGProvider) RepackNodes(copies map[int64]map[int]ddrv.Node) error {
+	tx, err := pgp.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for mid, ranges := range copies {
+		var old ddrv.Node
+		err = tx.QueryRow(`
+						SELECT url, size, iv, hash, mid, ex, "is", hm, replicas, stripe FROM node WHERE mid=$1
+						UNION ALL
+						SELECT url, size, iv, hash, mid, ex, "is", hm, replicas, stripe FROM session_node WHERE mid=$1
+						LIMIT 1
+						`, mid).
+			Scan(&old.URL, &old.Size, &old.Iv, &old.Hash, &old.MId, &old.Ex, &old.Is, &old.Hm, (*replicas)(&old.Replicas), stripe{&old.Stripe})
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for offset, node := range ranges {
+			for _, table := range []string{"node", "session_node"} {
+				if _, err = tx.Exec(`
+						UPDATE `+table+` SET url=$1, iv=$2, mid=$3, att=$4, ex=$5, "is"=$6, hm=$7, replicas=$8, stripe=$9, pack=$10
+						WHERE mid=$11 AND (pack->>'offset')::INT = $12
+						`, node.URL, node.Iv, node.MId, node.Att, node.Ex, node.Is, node.Hm, replicas(node.Replicas), stripe{&node.Stripe}, pack{&node.Pack}, mid, offset,
+				); err != nil {
+					return err
+				}
+			}
+		}
+		if _, err = tx.Exec(`
+						INSERT INTO deletion (mid, url, size, iv, hash, ex, "is", hm, replicas, stripe)
+						SELECT $1, $2, $3, $4, $5, $6, $7, $8, $9, $10
+						WHERE NOT EXISTS (SELECT 1 FROM node WHERE mid = $1)
+						  AND NOT EXISTS (SELECT 1 FROM session_node WHERE mid = $1)
+						ON CONFLICT (mid) DO NOTHING
+						`, old.MId, old.URL, old.Size, old.Iv, old.Hash, old.Ex, old.Is, old.Hm, replicas(old.Replicas), stripe{&old.Stripe},
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (pgp *PGProvider) MarkDamaged(fid, reason string) error {
+	if reason == "" {
+		_, err := pgp.db.Exec("DELETE FROM damaged WHERE file=$1", fid)
+		return err
+	}
+	_, err := pgp.db.Exec(`
+						INSERT INTO damaged (file, reason) VALUES ($1, $2)
+						ON CONFLICT (file) DO UPDATE SET reason = EXCLUDED.reason, marked = NOW()
+						`, fid, reason)
+	return pqErrToOs(err)
+}
+
+func (pgp *PGProvider) DamagedFiles() ([]*dp.Damage, error) {
+	rows, err := pgp.db.Query("SELECT file, reason, marked FROM damaged ORDER BY marked")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	files := make([]*dp.Damage, 0)
+	for rows.Next() {
+		damage := new(dp.Damage)
+		if err = rows.Scan(&damage.Id, &damage.Reason, &damage.Marked); err != nil {
+			return nil, err
+		}
+		files = append(files, damage)
+	}
+	return files, rows.Err()
+}
+
 func (pgp *PGProvider) Stat(name string) (*dp.File, error) {
 	file := new(dp.File)
 	err := pgp.db.QueryRow("SELECT id, name, dir, size, mtime FROM stat($1)", name).
@@ -327,6 +739,90 @@ func (pgp *PGProvider) refresh() error {
 	return err
 }
 
+// replicas stores replicas of a node as JSONB, nodes without replicas are stored as NULL
+type replicas []ddrv.Replica
+
+func (r replicas) Value() (driver.Value, error) {
+	if len(r) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal([]ddrv.Replica(r))
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (r *replicas) Scan(src interface{}) error {
+	switch data := src.(type) {
+	case nil:
+		*r = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(data, (*[]ddrv.Replica)(r))
+	case string:
+		return json.Unmarshal([]byte(data), (*[]ddrv.Replica)(r))
+	default:
+		return fmt.Errorf("unsupported replicas type %T", src)
+	}
+}
+
+// stripe stores the erasure coding stripe of a node as JSONB, nodes without stripe are stored as NULL
+type stripe struct{ s **ddrv.Stripe }
+
+func (s stripe) Value() (driver.Value, error) {
+	if *s.s == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(*s.s)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (s stripe) Scan(src interface{}) error {
+	switch data := src.(type) {
+	case nil:
+		*s.s = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(data, s.s)
+	case string:
+		return json.Unmarshal([]byte(data), s.s)
+	default:
+		return fmt.Errorf("unsupported stripe type %T", src)
+	}
+}
+
+// pack stores the packfile range of a node as JSONB, nodes which are not packed are stored as NULL
+type pack struct{ p **ddrv.Pack }
+
+func (p pack) Value() (driver.Value, error) {
+	if *p.p == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(*p.p)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (p pack) Scan(src interface{}) error {
+	switch data := src.(type) {
+	case nil:
+		*p.p = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(data, p.p)
+	case string:
+		return json.Unmarshal([]byte(data), p.p)
+	default:
+		return fmt.Errorf("unsupported pack type %T", src)
+	}
+}
+
 // Handle custom PGFs code
 func pqErrToOs(err error) error {
 	var pqErr *pq.Error
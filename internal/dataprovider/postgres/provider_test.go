@@ -0,0 +1,489 @@
+package postgres
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+
+	dp "github.com/forscht/ddrv/internal/dataprovider"
+	"github.com/forscht/ddrv/pkg/ddrv"
+	"github.com/forscht/ddrv/pkg/ddrv/ddrvtest"
+	"github.com/forscht/ddrv/pkg/migrate"
+)
+
+// dsn creates a database which is dropped once the test finishes and returns its connection string.
+// Tests are skipped unless POSTGRES_DB_URL points at a server the user is allowed to create databases on.
+func dsn(t *testing.T) string {
+	t.Helper()
+	url := os.Getenv("POSTGRES_DB_URL")
+	if url == "" {
+		t.Skip("POSTGRES_DB_URL is not set")
+	}
+	// Connection strings of urls can not be extended with the database name
+	if strings.HasPrefix(url, "postgres://") || strings.HasPrefix(url, "postgresql://") {
+		var err error
+		if url, err = pq.ParseURL(url); err != nil {
+			t.Fatalf("ParseURL() error = %v", err)
+		}
+	}
+	db, err := sql.Open(Driver, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := "ddrv_test_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	if _, err = db.Exec("CREATE DATABASE " + name); err != nil {
+		_ = db.Close()
+		t.Fatalf("CREATE DATABASE error = %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := db.Exec("DROP DATABASE IF EXISTS " + name); err != nil {
+			t.Errorf("DROP DATABASE error = %v", err)
+		}
+		_ = db.Close()
+	})
+	return url + " dbname=" + name
+}
+
+// load loads a postgres provider of a new database
+func load(t *testing.T, driver *ddrv.Driver) *PGProvider {
+	t.Helper()
+	provider := New(&Config{DbURL: dsn(t)}, driver).(*PGProvider)
+	dp.Load(provider)
+	t.Cleanup(func() { _ = provider.Close() })
+	return provider
+}
+
+func newDriver(t *testing.T, cfg *ddrv.Config) *ddrv.Driver {
+	t.Helper()
+	driver, err := ddrv.New(cfg)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	return driver
+}
+
+func randBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// put creates the file at path with data
+func put(t *testing.T, driver *ddrv.Driver, p string, data []byte) *dp.File {
+	t.Helper()
+	if err := dp.Touch(p); err != nil {
+		t.Fatal(err)
+	}
+	file, err := dp.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is written for empty files, like files of upload sessions before the first write
+	if len(data) == 0 {
+		return file
+	}
+	var nodes []ddrv.Node
+	w := driver.NewWriter(func(chunk ddrv.Node) { nodes = append(nodes, chunk) })
+	if _, err = w.Write(data); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err = dp.CreateNodes(file.Id, nodes); err != nil {
+		t.Fatalf("CreateNodes() error = %v", err)
+	}
+	return file
+}
+
+// check reports whether the file with the given id holds data
+func check(t *testing.T, driver *ddrv.Driver, id string, data []byte, what string) {
+	t.Helper()
+	nodes, err := dp.GetNodes(id)
+	if err != nil {
+		t.Fatalf("GetNodes() error = %v", err)
+	}
+	r, err := driver.NewReader(nodes, 0)
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	defer r.Close()
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("%s returned %d bytes, %v, want %d equal bytes", what, len(got), err, len(data))
+	}
+}
+
+func rm(t *testing.T, p string) {
+	t.Helper()
+	if err := dp.Rm(p); err != nil {
+		t.Fatalf("Rm(%s) error = %v", p, err)
+	}
+}
+
+// count returns the number of rows of query
+func count(t *testing.T, pgp *PGProvider, query string, args ...interface{}) int {
+	t.Helper()
+	var n int
+	if err := pgp.db.QueryRow("SELECT COUNT(*) FROM "+query, args...).Scan(&n); err != nil {
+		t.Fatalf("count of %s error = %v", query, err)
+	}
+	return n
+}
+
+func TestMigrations(t *testing.T) {
+	db := NewDb(dsn(t), false)
+	defer db.Close()
+	exists := func(relation string) bool {
+		t.Helper()
+		var ok bool
+		if err := db.QueryRow("SELECT to_regclass($1) IS NOT NULL", relation).Scan(&ok); err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	var version int
+	if err := db.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if want := migrations[len(migrations)-1].ID; version != want {
+		t.Fatalf("migrated to version %d, want %d", version, want)
+	}
+
+	// Migrations from the deletion queue on are reverted and applied again
+	var since []migrate.Migration
+	for _, m := range migrations {
+		if m.ID >= 14 {
+			since = append(since, m)
+		}
+	}
+	if err := migrate.NewMigrator(db).Exec(migrate.Down, since...); err != nil {
+		t.Fatalf("down migration error = %v", err)
+	}
+	relations := []string{"deletion", "damaged", "lease", "refresh_retry", "digest", "idx_node_parity", "idx_session_node_parity"}
+	for _, relation := range relations {
+		if exists(relation) {
+			t.Errorf("%s exists after down migration", relation)
+		}
+	}
+	if err := Migrate(db); err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+	for _, relation := range relations {
+		if !exists(relation) {
+			t.Errorf("%s does not exist after migration", relation)
+		}
+	}
+	var columns int
+	if err := db.QueryRow(`
+		SELECT COUNT(*) FROM information_schema.columns
+		WHERE table_name = 'deletion' AND column_name IN ('attempts', 'retry')
+	`).Scan(&columns); err != nil {
+		t.Fatal(err)
+	}
+	if columns != 2 {
+		t.Errorf("deletion has %d retry columns, want 2", columns)
+	}
+}
+
+func TestSharedMessages(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	driver := newDriver(t, s.Config(1024, "1"))
+	driver.Lookup = dp.Lookup
+	pgp := load(t, driver)
+
+	// b.bin reuses the chunks of a.bin, both have rows of the same messages
+	s.SetTTL(time.Hour)
+	data := randBytes(t, 2500)
+	a := put(t, driver, "/a.bin", data)
+	b := put(t, driver, "/b.bin", data)
+	s.SetTTL(24 * time.Hour)
+	if got := len(s.Messages("1")); got != 3 {
+		t.Fatalf("%d messages after upload, want 3", got)
+	}
+	nodes, err := dp.GetNodes(a.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes {
+		if got := count(t, pgp, "node WHERE mid=$1", node.MId); got != 2 {
+			t.Errorf("message %d has %d rows, want 2", node.MId, got)
+		}
+	}
+
+	// Refreshed links are stored in every row of the message
+	opts := dp.RefreshOptions{Window: 2 * time.Hour, Pause: time.Millisecond}
+	if _, err = dp.RefreshExpiring(context.Background(), driver, opts); err != nil {
+		t.Fatalf("RefreshExpiring() error = %v", err)
+	}
+	if expiring, err := dp.ExpiringNodes(time.Now().Add(2*time.Hour), 100); err != nil || len(expiring) != 0 {
+		t.Errorf("ExpiringNodes() after refresh = %v, %v, want none", expiring, err)
+	}
+
+	// Messages are queued once no row points at them
+	rm(t, "/a.bin")
+	if pending, err := dp.PendingDeletions(100); err != nil || len(pending) != 0 {
+		t.Errorf("PendingDeletions() = %d nodes, %v, want shared messages kept", len(pending), err)
+	}
+	check(t, driver, b.Id, data, "read of file sharing removed chunks")
+	rm(t, "/b.bin")
+	if pending, err := dp.PendingDeletions(100); err != nil || len(pending) != 3 {
+		t.Errorf("PendingDeletions() = %d nodes, %v, want 3", len(pending), err)
+	}
+	if deleted, err := dp.ProcessDeletions(context.Background(), driver); err != nil || deleted != 3 {
+		t.Errorf("ProcessDeletions() = %d, %v, want 3 deleted", deleted, err)
+	}
+	if got := len(s.Messages("1")); got != 0 {
+		t.Errorf("%d messages left, want 0", got)
+	}
+}
+
+func TestParityDeletions(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	channels := []string{"1", "2", "3", "4", "5"}
+	cfg := s.Config(1024, channels...)
+	cfg.DataShards, cfg.ParityShards = 3, 2
+	driver := newDriver(t, cfg)
+	driver.Lookup = dp.Lookup
+	pgp := load(t, driver)
+	messages := func() (n int) {
+		for _, channel := range channels {
+			n += len(s.Messages(channel))
+		}
+		return n
+	}
+
+	data := randBytes(t, 3000)
+	put(t, driver, "/a.bin", data)
+	// b.bin shares the chunks of a.bin, its stripe has parity shards of its own
+	b := put(t, driver, "/b.bin", data)
+	if got := messages(); got != 7 {
+		t.Fatalf("%d messages after upload, want 7", got)
+	}
+
+	// Parity shards of a.bin are queued by the trigger, the shared chunks are kept
+	rm(t, "/a.bin")
+	if got := count(t, pgp, "deletion"); got != 2 {
+		t.Errorf("%d messages queued after removal of a.bin, want 2 parity shards", got)
+	}
+	if deleted, err := dp.ProcessDeletions(context.Background(), driver); err != nil || deleted != 2 {
+		t.Errorf("ProcessDeletions() = %d, %v, want 2 deleted", deleted, err)
+	}
+	check(t, driver, b.Id, data, "read of file sharing deleted chunks")
+
+	rm(t, "/b.bin")
+	if deleted, err := dp.ProcessDeletions(context.Background(), driver); err != nil || deleted != 5 {
+		t.Errorf("ProcessDeletions() = %d, %v, want 5 deleted", deleted, err)
+	}
+	if got := messages(); got != 0 {
+		t.Errorf("%d messages left, want 0", got)
+	}
+}
+
+func TestLookupLease(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	driver := newDriver(t, s.Config(1024, "1"))
+	driver.Lookup = dp.Lookup
+	pgp := load(t, driver)
+
+	data := randBytes(t, 1000)
+	a := put(t, driver, "/a.bin", data)
+	nodes, err := dp.GetNodes(a.Id)
+	if err != nil || len(nodes) != 1 {
+		t.Fatalf("GetNodes() = %v, %v", nodes, err)
+	}
+	// A write reuses the chunk, the file holding it is removed before the write is committed
+	node, err := dp.Lookup(nodes[0].Hash, nodes[0].Size)
+	if err != nil || node == nil {
+		t.Fatalf("Lookup() = %v, %v", node, err)
+	}
+	// Another write referencing the message without a lease does not release the lease of the pending write
+	c := put(t, driver, "/c.bin", nil)
+	if err = dp.CreateNodes(c.Id, nodes); err != nil {
+		t.Fatalf("CreateNodes() error = %v", err)
+	}
+	rm(t, "/a.bin")
+	rm(t, "/c.bin")
+	if deleted, err := dp.ProcessDeletions(context.Background(), driver); err != nil || deleted != 0 {
+		t.Errorf("ProcessDeletions() = %d, %v, want leased message kept", deleted, err)
+	}
+	b := put(t, driver, "/b.bin", nil)
+	if err = dp.CreateNodes(b.Id, []ddrv.Node{*node}); err != nil {
+		t.Fatalf("CreateNodes() error = %v", err)
+	}
+	if got := count(t, pgp, "lease"); got != 0 {
+		t.Errorf("%d leases after the write is committed, want 0", got)
+	}
+	check(t, driver, b.Id, data, "read of file reusing a leased chunk")
+
+	// Expired leases are not waited for
+	node, err = dp.Lookup(nodes[0].Hash, nodes[0].Size)
+	if err != nil || node == nil {
+		t.Fatalf("Lookup() = %v, %v", node, err)
+	}
+	if _, err = pgp.db.Exec("UPDATE lease SET expires = NOW() - INTERVAL '1 second'"); err != nil {
+		t.Fatal(err)
+	}
+	rm(t, "/b.bin")
+	if deleted, err := dp.ProcessDeletions(context.Background(), driver); err != nil || deleted != 1 {
+		t.Errorf("ProcessDeletions() = %d, %v, want 1 deleted", deleted, err)
+	}
+	if got := count(t, pgp, "lease"); got != 0 {
+		t.Errorf("%d leases of deleted messages, want 0", got)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	driver := newDriver(t, s.Config(1024, "1"))
+	pgp := load(t, driver)
+
+	file := put(t, driver, "/a.bin", randBytes(t, 2500))
+	nodes, err := dp.GetNodes(file.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nodes whose links failed to refresh are skipped until the backoff passed
+	if err = dp.FailRefreshes([]int64{nodes[0].MId}); err != nil {
+		t.Fatalf("FailRefreshes() error = %v", err)
+	}
+	if err = dp.FailRefreshes([]int64{nodes[0].MId}); err != nil {
+		t.Fatalf("FailRefreshes() error = %v", err)
+	}
+	if got := count(t, pgp, "refresh_retry WHERE mid=$1 AND attempts=2", nodes[0].MId); got != 1 {
+		t.Errorf("%d refresh retries with 2 attempts, want 1", got)
+	}
+	expiring, err := dp.ExpiringNodes(time.Now().Add(48*time.Hour), 100)
+	if err != nil || len(expiring[file.Id]) != 2 {
+		t.Errorf("ExpiringNodes() = %v, %v, want 2 nodes", expiring, err)
+	}
+
+	// Messages which failed to delete are skipped until the backoff passed
+	rm(t, "/a.bin")
+	if err = dp.FailDeletions([]int64{nodes[0].MId}); err != nil {
+		t.Fatalf("FailDeletions() error = %v", err)
+	}
+	pending, err := dp.PendingDeletions(100)
+	if err != nil || len(pending) != 2 {
+		t.Fatalf("PendingDeletions() = %d nodes, %v, want 2", len(pending), err)
+	}
+	for _, node := range pending {
+		if node.MId == nodes[0].MId {
+			t.Errorf("PendingDeletions() returned parked message %d", node.MId)
+		}
+	}
+	if _, err = pgp.db.Exec("UPDATE deletion SET retry = NOW() - INTERVAL '1 second'"); err != nil {
+		t.Fatal(err)
+	}
+	if deleted, err := dp.ProcessDeletions(context.Background(), driver); err != nil || deleted != 3 {
+		t.Errorf("ProcessDeletions() = %d, %v, want 3 deleted", deleted, err)
+	}
+	if got := count(t, pgp, "refresh_retry"); got != 0 {
+		t.Errorf("%d refresh retries of deleted messages, want 0", got)
+	}
+}
+
+func TestRepackNodes(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	cfg := s.Config(1024, "1")
+	cfg.PackThreshold = 512
+	driver := newDriver(t, cfg)
+	pgp := load(t, driver)
+
+	// Files written together share a packfile, the last one is written by an upload session which is still open
+	data := make([][]byte, 5)
+	files := make([]*dp.File, len(data))
+	for i := range data {
+		data[i] = randBytes(t, 200)
+		files[i] = put(t, driver, fmt.Sprintf("/%d.bin", i), nil)
+	}
+	session, err := dp.CreateSession(files[4].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, len(data))
+	for i := range data {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var nodes []ddrv.Node
+			w := driver.NewWriter(func(chunk ddrv.Node) { nodes = append(nodes, chunk) })
+			if _, errs[i] = w.Write(data[i]); errs[i] == nil {
+				errs[i] = w.Close()
+			}
+			if errs[i] != nil {
+				return
+			}
+			if i < 4 {
+				errs[i] = dp.CreateNodes(files[i].Id, nodes)
+				return
+			}
+			for _, chunk := range nodes {
+				if errs[i] = dp.AppendSession(session.Id, chunk); errs[i] != nil {
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("write of file %d error = %v", i, err)
+		}
+	}
+	if got := len(s.Messages("1")); got != 1 {
+		t.Fatalf("%d messages after upload, want 1", got)
+	}
+	for i := 1; i < 4; i++ {
+		rm(t, fmt.Sprintf("/%d.bin", i))
+	}
+	// The packfile is kept as long as any of its ranges is referenced
+	if pending, err := dp.PendingDeletions(100); err != nil || len(pending) != 0 {
+		t.Errorf("PendingDeletions() = %d nodes, %v, want packfile kept", len(pending), err)
+	}
+	packed, err := dp.PackedNodes()
+	if err != nil || len(packed) != 2 {
+		t.Fatalf("PackedNodes() = %v, %v, want nodes of 2 files", packed, err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	report, err := dp.CollectGarbage(context.Background(), driver, dp.GCOptions{Grace: time.Millisecond})
+	if err != nil {
+		t.Fatalf("CollectGarbage() error = %v", err)
+	}
+	if report.Repacked != 1 || report.Unused != 600 {
+		t.Errorf("repacked %d packfiles with %d unused bytes, want 1 with 600 bytes", report.Repacked, report.Unused)
+	}
+	// Rows of files and of the session point at the new packfile, the old one is queued
+	if got := count(t, pgp, "deletion"); got != 1 {
+		t.Errorf("%d messages queued after repack, want 1", got)
+	}
+	if deleted, err := dp.ProcessDeletions(context.Background(), driver); err != nil || deleted != 1 {
+		t.Errorf("ProcessDeletions() = %d, %v, want 1 deleted", deleted, err)
+	}
+	if err = dp.CommitSession(session.Id); err != nil {
+		t.Fatalf("CommitSession() error = %v", err)
+	}
+	check(t, driver, files[0].Id, data[0], "read of repacked file")
+	check(t, driver, files[4].Id, data[4], "read of file committed after repack")
+}
@@ -0,0 +1,190 @@
+package postgres
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	dp "github.com/forscht/ddrv/internal/dataprovider"
+	"github.com/forscht/ddrv/pkg/ddrv"
+)
+
+func (pgp *PGProvider) CreateSession(fid string) (*dp.Session, error) {
+	file, err := pgp.Get(fid, "")
+	if err != nil {
+		return nil, err
+	}
+	if file.Dir {
+		return nil, dp.ErrNotExist
+	}
+	session := &dp.Session{Id: pgp.sg.Generate().String(), File: fid}
+	if err = pgp.db.QueryRow("INSERT INTO session (id, file) VALUES($1, $2) RETURNING mtime", session.Id, fid).
+		Scan(&session.MTime); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (pgp *PGProvider) GetSession(id string) (*dp.Session, error) {
+	session := new(dp.Session)
+	err := pgp.db.QueryRow("SELECT id, file, size, mtime FROM session WHERE id=$1", id).
+		Scan(&session.Id, &session.File, &session.Size, &session.MTime)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, dp.ErrNotExist
+		}
+		return nil, err
+	}
+	return session, nil
+}
+
+// GetFileSession returns the most recently active session of the file
+func (pgp *PGProvider) GetFileSession(fid string) (*dp.Session, error) {
+	session := new(dp.Session)
+	err := pgp.db.QueryRow("SELECT id, file, size, mtime FROM session WHERE file=$1 ORDER BY mtime DESC LIMIT 1", fid).
+		Scan(&session.Id, &session.File, &session.Size, &session.MTime)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, dp.ErrNotExist
+		}
+		return nil, err
+	}
+	return session, nil
+}
+
+func (pgp *PGProvider) AppendSession(id string, node ddrv.Node) error {
+	tx, err := pgp.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE session SET size = size + $1, mtime = NOW() WHERE id=$2", node.Size, id)
+	if err != nil {
+		return err
+	}
+	if rAffected, _ := res.RowsAffected(); rAffected == 0 {
+		return dp.ErrNotExist
+	}
+	if _, err = tx.Exec(
+		`INSERT INTO session_node (id, session, url, size, iv, hash, mid, att, ex, "is", hm, replicas, stripe, pack) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`,
+		pgp.sg.Generate(), id, node.URL, node.Size, node.Iv, node.Hash, node.MId, node.Att, node.Ex, node.Is, node.Hm, replicas(node.Replicas), stripe{&node.Stripe}, pack{&node.Pack},
+	); err != nil {
+		return err
+	}
+	if err = releaseLeases(tx, []ddrv.Node{node}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CommitSession appends recorded nodes to the file and removes the session
+func (pgp *PGProvider) CommitSession(id string) error {
+	tx, err := pgp.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var fid string
+	if err = tx.QueryRow("SELECT file FROM session WHERE id=$1 FOR UPDATE", id).Scan(&fid); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return dp.ErrNotExist
+		}
+		return err
+	}
+	// Session node ids are snowflakes generated after existing nodes of the file, so order is preserved
+	if _, err = tx.Exec(`
+						INSERT INTO node (id, file, url, size, iv, hash, mid, att, ex, "is", hm, replicas, stripe, pack)
+						SELECT id, $2, url, size, iv, hash, mid, att, ex, "is", hm, replicas, stripe, pack FROM session_node WHERE session = $1
+						`, id, fid); err != nil {
+		if pqErrToOs(err) == nil { // file was removed during the upload
+			return dp.ErrNotExist
+		}
+		return err
+	}
+	if _, err = tx.Exec(`
+						UPDATE fs
+						SET size = COALESCE((SELECT SUM(size) FROM node WHERE node.file = fs.id), 0), mtime = NOW()
+						WHERE id = $1;
+						`, fid); err != nil {
+		return err
+	}
+	// The digest does not cover the appended nodes
+	if _, err = tx.Exec("DELETE FROM digest WHERE file=$1", fid); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM session_node WHERE session=$1", id); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM session WHERE id=$1", id); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	return pgp.refresh()
+}
+
+// DeleteSession removes the session and its nodes, nodes whose messages are not referenced anymore are queued for deletion
+func (pgp *PGProvider) DeleteSession(id string) error {
+	tx, err := pgp.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM session WHERE id=$1", id)
+	if err != nil {
+		return err
+	}
+	if rAffected, _ := res.RowsAffected(); rAffected == 0 {
+		return dp.ErrNotExist
+	}
+	// Deduplicated chunks may still be referenced by nodes of files or other sessions
+	if _, err = tx.Exec(`
+						INSERT INTO deletion (mid, url, size, iv, hash, ex, "is", hm, replicas)
+						SELECT DISTINCT ON (sn.mid) sn.mid, sn.url, sn.size, sn.iv, sn.hash, sn.ex, sn."is", sn.hm, sn.replicas FROM session_node sn
+						WHERE sn.session = $1 AND sn.mid IS NOT NULL
+						AND NOT EXISTS (SELECT 1 FROM node WHERE node.mid = sn.mid)
+						AND NOT EXISTS (SELECT 1 FROM session_node o WHERE o.mid = sn.mid AND o.session <> $1)
+						ON CONFLICT (mid) DO NOTHING
+						`, id); err != nil {
+		return err
+	}
+	// Parity shards are shared by the stripe, they are orphans once no other node points at them
+	if _, err = tx.Exec(`
+						INSERT INTO deletion (mid, url, size, iv, hash, ex, "is", hm)
+						SELECT DISTINCT ON (p->'mid') (p->>'mid')::BIGINT, p->>'url', COALESCE((p->>'size')::INT, 0), COALESCE(p->>'Iv', ''),
+						       COALESCE(p->>'Hash', ''), (p->>'ex')::INT, (p->>'is')::INT, p->>'hm'
+						FROM session_node sn, jsonb_array_elements(sn.stripe->'parity') p
+						WHERE sn.session = $1
+						AND NOT EXISTS (SELECT 1 FROM node WHERE node.stripe->'parity' @> jsonb_build_array(jsonb_build_object('mid', p->'mid')))
+						AND NOT EXISTS (SELECT 1 FROM session_node o WHERE o.session <> $1 AND o.stripe->'parity' @> jsonb_build_array(jsonb_build_object('mid', p->'mid')))
+						ON CONFLICT (mid) DO NOTHING
+						`, id); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM session_node WHERE session=$1", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (pgp *PGProvider) StaleSessions(before time.Time) ([]*dp.Session, error) {
+	rows, err := pgp.db.Query("SELECT id, file, size, mtime FROM session WHERE mtime < $1", before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make([]*dp.Session, 0)
+	for rows.Next() {
+		session := new(dp.Session)
+		if err = rows.Scan(&session.Id, &session.File, &session.Size, &session.MTime); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
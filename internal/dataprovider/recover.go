@@ -0,0 +1,318 @@
+package dataprovider
+
+import (
+	"context"
+	"errors"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/forscht/ddrv/pkg/ddrv"
+)
+
+// RecoverOptions configures Recover
+type RecoverOptions struct {
+	Channels []string // Channels to scan, defaults to the channels of the driver and its webhooks
+	DryRun   bool     // Report recoverable files without creating them
+}
+
+// RecoverReport is the result of Recover
+type RecoverReport struct {
+	Messages   int      `json:"messages"`   // Number of scanned messages
+	Chunks     int      `json:"chunks"`     // Chunks described by manifests, a message holds up to ddrv.MaxAttachments chunks
+	Unreadable int      `json:"unreadable"` // Manifests which could not be read, e.g. sealed with another passphrase
+	Recovered  []string `json:"recovered"`  // Paths of recovered files
+	Incomplete []string `json:"incomplete"` // Paths of files with missing chunks, they are not recovered
+	Existing   []string `json:"existing"`   // Paths which already exist in the provider
+}
+
+// recoveredWrite holds chunks of one write of a file found in channel history
+type recoveredWrite struct {
+	manifest ddrv.Manifest
+	chunks   map[int][]ddrv.Node         // index -> copies
+	parity   map[int]map[int][]ddrv.Node // index of the first chunk of the stripe -> parity index -> copies
+	shards   map[int]int                 // index of the first chunk of the stripe -> data shards
+	last     int64                       // Id of the newest message of the write
+}
+
+// Recover rebuilds files from manifests embedded in chunk messages, it is meant to restore a lost dataprovider
+// into a fresh one. Chunks of a file are grouped by writes, the newest write starting at the beginning of the file
+// is recovered along with upload sessions continuing it. Files are created at the path they were written to,
+// renames after the upload are lost. Chunks reused by deduplication belong to the file which uploaded them,
+// so files holding such chunks are reported incomplete.
+func Recover(ctx context.Context, driver *ddrv.Driver, opts RecoverOptions) (*RecoverReport, error) {
+	if driver.Rest == nil {
+		return nil, errors.New("recovery needs chunks stored on discord")
+	}
+	channels := opts.Channels
+	if len(channels) == 0 {
+		var err error
+		if channels, err = dataChannels(ctx, driver); err != nil {
+			return nil, err
+		}
+	}
+	if len(channels) == 0 {
+		return nil, errors.New("no channels to recover from")
+	}
+	report := &RecoverReport{Recovered: make([]string, 0), Incomplete: make([]string, 0), Existing: make([]string, 0)}
+	files := make(map[string]map[int64]*recoveredWrite)
+	for _, channelId := range channels {
+		err := scanChannel(ctx, driver.Rest, channelId, func(chunks []ddrv.Node, manifests []ddrv.Manifest, err error) {
+			report.Messages++
+			if err != nil {
+				report.Unreadable++
+				log.Warn().Str("c", "recover").Err(err).Msg("failed to read manifest")
+				return
+			}
+			for i := range chunks {
+				report.Chunks++
+				addChunk(files, chunks[i], manifests[i])
+			}
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+	type rebuilt struct {
+		path  string
+		mtime time.Time
+		nodes []ddrv.Node
+	}
+	var rebuilts []rebuilt
+	for _, writes := range files {
+		p, mtime, nodes, ok := rebuild(writes)
+		if !ok {
+			report.Incomplete = append(report.Incomplete, p)
+			continue
+		}
+		rebuilts = append(rebuilts, rebuilt{p, mtime, nodes})
+	}
+	// A removed file may still have messages, the newest file written to a path takes it
+	sort.Slice(rebuilts, func(i, j int) bool { return rebuilts[i].mtime.After(rebuilts[j].mtime) })
+	claimed := make(map[string]bool)
+	for _, r := range rebuilts {
+		p := r.path
+		if _, err := Stat(p); err == nil || claimed[p] {
+			report.Existing = append(report.Existing, p)
+			continue
+		} else if !errors.Is(err, ErrNotExist) {
+			return report, err
+		}
+		if !opts.DryRun {
+			if err := restore(p, r.mtime, r.nodes); err != nil {
+				return report, err
+			}
+		}
+		claimed[p] = true
+		report.Recovered = append(report.Recovered, p)
+	}
+	sort.Strings(report.Recovered)
+	sort.Strings(report.Incomplete)
+	sort.Strings(report.Existing)
+	return report, nil
+}
+
+// scanChannel pages through messages of the channel from the newest one and reads their manifests.
+// fn is called for every message with its chunks and their manifests, both are nil if the message carries no manifest.
+func scanChannel(ctx context.Context, rest *ddrv.Rest, channelId string, fn func(chunks []ddrv.Node, manifests []ddrv.Manifest, err error)) error {
+	var messages []ddrv.Message
+	var before int64
+	for {
+		messages = messages[:0]
+		if err := rest.GetMessagesContext(ctx, channelId, before, "before", &messages); err != nil {
+			return err
+		}
+		if len(messages) == 0 {
+			return nil
+		}
+		for i := range messages {
+			mid, err := strconv.ParseInt(messages[i].Id, 10, 64)
+			if err != nil {
+				return err
+			}
+			before = mid
+			fn(rest.Chunks(&messages[i]))
+		}
+	}
+}
+
+func addChunk(files map[string]map[int64]*recoveredWrite, chunk ddrv.Node, m ddrv.Manifest) {
+	writes, ok := files[m.File]
+	if !ok {
+		writes = make(map[int64]*recoveredWrite)
+		files[m.File] = writes
+	}
+	w, ok := writes[m.Write]
+	if !ok {
+		w = &recoveredWrite{
+			manifest: m,
+			chunks:   make(map[int][]ddrv.Node),
+			parity:   make(map[int]map[int][]ddrv.Node),
+			shards:   make(map[int]int),
+		}
+		writes[m.Write] = w
+	}
+	if chunk.MId > w.last {
+		w.last = chunk.MId
+	}
+	if m.Parity == 0 {
+		w.chunks[m.Index] = append(w.chunks[m.Index], chunk)
+		return
+	}
+	if w.parity[m.Index] == nil {
+		w.parity[m.Index] = make(map[int][]ddrv.Node)
+	}
+	w.parity[m.Index][m.Parity-1] = append(w.parity[m.Index][m.Parity-1], chunk)
+	w.shards[m.Index] = m.Shards
+}
+
+// rebuild returns path, modification time and nodes of the file written by writes.
+// It reports false if chunks of the file are missing.
+func rebuild(writes map[int64]*recoveredWrite) (string, time.Time, []ddrv.Node, bool) {
+	var chain []*recoveredWrite
+	var offset int64
+	var prev int64
+	for {
+		// The newest write starting where the file ends so far, the newest write from the beginning replaced
+		// older ones and a write continuing another one started after it
+		var next *recoveredWrite
+		for _, w := range writes {
+			if w.manifest.Base == offset && w.manifest.Write > prev && (next == nil || w.manifest.Write > next.manifest.Write) {
+				next = w
+			}
+		}
+		if next == nil {
+			break
+		}
+		chain = append(chain, next)
+		prev = next.manifest.Write
+		size, ok := next.size()
+		if !ok || size == 0 {
+			break
+		}
+		offset += size
+	}
+	var newest *recoveredWrite
+	for _, w := range writes {
+		if newest == nil || w.manifest.Write > newest.manifest.Write {
+			newest = w
+		}
+	}
+	p := newest.manifest.Path
+	if p == "" {
+		p = path.Join("/recovered", newest.manifest.File)
+	}
+	if len(chain) == 0 {
+		return p, time.Time{}, nil, false
+	}
+	last := chain[len(chain)-1]
+	if last.manifest.Path != "" {
+		p = last.manifest.Path
+	}
+	var nodes []ddrv.Node
+	for _, w := range chain {
+		chunks, ok := w.nodes()
+		if !ok {
+			return p, time.Time{}, nil, false
+		}
+		nodes = append(nodes, chunks...)
+	}
+	if size := last.manifest.Size; size > 0 && offset != size {
+		return p, time.Time{}, nil, false
+	}
+	return p, ddrv.SnowflakeTime(last.last), nodes, true
+}
+
+// size returns the number of bytes written by the write, it reports false if chunks are missing
+func (w *recoveredWrite) size() (int64, bool) {
+	var size int64
+	for i := 0; i < len(w.chunks); i++ {
+		copies, ok := w.chunks[i]
+		if !ok {
+			return 0, false
+		}
+		size += int64(copies[0].Size)
+	}
+	return size, true
+}
+
+// nodes returns chunks of the write in order, copies become replicas and parity shards are attached to stripes
+func (w *recoveredWrite) nodes() ([]ddrv.Node, bool) {
+	nodes := make([]ddrv.Node, len(w.chunks))
+	for i := range nodes {
+		copies, ok := w.chunks[i]
+		if !ok {
+			return nil, false
+		}
+		sort.Slice(copies, func(a, b int) bool { return copies[a].MId < copies[b].MId })
+		node := copies[0]
+		for _, c := range copies[1:] {
+			node.Replicas = append(node.Replicas, ddrv.Replica{URL: c.URL, MId: c.MId, Att: c.Att, Ex: c.Ex, Is: c.Is, Hm: c.Hm})
+		}
+		nodes[i] = node
+	}
+	for first, shards := range w.parity {
+		k := w.shards[first]
+		parity := make([]ddrv.Node, len(shards))
+		for j := range parity {
+			copies, ok := shards[j]
+			if !ok {
+				// Stripe can not be described without every parity shard, chunks are recovered without it
+				parity = nil
+				break
+			}
+			parity[j] = copies[0]
+		}
+		if parity == nil || k <= 0 {
+			continue
+		}
+		data := 0
+		for i := first; i < first+k && i < len(nodes); i++ {
+			data++
+		}
+		for i := first; i < first+data; i++ {
+			nodes[i].Stripe = &ddrv.Stripe{Index: i - first, Data: data, Shards: k, Size: parity[0].Size, Parity: parity}
+		}
+	}
+	return nodes, true
+}
+
+// messages returns every message of the write, copies of chunks and parity shards
+func (w *recoveredWrite) messages() []ddrv.Node {
+	var messages []ddrv.Node
+	for _, copies := range w.chunks {
+		messages = append(messages, copies...)
+	}
+	for _, shards := range w.parity {
+		for _, copies := range shards {
+			messages = append(messages, copies...)
+		}
+	}
+	return messages
+}
+
+// restore creates the file at p with given nodes
+func restore(p string, mtime time.Time, nodes []ddrv.Node) error {
+	dir, name := path.Split(p)
+	dir = path.Clean(dir)
+	if dir != "/" {
+		if err := Mkdir(dir); err != nil && !errors.Is(err, ErrExist) {
+			return err
+		}
+	}
+	parent, err := Stat(dir)
+	if err != nil {
+		return err
+	}
+	file, err := Create(name, parent.Id, false)
+	if err != nil {
+		return err
+	}
+	if err = CreateNodes(file.Id, nodes); err != nil {
+		return err
+	}
+	return ChMTime(p, mtime)
+}
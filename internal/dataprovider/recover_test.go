@@ -0,0 +1,102 @@
+package dataprovider_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	dp "github.com/forscht/ddrv/internal/dataprovider"
+	"github.com/forscht/ddrv/pkg/ddrv"
+	"github.com/forscht/ddrv/pkg/ddrv/ddrvtest"
+)
+
+func TestRecover(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	cfg := s.Config(1024, "1", "2")
+	cfg.Replicas = 2
+	driver := newDriver(t, cfg)
+	provider := load(t, driver, "")
+
+	files := map[string][]byte{}
+	for p, size := range map[string]int{"/docs/a.bin": 2500, "/b.bin": 1000, "/c.bin": 3000, "/d.bin": 1500} {
+		files[p] = randBytes(t, size)
+	}
+	put(t, driver, "/docs/a.bin", files["/docs/a.bin"])
+	put(t, driver, "/b.bin", files["/b.bin"])
+	// Upload session continued by a second write
+	c := put(t, driver, "/c.bin", nil)
+	session, err := dp.CreateSession(c.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, part := range [][]byte{files["/c.bin"][:1500], files["/c.bin"][1500:]} {
+		ctx := ddrv.WithManifest(context.Background(), c.Id, "/c.bin", session.Size, 0)
+		w := driver.NewWriterContext(ctx, func(chunk ddrv.Node) {
+			if err := dp.AppendSession(session.Id, chunk); err != nil {
+				t.Error(err)
+			}
+			session.Size += int64(chunk.Size)
+		})
+		if _, err = w.Write(part); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = dp.CommitSession(session.Id); err != nil {
+		t.Fatal(err)
+	}
+	// Messages of the removed file are still queued for deletion
+	put(t, driver, "/d.bin", files["/b.bin"])
+	rm(t, "/d.bin")
+	put(t, driver, "/d.bin", files["/d.bin"])
+	_ = provider.Close()
+
+	// Rebuild into a fresh provider
+	provider = load(t, driver, "")
+	defer provider.Close()
+	report, err := dp.Recover(context.Background(), driver, dp.RecoverOptions{})
+	if err != nil {
+		t.Fatalf("Recover() error = %v", err)
+	}
+	want := []string{"/b.bin", "/c.bin", "/d.bin", "/docs/a.bin"}
+	if strings.Join(report.Recovered, ",") != strings.Join(want, ",") || len(report.Incomplete) != 0 || len(report.Existing) != 0 {
+		t.Fatalf("Recover() = %+v, want %v recovered", report, want)
+	}
+	if report.Chunks != 2*(3+1+4+2+1) {
+		t.Errorf("Recover() found %d chunk messages, want %d", report.Chunks, 2*(3+1+4+2+1))
+	}
+	for p, data := range files {
+		file, err := dp.Stat(p)
+		if err != nil {
+			t.Fatalf("Stat(%s) error = %v", p, err)
+		}
+		nodes, _ := dp.GetNodes(file.Id)
+		if file.Size != int64(len(data)) || len(nodes[0].Replicas) != 1 {
+			t.Errorf("recovered %s has size %d and %d replicas, want %d and 1", p, file.Size, len(nodes[0].Replicas), len(data))
+		}
+		check(t, driver, file.Id, data, "read of recovered "+p)
+	}
+	// Files are not recovered twice
+	report, err = dp.Recover(context.Background(), driver, dp.RecoverOptions{DryRun: true})
+	if err != nil || len(report.Recovered) != 0 || strings.Join(report.Existing, ",") != strings.Join(want, ",") {
+		t.Errorf("second Recover() = %+v, %v, want every file existing", report, err)
+	}
+
+	// Chunks uploaded through webhooks are found in the channels of the webhooks
+	cfg = s.Config(1024)
+	cfg.Channels = nil
+	cfg.Webhooks = []string{s.Webhook("7")}
+	driver = newDriver(t, cfg)
+	hooked := load(t, driver, "")
+	put(t, driver, "/e.bin", files["/b.bin"])
+	_ = hooked.Close()
+	hooked = load(t, driver, "")
+	defer hooked.Close()
+	report, err = dp.Recover(context.Background(), driver, dp.RecoverOptions{})
+	if err != nil || strings.Join(report.Recovered, ",") != "/e.bin" {
+		t.Errorf("Recover() of webhook chunks = %+v, %v, want /e.bin recovered", report, err)
+	}
+}
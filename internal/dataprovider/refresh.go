@@ -0,0 +1,157 @@
+package dataprovider
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/forscht/ddrv/pkg/ddrv"
+)
+
+// DefaultRefreshWindow is how long before their expiry links are refreshed in background
+const DefaultRefreshWindow = 2 * time.Hour
+
+// DefaultRefreshBudget is the maximum number of nodes refreshed by a run of RefreshExpiring
+const DefaultRefreshBudget = 5000
+
+// DefaultRefreshPause is the pause between batches of RefreshExpiring, it keeps refreshes from starving requests
+const DefaultRefreshPause = time.Second
+
+// RefreshRetry is how long refreshing links of a message is postponed after it failed, the delay doubles
+// with every failed attempt up to MaxRefreshRetry. Links of deleted messages can not be refreshed anymore.
+const (
+	RefreshRetry    = time.Hour
+	MaxRefreshRetry = 7 * 24 * time.Hour
+)
+
+// RefreshBackoff returns how long refreshing links of a message is postponed after given number of failed attempts
+func RefreshBackoff(attempts int) time.Duration {
+	return backoff(RefreshRetry, MaxRefreshRetry, attempts)
+}
+
+// RefreshOptions configures RefreshExpiring
+type RefreshOptions struct {
+	Window time.Duration // Links expiring within Window are refreshed, defaults to DefaultRefreshWindow
+	Budget int           // Maximum number of refreshed nodes, defaults to DefaultRefreshBudget
+	Pause  time.Duration // Pause between batches, defaults to DefaultRefreshPause
+}
+
+func ExpiringNodes(before time.Time, limit int) (map[string][]ddrv.Node, error) {
+	log.Debug().Str("c", "dataprovider").Time("before", before).Int("limit", limit).Msg("EXPIRING_NODES")
+	return provider.ExpiringNodes(int(before.Unix()), limit)
+}
+
+func UpdateNodes(fid string, nodes []ddrv.Node) error {
+	log.Debug().Str("c", "dataprovider").Str("fid", fid).Int("count", len(nodes)).Msg("UPDATE_NODES")
+	return provider.UpdateNodes(fid, nodes)
+}
+
+func FailRefreshes(mids []int64) error {
+	log.Debug().Str("c", "dataprovider").Int("count", len(mids)).Msg("FAIL_REFRESHES")
+	return provider.FailRefreshes(mids)
+}
+
+// RefreshExpiring refreshes links of nodes which expire within opts.Window and stores them, so reads
+// do not wait for expired links to be refreshed. Nodes are refreshed in batches of ddrv.MaxRefreshURLs,
+// up to opts.Budget nodes per call. Nodes whose links could not be refreshed, like nodes of deleted messages,
+// are parked and retried with backoff, so they do not take up the budget of every call. It returns the number
+// of refreshed nodes.
+func RefreshExpiring(ctx context.Context, driver *ddrv.Driver, opts RefreshOptions) (int, error) {
+	// Links of other stores do not expire
+	if _, ok := driver.Store.(ddrv.Refresher); !ok {
+		return 0, nil
+	}
+	window, budget, pause := opts.Window, opts.Budget, opts.Pause
+	if window <= 0 {
+		window = DefaultRefreshWindow
+	}
+	if budget <= 0 {
+		budget = DefaultRefreshBudget
+	}
+	if pause <= 0 {
+		pause = DefaultRefreshPause
+	}
+	before := time.Now().Add(window)
+	deadline := int(before.Unix())
+	expiring, err := ExpiringNodes(before, budget)
+	if err != nil {
+		return 0, err
+	}
+	type fileNodes struct {
+		fid   string
+		nodes []ddrv.Node
+	}
+	var batch []fileNodes
+	size, refreshed, flushed := 0, 0, false
+	throttle := time.NewTicker(pause)
+	defer throttle.Stop()
+	flush := func() error {
+		if flushed {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-throttle.C:
+			}
+		}
+		flushed = true
+		chunks := make([]*ddrv.Node, 0, size)
+		for _, f := range batch {
+			for i := range f.nodes {
+				chunks = append(chunks, &f.nodes[i])
+			}
+		}
+		if err := driver.RefreshNodesContext(ctx, chunks, before); err != nil {
+			return err
+		}
+		var failed []int64
+		for _, f := range batch {
+			nodes := make([]ddrv.Node, 0, len(f.nodes))
+			for _, node := range f.nodes {
+				if node.Expired(deadline) {
+					failed = append(failed, node.MId)
+					continue
+				}
+				nodes = append(nodes, node)
+			}
+			if len(nodes) == 0 {
+				continue
+			}
+			if err := UpdateNodes(f.fid, nodes); err != nil {
+				return err
+			}
+			refreshed += len(nodes)
+		}
+		if len(failed) > 0 {
+			log.Warn().Str("c", "refresh").Int("count", len(failed)).Msg("failed to refresh links of nodes, their messages may be deleted")
+			if err := FailRefreshes(failed); err != nil {
+				return err
+			}
+		}
+		batch, size = batch[:0], 0
+		return nil
+	}
+	for fid, nodes := range expiring {
+		for len(nodes) > 0 {
+			n := ddrv.MaxRefreshURLs - size
+			if n > len(nodes) {
+				n = len(nodes)
+			}
+			batch = append(batch, fileNodes{fid, nodes[:n]})
+			size += n
+			nodes = nodes[n:]
+			if size < ddrv.MaxRefreshURLs {
+				continue
+			}
+			if err = flush(); err != nil {
+				return refreshed, err
+			}
+		}
+	}
+	if size > 0 {
+		if err = flush(); err != nil {
+			return refreshed, err
+		}
+	}
+	return refreshed, nil
+}
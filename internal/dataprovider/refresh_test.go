@@ -0,0 +1,85 @@
+package dataprovider_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	dp "github.com/forscht/ddrv/internal/dataprovider"
+	"github.com/forscht/ddrv/pkg/ddrv/ddrvtest"
+)
+
+func TestRefreshExpiring(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	cfg := s.Config(1024, "1", "2")
+	cfg.Replicas = 2
+	driver := newDriver(t, cfg)
+	defer load(t, driver, "").Close()
+
+	// Links of the first file expire within the refresh window
+	s.SetTTL(time.Hour)
+	data := randBytes(t, 2500)
+	file := put(t, driver, "/a.bin", data)
+	s.SetTTL(24 * time.Hour)
+	put(t, driver, "/b.bin", data)
+
+	opts := dp.RefreshOptions{Window: 2 * time.Hour, Pause: time.Millisecond}
+	refreshed, err := dp.RefreshExpiring(context.Background(), driver, opts)
+	if err != nil || refreshed != 3 {
+		t.Fatalf("RefreshExpiring() = %d, %v, want 3 nodes of a.bin", refreshed, err)
+	}
+	if got := s.Stats().Refreshes; got != 1 {
+		t.Errorf("RefreshExpiring() sent %d refresh requests, want 1", got)
+	}
+	nodes, err := dp.ExpiringNodes(time.Now().Add(2*time.Hour), 100)
+	if err != nil || len(nodes) != 0 {
+		t.Errorf("ExpiringNodes() after refresh = %v, %v, want none", nodes, err)
+	}
+	if refreshed, err = dp.RefreshExpiring(context.Background(), driver, opts); err != nil || refreshed != 0 {
+		t.Errorf("second RefreshExpiring() = %d, %v, want 0", refreshed, err)
+	}
+	check(t, driver, file.Id, data, "read after refresh")
+}
+
+func TestRefreshDeleted(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	driver := newDriver(t, s.Config(1024, "1"))
+	defer load(t, driver, "").Close()
+
+	// Messages of the second file are deleted behind the back of ddrv, their links can not be refreshed
+	s.SetTTL(time.Hour)
+	data := randBytes(t, 2500)
+	file := put(t, driver, "/a.bin", data)
+	deleted := put(t, driver, "/b.bin", data)
+	s.SetTTL(24 * time.Hour)
+	nodes, err := dp.GetNodes(deleted.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes {
+		if err = driver.Rest.DeleteMessage("1", node.MId); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := dp.RefreshOptions{Window: 2 * time.Hour, Pause: time.Millisecond}
+	refreshed, err := dp.RefreshExpiring(context.Background(), driver, opts)
+	if err != nil || refreshed != 3 {
+		t.Fatalf("RefreshExpiring() = %d, %v, want 3 nodes of a.bin", refreshed, err)
+	}
+	// Nodes of deleted messages are parked instead of coming back on every run
+	expiring, err := dp.ExpiringNodes(time.Now().Add(2*time.Hour), 100)
+	if err != nil || len(expiring) != 0 {
+		t.Errorf("ExpiringNodes() after refresh = %v, %v, want none", expiring, err)
+	}
+	requests := s.Stats().Requests
+	if refreshed, err = dp.RefreshExpiring(context.Background(), driver, opts); err != nil || refreshed != 0 {
+		t.Errorf("second RefreshExpiring() = %d, %v, want 0", refreshed, err)
+	}
+	if got := s.Stats().Requests - requests; got != 0 {
+		t.Errorf("second RefreshExpiring() sent %d requests, want none", got)
+	}
+	check(t, driver, file.Id, data, "read after refresh")
+}
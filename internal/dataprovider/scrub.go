@@ -0,0 +1,220 @@
+package dataprovider
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/forscht/ddrv/pkg/ddrv"
+)
+
+// DefaultScrubInterval is the pause between reads of a scrub, it keeps scrubbing from starving downloads
+const DefaultScrubInterval = 100 * time.Millisecond
+
+// Damage marks a file whose data can not be read anymore
+type Damage struct {
+	Id     string    `json:"id"`
+	Reason string    `json:"reason"`
+	Marked time.Time `json:"marked"`
+}
+
+// ScrubOptions configures Scrub
+type ScrubOptions struct {
+	Interval time.Duration // Pause between reads, defaults to DefaultScrubInterval
+	Full     bool          // Read whole chunks and verify checksums, otherwise only the end of every chunk is read
+	Mark     bool          // Mark damaged files in the provider and clear marks of files which are readable again
+}
+
+// ScrubReport is the result of Scrub
+type ScrubReport struct {
+	Started  time.Time      `json:"started"`
+	Finished time.Time      `json:"finished"`
+	Files    int            `json:"files"`    // Number of verified files
+	Messages int            `json:"messages"` // Number of verified messages of chunks, replicas and parity shards
+	Failed   int            `json:"failed"`   // Number of messages which could not be read
+	Damaged  []*ScrubResult `json:"damaged"`  // Files with chunks which can neither be read nor reconstructed
+	Degraded []*ScrubResult `json:"degraded"` // Files which are only readable through replicas or parity shards
+	Skipped  []*ScrubResult `json:"skipped"`  // Files whose nodes could not be loaded
+}
+
+// ScrubResult describes problems found in a file
+type ScrubResult struct {
+	Id     string   `json:"id"`
+	Path   string   `json:"path"`
+	Errors []string `json:"errors"`
+}
+
+func MarkDamaged(fid, reason string) error {
+	log.Debug().Str("c", "dataprovider").Str("fid", fid).Str("reason", reason).Msg("MARK_DAMAGED")
+	return provider.MarkDamaged(fid, reason)
+}
+
+func DamagedFiles() ([]*Damage, error) {
+	log.Debug().Str("c", "dataprovider").Msg("DAMAGED_FILES")
+	return provider.DamagedFiles()
+}
+
+// Scrub walks every file and verifies that its chunks, replicas and parity shards can still be read.
+// Reads are throttled by opts.Interval. A file is damaged if a chunk can neither be read from one of its copies
+// nor be reconstructed from its stripe, and degraded if some of its messages failed but the data is still readable.
+func Scrub(ctx context.Context, driver *ddrv.Driver, opts ScrubOptions) (*ScrubReport, error) {
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = DefaultScrubInterval
+	}
+	s := &scrubber{
+		driver:   driver,
+		opts:     opts,
+		throttle: time.NewTicker(interval),
+		report: &ScrubReport{
+			Started:  time.Now(),
+			Damaged:  make([]*ScrubResult, 0),
+			Degraded: make([]*ScrubResult, 0),
+			Skipped:  make([]*ScrubResult, 0),
+		},
+	}
+	defer s.throttle.Stop()
+	if opts.Mark {
+		damaged, err := DamagedFiles()
+		if err != nil {
+			return nil, err
+		}
+		s.marked = make(map[string]bool, len(damaged))
+		for _, d := range damaged {
+			s.marked[d.Id] = true
+		}
+	}
+	err := s.walk(ctx, "", "/")
+	s.report.Finished = time.Now()
+	return s.report, err
+}
+
+type scrubber struct {
+	driver   *ddrv.Driver
+	opts     ScrubOptions
+	throttle *time.Ticker
+	marked   map[string]bool // ids of files marked damaged before the scrub
+	report   *ScrubReport
+}
+
+// scrubKey identifies a verified message attachment, att is -1 for parity shards
+type scrubKey struct {
+	mid int64
+	att int
+}
+
+func (s *scrubber) walk(ctx context.Context, id, dir string) error {
+	files, err := GetChild(id)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		p := path.Join(dir, path.Base(file.Name))
+		if file.Dir {
+			err = s.walk(ctx, file.Id, p)
+		} else {
+			err = s.file(ctx, file, p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *scrubber) file(ctx context.Context, file *File, p string) error {
+	nodes, err := GetNodes(file.Id)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		s.report.Skipped = append(s.report.Skipped, &ScrubResult{Id: file.Id, Path: p, Errors: []string{err.Error()}})
+		return nil
+	}
+	s.report.Files++
+	result := &ScrubResult{Id: file.Id, Path: p, Errors: make([]string, 0)}
+	// Chunks are verified once by message and attachment, parity shards are shared by every chunk
+	// of a stripe and are verified once by message
+	checked := make(map[scrubKey]error)
+	verify := func(node ddrv.Node, parity bool) error {
+		key := scrubKey{mid: node.MId, att: node.Att}
+		if parity {
+			key.att = -1
+		}
+		if err, ok := checked[key]; ok {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.throttle.C:
+		}
+		err := s.driver.VerifyNode(ctx, node, s.opts.Full)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		checked[key] = err
+		s.report.Messages++
+		if err != nil {
+			s.report.Failed++
+			result.Errors = append(result.Errors, err.Error())
+		}
+		return err
+	}
+	var damaged bool
+	// Lost chunks and parity shards of stripes, by message id of the first parity shard
+	lost := make(map[int64]int)
+	stripes := make(map[int64]*ddrv.Stripe)
+	for _, node := range nodes {
+		readable := false
+		for _, chunk := range node.Copies() {
+			if verify(chunk, false) == nil {
+				readable = true
+			}
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if node.Stripe == nil || len(node.Stripe.Parity) == 0 {
+			damaged = damaged || !readable
+			continue
+		}
+		key := node.Stripe.Parity[0].MId
+		if _, ok := stripes[key]; !ok {
+			stripes[key] = node.Stripe
+			for _, parity := range node.Stripe.Parity {
+				if verify(parity, true) != nil {
+					lost[key]++
+				}
+			}
+		}
+		if !readable {
+			lost[key]++
+		}
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	for key, stripe := range stripes {
+		if lost[key] > len(stripe.Parity) {
+			damaged = true
+		}
+	}
+	switch {
+	case damaged:
+		s.report.Damaged = append(s.report.Damaged, result)
+		if s.opts.Mark {
+			reason := fmt.Sprintf("%d of %d messages can not be read : %s", len(result.Errors), len(checked), result.Errors[0])
+			return MarkDamaged(file.Id, reason)
+		}
+	case len(result.Errors) > 0:
+		s.report.Degraded = append(s.report.Degraded, result)
+	}
+	if !damaged && s.marked[file.Id] {
+		return MarkDamaged(file.Id, "")
+	}
+	return nil
+}
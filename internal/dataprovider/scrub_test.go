@@ -0,0 +1,91 @@
+package dataprovider_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	dp "github.com/forscht/ddrv/internal/dataprovider"
+	"github.com/forscht/ddrv/pkg/ddrv/ddrvtest"
+)
+
+func TestScrub(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	cfg := s.Config(1024, "1", "2")
+	cfg.Replicas = 2
+	driver := newDriver(t, cfg)
+	defer load(t, driver, "").Close()
+
+	data := randBytes(t, 2500)
+	degraded := put(t, driver, "/a.bin", data)
+	damaged := put(t, driver, "/b.bin", data[:2000])
+	put(t, driver, "/c.bin", data[:1000])
+	remove := func(mids ...int64) {
+		for _, mid := range mids {
+			for _, channel := range []string{"1", "2"} {
+				if err := driver.Rest.DeleteMessage(channel, mid); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	nodes, _ := dp.GetNodes(degraded.Id)
+	remove(nodes[1].MId)
+	nodes, _ = dp.GetNodes(damaged.Id)
+	remove(nodes[0].MessageIds()...)
+
+	report, err := dp.Scrub(context.Background(), driver, dp.ScrubOptions{Interval: time.Millisecond, Mark: true})
+	if err != nil {
+		t.Fatalf("Scrub() error = %v", err)
+	}
+	if report.Files != 3 || report.Messages != 12 || report.Failed != 3 {
+		t.Errorf("Scrub() verified %d files and %d messages with %d failed, want 3, 12 and 3", report.Files, report.Messages, report.Failed)
+	}
+	if len(report.Damaged) != 1 || report.Damaged[0].Id != damaged.Id || report.Damaged[0].Path != "/b.bin" {
+		t.Errorf("Scrub() damaged = %+v, want /b.bin", report.Damaged)
+	}
+	if len(report.Degraded) != 1 || report.Degraded[0].Id != degraded.Id {
+		t.Errorf("Scrub() degraded = %+v, want /a.bin", report.Degraded)
+	}
+	marked, err := dp.DamagedFiles()
+	if err != nil || len(marked) != 1 || marked[0].Id != damaged.Id {
+		t.Errorf("DamagedFiles() = %v, %v, want b.bin", marked, err)
+	}
+
+	// Marks are removed along with the file
+	rm(t, "/b.bin")
+	if marked, err = dp.DamagedFiles(); err != nil || len(marked) != 0 {
+		t.Errorf("DamagedFiles() after removal = %v, %v, want none", marked, err)
+	}
+}
+
+func TestScrubAttachments(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	cfg := s.Config(1024, "1")
+	cfg.Attachments = 3
+	driver := newDriver(t, cfg)
+	defer load(t, driver, "").Close()
+
+	// Every chunk of the file is an attachment of the same message
+	file := put(t, driver, "/a.bin", randBytes(t, 2500))
+	nodes, err := dp.GetNodes(file.Id)
+	if err != nil || len(nodes) != 3 || nodes[0].MId != nodes[2].MId {
+		t.Fatalf("GetNodes() = %+v, %v, want 3 chunks of one message", nodes, err)
+	}
+	if !s.Corrupt(nodes[2].URL) {
+		t.Fatal("Corrupt() = false")
+	}
+
+	report, err := dp.Scrub(context.Background(), driver, dp.ScrubOptions{Interval: time.Millisecond, Full: true})
+	if err != nil {
+		t.Fatalf("Scrub() error = %v", err)
+	}
+	if report.Messages != 3 || report.Failed != 1 {
+		t.Errorf("Scrub() verified %d messages with %d failed, want 3 and 1", report.Messages, report.Failed)
+	}
+	if len(report.Damaged) != 1 || report.Damaged[0].Id != file.Id {
+		t.Errorf("Scrub() damaged = %+v, want /a.bin", report.Damaged)
+	}
+}
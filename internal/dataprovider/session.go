@@ -0,0 +1,93 @@
+package dataprovider
+
+import (
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/forscht/ddrv/pkg/ddrv"
+)
+
+// Session is an upload in progress. Chunks of the upload are recorded as soon as they are written
+// to discord, so an interrupted upload can be resumed from the offset of the last recorded chunk.
+type Session struct {
+	Id    string    `json:"id"`
+	File  string    `json:"file"`  // Id of the file the upload is appended to on commit
+	Size  int64     `json:"size"`  // Number of bytes recorded so far
+	MTime time.Time `json:"mtime"` // Time the session was created or a chunk was last recorded
+}
+
+func CreateSession(fid string) (*Session, error) {
+	log.Debug().Str("c", "dataprovider").Str("fid", fid).Msg("CREATE_SESSION")
+	return provider.CreateSession(fid)
+}
+
+func GetSession(id string) (*Session, error) {
+	log.Debug().Str("c", "dataprovider").Str("id", id).Msg("GET_SESSION")
+	return provider.GetSession(id)
+}
+
+func GetFileSession(fid string) (*Session, error) {
+	log.Debug().Str("c", "dataprovider").Str("fid", fid).Msg("GET_FILE_SESSION")
+	return provider.GetFileSession(fid)
+}
+
+func AppendSession(id string, node ddrv.Node) error {
+	log.Debug().Str("c", "dataprovider").Str("id", id).Int("size", node.Size).Msg("APPEND_SESSION")
+	return provider.AppendSession(id, node)
+}
+
+func CommitSession(id string) error {
+	log.Debug().Str("c", "dataprovider").Str("id", id).Msg("COMMIT_SESSION")
+	return provider.CommitSession(id)
+}
+
+// CommitLater returns a callback for ddrv.WithCommit which appends the packed chunk to the session
+// and commits the session once the packfile is uploaded, then stores digest of the file unless it is empty.
+// The session is kept if the upload or recording fails, so the file is not committed with missing bytes
+// and the session is swept once it expires.
+func CommitLater(session *Session, digest string) func(chunk ddrv.Node, err error) {
+	return func(chunk ddrv.Node, err error) {
+		if err == nil {
+			err = AppendSession(session.Id, chunk)
+		}
+		if err == nil {
+			err = CommitSession(session.Id)
+		}
+		if err == nil && digest != "" {
+			err = SetDigest(session.File, digest)
+		}
+		if err != nil {
+			log.Error().Str("c", "dataprovider").Str("id", session.Id).Err(err).Msg("failed to commit packed file")
+		}
+	}
+}
+
+// DeleteSession removes the session. Messages of its chunks which no file points at anymore are queued for deletion,
+// PendingDeletions keeps them while they are leased by writes reusing the chunks.
+func DeleteSession(id string) error {
+	log.Debug().Str("c", "dataprovider").Str("id", id).Msg("DELETE_SESSION")
+	return provider.DeleteSession(id)
+}
+
+func StaleSessions(before time.Time) ([]*Session, error) {
+	log.Debug().Str("c", "dataprovider").Time("before", before).Msg("STALE_SESSIONS")
+	return provider.StaleSessions(before)
+}
+
+// SweepSessions deletes sessions which did not record any chunk for ttl.
+func SweepSessions(ttl time.Duration) error {
+	sessions, err := StaleSessions(time.Now().Add(-ttl))
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if err = DeleteSession(session.Id); err != nil && !errors.Is(err, ErrNotExist) {
+			return err
+		}
+		log.Info().Str("c", "dataprovider").Str("id", session.Id).Str("fid", session.File).
+			Int64("size", session.Size).Msg("removed abandoned upload session")
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package dataprovider_test
+
+import (
+	"context"
+	"testing"
+
+	dp "github.com/forscht/ddrv/internal/dataprovider"
+	"github.com/forscht/ddrv/pkg/ddrv"
+	"github.com/forscht/ddrv/pkg/ddrv/ddrvtest"
+)
+
+func TestDeleteSession(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	driver := newDriver(t, s.Config(1024, "1"))
+	driver.Lookup = dp.Lookup
+	defer load(t, driver, "").Close()
+
+	data := randBytes(t, 2500)
+	a := put(t, driver, "/a.bin", nil)
+	session, err := dp.CreateSession(a.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks []ddrv.Node
+	w := driver.NewWriter(func(chunk ddrv.Node) {
+		chunks = append(chunks, chunk)
+		if err := dp.AppendSession(session.Id, chunk); err != nil {
+			t.Error(err)
+		}
+	})
+	if _, err = w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(s.Messages("1")); got != 3 {
+		t.Fatalf("%d messages after upload, want 3", got)
+	}
+
+	// A write reuses the first chunk of the session before the session is aborted
+	node, err := dp.Lookup(chunks[0].Hash, chunks[0].Size)
+	if err != nil || node == nil {
+		t.Fatalf("Lookup() = %v, %v", node, err)
+	}
+	if err = dp.DeleteSession(session.Id); err != nil {
+		t.Fatalf("DeleteSession() error = %v", err)
+	}
+	if got := len(s.Messages("1")); got != 3 {
+		t.Errorf("%d messages right after abort, want 3", got)
+	}
+	// The leased message is kept
+	if deleted, err := dp.ProcessDeletions(context.Background(), driver); err != nil || deleted != 2 {
+		t.Errorf("ProcessDeletions() = %d, %v, want 2 deleted", deleted, err)
+	}
+	b := put(t, driver, "/b.bin", nil)
+	if err = dp.CreateNodes(b.Id, []ddrv.Node{*node}); err != nil {
+		t.Fatalf("CreateNodes() error = %v", err)
+	}
+	check(t, driver, b.Id, data[:1024], "read of file reusing a chunk of aborted session")
+	if err = dp.DeleteSession(session.Id); err != dp.ErrNotExist {
+		t.Errorf("AbortSession() of aborted session error = %v, want %v", err, dp.ErrNotExist)
+	}
+}
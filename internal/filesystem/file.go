@@ -1,6 +1,8 @@
 package filesystem
 
 import (
+	"context"
+	"errors"
 	"io"
 	"os"
 	"path/filepath"
@@ -24,7 +26,12 @@ type File struct {
 
 	fs          *Fs
 	driver      *ddrv.Driver
-	chunks      []ddrv.Node
+	ctx         context.Context    // cancels in-flight Discord I/O of the file
+	cancel      context.CancelFunc // called on Close or failed transfer
+	session     *dp.Session        // upload session recording written chunks
+	sessionErr  error              // first error recording a chunk, the transfer is cancelled on error
+	packed      bool               // whether the session is committed once the packfile of the file is uploaded
+	whole       bool               // whether the written bytes are the whole content of the file
 	streamWrite io.WriteCloser
 	streamRead  io.ReadCloser
 }
@@ -137,15 +144,29 @@ func (f *File) Write(p []byte) (int, error) {
 			if err := dp.Truncate(f.id); err != nil {
 				return 0, err
 			}
+			f.size = 0
 		}
+		// Session is already set when an interrupted upload is resumed
+		if f.session == nil {
+			session, err := dp.CreateSession(f.id)
+			if err != nil {
+				return 0, err
+			}
+			f.session = session
+		}
+		// Chunk messages carry a manifest, so the file can be recovered from discord,
+		// the session is appended to the committed bytes of the file
+		ctx := ddrv.WithManifest(f.ctx, f.id, f.name, f.size+f.session.Size, 0)
+		f.whole = f.size+f.session.Size == 0
+		// Small files are committed once their packfile is uploaded, Close does not wait for it
+		ctx = ddrv.WithCommit(ctx, func() (func(chunk ddrv.Node, err error), error) {
+			f.packed = true
+			return dp.CommitLater(f.session, f.digest()), nil
+		})
 		if f.fs.asyncWrite {
-			f.streamWrite = f.driver.NewNWriter(func(chunk ddrv.Node) {
-				f.chunks = append(f.chunks, chunk)
-			})
+			f.streamWrite = f.driver.NewNWriterContext(ctx, f.record)
 		} else {
-			f.streamWrite = f.driver.NewWriter(func(chunk ddrv.Node) {
-				f.chunks = append(f.chunks, chunk)
-			})
+			f.streamWrite = f.driver.NewWriterContext(ctx, f.record)
 		}
 	}
 	n, err := f.streamWrite.Write(p)
@@ -153,11 +174,54 @@ func (f *File) Write(p []byte) (int, error) {
 	return n, err
 }
 
+// record records the written chunk in the upload session, so it survives an interrupted transfer.
+func (f *File) record(chunk ddrv.Node) {
+	if f.sessionErr != nil {
+		return
+	}
+	if err := dp.AppendSession(f.session.Id, chunk); err != nil {
+		f.sessionErr = err
+		// Chunks after the missing one can not be resumed
+		f.cancel()
+		return
+	}
+	f.session.Size += int64(chunk.Size)
+}
+
+// resume continues the interrupted upload of the file at offset, which must be the size
+// of the file plus the bytes recorded by its pending upload session.
+func (f *File) resume(offset int64) (int64, error) {
+	if f.streamWrite != nil {
+		return 0, ErrNotSupported
+	}
+	session, err := dp.GetFileSession(f.id)
+	if err != nil && !errors.Is(err, dp.ErrNotExist) {
+		return 0, err
+	}
+	size := f.size
+	if session != nil {
+		size += session.Size
+	}
+	if offset != size {
+		return 0, ErrInvalidSeek
+	}
+	f.session = session
+	return offset, nil
+}
+
 func (f *File) Seek(offset int64, whence int) (int64, error) {
 	if f.IsDir() {
 		return 0, ErrIsDir
 	}
 
+	// Files opened for writing can only be seeked to resume an upload, e.g. FTP REST before STOR
+	if CheckFlag(os.O_WRONLY, f.flag) {
+		if whence == io.SeekStart && CheckFlag(f.flag, os.O_WRONLY|os.O_CREATE) {
+			return f.resume(offset)
+		}
+		return 0, ErrNotSupported
+	}
+
 	if !CheckFlag(os.O_RDONLY, f.flag) {
 		return 0, ErrNotSupported
 	}
@@ -189,19 +253,40 @@ func (f *File) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (f *File) Close() error {
+	if f.cancel != nil {
+		defer f.cancel()
+	}
 	if f.streamWrite != nil {
 		if err := f.streamWrite.Close(); err != nil {
 			return err
 		}
-		// Special case, some FTP clients try to create blank file
-		// and then try to write it to FTP, we can ignore chunks with 0 bytes
-		if len(f.chunks) == 1 && f.chunks[0].Size == 0 {
-			return nil
+		if f.sessionErr != nil {
+			return f.sessionErr
 		}
-		err := dp.CreateNodes(f.id, f.chunks)
-		if err != nil {
+		// Do not commit partially written file if the transfer failed,
+		// recorded chunks stay in the session, so the upload can be resumed
+		if err := f.ctx.Err(); err != nil {
 			return err
 		}
+		switch {
+		case f.packed:
+			// The session is committed along with the packfile
+		case f.session.Size == 0:
+			// Special case, some FTP clients try to create blank file
+			// and then try to write it to FTP, we can ignore chunks with 0 bytes
+			if err := dp.DeleteSession(f.session.Id); err != nil {
+				return err
+			}
+		default:
+			if err := dp.CommitSession(f.session.Id); err != nil {
+				return err
+			}
+			if digest := f.digest(); digest != "" {
+				if err := dp.SetDigest(f.id, digest); err != nil {
+					return err
+				}
+			}
+		}
 		f.streamWrite = nil
 	}
 	if f.streamRead != nil {
@@ -214,8 +299,24 @@ func (f *File) Close() error {
 	return nil
 }
 
+// digest returns the SHA-256 of the written bytes if they are the whole content of the file
+func (f *File) digest() string {
+	if !f.whole {
+		return ""
+	}
+	return f.streamWrite.(ddrv.Digester).Digest()
+}
+
+// TransferError implements ftpserver.FileTransferError, it aborts in-flight Discord I/O
+// of the file so that a failed upload is not committed on Close.
+func (f *File) TransferError(_ error) {
+	if f.cancel != nil {
+		f.cancel()
+	}
+}
+
 func (f *File) openReadStream(startAt int64) error {
-	stream, err := f.driver.NewReader(f.data, startAt)
+	stream, err := f.driver.NewReaderContext(f.ctx, f.data, startAt)
 	if err != nil {
 		return err
 	}
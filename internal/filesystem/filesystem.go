@@ -1,6 +1,7 @@
 package filesystem
 
 import (
+	"context"
 	"errors"
 	"os"
 	"path/filepath"
@@ -69,6 +70,7 @@ func (fs *Fs) Open(name string) (afero.File, error) {
 	file := fs.convertToAferoFile(f)
 	file.flag = os.O_RDONLY
 	file.driver = fs.driver
+	file.ctx, file.cancel = context.WithCancel(context.Background())
 	if !file.dir {
 		file.data, err = dp.GetNodes(file.id)
 		if err != nil {
@@ -98,11 +100,19 @@ func (fs *Fs) OpenFile(name string, flag int, _ os.FileMode) (afero.File, error)
 	file := fs.convertToAferoFile(f)
 	file.flag = flag
 	file.driver = fs.driver
+	file.ctx, file.cancel = context.WithCancel(context.Background())
 
 	if CheckFlag(os.O_TRUNC, flag) {
 		if err = dp.Truncate(file.id); err != nil {
 			return nil, err
 		}
+		file.size = 0
+		// Overwriting the file discards its interrupted upload
+		if session, err := dp.GetFileSession(file.id); err == nil {
+			if err = dp.DeleteSession(session.Id); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	if !file.dir {
@@ -137,6 +147,7 @@ func (fs *Fs) Stat(name string) (os.FileInfo, error) {
 	if err != nil {
 		return nil, os.ErrNotExist
 	}
+	// Bytes of an interrupted upload are not counted, they can not be read before the upload is committed
 	return fs.convertToAferoFile(f).Stat()
 }
 
@@ -136,6 +136,14 @@ func (lff *LogFsFile) Close() error {
 	return err
 }
 
+// TransferError forwards failed transfer notification to the source file if it supports it
+func (lff *LogFsFile) TransferError(err error) {
+	log.Error().Str("c", "fs").Str("name", lff.src.Name()).Err(err).Msg("TRANSFER_ERROR")
+	if tf, ok := lff.src.(interface{ TransferError(err error) }); ok {
+		tf.TransferError(err)
+	}
+}
+
 // Read only log error
 func (lff *LogFsFile) Read(p []byte) (int, error) {
 	n, err := lff.src.Read(p)
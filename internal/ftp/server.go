@@ -36,6 +36,14 @@ func Serv(drvr *ddrv.Driver, cfg *Config) error {
 	if cfg.Addr == "" {
 		return nil
 	}
+	server := New(drvr, cfg)
+	log.Info().Str("c", "ftp").Str("addr", cfg.Addr).Msg("starting ftp server")
+
+	return server.ListenAndServe()
+}
+
+// New creates the FTP server serving ddrv filesystem, without starting a listener.
+func New(drvr *ddrv.Driver, cfg *Config) *ftpserver.FtpServer {
 	var portRange *ftpserver.PortRange
 	if cfg.PortRange != "" {
 		portRange = &ftpserver.PortRange{}
@@ -78,10 +86,7 @@ func Serv(drvr *ddrv.Driver, cfg *Config) error {
 	}
 
 	// Instantiate the FTP server with the driver and return a pointer to it
-	server := ftpserver.NewFtpServer(driver)
-	log.Info().Str("c", "ftp").Str("addr", cfg.Addr).Msg("starting ftp server")
-
-	return server.ListenAndServe()
+	return ftpserver.NewFtpServer(driver)
 }
 
 // Driver is the FTP server driver implementation.
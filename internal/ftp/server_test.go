@@ -0,0 +1,222 @@
+package ftp_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+
+	dp "github.com/forscht/ddrv/internal/dataprovider"
+	"github.com/forscht/ddrv/internal/dataprovider/boltdb"
+	ddrvftp "github.com/forscht/ddrv/internal/ftp"
+	"github.com/forscht/ddrv/pkg/ddrv"
+	"github.com/forscht/ddrv/pkg/ddrv/ddrvtest"
+)
+
+func dial(t *testing.T, asyncWrite bool) (*ftp.ServerConn, *ddrv.Driver) {
+	t.Helper()
+	s := ddrvtest.NewServer()
+	t.Cleanup(s.Close)
+	cfg := s.Config(1024, "1", "2", "3")
+	cfg.Prefetch = 2
+	driver, err := ddrv.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := boltdb.New(driver, &boltdb.Config{DbPath: filepath.Join(t.TempDir(), "ddrv.db")})
+	t.Cleanup(func() { _ = provider.Close() })
+	dp.Load(provider)
+
+	server := ddrvftp.New(driver, &ddrvftp.Config{Addr: "127.0.0.1:0", Username: "user", Password: "pass", AsyncWrite: asyncWrite})
+	if err = server.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.Serve() }()
+	t.Cleanup(func() { _ = server.Stop() })
+
+	conn, err := ftp.Dial(server.Addr(), ftp.DialWithTimeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Quit() })
+	if err = conn.Login("user", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	return conn, driver
+}
+
+func retr(t *testing.T, conn *ftp.ServerConn, path string, offset uint64) []byte {
+	t.Helper()
+	resp, err := conn.RetrFrom(path, offset)
+	if err != nil {
+		t.Fatalf("RETR %s error = %v", path, err)
+	}
+	defer resp.Close()
+	data, err := io.ReadAll(resp)
+	if err != nil {
+		t.Fatalf("RETR %s read error = %v", path, err)
+	}
+	return data
+}
+
+func TestFTP(t *testing.T) {
+	for _, asyncWrite := range []bool{false, true} {
+		conn, _ := dial(t, asyncWrite)
+
+		if err := conn.MakeDir("/backups"); err != nil {
+			t.Fatalf("MKD error = %v", err)
+		}
+		data := make([]byte, 5000)
+		_, _ = rand.Read(data)
+		if err := conn.Stor("/backups/db.bin", bytes.NewReader(data)); err != nil {
+			t.Fatalf("STOR error = %v", err)
+		}
+
+		size, err := conn.FileSize("/backups/db.bin")
+		if err != nil {
+			t.Fatalf("SIZE error = %v", err)
+		}
+		if size != int64(len(data)) {
+			t.Errorf("SIZE = %d, want %d", size, len(data))
+		}
+		if got := retr(t, conn, "/backups/db.bin", 0); !bytes.Equal(got, data) {
+			t.Errorf("RETR returned %d bytes, want %d equal bytes", len(got), len(data))
+		}
+		if got := retr(t, conn, "/backups/db.bin", 3000); !bytes.Equal(got, data[3000:]) {
+			t.Errorf("RETR from offset returned %d bytes, want %d equal bytes", len(got), len(data)-3000)
+		}
+
+		if err = conn.Rename("/backups/db.bin", "/backups/db.old"); err != nil {
+			t.Fatalf("RNFR/RNTO error = %v", err)
+		}
+		entries, err := conn.List("/backups")
+		if err != nil {
+			t.Fatalf("LIST error = %v", err)
+		}
+		if len(entries) != 1 || entries[0].Name != "db.old" {
+			t.Errorf("LIST returned unexpected entries %v", entries)
+		}
+		if err = conn.Delete("/backups/db.old"); err != nil {
+			t.Fatalf("DELE error = %v", err)
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	for _, asyncWrite := range []bool{false, true} {
+		conn, driver := dial(t, asyncWrite)
+		data := make([]byte, 5000)
+		_, _ = rand.Read(data)
+
+		// Leave an upload interrupted after two chunks were recorded
+		if err := conn.Stor("/big.bin", bytes.NewReader(nil)); err != nil {
+			t.Fatalf("STOR error = %v", err)
+		}
+		file, err := dp.Stat("/big.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		session, err := dp.CreateSession(file.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := driver.NewWriter(func(chunk ddrv.Node) {
+			if err := dp.AppendSession(session.Id, chunk); err != nil {
+				t.Error(err)
+			}
+		})
+		_, _ = w.Write(data[:2048])
+		_ = w.Close()
+
+		// Only committed bytes are reported, the upload is resumed from the end of the session
+		size, err := conn.FileSize("/big.bin")
+		if err != nil {
+			t.Fatalf("SIZE error = %v", err)
+		}
+		if size != 0 {
+			t.Fatalf("SIZE of interrupted upload = %d, want 0", size)
+		}
+		if got := retr(t, conn, "/big.bin", 0); len(got) != 0 {
+			t.Errorf("RETR of interrupted upload returned %d bytes, want 0", len(got))
+		}
+		size = 2048
+		if err = conn.StorFrom("/big.bin", bytes.NewReader(data[1000:]), 1000); err == nil {
+			t.Errorf("STOR from offset not matching the upload succeeded")
+		}
+		if err = conn.StorFrom("/big.bin", bytes.NewReader(data[size:]), uint64(size)); err != nil {
+			t.Fatalf("STOR from offset error = %v", err)
+		}
+		if got := retr(t, conn, "/big.bin", 0); !bytes.Equal(got, data) {
+			t.Errorf("RETR of resumed upload returned %d bytes, want %d equal bytes", len(got), len(data))
+		}
+
+		// Abandoned sessions are swept along with their messages
+		session, err = dp.CreateSession(file.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w = driver.NewWriter(func(chunk ddrv.Node) { _ = dp.AppendSession(session.Id, chunk) })
+		_, _ = w.Write(data)
+		_ = w.Close()
+		if err = dp.SweepSessions(0); err != nil {
+			t.Fatalf("SweepSessions error = %v", err)
+		}
+		if _, err = dp.GetSession(session.Id); err == nil {
+			t.Errorf("session still exists after sweep")
+		}
+		if size, _ = conn.FileSize("/big.bin"); size != int64(len(data)) {
+			t.Errorf("SIZE after sweep = %d, want %d", size, len(data))
+		}
+
+		// Resumed chunks of a file with committed bytes are placed after them in their manifests
+		if session, err = dp.CreateSession(file.Id); err != nil {
+			t.Fatal(err)
+		}
+		w = driver.NewWriter(func(chunk ddrv.Node) { _ = dp.AppendSession(session.Id, chunk) })
+		_, _ = w.Write(data[:1024])
+		_ = w.Close()
+		if err = conn.StorFrom("/big.bin", bytes.NewReader(data[1024:3000]), uint64(len(data)+1024)); err != nil {
+			t.Fatalf("STOR from offset error = %v", err)
+		}
+		want := append(append([]byte(nil), data...), data[:3000]...)
+		if got := retr(t, conn, "/big.bin", 0); !bytes.Equal(got, want) {
+			t.Errorf("RETR of resumed file returned %d bytes, want %d equal bytes", len(got), len(want))
+		}
+		messages := make(map[int64]ddrv.Message)
+		for _, channel := range []string{"1", "2", "3"} {
+			var page []ddrv.Message
+			if err = driver.Rest.GetMessages(channel, 0, "", &page); err != nil {
+				t.Fatal(err)
+			}
+			for _, m := range page {
+				mid, _ := strconv.ParseInt(m.Id, 10, 64)
+				messages[mid] = m
+			}
+		}
+		nodes, err := dp.GetNodes(file.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var offset int64
+		resumed := 0
+		for _, node := range nodes {
+			if offset >= int64(len(data)+1024) {
+				msg := messages[node.MId]
+				_, manifests, err := driver.Rest.Chunks(&msg)
+				if err != nil || len(manifests) != 1 || manifests[0].Offset != offset {
+					t.Errorf("manifest of chunk at %d = %+v, %v, want offset %d", offset, manifests, err, offset)
+				}
+				resumed++
+			}
+			offset += int64(node.Size)
+		}
+		if resumed != 2 {
+			t.Errorf("%d resumed chunks, want 2", resumed)
+		}
+	}
+}
@@ -27,6 +27,13 @@ func Load(app *fiber.App, driver *ddrv.Driver) {
 	// verify JWT token (required on a page load)
 	api.Get("/check_token", CheckTokenHandler())
 
+	// health of discord tokens and rate limiter statistics
+	api.Get("/status", StatusHandler(driver))
+
+	// verify every stored chunk is still retrievable and list damaged files
+	api.Post("/scrub", StartScrubHandler(driver))
+	api.Get("/scrub", GetScrubHandler())
+
 	// If dataprovider is postgres, we require id and dirId to be guid
 	if dataprovider.Name() == "postgres" {
 		// Load directory middlewares
@@ -41,6 +48,10 @@ func Load(app *fiber.App, driver *ddrv.Driver) {
 		api.Put("/directories/:dirId<guid>/files/:id<guid>", UpdateFileHandler())
 		api.Delete("/directories/:dirId<guid>/files/:id<guid>", DelFileHandler())
 
+		// Load upload session middlewares
+		api.Post("/directories/:dirId<guid>/sessions", CreateSessionHandler())
+		loadSessions(api, driver)
+
 		// Just like discord, we will not authorize file endpoints
 		// so that it can work with download managers or media players
 		app.Get("/files/:id<guid>", DownloadFileHandler(driver))
@@ -61,8 +72,20 @@ func Load(app *fiber.App, driver *ddrv.Driver) {
 	api.Put("/directories/:dirId/files/:id", UpdateFileHandler())
 	api.Delete("/directories/:dirId/files/:id", DelFileHandler())
 
+	// Load upload session middlewares
+	api.Post("/directories/:dirId/sessions", CreateSessionHandler())
+	loadSessions(api, driver)
+
 	// Just like discord, we will not authorize file endpoints
 	// so that it can work with download managers or media players
 	app.Get("/files/:id", DownloadFileHandler(driver))
 	app.Get("/files/:id/:fname", DownloadFileHandler(driver))
 }
+
+// loadSessions loads routes of upload sessions, session ids are the same for every dataprovider
+func loadSessions(api fiber.Router, driver *ddrv.Driver) {
+	api.Get("/sessions/:id", GetSessionHandler())
+	api.Patch("/sessions/:id", UploadSessionHandler(driver))
+	api.Post("/sessions/:id/commit", CommitSessionHandler())
+	api.Delete("/sessions/:id", DelSessionHandler())
+}
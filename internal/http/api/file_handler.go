@@ -1,11 +1,14 @@
 package api
 
 import (
+	"context"
 	"errors"
 	"io"
 	"mime"
 	"mime/multipart"
+	"net"
 	"path/filepath"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 
@@ -36,7 +39,11 @@ func GetFileHandler() fiber.Handler {
 func CreateFileHandler(driver *ddrv.Driver) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		dirId := c.Params("dirId")
-		body := c.Context().RequestBodyStream()
+		// Cancel in-flight uploads if the request body can not be read till the end, e.g. the client disconnects
+		ctx, cancel := context.WithCancel(c.UserContext())
+		defer cancel()
+		body := newBodyReader(c, cancel)
+		defer body.stop()
 		_, params, err := mime.ParseMediaType(string(c.Request().Header.ContentType()))
 		if err != nil {
 			return fiber.NewError(StatusBadRequest, ErrBadRequest)
@@ -75,17 +82,33 @@ func CreateFileHandler(driver *ddrv.Driver) fiber.Handler {
 
 				var dwriter io.WriteCloser
 				onChunk := func(a ddrv.Node) {
-					file.Size += int64(a.Size)
 					nodes = append(nodes, a)
 				}
 
+				// Chunk messages carry a manifest, so the file can be recovered from discord
+				ctx, err = withManifest(ctx, file.Id, 0)
+				if err != nil {
+					return err
+				}
+				// Small files are kept as upload sessions which are committed once their packfile is uploaded,
+				// the response does not wait for it
+				ctx = ddrv.WithCommit(ctx, func() (func(chunk ddrv.Node, err error), error) {
+					session, err := dp.CreateSession(file.Id)
+					if err != nil {
+						return nil, err
+					}
+					// The packed chunk holds the whole file, nothing is written anymore
+					return dp.CommitLater(session, dwriter.(ddrv.Digester).Digest()), nil
+				})
 				if c.Locals("asyncwrite").(bool) {
-					dwriter = driver.NewNWriter(onChunk)
+					dwriter = driver.NewNWriterContext(ctx, onChunk)
 				} else {
-					dwriter = driver.NewWriter(onChunk)
+					dwriter = driver.NewWriterContext(ctx, onChunk)
 				}
 
-				if _, err = io.Copy(dwriter, part); err != nil {
+				if file.Size, err = io.Copy(dwriter, part); err != nil {
+					cancel()
+					_ = dwriter.Close()
 					return err
 				}
 
@@ -96,6 +119,11 @@ func CreateFileHandler(driver *ddrv.Driver) fiber.Handler {
 				if err = dp.CreateNodes(file.Id, nodes); err != nil {
 					return err
 				}
+				if len(nodes) > 0 {
+					if err = dp.SetDigest(file.Id, dwriter.(ddrv.Digester).Digest()); err != nil {
+						return err
+					}
+				}
 
 				return c.Status(StatusOk).
 					JSON(Response{Message: "file created", Data: file})
@@ -180,6 +208,16 @@ func DownloadFileHandler(driver *ddrv.Driver) fiber.Handler {
 		if err != nil {
 			return err
 		}
+		digest, err := dp.GetDigest(id)
+		if err != nil {
+			return err
+		}
+		if digest != "" {
+			c.Set(HeaderDigest, "sha256="+digest)
+		}
+		if digest := ddrv.ChunkDigest(nodes); digest != "" {
+			c.Set(HeaderChunkDigest, "sha256="+digest)
+		}
 
 		fileRange := c.Request().Header.Peek("range")
 		if fileRange != nil {
@@ -190,14 +228,15 @@ func DownloadFileHandler(driver *ddrv.Driver) fiber.Handler {
 
 			c.Response().Header.Set("Content-Range", r.Header)
 
-			dreader, err := driver.NewReader(nodes, r.Start)
+			// Reader is closed by fasthttp once the response is sent or the client goes away
+			dreader, err := driver.NewReaderContext(c.UserContext(), nodes, r.Start)
 			if err != nil {
 				return err
 			}
 			c.Status(StatusPartialContent).Response().SetBodyStream(lreader.New(dreader, int(r.Length)), int(r.Length))
 		} else {
 			c.Set(fiber.HeaderAcceptRanges, "bytes")
-			dreader, err := driver.NewReader(nodes, 0)
+			dreader, err := driver.NewReaderContext(c.UserContext(), nodes, 0)
 			if err != nil {
 				return err
 			}
@@ -207,3 +246,98 @@ func DownloadFileHandler(driver *ddrv.Driver) fiber.Handler {
 		return err
 	}
 }
+
+// withManifest returns ctx which makes writers embed a manifest of the file into chunk messages,
+// offset is the position the write starts at.
+func withManifest(ctx context.Context, fid string, offset int64) (context.Context, error) {
+	p, err := dp.Path(fid)
+	if err != nil {
+		return nil, err
+	}
+	return ddrv.WithManifest(ctx, fid, p, offset, 0), nil
+}
+
+// The request body is read ahead of the upload by up to bodyReadahead blocks of bodyBlockSize bytes
+const (
+	bodyReadahead = 4
+	bodyBlockSize = 32 * 1024
+)
+
+// bodyReader reads the request body in background, ahead of the upload. fasthttp does not report closed
+// connections, so this is how a client which disconnects while a chunk is uploaded is noticed.
+// cancel is called as soon as the body can not be read till the end.
+type bodyReader struct {
+	conn   net.Conn
+	blocks chan []byte
+	done   chan struct{} // Closed by stop
+	exited chan struct{} // Closed once the body is not read anymore
+	err    error         // Error which ended the body, set before blocks is closed
+	block  []byte
+}
+
+func newBodyReader(c *fiber.Ctx, cancel context.CancelFunc) *bodyReader {
+	b := &bodyReader{
+		conn:   c.Context().Conn(),
+		blocks: make(chan []byte, bodyReadahead),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	go b.readAhead(c.Context().RequestBodyStream(), c.Request().Header.ContentLength(), cancel)
+	return b
+}
+
+func (b *bodyReader) readAhead(body io.Reader, size int, cancel context.CancelFunc) {
+	defer close(b.exited)
+	defer close(b.blocks)
+	read := 0
+	for {
+		buf := make([]byte, bodyBlockSize)
+		n, err := body.Read(buf)
+		read += n
+		// A closed connection ends the body early
+		if err == io.EOF && size >= 0 && read < size {
+			err = io.ErrUnexpectedEOF
+		}
+		if n > 0 {
+			select {
+			case b.blocks <- buf[:n]:
+			case <-b.done:
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				cancel()
+			}
+			b.err = err
+			return
+		}
+	}
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	for len(b.block) == 0 {
+		block, ok := <-b.blocks
+		if !ok {
+			return 0, b.err
+		}
+		b.block = block
+	}
+	n := copy(p, b.block)
+	b.block = b.block[n:]
+	return n, nil
+}
+
+// stop stops reading the body, it must be called before the handler returns
+func (b *bodyReader) stop() {
+	close(b.done)
+	select {
+	case <-b.exited:
+		return
+	default:
+	}
+	// Unblock the pending read, the rest of the body is not read anyway
+	_ = b.conn.SetReadDeadline(time.Now())
+	<-b.exited
+	_ = b.conn.SetReadDeadline(time.Time{})
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"context"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+
+	dp "github.com/forscht/ddrv/internal/dataprovider"
+	"github.com/forscht/ddrv/pkg/ddrv"
+)
+
+// scrub holds state of the scrub started through the api, only one scrub runs at a time
+var scrub struct {
+	sync.Mutex
+	running bool
+	report  *dp.ScrubReport
+	err     error
+}
+
+// StartScrubHandler starts verifying every stored chunk in background, progress is reported by GetScrubHandler.
+func StartScrubHandler(driver *ddrv.Driver) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		req := new(ScrubRequest)
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(req); err != nil {
+				return fiber.NewError(StatusBadRequest, ErrBadRequest)
+			}
+		}
+		scrub.Lock()
+		defer scrub.Unlock()
+		if scrub.running {
+			return fiber.NewError(StatusConflict, ErrScrubRunning)
+		}
+		scrub.running = true
+		go func() {
+			report, err := dp.Scrub(context.Background(), driver, dp.ScrubOptions{Full: req.Full, Mark: req.Mark})
+			if err != nil {
+				log.Error().Str("c", "api").Err(err).Msg("scrub failed")
+			}
+			scrub.Lock()
+			defer scrub.Unlock()
+			scrub.running, scrub.report, scrub.err = false, report, err
+		}()
+		return c.Status(StatusAccepted).
+			JSON(Response{Message: "scrub started"})
+	}
+}
+
+// GetScrubHandler reports whether a scrub is running, the report of the last scrub and files marked damaged.
+func GetScrubHandler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		damaged, err := dp.DamagedFiles()
+		if err != nil {
+			return err
+		}
+		scrub.Lock()
+		status := ScrubStatus{Running: scrub.running, Report: scrub.report, Damaged: damaged}
+		if scrub.err != nil {
+			status.Error = scrub.err.Error()
+		}
+		scrub.Unlock()
+		return c.Status(StatusOk).
+			JSON(Response{Message: "scrub status retrieved", Data: status})
+	}
+}
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+
+	dp "github.com/forscht/ddrv/internal/dataprovider"
+	"github.com/forscht/ddrv/pkg/ddrv"
+	"github.com/forscht/ddrv/pkg/ns"
+)
+
+// uploading holds ids of sessions with an upload in progress
+var uploading sync.Map
+
+// CreateSessionHandler creates an empty file and an upload session for it.
+func CreateSessionHandler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		dirId := c.Params("dirId")
+
+		file := new(dp.File)
+		if err := c.BodyParser(file); err != nil {
+			return fiber.NewError(StatusBadRequest, ErrBadRequest)
+		}
+		file.Parent = ns.NullString(dirId)
+		if err := validate.Struct(file); err != nil {
+			return fiber.NewError(StatusBadRequest, err.Error())
+		}
+
+		file, err := dp.Create(file.Name, dirId, false)
+		if err != nil {
+			if errors.Is(err, dp.ErrExist) || err == dp.ErrInvalidParent {
+				return fiber.NewError(StatusBadRequest, err.Error())
+			}
+			return err
+		}
+		session, err := dp.CreateSession(file.Id)
+		if err != nil {
+			return err
+		}
+		return c.Status(StatusCreated).
+			JSON(Response{Message: "session created", Data: session})
+	}
+}
+
+func GetSessionHandler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		session, err := dp.GetSession(c.Params("id"))
+		if err != nil {
+			if errors.Is(err, dp.ErrNotExist) {
+				return fiber.NewError(StatusNotFound, err.Error())
+			}
+			return err
+		}
+		return c.Status(StatusOk).
+			JSON(Response{Message: "session retrieved", Data: session})
+	}
+}
+
+// UploadSessionHandler appends the request body to the session. Upload-Offset header must match
+// the session size, so a client resumes an interrupted upload from the size reported by the session.
+// Every chunk is recorded as soon as it is written to discord.
+func UploadSessionHandler(driver *ddrv.Driver) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id := c.Params("id")
+
+		if _, busy := uploading.LoadOrStore(id, true); busy {
+			return fiber.NewError(StatusConflict, ErrSessionBusy)
+		}
+		defer uploading.Delete(id)
+
+		session, err := dp.GetSession(id)
+		if err != nil {
+			if errors.Is(err, dp.ErrNotExist) {
+				return fiber.NewError(StatusNotFound, err.Error())
+			}
+			return err
+		}
+		offset, err := strconv.ParseInt(c.Get(HeaderUploadOffset), 10, 64)
+		if err != nil {
+			return fiber.NewError(StatusBadRequest, ErrBadRequest)
+		}
+		if offset != session.Size {
+			c.Set(HeaderUploadOffset, strconv.FormatInt(session.Size, 10))
+			return fiber.NewError(StatusConflict, ErrSessionOffset)
+		}
+
+		// Cancel in-flight uploads if the request body can not be read till the end, e.g. the client disconnects,
+		// or a chunk can not be recorded, chunks recorded so far are kept
+		ctx, cancel := context.WithCancel(c.UserContext())
+		defer cancel()
+		body := newBodyReader(c, cancel)
+		defer body.stop()
+		var recordErr error
+		onChunk := func(chunk ddrv.Node) {
+			if recordErr != nil {
+				return
+			}
+			if recordErr = dp.AppendSession(id, chunk); recordErr != nil {
+				cancel()
+			}
+		}
+		if ctx, err = withManifest(ctx, session.File, session.Size); err != nil {
+			return err
+		}
+		var dwriter io.WriteCloser
+		if c.Locals("asyncwrite").(bool) {
+			dwriter = driver.NewNWriterContext(ctx, onChunk)
+		} else {
+			dwriter = driver.NewWriterContext(ctx, onChunk)
+		}
+
+		if _, err = io.Copy(dwriter, body); err != nil {
+			cancel()
+			_ = dwriter.Close()
+			return err
+		}
+		if err = dwriter.Close(); err != nil {
+			return err
+		}
+		if recordErr != nil {
+			return recordErr
+		}
+
+		if session, err = dp.GetSession(id); err != nil {
+			return err
+		}
+		c.Set(HeaderUploadOffset, strconv.FormatInt(session.Size, 10))
+		return c.Status(StatusOk).
+			JSON(Response{Message: "session updated", Data: session})
+	}
+}
+
+// CommitSessionHandler appends the uploaded data to the file and removes the session.
+func CommitSessionHandler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id := c.Params("id")
+
+		if _, busy := uploading.Load(id); busy {
+			return fiber.NewError(StatusConflict, ErrSessionBusy)
+		}
+		session, err := dp.GetSession(id)
+		if err != nil {
+			if errors.Is(err, dp.ErrNotExist) {
+				return fiber.NewError(StatusNotFound, err.Error())
+			}
+			return err
+		}
+		if err = dp.CommitSession(id); err != nil {
+			if errors.Is(err, dp.ErrNotExist) {
+				return fiber.NewError(StatusNotFound, err.Error())
+			}
+			return err
+		}
+		file, err := dp.Get(session.File, "")
+		if err != nil {
+			return err
+		}
+		return c.Status(StatusOk).
+			JSON(Response{Message: "session committed", Data: file})
+	}
+}
+
+// DelSessionHandler aborts the upload, messages of its chunks are queued for deletion.
+func DelSessionHandler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id := c.Params("id")
+
+		if _, busy := uploading.Load(id); busy {
+			return fiber.NewError(StatusConflict, ErrSessionBusy)
+		}
+		if err := dp.DeleteSession(id); err != nil {
+			if errors.Is(err, dp.ErrNotExist) {
+				return fiber.NewError(StatusNotFound, err.Error())
+			}
+			return err
+		}
+		return c.Status(StatusOk).
+			JSON(Response{Message: "session deleted"})
+	}
+}
@@ -0,0 +1,21 @@
+package api
+
+import (
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/forscht/ddrv/pkg/ddrv"
+)
+
+// StatusHandler reports health of discord tokens, evicted tokens are not used until they pass a probe,
+// and how long requests waited for discord rate limits.
+func StatusHandler(driver *ddrv.Driver) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var status Status
+		// Chunks may be stored without discord
+		if driver.Rest != nil {
+			status = Status{Tokens: driver.Rest.TokenStatus(), Limiter: driver.Rest.LimiterStats()}
+		}
+		return c.Status(StatusOk).
+			JSON(Response{Message: "status retrieved", Data: status})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/gofiber/fiber/v2"
 
 	dp "github.com/forscht/ddrv/internal/dataprovider"
+	"github.com/forscht/ddrv/pkg/ddrv"
 )
 
 const (
@@ -15,12 +16,26 @@ const (
 	StatusForbidden           = fiber.StatusForbidden
 	StatusUnauthorized        = fiber.StatusUnauthorized
 	StatusCreated             = fiber.StatusCreated
+	StatusConflict            = fiber.StatusConflict
+	StatusAccepted            = fiber.StatusAccepted
 )
 
+// HeaderDigest carries the SHA-256 of the file content, it is only set for files written in one go
+const HeaderDigest = "X-Ddrv-Digest"
+
+// HeaderChunkDigest carries the SHA-256 of the concatenated hex checksums of the file chunks, see ddrv.ChunkDigest
+const HeaderChunkDigest = "X-Ddrv-Chunk-Digest"
+
+// HeaderUploadOffset carries the offset an upload session is continued from
+const HeaderUploadOffset = "Upload-Offset"
+
 const (
 	ErrBadRequest          = "bad request body"
 	ErrUnauthorized        = "authorization failed"
 	ErrBadUsernamePassword = "invalid username or password"
+	ErrSessionOffset       = "upload offset does not match session size"
+	ErrSessionBusy         = "session is already being uploaded to"
+	ErrScrubRunning        = "scrub is already running"
 )
 
 type Response struct {
@@ -37,3 +52,20 @@ type Directory struct {
 	*dp.File
 	Files []*dp.File `json:"files"`
 }
+
+type Status struct {
+	Tokens  []ddrv.TokenStatus `json:"tokens"`
+	Limiter ddrv.LimiterStats  `json:"limiter"`
+}
+
+type ScrubRequest struct {
+	Full bool `json:"full"`
+	Mark bool `json:"mark"`
+}
+
+type ScrubStatus struct {
+	Running bool            `json:"running"`
+	Report  *dp.ScrubReport `json:"report,omitempty"` // Report of the last finished scrub
+	Error   string          `json:"error,omitempty"`  // Error which stopped the last scrub
+	Damaged []*dp.Damage    `json:"damaged"`          // Files marked damaged
+}
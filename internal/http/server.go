@@ -25,7 +25,33 @@ type Config struct {
 }
 
 func Serv(driver *ddrv.Driver, cfg *Config) error {
+	app := New(driver, cfg)
 
+	// Error channel to capture any listen errors
+	errChan := make(chan error)
+
+	// Listen on HTTP
+	go func() {
+		if cfg.Addr != "" {
+			log.Info().Str("c", "http").Str("addr", cfg.Addr).Msg("starting http server")
+			errChan <- app.Listen(cfg.Addr)
+		}
+	}()
+
+	// Listen on HTTPS
+	go func() {
+		if cfg.HTTPSAddr != "" && cfg.HTTPSCrtPath != "" && cfg.HTTPSKeyPath != "" {
+			log.Info().Str("c", "http").Str("addr", cfg.HTTPSAddr).Msg("starting https server")
+			errChan <- app.ListenTLS(cfg.HTTPSAddr, cfg.HTTPSCrtPath, cfg.HTTPSKeyPath)
+		}
+	}()
+
+	// Return the first error received
+	return <-errChan
+}
+
+// New creates the fiber app serving web and API routes, without starting a listener.
+func New(driver *ddrv.Driver, cfg *Config) *fiber.App {
 	fconfig := fiber.Config{
 		DisablePreParseMultipartForm: true, // https://github.com/gofiber/fiber/issues/1838
 		StreamRequestBody:            true,
@@ -72,25 +98,5 @@ func Serv(driver *ddrv.Driver, cfg *Config) error {
 	// Register API routes
 	api.Load(app, driver)
 
-	// Error channel to capture any listen errors
-	errChan := make(chan error)
-
-	// Listen on HTTP
-	go func() {
-		if cfg.Addr != "" {
-			log.Info().Str("c", "http").Str("addr", cfg.Addr).Msg("starting http server")
-			errChan <- app.Listen(cfg.Addr)
-		}
-	}()
-
-	// Listen on HTTPS
-	go func() {
-		if cfg.HTTPSAddr != "" && cfg.HTTPSCrtPath != "" && cfg.HTTPSKeyPath != "" {
-			log.Info().Str("c", "http").Str("addr", cfg.HTTPSAddr).Msg("starting https server")
-			errChan <- app.ListenTLS(cfg.HTTPSAddr, cfg.HTTPSCrtPath, cfg.HTTPSKeyPath)
-		}
-	}()
-
-	// Return the first error received
-	return <-errChan
+	return app
 }
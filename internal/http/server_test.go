@@ -0,0 +1,408 @@
+package http_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	dp "github.com/forscht/ddrv/internal/dataprovider"
+	"github.com/forscht/ddrv/internal/dataprovider/boltdb"
+	ddrvhttp "github.com/forscht/ddrv/internal/http"
+	"github.com/forscht/ddrv/internal/http/api"
+	"github.com/forscht/ddrv/pkg/ddrv"
+	"github.com/forscht/ddrv/pkg/ddrv/ddrvtest"
+)
+
+func newApp(t *testing.T, asyncWrite, dedup bool) (*fiber.App, *ddrvtest.Server) {
+	t.Helper()
+	s := ddrvtest.NewServer()
+	t.Cleanup(s.Close)
+	cfg := s.Config(1024, "1", "2", "3")
+	cfg.Prefetch = 2
+	driver, err := ddrv.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := boltdb.New(driver, &boltdb.Config{DbPath: filepath.Join(t.TempDir(), "ddrv.db")})
+	t.Cleanup(func() { _ = provider.Close() })
+	dp.Load(provider)
+	if dedup {
+		driver.Lookup = dp.Lookup
+	}
+	return ddrvhttp.New(driver, &ddrvhttp.Config{AsyncWrite: asyncWrite}), s
+}
+
+func do(t *testing.T, app *fiber.App, req *http.Request, wantStatus int) *http.Response {
+	t.Helper()
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != wantStatus {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("%s %s: status %d, want %d: %s", req.Method, req.URL, resp.StatusCode, wantStatus, body)
+	}
+	return resp
+}
+
+func root(t *testing.T, app *fiber.App) string {
+	t.Helper()
+	dir := new(api.Directory)
+	decode(t, do(t, app, httptest.NewRequest(http.MethodGet, "/api/directories/", nil), http.StatusOK), dir)
+	return dir.Id
+}
+
+func decode(t *testing.T, resp *http.Response, v interface{}) {
+	t.Helper()
+	var body struct {
+		api.Response
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(body.Data, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func upload(t *testing.T, app *fiber.App, dirId, name string, data []byte) *dp.File {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = part.Write(data)
+	_ = mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/api/directories/"+dirId+"/files", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	file := new(dp.File)
+	decode(t, do(t, app, req, http.StatusOK), file)
+	return file
+}
+
+func sha256sum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestFiles(t *testing.T) {
+	for _, asyncWrite := range []bool{false, true} {
+		app, _ := newApp(t, asyncWrite, false)
+
+		req := httptest.NewRequest(http.MethodPost, "/api/directories/",
+			bytes.NewBufferString(`{"name":"docs","parent":"`+root(t, app)+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		dir := new(dp.File)
+		decode(t, do(t, app, req, http.StatusCreated), dir)
+
+		data := make([]byte, 5000)
+		_, _ = rand.Read(data)
+		file := upload(t, app, dir.Id, "hello.bin", data)
+		if file.Size != int64(len(data)) {
+			t.Errorf("uploaded file size %d, want %d", file.Size, len(data))
+		}
+
+		resp := do(t, app, httptest.NewRequest(http.MethodGet, "/files/"+file.Id, nil), http.StatusOK)
+		if got, _ := io.ReadAll(resp.Body); !bytes.Equal(got, data) {
+			t.Errorf("download returned %d bytes, want %d equal bytes", len(got), len(data))
+		}
+		if digest, want := resp.Header.Get(api.HeaderDigest), "sha256="+sha256sum(data); digest != want {
+			t.Errorf("%s = %q, want %q", api.HeaderDigest, digest, want)
+		}
+		if digest := resp.Header.Get(api.HeaderChunkDigest); !strings.HasPrefix(digest, "sha256=") {
+			t.Errorf("%s = %q", api.HeaderChunkDigest, digest)
+		}
+
+		req = httptest.NewRequest(http.MethodGet, "/files/"+file.Id+"/hello.bin", nil)
+		req.Header.Set("Range", "bytes=1000-2999")
+		resp = do(t, app, req, http.StatusPartialContent)
+		if got, _ := io.ReadAll(resp.Body); !bytes.Equal(got, data[1000:3000]) {
+			t.Errorf("range download returned %d bytes, want %d equal bytes", len(got), 2000)
+		}
+		if cr := resp.Header.Get("Content-Range"); cr != "bytes 1000-2999/5000" {
+			t.Errorf("Content-Range = %s", cr)
+		}
+
+		do(t, app, httptest.NewRequest(http.MethodDelete, "/api/directories/"+dir.Id+"/files/"+file.Id, nil), http.StatusOK)
+		do(t, app, httptest.NewRequest(http.MethodGet, "/files/"+file.Id, nil), http.StatusNotFound)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	for _, asyncWrite := range []bool{false, true} {
+		app, s := newApp(t, asyncWrite, true)
+		rootId := root(t, app)
+		data := make([]byte, 5000)
+		_, _ = rand.Read(data)
+
+		first := upload(t, app, rootId, "a.bin", data)
+		uploads := s.Stats().Uploads
+		second := upload(t, app, rootId, "b.bin", data)
+		if got := s.Stats().Uploads - uploads; got != 0 {
+			t.Fatalf("uploading same content again created %d attachments, want 0", got)
+		}
+
+		// Shared chunks stay alive while second file points at them
+		do(t, app, httptest.NewRequest(http.MethodDelete, "/api/directories/"+rootId+"/files/"+first.Id, nil), http.StatusOK)
+		resp := do(t, app, httptest.NewRequest(http.MethodGet, "/files/"+second.Id, nil), http.StatusOK)
+		if got, _ := io.ReadAll(resp.Body); !bytes.Equal(got, data) {
+			t.Errorf("download of deduplicated file returned %d bytes, want %d equal bytes", len(got), len(data))
+		}
+		third := upload(t, app, rootId, "c.bin", data)
+		if got := s.Stats().Uploads - uploads; got != 0 {
+			t.Errorf("uploading content still referenced created %d attachments, want 0", got)
+		}
+
+		// Once no file references the chunks, they are uploaded again
+		do(t, app, httptest.NewRequest(http.MethodDelete, "/api/directories/"+rootId+"/files/"+second.Id, nil), http.StatusOK)
+		do(t, app, httptest.NewRequest(http.MethodDelete, "/api/directories/"+rootId+"/files/"+third.Id, nil), http.StatusOK)
+		upload(t, app, rootId, "d.bin", data)
+		if got := s.Stats().Uploads - uploads; got != 5 {
+			t.Errorf("uploading unreferenced content created %d attachments, want 5", got)
+		}
+	}
+}
+
+func patch(t *testing.T, app *fiber.App, id string, offset int, data []byte, wantStatus int) *dp.Session {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPatch, "/api/sessions/"+id, bytes.NewReader(data))
+	req.Header.Set(api.HeaderUploadOffset, strconv.Itoa(offset))
+	resp := do(t, app, req, wantStatus)
+	if wantStatus != http.StatusOK {
+		return nil
+	}
+	session := new(dp.Session)
+	decode(t, resp, session)
+	return session
+}
+
+func TestSessions(t *testing.T) {
+	for _, asyncWrite := range []bool{false, true} {
+		app, s := newApp(t, asyncWrite, false)
+		rootId := root(t, app)
+		data := make([]byte, 5000)
+		_, _ = rand.Read(data)
+
+		req := httptest.NewRequest(http.MethodPost, "/api/directories/"+rootId+"/sessions", bytes.NewBufferString(`{"name":"big.bin"}`))
+		req.Header.Set("Content-Type", "application/json")
+		session := new(dp.Session)
+		decode(t, do(t, app, req, http.StatusCreated), session)
+
+		// Upload is continued from the size recorded by the session
+		if got := patch(t, app, session.Id, 0, data[:2048], http.StatusOK); got.Size != 2048 {
+			t.Errorf("session size %d after first part, want 2048", got.Size)
+		}
+		patch(t, app, session.Id, 1000, data[2048:], http.StatusConflict)
+		got := new(dp.Session)
+		decode(t, do(t, app, httptest.NewRequest(http.MethodGet, "/api/sessions/"+session.Id, nil), http.StatusOK), got)
+		if got.Size != 2048 {
+			t.Fatalf("session size %d, want 2048", got.Size)
+		}
+		patch(t, app, session.Id, int(got.Size), data[got.Size:], http.StatusOK)
+
+		file := new(dp.File)
+		decode(t, do(t, app, httptest.NewRequest(http.MethodPost, "/api/sessions/"+session.Id+"/commit", nil), http.StatusOK), file)
+		if file.Size != int64(len(data)) {
+			t.Errorf("committed file size %d, want %d", file.Size, len(data))
+		}
+		resp := do(t, app, httptest.NewRequest(http.MethodGet, "/files/"+file.Id, nil), http.StatusOK)
+		if got, _ := io.ReadAll(resp.Body); !bytes.Equal(got, data) {
+			t.Errorf("download of committed session returned %d bytes, want %d equal bytes", len(got), len(data))
+		}
+		do(t, app, httptest.NewRequest(http.MethodGet, "/api/sessions/"+session.Id, nil), http.StatusNotFound)
+
+		// Messages of aborted session are queued for deletion
+		messages := func() int { return len(s.Messages("1")) + len(s.Messages("2")) + len(s.Messages("3")) }
+		before := messages()
+		req = httptest.NewRequest(http.MethodPost, "/api/directories/"+rootId+"/sessions", bytes.NewBufferString(`{"name":"aborted.bin"}`))
+		req.Header.Set("Content-Type", "application/json")
+		decode(t, do(t, app, req, http.StatusCreated), session)
+		patch(t, app, session.Id, 0, data, http.StatusOK)
+		uploaded := messages() - before
+		do(t, app, httptest.NewRequest(http.MethodDelete, "/api/sessions/"+session.Id, nil), http.StatusOK)
+		if pending, err := dp.PendingDeletions(100); err != nil || len(pending) != uploaded {
+			t.Errorf("PendingDeletions() after aborting session = %d nodes, %v, want %d", len(pending), err, uploaded)
+		}
+	}
+}
+
+func TestPackedUploads(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	cfg := s.Config(1024, "1")
+	cfg.PackThreshold = 512
+	cfg.PackDelay = time.Hour
+	driver, err := ddrv.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := boltdb.New(driver, &boltdb.Config{DbPath: filepath.Join(t.TempDir(), "ddrv.db")})
+	defer provider.Close()
+	dp.Load(provider)
+	app := ddrvhttp.New(driver, &ddrvhttp.Config{})
+	rootId := root(t, app)
+
+	// Uploads of small files return before their packfile is uploaded, the files are kept as upload sessions
+	files := make([]*dp.File, 4)
+	data := make([][]byte, len(files))
+	for i := range files {
+		data[i] = make([]byte, 100)
+		_, _ = rand.Read(data[i])
+		files[i] = upload(t, app, rootId, fmt.Sprintf("%d.bin", i), data[i])
+		if files[i].Size != 100 {
+			t.Errorf("uploaded file size %d, want 100", files[i].Size)
+		}
+		if _, err = dp.GetFileSession(files[i].Id); err != nil {
+			t.Errorf("GetFileSession() of pending file error = %v", err)
+		}
+	}
+	if got := len(s.Messages("1")); got != 0 {
+		t.Fatalf("%d messages before the packfile is flushed, want 0", got)
+	}
+
+	// Closing the driver uploads the packfile and commits the files
+	if err = driver.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if got := len(s.Messages("1")); got != 1 {
+		t.Errorf("%d sequential uploads took %d messages, want 1", len(files), got)
+	}
+	for i, file := range files {
+		if _, err = dp.GetFileSession(file.Id); !errors.Is(err, dp.ErrNotExist) {
+			t.Errorf("GetFileSession() of committed file error = %v, want %v", err, dp.ErrNotExist)
+		}
+		resp := do(t, app, httptest.NewRequest(http.MethodGet, "/files/"+file.Id, nil), http.StatusOK)
+		if got, _ := io.ReadAll(resp.Body); !bytes.Equal(got, data[i]) {
+			t.Errorf("download of packed file %d returned %d bytes, want %d equal bytes", i, len(got), len(data[i]))
+		}
+		if digest, want := resp.Header.Get(api.HeaderDigest), "sha256="+sha256sum(data[i]); digest != want {
+			t.Errorf("%s of packed file %d = %q, want %q", api.HeaderDigest, i, digest, want)
+		}
+	}
+}
+
+func TestUploadDisconnect(t *testing.T) {
+	for name, asyncWrite := range map[string]bool{"sync": false, "async": true} {
+		t.Run(name, func(t *testing.T) {
+			s := ddrvtest.NewServer()
+			defer s.Close()
+			cfg := s.Config(1024, "1")
+			cfg.Retry = ddrv.RetryPolicy{MaxAttempts: 1}
+			// Uploads hang until they are cancelled
+			started, cancelled := make(chan struct{}), make(chan struct{})
+			var start, cancel sync.Once
+			cfg.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				if req.Method == http.MethodPost && strings.HasSuffix(req.URL.Path, "/messages") {
+					start.Do(func() { close(started) })
+					<-req.Context().Done()
+					cancel.Do(func() { close(cancelled) })
+					return nil, req.Context().Err()
+				}
+				return http.DefaultTransport.RoundTrip(req)
+			})
+			driver, err := ddrv.New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			provider := boltdb.New(driver, &boltdb.Config{DbPath: filepath.Join(t.TempDir(), "ddrv.db")})
+			defer provider.Close()
+			dp.Load(provider)
+			app := ddrvhttp.New(driver, &ddrvhttp.Config{AsyncWrite: asyncWrite})
+			rootId := root(t, app)
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go func() { _ = app.Listener(ln) }()
+			defer func() { _ = app.ShutdownWithTimeout(5 * time.Second) }()
+
+			// The client sends a part of the file and disconnects while the first chunk is uploaded
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			part := "--ddrv\r\nContent-Disposition: form-data; name=\"file\"; filename=\"a.bin\"\r\n" +
+				"Content-Type: application/octet-stream\r\n\r\n"
+			_, _ = fmt.Fprintf(conn, "POST /api/directories/%s/files HTTP/1.1\r\nHost: ddrv\r\n"+
+				"Content-Type: multipart/form-data; boundary=ddrv\r\nContent-Length: %d\r\n\r\n%s", rootId, len(part)+100000, part)
+			// More than fasthttp reads before the handler is called
+			data := make([]byte, 20000)
+			_, _ = rand.Read(data)
+			_, _ = conn.Write(data)
+			select {
+			case <-started:
+			case <-time.After(5 * time.Second):
+				t.Fatal("upload did not start")
+			}
+			_ = conn.Close()
+			select {
+			case <-cancelled:
+			case <-time.After(5 * time.Second):
+				t.Fatal("upload was not cancelled after the client disconnected")
+			}
+		})
+	}
+}
+
+func TestStatus(t *testing.T) {
+	app, s := newApp(t, false, false)
+
+	status := new(api.Status)
+	decode(t, do(t, app, httptest.NewRequest(http.MethodGet, "/api/status", nil), http.StatusOK), status)
+	if len(status.Tokens) != 1 || status.Tokens[0].State != ddrv.TokenHealthy {
+		t.Fatalf("status tokens = %+v, want one healthy token", status.Tokens)
+	}
+	if strings.Contains(status.Tokens[0].Token, s.Token) {
+		t.Errorf("status token = %s, want masked token", status.Tokens[0].Token)
+	}
+}
+
+// roundTripFunc implements http.RoundTripper with a function
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestScrub(t *testing.T) {
+	app, _ := newApp(t, false, false)
+	rootId := root(t, app)
+	data := make([]byte, 2500)
+	_, _ = rand.Read(data)
+	upload(t, app, rootId, "a.bin", data)
+	upload(t, app, rootId, "b.bin", data[:1000])
+
+	do(t, app, httptest.NewRequest(http.MethodPost, "/api/scrub", nil), http.StatusAccepted)
+	var status api.ScrubStatus
+	for i := 0; i < 100; i++ {
+		decode(t, do(t, app, httptest.NewRequest(http.MethodGet, "/api/scrub", nil), http.StatusOK), &status)
+		if !status.Running {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if status.Running || status.Report == nil || status.Report.Files != 2 || len(status.Report.Damaged) != 0 || len(status.Damaged) != 0 {
+		t.Errorf("scrub status = %+v, want finished scrub of 2 files without damaged files", status)
+	}
+}
@@ -0,0 +1,340 @@
+package ddrv
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	CipherAES256GCM         = "aes-256-gcm"
+	CipherXChaCha20Poly1305 = "xchacha20-poly1305"
+)
+
+// EncBlockSize is the plaintext size of each sealed block of an encrypted chunk.
+// Chunks are sealed block by block, so range reads only need to fetch and
+// decrypt the blocks that contain the requested range.
+const EncBlockSize = 64 * 1024
+
+// ivSize is the size of random per chunk value used to derive the chunk key
+const ivSize = 16
+
+// saltSize is the size of salts generated by NewSalt
+const saltSize = 16
+
+// ErrNoPassphrase is returned when reading an encrypted chunk without a configured passphrase
+var ErrNoPassphrase = errors.New("chunk is encrypted but no passphrase is configured")
+
+// crypter encrypts and decrypts chunks. Every chunk is encrypted with its own key derived from the
+// master key and the chunk iv. Chunk plaintext is split into EncBlockSize blocks, each block is sealed
+// with its index as nonce and a flag marking the last block as additional data, so blocks cannot be
+// reordered and truncation is detected.
+type crypter struct {
+	name   string
+	master []byte
+}
+
+// NewSalt returns a new random hex encoded salt for Config.Salt
+func NewSalt() (string, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(salt), nil
+}
+
+// newCrypter derives the master key from the passphrase and the hex encoded salt
+func newCrypter(passphrase, name, salt string) (*crypter, error) {
+	if name == "" {
+		name = CipherAES256GCM
+	}
+	if name != CipherAES256GCM && name != CipherXChaCha20Poly1305 {
+		return nil, fmt.Errorf("unsupported cipher %s", name)
+	}
+	if salt == "" {
+		return nil, errors.New("passphrase is set without a salt, generate one with NewSalt")
+	}
+	raw, err := hex.DecodeString(salt)
+	if err != nil || len(raw) < saltSize {
+		return nil, fmt.Errorf("salt must be at least %d hex encoded bytes", saltSize)
+	}
+	master, err := scrypt.Key([]byte(passphrase), raw, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	return &crypter{name: name, master: master}, nil
+}
+
+// aead returns the AEAD of the chunk with given iv
+func (c *crypter) aead(iv []byte) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, c.master, iv, []byte(c.name)), key); err != nil {
+		return nil, err
+	}
+	if c.name == CipherXChaCha20Poly1305 {
+		return chacha20poly1305.NewX(key)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// overhead returns the number of bytes added to every sealed block
+func (c *crypter) overhead() int {
+	// Both AES-GCM and XChaCha20-Poly1305 use 16 bytes tag
+	return 16
+}
+
+// sealedSize returns the encrypted size of n plaintext bytes.
+func (c *crypter) sealedSize(n int) int {
+	blocks := (n + EncBlockSize - 1) / EncBlockSize
+	if blocks == 0 {
+		blocks = 1 // empty chunk is still sealed as one empty block
+	}
+	return n + blocks*c.overhead()
+}
+
+// plainSize returns the plaintext size of n encrypted bytes.
+func (c *crypter) plainSize(n int) int {
+	sealedBlock := EncBlockSize + c.overhead()
+	size := (n / sealedBlock) * EncBlockSize
+	if rem := n % sealedBlock; rem > c.overhead() {
+		size += rem - c.overhead()
+	}
+	return size
+}
+
+// maxPlainSize returns the largest plaintext chunk whose encrypted size fits into n bytes.
+func (c *crypter) maxPlainSize(n int) int {
+	size := c.plainSize(n)
+	for size > 0 && c.sealedSize(size) > n {
+		size--
+	}
+	return size
+}
+
+// sealedRange maps the plaintext range start-end of a chunk with size plaintext bytes to the range of
+// sealed blocks holding it. It returns the ciphertext range, the index of the first block and the
+// number of plaintext bytes to skip in the first block.
+func (c *crypter) sealedRange(start, end, size int) (cstart, cend, first, skip int) {
+	sealedBlock := EncBlockSize + c.overhead()
+	first = start / EncBlockSize
+	skip = start % EncBlockSize
+	cstart = first * sealedBlock
+	cend = (end/EncBlockSize+1)*sealedBlock - 1
+	if max := c.sealedSize(size) - 1; cend > max {
+		cend = max
+	}
+	return cstart, cend, first, skip
+}
+
+// lastBlock returns the index of the last sealed block of a chunk with size plaintext bytes
+func lastBlock(size int) int {
+	if size == 0 {
+		return 0
+	}
+	return (size - 1) / EncBlockSize
+}
+
+// newIv returns a new random chunk iv encoded as hex
+func (c *crypter) newIv() (string, error) {
+	iv := make([]byte, ivSize)
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(iv), nil
+}
+
+// encrypt returns a reader which reads sealed blocks of plaintext read from r
+func (c *crypter) encrypt(r io.Reader, iv string) (io.Reader, error) {
+	aead, err := c.chunkAEAD(iv)
+	if err != nil {
+		return nil, err
+	}
+	return &encrypter{r: r, aead: aead, next: make([]byte, 0, EncBlockSize)}, nil
+}
+
+// decrypt returns a reader which opens sealed blocks read from rc and returns n plaintext bytes.
+// rc must start at the beginning of the block with index first, last is the index of the last block
+// in the chunk and skip is the number of plaintext bytes to drop from the first block.
+func (c *crypter) decrypt(rc io.ReadCloser, iv string, first, last, skip, n int) (io.ReadCloser, error) {
+	aead, err := c.chunkAEAD(iv)
+	if err != nil {
+		return nil, err
+	}
+	return &decrypter{
+		rc:     rc,
+		aead:   aead,
+		block:  uint32(first),
+		last:   uint32(last),
+		skip:   skip,
+		remain: n,
+		buf:    make([]byte, EncBlockSize+c.overhead()),
+	}, nil
+}
+
+func (c *crypter) chunkAEAD(iv string) (cipher.AEAD, error) {
+	raw, err := hex.DecodeString(iv)
+	if err != nil || len(raw) != ivSize {
+		return nil, fmt.Errorf("invalid chunk iv %q", iv)
+	}
+	return c.aead(raw)
+}
+
+// manifestBlock is the nonce index manifests are sealed with, chunks never have that many blocks
+const manifestBlock = math.MaxUint32
+
+// sealManifest seals the manifest of the chunk with the chunk key, additional data tells it apart from blocks
+func (c *crypter) sealManifest(iv string, data []byte) ([]byte, error) {
+	aead, err := c.chunkAEAD(iv)
+	if err != nil {
+		return nil, err
+	}
+	nonce, _ := blockNonce(aead, manifestBlock, false)
+	return aead.Seal(nil, nonce, data, []byte{2}), nil
+}
+
+// openManifest opens a manifest sealed by sealManifest
+func (c *crypter) openManifest(iv string, sealed []byte) ([]byte, error) {
+	aead, err := c.chunkAEAD(iv)
+	if err != nil {
+		return nil, err
+	}
+	nonce, _ := blockNonce(aead, manifestBlock, false)
+	data, err := aead.Open(nil, nonce, sealed, []byte{2})
+	if err != nil {
+		return nil, fmt.Errorf("open manifest : %w", err)
+	}
+	return data, nil
+}
+
+// blockNonce returns the nonce and additional data of the block at idx
+func blockNonce(aead cipher.AEAD, idx uint32, last bool) ([]byte, []byte) {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint32(nonce[len(nonce)-4:], idx)
+	ad := []byte{0}
+	if last {
+		ad[0] = 1
+	}
+	return nonce, ad
+}
+
+type encrypter struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	block uint32
+	next  []byte // plaintext of the next block, read ahead to detect the last block
+	out   []byte // sealed bytes not yet returned
+	done  bool
+	err   error
+}
+
+func (e *encrypter) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if e.err != nil {
+			return 0, e.err
+		}
+		if err := e.seal(); err != nil {
+			e.err = err
+		}
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// seal seals the next block into e.out
+func (e *encrypter) seal() error {
+	if e.block == 0 && len(e.next) == 0 {
+		if err := e.fill(&e.next); err != nil {
+			return err
+		}
+	}
+	cur := e.next
+	e.next = make([]byte, 0, EncBlockSize)
+	if len(cur) == EncBlockSize {
+		if err := e.fill(&e.next); err != nil {
+			return err
+		}
+	}
+	last := len(e.next) == 0
+	nonce, ad := blockNonce(e.aead, e.block, last)
+	e.out = e.aead.Seal(nil, nonce, cur, ad)
+	e.block++
+	e.done = last
+	return nil
+}
+
+// fill reads up to EncBlockSize bytes into buf
+func (e *encrypter) fill(buf *[]byte) error {
+	n, err := io.ReadFull(e.r, (*buf)[:EncBlockSize])
+	*buf = (*buf)[:n]
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil
+	}
+	return err
+}
+
+type decrypter struct {
+	rc     io.ReadCloser
+	aead   cipher.AEAD
+	block  uint32
+	last   uint32
+	skip   int
+	remain int // plaintext bytes left to return
+	buf    []byte
+	out    []byte
+}
+
+func (d *decrypter) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.remain <= 0 || d.block > d.last {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(d.rc, d.buf)
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		nonce, ad := blockNonce(d.aead, d.block, d.block == d.last)
+		plain, err := d.aead.Open(d.buf[:0], nonce, d.buf[:n], ad)
+		if err != nil {
+			return 0, fmt.Errorf("decrypt chunk block %d : %v", d.block, err)
+		}
+		if d.skip > len(plain) {
+			return 0, fmt.Errorf("decrypt chunk block %d : invalid offset", d.block)
+		}
+		d.out = plain[d.skip:]
+		if len(d.out) > d.remain {
+			d.out = d.out[:d.remain]
+		}
+		d.remain -= len(d.out)
+		d.skip = 0
+		d.block++
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+func (d *decrypter) Close() error {
+	return d.rc.Close()
+}
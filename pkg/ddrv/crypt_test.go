@@ -0,0 +1,147 @@
+package ddrv_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/forscht/ddrv/pkg/ddrv"
+	"github.com/forscht/ddrv/pkg/ddrv/ddrvtest"
+)
+
+func TestEncryption(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+
+	for _, cipher := range []string{ddrv.CipherAES256GCM, ddrv.CipherXChaCha20Poly1305} {
+		t.Run(cipher, func(t *testing.T) {
+			cfg := s.Config(200000, "1", "2", "3")
+			cfg.Passphrase = "secret"
+			cfg.Cipher = cipher
+			driver := newDriver(t, cfg)
+			if driver.ChunkSize >= 200000 {
+				t.Fatalf("chunk size %d does not leave room for encryption overhead", driver.ChunkSize)
+			}
+			data := randBytes(t, 500000)
+
+			var nodes []ddrv.Node
+			write(t, driver.NewNWriter(func(chunk ddrv.Node) { nodes = append(nodes, chunk) }), data)
+			var size int
+			for _, node := range nodes {
+				if node.Iv == "" {
+					t.Fatal("chunk was uploaded without iv")
+				}
+				size += node.Size
+			}
+			if size != len(data) {
+				t.Fatalf("chunks hold %d bytes, want %d", size, len(data))
+			}
+			for _, pos := range []int64{0, 1, ddrv.EncBlockSize - 1, ddrv.EncBlockSize, 199990, 300000, int64(len(data)) - 1} {
+				if got := read(t, driver, nodes, pos); !bytes.Equal(got, data[pos:]) {
+					t.Errorf("read at %d: got %d bytes, want %d equal bytes", pos, len(got), len(data[pos:]))
+				}
+			}
+
+			r, err := driver.Rest.ReadAttachment(&nodes[0], 70000, 140000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			_ = r.Close()
+			if err != nil || !bytes.Equal(got, data[70000:140001]) {
+				t.Errorf("ReadAttachment() range returned %d bytes, err %v", len(got), err)
+			}
+
+			plain := newDriver(t, s.Config(200000, "1", "2", "3"))
+			if _, err = plain.Rest.ReadAttachment(&nodes[0], 0, nodes[0].Size-1); err != ddrv.ErrNoPassphrase {
+				t.Errorf("ReadAttachment() without passphrase error = %v, want %v", err, ddrv.ErrNoPassphrase)
+			}
+			cfg = s.Config(200000, "1", "2", "3")
+			cfg.Passphrase = "wrong"
+			cfg.Cipher = cipher
+			r, err = newDriver(t, cfg).NewReader(nodes, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = io.ReadAll(r); err == nil {
+				t.Error("read with wrong passphrase succeeded")
+			}
+		})
+	}
+}
+
+func TestEncryptionSalt(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	salted := func(salt string) *ddrv.Driver {
+		cfg := s.Config(200000, "1")
+		cfg.Passphrase, cfg.Salt = "secret", salt
+		return newDriver(t, cfg)
+	}
+	salt, err := ddrv.NewSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ddrv.NewSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if salt == other {
+		t.Fatal("NewSalt() returned the same salt twice")
+	}
+	for name, bad := range map[string]string{"short": "abcd", "empty": ""} {
+		cfg := s.Config(200000, "1")
+		cfg.Passphrase, cfg.Salt = "secret", bad
+		if _, err = ddrv.New(cfg); err == nil {
+			t.Errorf("New() accepted a passphrase with %s salt", name)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, m := range s.Messages("1") {
+		seen[m.Id] = true
+	}
+	data := randBytes(t, 300000)
+	var nodes []ddrv.Node
+	ctx := ddrv.WithManifest(context.Background(), "f1", "/a.bin", 0, 0)
+	write(t, salted(salt).NewNWriterContext(ctx, func(chunk ddrv.Node) { nodes = append(nodes, chunk) }), data)
+
+	reader := salted(salt)
+	for _, pos := range []int64{0, ddrv.EncBlockSize + 1, int64(len(data)) - 1} {
+		if got := read(t, reader, nodes, pos); !bytes.Equal(got, data[pos:]) {
+			t.Errorf("read at %d: got %d bytes, want %d equal bytes", pos, len(got), len(data[pos:]))
+		}
+	}
+	for _, m := range s.Messages("1") {
+		if seen[m.Id] {
+			continue
+		}
+		msg := ddrv.Message{Id: m.Id, Content: m.Content, Attachments: []ddrv.Node{{URL: m.Attachments[0].URL, Size: m.Attachments[0].Size}}}
+		if _, manifests, err := reader.Rest.Chunks(&msg); err != nil || manifests[0].Path != "/a.bin" {
+			t.Errorf("Chunks() = %v, %v, want manifest of /a.bin", manifests, err)
+		}
+	}
+
+	// A deployment with another salt can not read them
+	r, err := salted(other).NewReader(nodes, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadAll(r); err == nil {
+		t.Error("read with another salt succeeded")
+	}
+
+	// The salt can be kept in a file
+	path := filepath.Join(t.TempDir(), "salt")
+	if err = os.WriteFile(path, []byte(salt+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := s.Config(200000, "1")
+	cfg.Passphrase, cfg.Salt, cfg.SaltFile = "secret", "", path
+	if got := read(t, newDriver(t, cfg), nodes, 0); !bytes.Equal(got, data) {
+		t.Errorf("read with salt file returned %d bytes, want %d equal bytes", len(got), len(data))
+	}
+}
@@ -1,9 +1,10 @@
 package ddrv
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"strconv"
+	"net/http"
 	"time"
 )
 
@@ -12,22 +13,120 @@ const MaxChunkSizeNitro = 500 * 1024 * 1024
 const MaxChunkSizeNitroBasic = 50 * 1024 * 1024
 
 type Driver struct {
+	// Store holds the chunks, it is Rest unless chunks are stored elsewhere
+	Store ChunkStore
+	// Rest is the discord client of features which only work with discord, like garbage collection and recovery,
+	// nil if chunks are not stored on discord. Writers and readers only talk to Store.
 	Rest      *Rest
 	ChunkSize int
+	// Lookup enables chunk deduplication when set. Writers look up every chunk by checksum
+	// and reuse the existing chunk instead of uploading the same bytes again.
+	Lookup LookupFunc
+
+	prefetch int     // Number of chunks readers download ahead
+	budget   *budget // Memory budget of prefetched chunks
+	coder    *coder  // Erasure coder of written stripes, nil if erasure coding is disabled
+	packer   *packer // Packs small files into packfiles, nil if packfiles are disabled
+	spoolDir string  // Directory of temporary files buffering chunks of writers
+	memory   bool    // Whether writers buffer chunks in memory instead of temporary files
 }
 
+// LookupFunc returns an existing chunk with given checksum and size, or nil if there is none.
+type LookupFunc func(hash string, size int) (*Node, error)
+
 type Config struct {
-	Tokens    []string
-	TokenType int
-	Channels  []string
-	ChunkSize int
-	Nitro     bool
+	Tokens    []string `mapstructure:"token"`
+	TokenType int      `mapstructure:"token_type"`
+	// TokenCooldown is how long a token rejected by discord with 401 or 403 is kept out of rotation
+	// before a request probes it again, defaults to DefaultTokenCooldown. 403 responses for a missing permission
+	// do not count, and the last healthy token is never taken out of rotation.
+	TokenCooldown time.Duration `mapstructure:"token_cooldown"`
+	Channels      []string      `mapstructure:"channels"`
+	ChunkSize     int           `mapstructure:"chunk_size"`
+	Nitro         bool          `mapstructure:"nitro"`
+	// Webhooks are discord webhook URLs chunks are uploaded through instead of Channels.
+	// Every webhook has its own rate limit, Tokens are still used to read messages and refresh URLs.
+	Webhooks []string `mapstructure:"webhooks"`
+	// Replicas is the number of copies of every chunk, each uploaded to a different channel or webhook.
+	// Readers fall back to the next copy when a chunk can not be read. Defaults to 1, no replication.
+	Replicas int `mapstructure:"replicas"`
+	// DataShards and ParityShards enable erasure coding when ParityShards is set. Every DataShards chunks
+	// form a stripe, ParityShards parity chunks are uploaded for each stripe, and readers reconstruct
+	// up to ParityShards missing or damaged chunks of a stripe. It can not be combined with Replicas.
+	DataShards   int `mapstructure:"data_shards"`
+	ParityShards int `mapstructure:"parity_shards"`
+	// Attachments is the number of chunks writers upload as attachments of a single message, up to MaxAttachments.
+	// Packing chunks saves messages and requests when chunks are small, a message must fit the upload limit of
+	// the token type though, and deleting it removes every chunk it holds. Defaults to 1.
+	Attachments int `mapstructure:"attachments"`
+	// PackThreshold enables packfiles when set. Files smaller than PackThreshold bytes are appended to a packfile
+	// shared with other small files instead of taking a message of their own, their nodes locate them in the packfile.
+	// It can be up to the chunk size and can not be combined with erasure coding.
+	PackThreshold int `mapstructure:"pack_threshold"`
+	// PackDelay is how long a packfile waits for another file before it is uploaded, defaults to DefaultPackDelay.
+	// Writers of packed files return from Close once their packfile is uploaded, unless their context is created
+	// by WithCommit. Driver.Close uploads the open packfile right away.
+	PackDelay time.Duration `mapstructure:"pack_delay"`
+	// BulkDelete deletes messages younger than BulkDeleteMaxAge up to MaxBulkDelete per request.
+	// It needs a bot token with Manage Messages permission in every channel.
+	BulkDelete bool `mapstructure:"bulk_delete"`
+	// StoreDir stores chunks as files of the directory instead of discord when set,
+	// for development and air-gapped testing. Tokens and channels are not needed then,
+	// Passphrase and Replicas can not be used.
+	StoreDir string `mapstructure:"store_dir"`
+
+	// APIURL is the base URL of the Discord API, defaults to DefaultAPIURL.
+	// It can point to any Discord compatible server, e.g. a staging stand-in.
+	APIURL string `mapstructure:"api_url"`
+	// CDNHosts is the allowlist of hosts attachments can be read from,
+	// defaults to DefaultCDNHosts.
+	CDNHosts []string `mapstructure:"cdn_hosts"`
+	// Proxy is an optional http://, https:// or socks5:// proxy URL used for every outbound request.
+	// If empty, proxy settings are read from the environment (HTTP_PROXY, HTTPS_PROXY, NO_PROXY).
+	Proxy string `mapstructure:"proxy"`
+	// Transport overrides the http.RoundTripper used for every outbound request.
+	// When set, Proxy is ignored.
+	Transport http.RoundTripper `mapstructure:"-"`
+
+	// Passphrase enables client-side encryption of chunks when set.
+	// Chunks are encrypted before upload and decrypted on read with a key derived from it.
+	Passphrase string `mapstructure:"passphrase"`
+	// Salt is the hex encoded random salt the encryption key is derived from the passphrase with, see NewSalt.
+	// It is required with a passphrase, either by Salt or SaltFile, and must be kept along with the passphrase.
+	Salt string `mapstructure:"salt"`
+	// SaltFile is the path of a file holding the salt, it is read if Salt is empty.
+	SaltFile string `mapstructure:"salt_file"`
+	// Cipher is the encryption algorithm, either CipherAES256GCM (default) or CipherXChaCha20Poly1305.
+	Cipher string `mapstructure:"cipher"`
+	// Dedup enables content-addressed chunk deduplication. Chunks are indexed by
+	// the data provider, which is wired to the driver through Driver.Lookup.
+	Dedup bool `mapstructure:"dedup"`
+	// Retry is the policy for retrying failed requests, zero values default to DefaultRetryPolicy.
+	Retry RetryPolicy `mapstructure:"retry"`
+	// Prefetch is the number of chunks readers download in parallel ahead of the chunk being read,
+	// 0 disables read-ahead.
+	Prefetch int `mapstructure:"prefetch"`
+	// PrefetchMemory caps memory in bytes used by prefetched chunks of all readers,
+	// defaults to DefaultPrefetchMemory.
+	PrefetchMemory int `mapstructure:"prefetch_memory"`
+	// SpoolDir is the directory of temporary files writers buffer chunks in until they fill a message,
+	// defaults to the directory for temporary files of the system.
+	SpoolDir string `mapstructure:"spool_dir"`
+	// MemoryBuffer makes writers buffer chunks in memory instead of temporary files.
+	MemoryBuffer bool `mapstructure:"memory_buffer"`
 }
 
 func New(cfg *Config) (*Driver, error) {
-	if len(cfg.Tokens) == 0 || len(cfg.Channels) == 0 {
+	if cfg.StoreDir != "" {
+		store, err := NewDirStore(cfg.StoreDir)
+		if err != nil {
+			return nil, err
+		}
+		return NewWithStore(store, cfg)
+	}
+	if len(cfg.Tokens) == 0 || (len(cfg.Channels) == 0 && len(cfg.Webhooks) == 0) {
 		return nil,
-			fmt.Errorf("not enough tokens or channels : tokens %d channels %d", len(cfg.Tokens), len(cfg.Channels))
+			fmt.Errorf("not enough tokens or channels : tokens %d channels %d webhooks %d", len(cfg.Tokens), len(cfg.Channels), len(cfg.Webhooks))
 	}
 	chunkSize, err := parseChunkSize(cfg.ChunkSize, cfg.TokenType)
 	if err != nil {
@@ -43,53 +142,216 @@ func New(cfg *Config) (*Driver, error) {
 			cfg.Tokens[i] = "Bot " + token
 		}
 	}
-	return &Driver{NewRest(cfg.Tokens, cfg.Channels, chunkSize, cfg.Nitro), chunkSize}, nil
+	cfg.ChunkSize = chunkSize
+	rest, err := NewRest(cfg)
+	if err != nil {
+		return nil, err
+	}
+	// Encrypted chunks are larger than plaintext, leave room for the authentication tags
+	if rest.crypt != nil {
+		chunkSize = rest.crypt.maxPlainSize(chunkSize)
+	}
+	d, err := newDriver(rest, chunkSize, cfg)
+	if err != nil {
+		return nil, err
+	}
+	d.Rest = rest
+	return d, nil
+}
+
+// NewWithStore creates a Driver which stores chunks in store, discord settings of cfg are ignored.
+// It lets the chunking pipeline be reused with storage backends other than discord. Encryption and replicas
+// are done by Rest, setting Passphrase or Replicas is an error, so chunks are never stored in plaintext by mistake.
+func NewWithStore(store ChunkStore, cfg *Config) (*Driver, error) {
+	if cfg.Passphrase != "" {
+		return nil, fmt.Errorf("encryption is only available with discord storage")
+	}
+	if cfg.Replicas > 1 {
+		return nil, fmt.Errorf("replicas are only available with discord storage")
+	}
+	chunkSize, err := parseChunkSize(cfg.ChunkSize, cfg.TokenType)
+	if err != nil {
+		return nil, err
+	}
+	return newDriver(store, chunkSize, cfg)
+}
+
+func newDriver(store ChunkStore, chunkSize int, cfg *Config) (*Driver, error) {
+	var c *coder
+	var err error
+	if cfg.ParityShards > 0 {
+		if cfg.Replicas > 1 {
+			return nil, fmt.Errorf("erasure coding can not be used with replicas")
+		}
+		if c, err = newCoder(cfg.DataShards, cfg.ParityShards); err != nil {
+			return nil, err
+		}
+	}
+	var p *packer
+	if cfg.PackThreshold > 0 {
+		if c != nil {
+			return nil, fmt.Errorf("packfiles can not be used with erasure coding")
+		}
+		if cfg.PackThreshold > chunkSize {
+			return nil, fmt.Errorf("pack threshold %d exceeds chunk size %d", cfg.PackThreshold, chunkSize)
+		}
+		p = newPacker(store, cfg.PackThreshold, chunkSize, cfg.PackDelay)
+	}
+	memory := cfg.PrefetchMemory
+	if memory <= 0 {
+		memory = DefaultPrefetchMemory
+	}
+	return &Driver{
+		Store:     store,
+		ChunkSize: chunkSize,
+		prefetch:  cfg.Prefetch,
+		budget:    newBudget(memory),
+		coder:     c,
+		packer:    p,
+		spoolDir:  cfg.SpoolDir,
+		memory:    cfg.MemoryBuffer,
+	}, nil
+}
+
+// newSpool returns the buffer of a new Writer
+func (d *Driver) newSpool() *spool {
+	return &spool{dir: d.spoolDir, mem: d.memory}
 }
 
 // NewWriter creates a new ddrv.Writer instance that implements an io.WriterCloser.
 // This allows for writing large files to Discord as small, manageable chunks.
 func (d *Driver) NewWriter(onChunk func(chunk Node)) io.WriteCloser {
-	return NewWriter(onChunk, d.ChunkSize, d.Rest)
+	return d.NewWriterContext(context.Background(), onChunk)
+}
+
+// NewWriterContext is like NewWriter but in-flight uploads are cancelled when ctx is done.
+// The writer implements Digester.
+func (d *Driver) NewWriterContext(ctx context.Context, onChunk func(chunk Node)) io.WriteCloser {
+	return newDigestWriter(d.newWriter(ctx, onChunk))
+}
+
+func (d *Driver) newWriter(ctx context.Context, onChunk func(chunk Node)) io.WriteCloser {
+	if d.coder != nil {
+		return newStripeWriter(ctx, onChunk, d.ChunkSize, d.Store, d.coder, func(onChunk func(chunk Node)) io.WriteCloser {
+			return newWriter(ctx, onChunk, d.ChunkSize, d.Store, d.Lookup, d.newSpool())
+		})
+	}
+	if d.packs(ctx) {
+		return newPackWriter(ctx, onChunk, d.packer, d.Lookup, func() io.WriteCloser {
+			return newWriter(ctx, onChunk, d.ChunkSize, d.Store, d.Lookup, d.newSpool())
+		})
+	}
+	return newWriter(ctx, onChunk, d.ChunkSize, d.Store, d.Lookup, d.newSpool())
 }
 
 // NewNWriter creates a new ddrv.NWriter instance that implements an io.WriterCloser.
 // This allows for writing large files to Discord as small, manageable chunks.
 // NWriter buffers bytes into memory and writes data to discord in parallel
 func (d *Driver) NewNWriter(onChunk func(chunk Node)) io.WriteCloser {
-	return NewNWriter(onChunk, d.ChunkSize, d.Rest)
+	return d.NewNWriterContext(context.Background(), onChunk)
+}
+
+// NewNWriterContext is like NewNWriter but in-flight uploads are cancelled when ctx is done.
+// The writer implements Digester.
+func (d *Driver) NewNWriterContext(ctx context.Context, onChunk func(chunk Node)) io.WriteCloser {
+	return newDigestWriter(d.newNWriter(ctx, onChunk))
+}
+
+func (d *Driver) newNWriter(ctx context.Context, onChunk func(chunk Node)) io.WriteCloser {
+	if d.coder != nil {
+		return newStripeWriter(ctx, onChunk, d.ChunkSize, d.Store, d.coder, func(onChunk func(chunk Node)) io.WriteCloser {
+			return newNWriter(ctx, onChunk, d.ChunkSize, d.Store, d.Lookup)
+		})
+	}
+	if d.packs(ctx) {
+		return newPackWriter(ctx, onChunk, d.packer, d.Lookup, func() io.WriteCloser {
+			return newNWriter(ctx, onChunk, d.ChunkSize, d.Store, d.Lookup)
+		})
+	}
+	return newNWriter(ctx, onChunk, d.ChunkSize, d.Store, d.Lookup)
+}
+
+// Close uploads the open packfile and waits until every packfile is uploaded and files committed through
+// WithCommit are passed to their callbacks. Writers must not be used after Close.
+func (d *Driver) Close() error {
+	if d.packer != nil {
+		d.packer.flush()
+	}
+	return nil
+}
+
+// packs reports whether writers with ctx pack small files, chunks written to a given channel are never packed
+func (d *Driver) packs(ctx context.Context) bool {
+	return d.packer != nil && channelOf(ctx) == ""
 }
 
 // NewReader creates a new Reader instance that implements an io.ReaderCloser.
 // This allows for reading large files from Discord that were split into small chunks.
 func (d *Driver) NewReader(chunks []Node, pos int64) (io.ReadCloser, error) {
-	return NewReader(chunks, pos, d.Rest)
+	return d.NewReaderContext(context.Background(), chunks, pos)
+}
+
+// NewReaderContext is like NewReader but in-flight downloads are cancelled when ctx is done
+// or when the reader is closed.
+func (d *Driver) NewReaderContext(ctx context.Context, chunks []Node, pos int64) (io.ReadCloser, error) {
+	return newReader(ctx, chunks, pos, d.Store, d.prefetch, d.budget)
 }
 
 // UpdateNodes finds expired chunks and updates chunk signature in given chunks slice
 func (d *Driver) UpdateNodes(chunks []*Node) error {
-	currentTimestamp := int(time.Now().Unix())
-	expired := make(map[int64]*Node)
-	for i, chunk := range chunks {
-		if currentTimestamp > chunk.Ex {
-			expired[chunk.MId] = chunks[i]
+	return d.UpdateNodesContext(context.Background(), chunks)
+}
+
+// UpdateNodesContext is like UpdateNodes but stops when ctx is done.
+// Expired links of replicas and parity shards are updated as well.
+func (d *Driver) UpdateNodesContext(ctx context.Context, chunks []*Node) error {
+	return d.Store.Refresh(ctx, chunks)
+}
+
+// RefreshNodesContext is like UpdateNodesContext but updates links which expire before the time as well,
+// so links can be refreshed ahead of their expiry.
+func (d *Driver) RefreshNodesContext(ctx context.Context, chunks []*Node, before time.Time) error {
+	if r, ok := d.Store.(Refresher); ok {
+		return r.RefreshBefore(ctx, chunks, before)
+	}
+	return d.Store.Refresh(ctx, chunks)
+}
+
+// DeleteNodes deletes messages holding given chunks, their replicas and parity shards from discord.
+func (d *Driver) DeleteNodes(chunks []Node) error {
+	return d.DeleteNodesContext(context.Background(), chunks)
+}
+
+// DeleteNodesContext is like DeleteNodes but stops when ctx is done.
+func (d *Driver) DeleteNodesContext(ctx context.Context, chunks []Node) error {
+	// Parity shards are shared by every chunk of the stripe, delete each message once
+	seen := make(map[int64]bool)
+	var messages []Node
+	add := func(chunk Node) {
+		if !seen[chunk.MId] {
+			seen[chunk.MId] = true
+			messages = append(messages, chunk)
 		}
 	}
-	var messages []Message
-	for mid, chunk := range expired {
-		if currentTimestamp > chunk.Ex {
-			cid := extractChannelId(chunk.URL)
-			if err := d.Rest.GetMessages(cid, mid-1, "after", &messages); err != nil {
-				return err
-			}
-			for _, msg := range messages {
-				id, _ := strconv.ParseInt(msg.Id, 10, 64)
-				if updatedChunk, ok := expired[id]; ok {
-					updatedChunk.URL, updatedChunk.Ex, updatedChunk.Is, updatedChunk.Hm = DecodeAttachmentURL(msg.Attachments[0].URL)
-				}
+	for _, chunk := range chunks {
+		add(chunk)
+		for i := range chunk.Replicas {
+			add(chunk.replica(i))
+		}
+		if chunk.Stripe != nil {
+			for _, parity := range chunk.Stripe.Parity {
+				add(parity)
 			}
 		}
 	}
-	return nil
+	return deleteChunks(ctx, d.Store, messages)
+}
+
+// VerifyNode checks that the chunk can still be read and has the expected size. Only the end of the chunk
+// is read unless full is set, then the whole chunk is read and compared to its checksum.
+// Replicas and parity shards are not read, they can be verified as nodes of their own.
+func (d *Driver) VerifyNode(ctx context.Context, chunk Node, full bool) error {
+	return verifyChunk(ctx, d.Store, chunk, full)
 }
 
 // parseChunkSize is a function that accepts a size and a tokenType as its arguments.
@@ -0,0 +1,216 @@
+package ddrv_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/forscht/ddrv/pkg/ddrv"
+	"github.com/forscht/ddrv/pkg/ddrv/ddrvtest"
+)
+
+func newDriver(t *testing.T, cfg *ddrv.Config) *ddrv.Driver {
+	t.Helper()
+	driver, err := ddrv.New(cfg)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	return driver
+}
+
+func randBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func write(t *testing.T, w io.WriteCloser, data []byte) {
+	t.Helper()
+	// Write in odd sized pieces to cross chunk boundaries
+	for p := data; len(p) > 0; {
+		n := 777
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+}
+
+func read(t *testing.T, driver *ddrv.Driver, nodes []ddrv.Node, pos int64) []byte {
+	t.Helper()
+	r, err := driver.NewReader(nodes, pos)
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	return data
+}
+
+func TestWriterReader(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+
+	tests := []struct {
+		name   string
+		nitro  bool
+		writer func(d *ddrv.Driver, onChunk func(ddrv.Node)) io.WriteCloser
+	}{
+		{"writer", false, (*ddrv.Driver).NewWriter},
+		{"nwriter", false, (*ddrv.Driver).NewNWriter},
+		{"writer nitro", true, (*ddrv.Driver).NewWriter},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := s.Config(4096, "1", "2", "3")
+			cfg.Nitro = tt.nitro
+			driver := newDriver(t, cfg)
+			data := randBytes(t, 4096*5+123)
+
+			var nodes []ddrv.Node
+			write(t, tt.writer(driver, func(chunk ddrv.Node) { nodes = append(nodes, chunk) }), data)
+			if len(nodes) != 6 {
+				t.Fatalf("got %d chunks, want 6", len(nodes))
+			}
+			for _, pos := range []int64{0, 1, 4095, 4096, 10000, int64(len(data)) - 1} {
+				if got := read(t, driver, nodes, pos); !bytes.Equal(got, data[pos:]) {
+					t.Errorf("read at %d: got %d bytes, want %d equal bytes", pos, len(got), len(data[pos:]))
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateNodes(t *testing.T) {
+	// Without the refresh-urls endpoint messages of expired chunks are fetched instead
+	for _, refresh := range []bool{true, false} {
+		s := ddrvtest.NewServer()
+		defer s.Close()
+		if !refresh {
+			s.DisableRefreshURLs()
+		}
+		driver := newDriver(t, s.Config(1024, "1", "2"))
+		data := randBytes(t, 60*1024)
+
+		// Issue already expired attachment URLs
+		s.SetTTL(-time.Second)
+		var nodes []ddrv.Node
+		write(t, driver.NewWriter(func(chunk ddrv.Node) { nodes = append(nodes, chunk) }), data)
+		s.SetTTL(time.Hour)
+
+		r, err := driver.NewReader(nodes, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.ReadAll(r); err == nil {
+			t.Fatal("read with expired signatures succeeded")
+		}
+
+		expired := make([]*ddrv.Node, len(nodes))
+		for i := range nodes {
+			expired[i] = &nodes[i]
+		}
+		before := s.Stats()
+		if err := driver.UpdateNodes(expired); err != nil {
+			t.Fatalf("UpdateNodes() error = %v", err)
+		}
+		for _, node := range nodes {
+			if node.Ex <= int(time.Now().Unix()) {
+				t.Errorf("node %d was not refreshed", node.MId)
+			}
+		}
+		// 60 URLs are refreshed by 2 requests, or their messages are fetched by a request per channel page
+		after := s.Stats()
+		if refresh && (after.Refreshes-before.Refreshes != 2 || after.Requests-before.Requests != 2) {
+			t.Errorf("UpdateNodes() sent %d requests with %d refreshes, want 2 refreshes", after.Requests-before.Requests, after.Refreshes-before.Refreshes)
+		}
+		if !refresh && (after.Refreshes != 0 || after.Requests-before.Requests < 3) {
+			t.Errorf("UpdateNodes() sent %d requests with %d refreshes, want fallback to message fetches", after.Requests-before.Requests, after.Refreshes)
+		}
+		if got := read(t, driver, nodes, 0); !bytes.Equal(got, data) {
+			t.Error("read after UpdateNodes returned different data")
+		}
+	}
+}
+
+func TestContext(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	driver := newDriver(t, s.Config(1024))
+
+	var nodes []ddrv.Node
+	write(t, driver.NewWriter(func(chunk ddrv.Node) { nodes = append(nodes, chunk) }), randBytes(t, 2000))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for name, w := range map[string]io.WriteCloser{
+		"writer":  driver.NewWriterContext(ctx, nil),
+		"nwriter": driver.NewNWriterContext(ctx, nil),
+	} {
+		if _, err := w.Write(randBytes(t, 100)); !errors.Is(err, context.Canceled) {
+			t.Errorf("%s Write() with cancelled context error = %v, want %v", name, err, context.Canceled)
+		}
+		_ = w.Close()
+	}
+	r, err := driver.NewReaderContext(ctx, nodes, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadAll(r); !errors.Is(err, context.Canceled) {
+		t.Errorf("Read() with cancelled context error = %v, want %v", err, context.Canceled)
+	}
+
+	// Limiter sleeps are interrupted by context
+	s.GlobalLimit(5 * time.Second)
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	var messages []ddrv.Message
+	err = driver.Rest.GetMessagesContext(ctx, "1", 0, "", &messages)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("GetMessagesContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("GetMessagesContext() returned after %s, limiter sleep was not interrupted", elapsed)
+	}
+}
+
+func TestDeleteNodes(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	driver := newDriver(t, s.Config(1024, "1", "2"))
+
+	var nodes []ddrv.Node
+	write(t, driver.NewNWriter(func(chunk ddrv.Node) { nodes = append(nodes, chunk) }), randBytes(t, 3000))
+	// Deleting the same message twice is not an error
+	if err := driver.DeleteNodes(append(nodes, nodes[0])); err != nil {
+		t.Fatalf("DeleteNodes() error = %v", err)
+	}
+	if err := driver.DeleteNodes(nodes[:1]); err != nil {
+		t.Fatalf("DeleteNodes() of deleted message error = %v", err)
+	}
+	if got := len(s.Messages("1")) + len(s.Messages("2")); got != 0 {
+		t.Errorf("%d messages left after DeleteNodes, want 0", got)
+	}
+}
+
+type transportFunc func(req *http.Request) (*http.Response, error)
+
+func (f transportFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
@@ -0,0 +1,92 @@
+package ddrvtest
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serveCDN serves attachment data, it only accepts correctly signed and unexpired URLs.
+func (s *Server) serveCDN(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	ex, is, hm := query.Get("ex"), query.Get("is"), query.Get("hm")
+	expiry, err := strconv.ParseInt(ex, 16, 64)
+	if err != nil || !hmac.Equal([]byte(hm), []byte(s.hmac(r.URL.Path, ex, is))) || time.Now().Unix() > expiry {
+		http.Error(w, "This content is no longer available.", http.StatusNotFound)
+		return
+	}
+	s.mu.Lock()
+	data, ok := s.files[r.URL.Path]
+	s.stats.CDNReads++
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Accept-Ranges", "bytes")
+	rangeHeader := r.Header.Get("Range")
+	if rangeHeader == "" {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(data)
+		return
+	}
+	start, end, err := parseRange(rangeHeader, len(data))
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(data)))
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+	w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+	w.WriteHeader(http.StatusPartialContent)
+	_, _ = w.Write(data[start : end+1])
+}
+
+// parseRange parses a single "bytes=start-end" range against size.
+func parseRange(header string, size int) (int, int, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("unsupported range %s", header)
+	}
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid range %s", header)
+	}
+	var start, end int
+	var err error
+	switch {
+	case first == "":
+		// suffix range, last n bytes
+		n, err := strconv.Atoi(last)
+		if err != nil || n <= 0 {
+			return 0, 0, fmt.Errorf("invalid range %s", header)
+		}
+		if n > size {
+			n = size
+		}
+		start, end = size-n, size-1
+	default:
+		if start, err = strconv.Atoi(first); err != nil {
+			return 0, 0, fmt.Errorf("invalid range %s", header)
+		}
+		end = size - 1
+		if last != "" {
+			if end, err = strconv.Atoi(last); err != nil {
+				return 0, 0, fmt.Errorf("invalid range %s", header)
+			}
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	if start > end || start >= size {
+		return 0, 0, fmt.Errorf("range %s not satisfiable", header)
+	}
+	return start, end, nil
+}
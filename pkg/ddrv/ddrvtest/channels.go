@@ -0,0 +1,408 @@
+package ddrvtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// File is an attachment sent with a message.
+type File struct {
+	Name string
+	Data []byte
+}
+
+func (s *Server) getMessages(w http.ResponseWriter, r *http.Request, channel string) {
+	query := r.URL.Query()
+	limit := 50
+	if l := query.Get("limit"); l != "" {
+		limit, _ = strconv.Atoi(l)
+	}
+	if limit <= 0 || limit > 100 {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"message": "Invalid Form Body", "code": 50035})
+		return
+	}
+	after, _ := strconv.ParseInt(query.Get("after"), 10, 64)
+	before, _ := strconv.ParseInt(query.Get("before"), 10, 64)
+
+	s.mu.Lock()
+	all := s.messages[channel]
+	var page []*Message
+	switch {
+	case query.Has("after"):
+		// the oldest messages after the given id
+		for _, m := range all {
+			if id(m) > after {
+				page = append(page, m)
+				if len(page) == limit {
+					break
+				}
+			}
+		}
+	case query.Has("before"):
+		// the newest messages before the given id
+		for _, m := range all {
+			if id(m) < before {
+				page = append(page, m)
+			}
+		}
+		if len(page) > limit {
+			page = page[len(page)-limit:]
+		}
+	default:
+		page = all
+		if len(page) > limit {
+			page = page[len(page)-limit:]
+		}
+	}
+	// Discord returns the newest message first, with freshly signed attachment URLs
+	now := time.Now()
+	messages := make([]Message, 0, len(page))
+	for i := len(page) - 1; i >= 0; i-- {
+		messages = append(messages, s.resign(*page[i], now))
+	}
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, messages)
+}
+
+func (s *Server) createMessage(w http.ResponseWriter, r *http.Request, channel string) {
+	var content string
+	var files []File
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	switch mediaType {
+	case "multipart/form-data":
+		mreader, err := r.MultipartReader()
+		if err != nil {
+			badRequest(w, err)
+			return
+		}
+		for {
+			part, err := mreader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				badRequest(w, err)
+				return
+			}
+			data, err := io.ReadAll(part)
+			if err != nil {
+				badRequest(w, err)
+				return
+			}
+			if part.FormName() == "payload_json" {
+				var payload struct {
+					Content string `json:"content"`
+				}
+				if err = json.Unmarshal(data, &payload); err != nil {
+					badRequest(w, err)
+					return
+				}
+				content = payload.Content
+				continue
+			}
+			if part.FileName() != "" {
+				files = append(files, File{Name: part.FileName(), Data: data})
+			}
+		}
+	case "application/json":
+		var payload struct {
+			Content     string `json:"content"`
+			Attachments []struct {
+				Filename         string `json:"filename"`
+				UploadedFilename string `json:"uploaded_filename"`
+			} `json:"attachments"`
+		}
+		if err = json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			badRequest(w, err)
+			return
+		}
+		content = payload.Content
+		s.mu.Lock()
+		for _, a := range payload.Attachments {
+			data, ok := s.uploads[a.UploadedFilename]
+			if !ok {
+				s.mu.Unlock()
+				badRequest(w, fmt.Errorf("unknown uploaded_filename %s", a.UploadedFilename))
+				return
+			}
+			delete(s.uploads, a.UploadedFilename)
+			files = append(files, File{Name: a.Filename, Data: data})
+		}
+		s.mu.Unlock()
+	default:
+		badRequest(w, fmt.Errorf("unsupported content type %s", mediaType))
+		return
+	}
+	if content == "" && len(files) == 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"message": "Cannot send an empty message", "code": 50006})
+		return
+	}
+	if len(files) > 10 {
+		badRequest(w, fmt.Errorf("a message holds up to 10 attachments, got %d", len(files)))
+		return
+	}
+
+	m := s.AddMessage(channel, content, files...)
+	writeJSON(w, http.StatusOK, m)
+}
+
+// AddMessage stores a message with the given attachments directly in channel,
+// as if it was posted by another client.
+func (s *Server) AddMessage(channel, content string, files ...File) Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	m := &Message{Id: s.snowflake(), ChannelId: channel, Content: content, Attachments: []Attachment{}}
+	for _, f := range files {
+		aid := s.snowflake()
+		path := fmt.Sprintf("/attachments/%s/%s/%s", channel, aid, f.Name)
+		s.files[path] = f.Data
+		signed := s.sign(path, now, now.Add(s.ttl))
+		m.Attachments = append(m.Attachments, Attachment{
+			Id:       aid,
+			Filename: f.Name,
+			Size:     len(f.Data),
+			URL:      signed,
+			ProxyURL: signed,
+			path:     path,
+		})
+		s.stats.Uploads++
+	}
+	s.messages[channel] = append(s.messages[channel], m)
+	sort.Slice(s.messages[channel], func(i, j int) bool {
+		return id(s.messages[channel][i]) < id(s.messages[channel][j])
+	})
+	return *m
+}
+
+// webhook posts messages to a channel
+type webhook struct {
+	channel string
+	token   string
+}
+
+// executeWebhook creates a message in the channel of the webhook. The message is always
+// returned, as if wait=true was set.
+func (s *Server) executeWebhook(w http.ResponseWriter, r *http.Request, id, token string) {
+	s.mu.Lock()
+	hook, ok := s.webhooks[id]
+	s.mu.Unlock()
+	if !ok || hook.token != token {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"message": "Unknown Webhook", "code": 10015})
+		return
+	}
+	if !s.limits.take(w, "webhook:"+id, "POST /webhooks/{id}/{token}", id) {
+		s.mu.Lock()
+		s.stats.RateLimited++
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Lock()
+	s.stats.Webhooks++
+	s.mu.Unlock()
+	s.createMessage(w, r, hook.channel)
+}
+
+// getWebhook returns the webhook with the channel it posts to
+func (s *Server) getWebhook(w http.ResponseWriter, id, token string) {
+	s.mu.Lock()
+	hook, ok := s.webhooks[id]
+	s.mu.Unlock()
+	if !ok || hook.token != token {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"message": "Unknown Webhook", "code": 10015})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"id": id, "type": 1, "channel_id": hook.channel, "token": token})
+}
+
+func (s *Server) deleteMessage(w http.ResponseWriter, _ *http.Request, channel, mid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	messages := s.messages[channel]
+	for i, m := range messages {
+		if m.Id != mid {
+			continue
+		}
+		for _, a := range m.Attachments {
+			delete(s.files, a.path)
+		}
+		s.messages[channel] = append(messages[:i:i], messages[i+1:]...)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusNotFound, map[string]interface{}{"message": "Unknown Message", "code": 10008})
+}
+
+// bulkDelete deletes 2 to 100 messages of the channel. Like on Discord, only bots can use it, and the whole
+// request is rejected if it holds duplicates or messages older than 2 weeks. Unknown messages are ignored.
+func (s *Server) bulkDelete(w http.ResponseWriter, r *http.Request, channel, token string) {
+	if !strings.HasPrefix(token, "Bot ") {
+		writeJSON(w, http.StatusForbidden, map[string]interface{}{"message": "Only bots can use this endpoint", "code": 20002})
+		return
+	}
+	var body struct {
+		Messages []string `json:"messages"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		badRequest(w, err)
+		return
+	}
+	if len(body.Messages) < 2 || len(body.Messages) > 100 {
+		badRequest(w, fmt.Errorf("messages must hold 2 to 100 ids, got %d", len(body.Messages)))
+		return
+	}
+	ids := make(map[string]bool)
+	oldest := time.Now().Add(-14 * 24 * time.Hour).UnixMilli()
+	for _, mid := range body.Messages {
+		n, err := strconv.ParseInt(mid, 10, 64)
+		if err != nil || ids[mid] {
+			badRequest(w, fmt.Errorf("invalid or duplicate message id %q", mid))
+			return
+		}
+		if n>>22+DiscordEpoch < oldest {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"message": "You can only bulk delete messages that are under 14 days old.", "code": 50034})
+			return
+		}
+		ids[mid] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.messages[channel][:0:0]
+	for _, m := range s.messages[channel] {
+		if !ids[m.Id] {
+			kept = append(kept, m)
+			continue
+		}
+		for _, a := range m.Attachments {
+			delete(s.files, a.path)
+		}
+	}
+	s.messages[channel] = kept
+	s.stats.BulkDeletes++
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) createUploadURL(w http.ResponseWriter, r *http.Request, _ string) {
+	var payload struct {
+		Files []struct {
+			Filename string `json:"filename"`
+			FileSize int    `json:"file_size"`
+		} `json:"files"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		badRequest(w, err)
+		return
+	}
+	type attachment struct {
+		Id             int    `json:"id"`
+		UploadURL      string `json:"upload_url"`
+		UploadFilename string `json:"upload_filename"`
+	}
+	resp := struct {
+		Attachments []attachment `json:"attachments"`
+	}{}
+	s.mu.Lock()
+	for i, f := range payload.Files {
+		name := s.snowflake() + "/" + f.Filename
+		name = strings.ReplaceAll(name, "/", "-")
+		resp.Attachments = append(resp.Attachments, attachment{
+			Id:             i,
+			UploadURL:      s.URL + "/upload/" + name,
+			UploadFilename: name,
+		})
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) serveUpload(w http.ResponseWriter, r *http.Request, name string) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	s.mu.Lock()
+	s.uploads[name] = data
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+// refreshURLs signs attachment URLs again, URLs of attachments which do not exist are left out like on Discord.
+func (s *Server) refreshURLs(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		URLs []string `json:"attachment_urls"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		badRequest(w, err)
+		return
+	}
+	if len(body.URLs) == 0 || len(body.URLs) > 50 {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"message": "Invalid Form Body", "code": 50035})
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.noRefresh {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"message": "404: Not Found", "code": 0})
+		return
+	}
+	type refreshed struct {
+		Original  string `json:"original"`
+		Refreshed string `json:"refreshed"`
+	}
+	now := time.Now()
+	urls := make([]refreshed, 0, len(body.URLs))
+	for _, raw := range body.URLs {
+		u, err := url.Parse(raw)
+		if err != nil {
+			continue
+		}
+		if _, ok := s.files[u.Path]; ok {
+			urls = append(urls, refreshed{Original: raw, Refreshed: s.sign(u.Path, now, now.Add(s.ttl))})
+		}
+	}
+	s.stats.Refreshes++
+	writeJSON(w, http.StatusOK, map[string]interface{}{"refreshed_urls": urls})
+}
+
+// resign returns a copy of m with newly signed attachment URLs, must be called with s.mu held.
+func (s *Server) resign(m Message, now time.Time) Message {
+	attachments := make([]Attachment, len(m.Attachments))
+	for i, a := range m.Attachments {
+		a.URL = s.sign(a.path, now, now.Add(s.ttl))
+		a.ProxyURL = a.URL
+		attachments[i] = a
+	}
+	m.Attachments = attachments
+	return m
+}
+
+func id(m *Message) int64 {
+	i, _ := strconv.ParseInt(m.Id, 10, 64)
+	return i
+}
+
+func badRequest(w http.ResponseWriter, err error) {
+	writeJSON(w, http.StatusBadRequest, map[string]interface{}{"message": err.Error(), "code": 50035})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
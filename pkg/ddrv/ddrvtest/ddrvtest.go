@@ -0,0 +1,350 @@
+// Package ddrvtest provides an in-process fake Discord server for testing ddrv.
+// It implements the subset of the Discord API and CDN that ddrv.Rest talks to:
+// channel messages and their deletion including bulk delete, webhooks, the nitro upload-url flow, signed attachment URLs with
+// ex/is/hm expiry and their refresh, Range reads and rate-limit headers including 429 and global limits.
+package ddrvtest
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/forscht/ddrv/pkg/ddrv"
+)
+
+// APIPath is the path prefix of the fake Discord API
+const APIPath = "/api/v10"
+
+// DiscordEpoch is the first second of 2015 in milliseconds, used to generate snowflake ids
+const DiscordEpoch = 1420070400000
+
+// testSalt is the encryption salt of configs returned by Config
+const testSalt = "000102030405060708090a0b0c0d0e0f"
+
+// Server is a fake Discord server backed by httptest.Server.
+type Server struct {
+	*httptest.Server
+
+	// Token is the token accepted by the server, defaults to "token".
+	// If empty, any non-empty Authorization header is accepted.
+	Token string
+
+	mu        sync.Mutex
+	ttl       time.Duration // lifetime of signed attachment URLs
+	secret    []byte
+	seq       int64
+	messages  map[string][]*Message // channel id -> messages ordered by id
+	webhooks  map[string]webhook    // webhook id -> webhook
+	revoked   map[string]bool       // tokens rejected with 401
+	denied    map[string]bool       // channels rejected with 403 missing access
+	files     map[string][]byte     // attachment path -> data
+	uploads   map[string][]byte     // nitro upload filename -> data
+	limits    *limits
+	failures  []int // status codes to reply with for the next requests
+	noRefresh bool  // refresh-urls endpoint replies with 404
+	stats     Stats
+}
+
+// Stats counts requests served by the Server.
+type Stats struct {
+	Requests    int // Total number of requests
+	RateLimited int // Requests answered with 429
+	Uploads     int // Attachments created
+	Webhooks    int // Messages created by executing webhooks
+	CDNReads    int // Attachment reads served by the CDN
+	BulkDeletes int // Successful bulk delete requests
+	Refreshes   int // Successful refresh-urls requests
+}
+
+// Message is a message stored in a fake channel.
+type Message struct {
+	Id          string       `json:"id"`
+	ChannelId   string       `json:"channel_id"`
+	Content     string       `json:"content"`
+	Attachments []Attachment `json:"attachments"`
+}
+
+// Attachment is a file attached to a Message.
+type Attachment struct {
+	Id       string `json:"id"`
+	Filename string `json:"filename"`
+	Size     int    `json:"size"`
+	URL      string `json:"url"`
+	ProxyURL string `json:"proxy_url"`
+
+	path string // CDN path of the attachment
+}
+
+// NewServer starts and returns a new Server. The caller should call Close when finished.
+func NewServer() *Server {
+	s := &Server{
+		Token:    "token",
+		ttl:      24 * time.Hour,
+		secret:   []byte("ddrvtest"),
+		messages: make(map[string][]*Message),
+		webhooks: make(map[string]webhook),
+		revoked:  make(map[string]bool),
+		denied:   make(map[string]bool),
+		files:    make(map[string][]byte),
+		uploads:  make(map[string][]byte),
+		limits:   newLimits(),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// APIURL returns the base URL of the fake Discord API.
+func (s *Server) APIURL() string {
+	return s.URL + APIPath
+}
+
+// CDNHost returns the host name the fake CDN serves attachments from.
+func (s *Server) CDNHost() string {
+	u, _ := url.Parse(s.URL)
+	return u.Hostname()
+}
+
+// Config returns a ddrv.Config that points to the Server.
+func (s *Server) Config(chunkSize int, channels ...string) *ddrv.Config {
+	if len(channels) == 0 {
+		channels = []string{"1"}
+	}
+	token := s.Token
+	if token == "" {
+		token = "token"
+	}
+	return &ddrv.Config{
+		Tokens:    []string{token},
+		TokenType: ddrv.TokenUser,
+		Channels:  channels,
+		ChunkSize: chunkSize,
+		APIURL:    s.APIURL(),
+		CDNHosts:  []string{s.CDNHost()},
+		Salt:      testSalt, // Only used once a passphrase is set
+	}
+}
+
+// Revoke makes the server reject requests authorized with token, as if it was revoked.
+func (s *Server) Revoke(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revoked[token] = true
+}
+
+// Deny rejects requests to channel with 403 missing access, as if the token can not see the channel.
+func (s *Server) Deny(channel string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.denied[channel] = true
+}
+
+// Restore accepts the revoked token again.
+func (s *Server) Restore(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.revoked, token)
+}
+
+// Webhook creates a webhook which posts messages to channel and returns its URL.
+func (s *Server) Webhook(channel string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := s.snowflake()
+	hook := webhook{channel: channel, token: "webhook-" + id}
+	s.webhooks[id] = hook
+	return s.APIURL() + "/webhooks/" + id + "/" + hook.token
+}
+
+// Stats returns a snapshot of request counters.
+func (s *Server) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// Messages returns a copy of all messages stored in channel, ordered by id.
+func (s *Server) Messages(channel string) []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	messages := make([]Message, 0, len(s.messages[channel]))
+	for _, m := range s.messages[channel] {
+		messages = append(messages, *m)
+	}
+	return messages
+}
+
+// Corrupt flips the first byte of the attachment served at rawURL, as if it was damaged in storage.
+func (s *Server) Corrupt(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.files[u.Path]
+	if !ok || len(data) == 0 {
+		return false
+	}
+	corrupted := append([]byte(nil), data...)
+	corrupted[0] ^= 0xff
+	s.files[u.Path] = corrupted
+	return true
+}
+
+// DisableRefreshURLs makes the refresh-urls endpoint reply with 404, like a Discord API without it.
+func (s *Server) DisableRefreshURLs() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.noRefresh = true
+}
+
+// SetTTL sets the lifetime of attachment URLs signed from now on, defaults to 24 hours.
+// A negative ttl makes the server issue already expired URLs.
+func (s *Server) SetTTL(ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ttl = ttl
+}
+
+// RateLimit sets how many requests per token and route are allowed in window.
+// limit 0 disables per route rate limiting.
+func (s *Server) RateLimit(limit int, window time.Duration) {
+	s.limits.set(limit, window)
+}
+
+// GlobalLimit makes every API request fail with a global 429 for d.
+// If tokens are given, only requests made with them are limited.
+func (s *Server) GlobalLimit(d time.Duration, tokens ...string) {
+	s.limits.setGlobal(time.Now().Add(d), tokens...)
+}
+
+// ShareBucket makes routes, e.g. "GET /channels/{id}/messages", share one rate limit bucket hash.
+func (s *Server) ShareBucket(routes ...string) {
+	s.limits.share(routes...)
+}
+
+// FailNext makes the next n requests, API or CDN, fail with status.
+func (s *Server) FailNext(status, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < n; i++ {
+		s.failures = append(s.failures, status)
+	}
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.stats.Requests++
+	var status int
+	if len(s.failures) > 0 {
+		status = s.failures[0]
+		s.failures = s.failures[1:]
+	}
+	s.mu.Unlock()
+	if status != 0 {
+		writeJSON(w, status, map[string]interface{}{"message": http.StatusText(status), "code": 0})
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case strings.HasPrefix(r.URL.Path, APIPath+"/"):
+		s.serveAPI(w, r, parts[2:])
+	case len(parts) == 4 && parts[0] == "attachments" && r.Method == http.MethodGet:
+		s.serveCDN(w, r)
+	case len(parts) == 2 && parts[0] == "upload" && r.Method == http.MethodPut:
+		s.serveUpload(w, r, parts[1])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveAPI(w http.ResponseWriter, r *http.Request, parts []string) {
+	// Webhooks are authorized by the token in the URL
+	if len(parts) == 3 && parts[0] == "webhooks" && r.Method == http.MethodPost {
+		s.executeWebhook(w, r, parts[1], parts[2])
+		return
+	}
+	if len(parts) == 3 && parts[0] == "webhooks" && r.Method == http.MethodGet {
+		s.getWebhook(w, parts[1], parts[2])
+		return
+	}
+	token := r.Header.Get("Authorization")
+	s.mu.Lock()
+	revoked := s.revoked[token]
+	s.mu.Unlock()
+	if token == "" || revoked || (s.Token != "" && token != s.Token && token != "Bot "+s.Token) {
+		// Uploads are consumed before they are rejected, like discord does
+		_, _ = io.Copy(io.Discard, r.Body)
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"message": "401: Unauthorized", "code": 0})
+		return
+	}
+	if len(parts) == 2 && parts[0] == "attachments" && parts[1] == "refresh-urls" && r.Method == http.MethodPost {
+		if s.limits.take(w, token, route(r.Method, parts), "") {
+			s.refreshURLs(w, r)
+		}
+		return
+	}
+	if len(parts) < 3 || parts[0] != "channels" {
+		http.NotFound(w, r)
+		return
+	}
+	channel := parts[1]
+	s.mu.Lock()
+	denied := s.denied[channel]
+	s.mu.Unlock()
+	if denied {
+		_, _ = io.Copy(io.Discard, r.Body)
+		writeJSON(w, http.StatusForbidden, map[string]interface{}{"message": "Missing Access", "code": 50001})
+		return
+	}
+	if !s.limits.take(w, token, route(r.Method, parts), channel) {
+		s.mu.Lock()
+		s.stats.RateLimited++
+		s.mu.Unlock()
+		return
+	}
+
+	switch {
+	case len(parts) == 3 && parts[2] == "messages" && r.Method == http.MethodGet:
+		s.getMessages(w, r, channel)
+	case len(parts) == 3 && parts[2] == "messages" && r.Method == http.MethodPost:
+		s.createMessage(w, r, channel)
+	case len(parts) == 3 && parts[2] == "attachments" && r.Method == http.MethodPost:
+		s.createUploadURL(w, r, channel)
+	case len(parts) == 4 && parts[2] == "messages" && parts[3] == "bulk-delete" && r.Method == http.MethodPost:
+		s.bulkDelete(w, r, channel, token)
+	case len(parts) == 4 && parts[2] == "messages" && r.Method == http.MethodDelete:
+		s.deleteMessage(w, r, channel, parts[3])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// snowflake generates a new message or attachment id, must be called with s.mu held.
+func (s *Server) snowflake() string {
+	s.seq++
+	ms := time.Now().UnixMilli() - DiscordEpoch
+	return strconv.FormatInt(ms<<22|s.seq&0x3FFFFF, 10)
+}
+
+// sign returns signed CDN URL for path, must be called with s.mu held.
+func (s *Server) sign(path string, issued, expiry time.Time) string {
+	ex := strconv.FormatInt(expiry.Unix(), 16)
+	is := strconv.FormatInt(issued.Unix(), 16)
+	return s.URL + path + "?" + url.Values{"ex": {ex}, "is": {is}, "hm": {s.hmac(path, ex, is)}}.Encode()
+}
+
+func (s *Server) hmac(path, ex, is string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(path + ":" + ex + ":" + is))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,140 @@
+package ddrvtest
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limits implements Discord style per route and global rate limiting. Buckets are identified
+// by the hash of the route template and the major parameter, like on Discord.
+type limits struct {
+	mu      sync.Mutex
+	limit   int
+	window  time.Duration
+	global  time.Time
+	tokens  map[string]bool   // tokens limited by global, all if empty
+	shared  map[string]string // route -> route whose hash it shares
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	remaining int
+	reset     time.Time
+}
+
+func newLimits() *limits {
+	return &limits{
+		window:  time.Second,
+		tokens:  make(map[string]bool),
+		shared:  make(map[string]string),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+func (l *limits) set(limit int, window time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+	l.window = window
+	l.buckets = make(map[string]*bucket)
+}
+
+func (l *limits) setGlobal(until time.Time, tokens ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.global = until
+	l.tokens = make(map[string]bool)
+	for _, token := range tokens {
+		l.tokens[token] = true
+	}
+}
+
+func (l *limits) share(routes ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, route := range routes {
+		l.shared[route] = routes[0]
+	}
+}
+
+// take consumes one request from the bucket of token, route template and major parameter. It writes
+// rate limit headers to w and, if the request is rate limited, the 429 response. It returns false
+// when the request must not be processed.
+func (l *limits) take(w http.ResponseWriter, token, route, major string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+
+	if l.global.After(now) && (len(l.tokens) == 0 || l.tokens[token]) {
+		retryAfter := l.global.Sub(now).Seconds()
+		w.Header().Set("X-RateLimit-Global", "true")
+		w.Header().Set("X-RateLimit-Scope", "global")
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter))))
+		writeJSON(w, http.StatusTooManyRequests, map[string]interface{}{
+			"message":     "You are being rate limited.",
+			"retry_after": retryAfter,
+			"global":      true,
+		})
+		return false
+	}
+
+	if shared, ok := l.shared[route]; ok {
+		route = shared
+	}
+	hash := bucketHash(route)
+	w.Header().Set("X-RateLimit-Bucket", hash)
+	if l.limit <= 0 {
+		return true
+	}
+
+	key := token + ":" + hash + ":" + major
+	b, ok := l.buckets[key]
+	if !ok || now.After(b.reset) {
+		b = &bucket{remaining: l.limit, reset: now.Add(l.window)}
+		l.buckets[key] = b
+	}
+	resetAfter := b.reset.Sub(now).Seconds()
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(l.limit))
+	w.Header().Set("X-RateLimit-Reset", fmt.Sprintf("%.3f", float64(b.reset.UnixNano())/float64(time.Second)))
+	w.Header().Set("X-RateLimit-Reset-After", fmt.Sprintf("%.3f", resetAfter))
+
+	if b.remaining == 0 {
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Scope", "user")
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(resetAfter))))
+		writeJSON(w, http.StatusTooManyRequests, map[string]interface{}{
+			"message":     "You are being rate limited.",
+			"retry_after": resetAfter,
+			"global":      false,
+		})
+		return false
+	}
+	b.remaining--
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(b.remaining))
+	return true
+}
+
+// bucketHash returns a stable opaque bucket hash for route, like the one Discord returns.
+func bucketHash(route string) string {
+	sum := sha1.Sum([]byte(route))
+	return hex.EncodeToString(sum[:8])
+}
+
+// route returns the route template of the API request, e.g. "DELETE /channels/{id}/messages/{id}"
+func route(method string, parts []string) string {
+	tmpl := make([]string, len(parts))
+	for i, part := range parts {
+		if _, err := strconv.ParseInt(part, 10, 64); err == nil {
+			part = "{id}"
+		}
+		tmpl[i] = part
+	}
+	return method + " /" + strings.Join(tmpl, "/")
+}
@@ -0,0 +1,118 @@
+package ddrv
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DirStore stores chunks as files of a local directory, for development and air-gapped testing.
+// Chunks are named by their message id, which is unique within the directory. Links never expire.
+type DirStore struct {
+	dir string
+
+	mu   sync.Mutex // guards last
+	last int64      // Last issued message id
+}
+
+// NewDirStore creates a DirStore in dir, the directory is created if it does not exist.
+func NewDirStore(dir string) (*DirStore, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create chunk directory : %w", err)
+	}
+	return &DirStore{dir: dir}, nil
+}
+
+// id returns a new message id, ids increase like discord snowflakes
+func (s *DirStore) id() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := time.Now().UnixNano()
+	if id <= s.last {
+		id = s.last + 1
+	}
+	s.last = id
+	return id
+}
+
+func (s *DirStore) path(mid int64) string {
+	return filepath.Join(s.dir, strconv.FormatInt(mid, 10))
+}
+
+// Put writes the chunk to a temporary file and renames it once it is complete.
+func (s *DirStore) Put(ctx context.Context, reader io.Reader) (*Node, error) {
+	mid := s.id()
+	f, err := os.CreateTemp(s.dir, ".chunk-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	n, err := io.Copy(f, &ctxReader{ctx: ctx, r: reader})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("write chunk : %w", err)
+	}
+	path := s.path(mid)
+	if err = os.Rename(f.Name(), path); err != nil {
+		return nil, err
+	}
+	link := &url.URL{Scheme: "file", Path: filepath.ToSlash(path)}
+	return &Node{URL: link.String(), Size: int(n), MId: mid, Ex: math.MaxInt32}, nil
+}
+
+// Get reads the chunk from its file, the file is found by message id so the directory can be moved.
+func (s *DirStore) Get(ctx context.Context, chunk *Node, start, end int) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(s.path(chunk.MId))
+	if err != nil {
+		return nil, fmt.Errorf("read chunk %d : %w", chunk.MId, err)
+	}
+	if _, err = f.Seek(int64(start), io.SeekStart); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, int64(end-start+1)), f}, nil
+}
+
+func (s *DirStore) Delete(_ context.Context, chunk Node) error {
+	if err := os.Remove(s.path(chunk.MId)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Refresh does nothing, links of DirStore chunks do not expire.
+func (s *DirStore) Refresh(_ context.Context, _ []*Node) error {
+	return nil
+}
+
+// ctxReader stops reading once ctx is done
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,135 @@
+package ddrv_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/forscht/ddrv/pkg/ddrv"
+)
+
+func TestDirStore(t *testing.T) {
+	dir := t.TempDir()
+	driver := newDriver(t, &ddrv.Config{StoreDir: dir, ChunkSize: 1024, Prefetch: 2})
+	files := func() int {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("ReadDir() error = %v", err)
+		}
+		return len(entries)
+	}
+
+	data := randBytes(t, 5000)
+	for name, newWriter := range map[string]func(func(ddrv.Node)) io.WriteCloser{"writer": driver.NewWriter, "nwriter": driver.NewNWriter} {
+		t.Run(name, func(t *testing.T) {
+			var nodes []ddrv.Node
+			write(t, newWriter(func(chunk ddrv.Node) { nodes = append(nodes, chunk) }), data)
+			if len(nodes) != 5 || files() != 5 {
+				t.Fatalf("got %d chunks in %d files, want 5", len(nodes), files())
+			}
+			if got := read(t, driver, nodes, 0); !bytes.Equal(got, data) {
+				t.Errorf("read returned different data")
+			}
+			if got := read(t, driver, nodes, 1500); !bytes.Equal(got, data[1500:]) {
+				t.Errorf("read from 1500 returned different data")
+			}
+			expired := []*ddrv.Node{&nodes[0]}
+			if err := driver.UpdateNodes(expired); err != nil || nodes[0].Expired(int(time.Now().Unix())) {
+				t.Errorf("UpdateNodes() error = %v, expired = %v", err, nodes[0].Expired(int(time.Now().Unix())))
+			}
+			if err := driver.DeleteNodes(nodes); err != nil {
+				t.Fatalf("DeleteNodes() error = %v", err)
+			}
+			if files() != 0 {
+				t.Errorf("%d files left after DeleteNodes(), want 0", files())
+			}
+		})
+	}
+
+	// Encryption and replicas are only done by Rest, chunks are not stored in plaintext instead
+	for _, cfg := range []*ddrv.Config{{StoreDir: dir, Passphrase: "secret"}, {StoreDir: dir, Replicas: 2}} {
+		if _, err := ddrv.New(cfg); err == nil {
+			t.Errorf("New() with passphrase %q and %d replicas error = nil, want an error", cfg.Passphrase, cfg.Replicas)
+		}
+	}
+
+	// The whole pipeline works on top of other stores, chunks are erasure coded here
+	store, err := ddrv.NewDirStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewDirStore() error = %v", err)
+	}
+	driver, err = ddrv.NewWithStore(store, &ddrv.Config{ChunkSize: 1024, DataShards: 2, ParityShards: 1})
+	if err != nil {
+		t.Fatalf("NewWithStore() error = %v", err)
+	}
+	var nodes []ddrv.Node
+	write(t, driver.NewWriter(func(chunk ddrv.Node) { nodes = append(nodes, chunk) }), data)
+	lost := nodes[1]
+	lost.Stripe = nil
+	if err = driver.DeleteNodes([]ddrv.Node{lost}); err != nil {
+		t.Fatalf("DeleteNodes() error = %v", err)
+	}
+	if got := read(t, driver, nodes, 0); !bytes.Equal(got, data) {
+		t.Errorf("read without a chunk returned different data")
+	}
+}
+
+// batchStore is a DirStore which counts the batches it stores and deletes chunks in
+type batchStore struct {
+	*ddrv.DirStore
+	puts, deletes int
+}
+
+func (s *batchStore) PutBatch(ctx context.Context, readers []io.Reader) ([]*ddrv.Node, error) {
+	s.puts++
+	chunks := make([]*ddrv.Node, len(readers))
+	for i, reader := range readers {
+		chunk, err := s.Put(ctx, reader)
+		if err != nil {
+			return nil, err
+		}
+		chunks[i] = chunk
+	}
+	return chunks, nil
+}
+
+func (s *batchStore) BatchSize() int { return 3 }
+
+func (s *batchStore) DeleteBatch(ctx context.Context, chunks []ddrv.Node) error {
+	s.deletes++
+	for _, chunk := range chunks {
+		if err := s.Delete(ctx, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestStoreInterfaces(t *testing.T) {
+	dir, err := ddrv.NewDirStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewDirStore() error = %v", err)
+	}
+	store := &batchStore{DirStore: dir}
+	driver, err := ddrv.NewWithStore(store, &ddrv.Config{ChunkSize: 1024})
+	if err != nil {
+		t.Fatalf("NewWithStore() error = %v", err)
+	}
+
+	// Writers store chunks in batches of BatchSize, and the Driver deletes them at once
+	data := randBytes(t, 5000)
+	var nodes []ddrv.Node
+	write(t, driver.NewWriter(func(chunk ddrv.Node) { nodes = append(nodes, chunk) }), data)
+	if len(nodes) != 5 || store.puts != 2 {
+		t.Fatalf("got %d chunks in %d batches, want 5 in 2", len(nodes), store.puts)
+	}
+	if got := read(t, driver, nodes, 0); !bytes.Equal(got, data) {
+		t.Errorf("read returned different data")
+	}
+	if err = driver.DeleteNodes(nodes); err != nil || store.deletes != 1 {
+		t.Errorf("DeleteNodes() = %v in %d batches, want 1", err, store.deletes)
+	}
+}
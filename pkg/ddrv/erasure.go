@@ -0,0 +1,159 @@
+package ddrv
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Reed-Solomon erasure coding over GF(2^8). Parity shards are computed with a Cauchy matrix,
+// so data shards are stored unchanged and any k of k+m shards are enough to reconstruct a stripe.
+
+// ErrStripeLost is returned when too many shards of a stripe are missing to reconstruct a chunk
+var ErrStripeLost = errors.New("not enough shards to reconstruct stripe")
+
+// MaxShards is the maximum number of data and parity shards of a stripe
+const MaxShards = 256
+
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+	gfMul [256][256]byte
+)
+
+func init() {
+	// Generator 2 with the polynomial x^8 + x^4 + x^3 + x^2 + 1
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfExp[i+255] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMul[a][b] = gfExp[int(gfLog[a])+int(gfLog[b])]
+		}
+	}
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// coder computes parity shards of stripes with k data shards and m parity shards.
+type coder struct {
+	k, m   int
+	matrix [][]byte // (k+m) x k encoding matrix, identity on top of the Cauchy parity rows
+}
+
+func newCoder(k, m int) (*coder, error) {
+	if k <= 0 || m <= 0 || k+m > MaxShards {
+		return nil, fmt.Errorf("invalid erasure coding %d+%d : shards must be positive and at most %d in total", k, m, MaxShards)
+	}
+	c := &coder{k: k, m: m, matrix: make([][]byte, k+m)}
+	for i := 0; i < k; i++ {
+		c.matrix[i] = make([]byte, k)
+		c.matrix[i][i] = 1
+	}
+	for j := 0; j < m; j++ {
+		row := make([]byte, k)
+		for i := 0; i < k; i++ {
+			// x = k+j and y = i are distinct, so x ^ y is never 0
+			row[i] = gfInv(byte(k+j) ^ byte(i))
+		}
+		c.matrix[k+j] = row
+	}
+	return c, nil
+}
+
+// encode adds data at offset off of the i-th data shard to parity shards.
+// Parity is computed incrementally, so data can be streamed in pieces.
+func (c *coder) encode(parity [][]byte, i int, off int, data []byte) {
+	for j, shard := range parity {
+		mul := &gfMul[c.matrix[c.k+j][i]]
+		shard = shard[off : off+len(data)]
+		for n, b := range data {
+			shard[n] ^= mul[b]
+		}
+	}
+}
+
+// reconstruct returns the data shard with index target from shards, which holds k data shards followed
+// by m parity shards of equal size. Missing shards are nil, at least k shards must be present.
+func (c *coder) reconstruct(shards [][]byte, target int) ([]byte, error) {
+	if shards[target] != nil {
+		return shards[target], nil
+	}
+	// Pick k present shards and invert their rows of the encoding matrix
+	rows := make([]int, 0, c.k)
+	for i := 0; i < len(shards) && len(rows) < c.k; i++ {
+		if shards[i] != nil {
+			rows = append(rows, i)
+		}
+	}
+	if len(rows) < c.k {
+		return nil, ErrStripeLost
+	}
+	inv, err := invert(c.subMatrix(rows))
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(shards[rows[0]]))
+	for r, i := range rows {
+		if coef := inv[target][r]; coef != 0 {
+			mul := &gfMul[coef]
+			for n, b := range shards[i] {
+				out[n] ^= mul[b]
+			}
+		}
+	}
+	return out, nil
+}
+
+func (c *coder) subMatrix(rows []int) [][]byte {
+	sub := make([][]byte, len(rows))
+	for r, i := range rows {
+		sub[r] = append([]byte(nil), c.matrix[i]...)
+	}
+	return sub
+}
+
+// invert returns the inverse of the square matrix m using Gauss-Jordan elimination, m is modified.
+func invert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	inv := make([][]byte, n)
+	for i := range inv {
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && m[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("erasure coding matrix is singular")
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+		scale := gfInv(m[col][col])
+		for i := 0; i < n; i++ {
+			m[col][i] = gfMul[scale][m[col][i]]
+			inv[col][i] = gfMul[scale][inv[col][i]]
+		}
+		for row := 0; row < n; row++ {
+			if row == col || m[row][col] == 0 {
+				continue
+			}
+			f := m[row][col]
+			for i := 0; i < n; i++ {
+				m[row][i] ^= gfMul[f][m[col][i]]
+				inv[row][i] ^= gfMul[f][inv[col][i]]
+			}
+		}
+	}
+	return inv, nil
+}
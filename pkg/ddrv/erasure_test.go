@@ -0,0 +1,118 @@
+package ddrv
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestGF(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if got := gfMul[a][gfInv(byte(a))]; got != 1 {
+			t.Fatalf("%d * inv(%d) = %d, want 1", a, a, got)
+		}
+		if gfMul[a][0] != 0 || gfMul[0][a] != 0 {
+			t.Fatalf("%d * 0 != 0", a)
+		}
+	}
+}
+
+func TestNewCoder(t *testing.T) {
+	for _, tt := range []struct{ k, m int }{{0, 1}, {1, 0}, {-1, 2}, {200, 57}} {
+		if _, err := newCoder(tt.k, tt.m); err == nil {
+			t.Errorf("newCoder(%d, %d) succeeded", tt.k, tt.m)
+		}
+	}
+	if _, err := newCoder(200, 56); err != nil {
+		t.Errorf("newCoder(200, 56) error = %v", err)
+	}
+}
+
+// stripeOf returns k random data shards of given size followed by their m parity shards
+func stripeOf(t *testing.T, c *coder, size int) [][]byte {
+	t.Helper()
+	rnd := rand.New(rand.NewSource(int64(c.k*1000 + c.m)))
+	shards := make([][]byte, c.k+c.m)
+	for i := range shards {
+		shards[i] = make([]byte, size)
+	}
+	for i := 0; i < c.k; i++ {
+		rnd.Read(shards[i])
+		// Data is streamed in pieces
+		for off := 0; off < size; off += 7 {
+			end := off + 7
+			if end > size {
+				end = size
+			}
+			c.encode(shards[c.k:], i, off, shards[i][off:end])
+		}
+	}
+	return shards
+}
+
+func TestReconstruct(t *testing.T) {
+	for _, tt := range []struct{ k, m int }{{1, 1}, {2, 1}, {3, 2}, {4, 3}} {
+		c, err := newCoder(tt.k, tt.m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stripe := stripeOf(t, c, 100)
+		n := tt.k + tt.m
+		// Every subset of up to m missing shards
+		for missing := 0; missing < 1<<n; missing++ {
+			lost := 0
+			shards := make([][]byte, n)
+			for i := range shards {
+				if missing&(1<<i) != 0 {
+					lost++
+					continue
+				}
+				shards[i] = stripe[i]
+			}
+			for target := 0; target < tt.k; target++ {
+				got, err := c.reconstruct(shards, target)
+				if lost > tt.m {
+					if shards[target] == nil && !errors.Is(err, ErrStripeLost) {
+						t.Fatalf("%d+%d missing %b: reconstruct(%d) error = %v, want %v", tt.k, tt.m, missing, target, err, ErrStripeLost)
+					}
+					continue
+				}
+				if err != nil || !bytes.Equal(got, stripe[target]) {
+					t.Fatalf("%d+%d missing %b: reconstruct(%d) = %v, want the data shard", tt.k, tt.m, missing, target, err)
+				}
+			}
+		}
+	}
+}
+
+func TestInvert(t *testing.T) {
+	c, err := newCoder(3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := []int{1, 3, 4}
+	inv, err := invert(c.subMatrix(rows))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := c.subMatrix(rows)
+	for i := range m {
+		for j := range m {
+			var sum byte
+			for k := range m {
+				sum ^= gfMul[m[i][k]][inv[k][j]]
+			}
+			want := byte(0)
+			if i == j {
+				want = 1
+			}
+			if sum != want {
+				t.Fatalf("m * inv(m) [%d][%d] = %d, want identity", i, j, sum)
+			}
+		}
+	}
+	if _, err = invert([][]byte{{1, 2}, {1, 2}}); err == nil {
+		t.Error("invert() of a singular matrix succeeded")
+	}
+}
@@ -0,0 +1,184 @@
+package ddrv
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultTokenCooldown is how long a token rejected by discord stays out of rotation before it is probed again
+const DefaultTokenCooldown = 5 * time.Minute
+
+// ErrNoToken is returned when every token is out of rotation
+var ErrNoToken = errors.New("no healthy token available")
+
+const (
+	TokenHealthy = "healthy" // Token is in rotation
+	TokenEvicted = "evicted" // Token was rejected and waits for the cool-down to pass
+	TokenProbing = "probing" // Cool-down passed, a single request is testing the token
+)
+
+// TokenStatus is the health of a token as reported by Rest.TokenStatus
+type TokenStatus struct {
+	Token      string     `json:"token"`                 // Masked token
+	State      string     `json:"state"`                 // TokenHealthy, TokenEvicted or TokenProbing
+	Failures   int        `json:"failures"`              // Number of consecutive rejected requests
+	LastStatus int        `json:"last_status,omitempty"` // Status code of the last rejected request
+	ProbeAt    *time.Time `json:"probe_at,omitempty"`    // Time an evicted token is probed again
+}
+
+// Discord error codes of 403 responses which mean the token lacks a permission in a channel or on a message,
+// the token itself is still valid
+const (
+	codeMissingAccess      = 50001
+	codeMissingPermissions = 50013
+)
+
+// tokenPool hands out tokens in a round-robin fashion. Every token has a circuit breaker,
+// a token rejected with 401, or 403 for another reason than a missing permission, is taken out of rotation
+// for the cool-down. The last healthy token is never taken out, requests would fail without trying it.
+// Once the cool-down passes, a single request probes the token, and if it is not rejected the token is back in rotation.
+type tokenPool struct {
+	mu       sync.Mutex
+	tokens   []*tokenHealth
+	last     int
+	cooldown time.Duration
+}
+
+type tokenHealth struct {
+	token      string
+	evicted    bool
+	probing    bool
+	failures   int
+	lastStatus int
+	probeAt    time.Time
+}
+
+func newTokenPool(tokens []string, cooldown time.Duration) *tokenPool {
+	if cooldown <= 0 {
+		cooldown = DefaultTokenCooldown
+	}
+	p := &tokenPool{cooldown: cooldown}
+	for _, token := range tokens {
+		p.tokens = append(p.tokens, &tokenHealth{token: token})
+	}
+	return p
+}
+
+// next returns the next token in rotation, or an evicted token which is due for a probe.
+func (p *tokenPool) next() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for i := 0; i < len(p.tokens); i++ {
+		idx := (p.last + i) % len(p.tokens)
+		t := p.tokens[idx]
+		if t.evicted && (t.probing || now.Before(t.probeAt)) {
+			continue
+		}
+		if t.evicted {
+			t.probing = true
+		}
+		p.last = (idx + 1) % len(p.tokens)
+		return t.token, nil
+	}
+	return "", ErrNoToken
+}
+
+// available reports whether next can return a token
+func (p *tokenPool) available() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for _, t := range p.tokens {
+		if !t.evicted || (!t.probing && !now.Before(t.probeAt)) {
+			return true
+		}
+	}
+	return false
+}
+
+// report records the response status and discord error code of a request made with token, status is 0
+// if no response was received. It reports whether the token was rejected.
+func (p *tokenPool) report(token string, status, code int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var t *tokenHealth
+	for _, th := range p.tokens {
+		if th.token == token {
+			t = th
+			break
+		}
+	}
+	if t == nil {
+		return false
+	}
+	switch {
+	case status == http.StatusForbidden && (code == codeMissingAccess || code == codeMissingPermissions):
+		// The token works, it is just not allowed to do this
+		t.evicted = false
+		t.probing = false
+		t.failures = 0
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		t.failures++
+		t.lastStatus = status
+		if !t.evicted && p.healthy() == 1 {
+			return true
+		}
+		t.evicted = true
+		t.probing = false
+		t.probeAt = time.Now().Add(p.cooldown)
+		return true
+	case status == 0 || status == http.StatusTooManyRequests || status >= http.StatusInternalServerError:
+		// Says nothing about the token, a probing token is probed again by the next request
+		t.probing = false
+	default:
+		t.evicted = false
+		t.probing = false
+		t.failures = 0
+	}
+	return false
+}
+
+// healthy returns the number of tokens in rotation, must be called with p.mu held
+func (p *tokenPool) healthy() int {
+	n := 0
+	for _, t := range p.tokens {
+		if !t.evicted {
+			n++
+		}
+	}
+	return n
+}
+
+func (p *tokenPool) status() []TokenStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	statuses := make([]TokenStatus, 0, len(p.tokens))
+	for _, t := range p.tokens {
+		status := TokenStatus{Token: maskToken(t.token), State: TokenHealthy, Failures: t.failures, LastStatus: t.lastStatus}
+		if t.evicted {
+			status.State = TokenEvicted
+			probeAt := t.probeAt
+			status.ProbeAt = &probeAt
+			if t.probing {
+				status.State = TokenProbing
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func (p *tokenPool) len() int {
+	return len(p.tokens)
+}
+
+// maskToken hides all but the last 4 characters of token
+func maskToken(token string) string {
+	if len(token) <= 4 {
+		return "****"
+	}
+	return "****" + token[len(token)-4:]
+}
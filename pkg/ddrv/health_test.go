@@ -0,0 +1,123 @@
+package ddrv_test
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/forscht/ddrv/pkg/ddrv"
+	"github.com/forscht/ddrv/pkg/ddrv/ddrvtest"
+)
+
+func TestTokenHealth(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	s.Token = "" // accept any token
+	cfg := s.Config(1024, "1")
+	cfg.Tokens = []string{"token-good", "token-bad"}
+	cfg.TokenCooldown = 200 * time.Millisecond
+	driver := newDriver(t, cfg)
+	s.Revoke("token-bad")
+
+	// Requests rejected by the revoked token are sent again with the healthy one
+	data := randBytes(t, 4000)
+	var nodes []ddrv.Node
+	write(t, driver.NewWriter(func(chunk ddrv.Node) { nodes = append(nodes, chunk) }), data)
+	status := driver.Rest.TokenStatus()
+	if status[0].State != ddrv.TokenHealthy || status[1].State != ddrv.TokenEvicted || status[1].Failures != 1 {
+		t.Fatalf("TokenStatus() = %+v, want second token evicted after one failure", status)
+	}
+	if status[1].Token != "****-bad" {
+		t.Errorf("TokenStatus() token = %s, want masked token", status[1].Token)
+	}
+
+	// Still revoked token is evicted again by the probe
+	time.Sleep(cfg.TokenCooldown)
+	write(t, driver.NewWriter(nil), data)
+	if status = driver.Rest.TokenStatus(); status[1].State != ddrv.TokenEvicted || status[1].Failures != 2 {
+		t.Fatalf("TokenStatus() = %+v, want second token evicted after failed probe", status)
+	}
+
+	// Restored token is back in rotation after a successful probe
+	s.Restore("token-bad")
+	time.Sleep(cfg.TokenCooldown)
+	write(t, driver.NewWriter(nil), data)
+	if status = driver.Rest.TokenStatus(); status[1].State != ddrv.TokenHealthy || status[1].Failures != 0 {
+		t.Fatalf("TokenStatus() = %+v, want second token healthy after successful probe", status)
+	}
+
+	// The last healthy token stays in rotation once every other token is evicted
+	s.Revoke("token-good")
+	s.Revoke("token-bad")
+	if _, err := driver.NewWriter(nil).Write(data); err == nil {
+		t.Fatalf("write with revoked tokens succeeded")
+	}
+	var messages []ddrv.Message
+	var statusErr *ddrv.StatusError
+	if err := driver.Rest.GetMessages("1", 0, "", &messages); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GetMessages() error = %v, want status 401", err)
+	}
+	if status = driver.Rest.TokenStatus(); (status[0].State == ddrv.TokenHealthy) == (status[1].State == ddrv.TokenHealthy) {
+		t.Errorf("TokenStatus() = %+v, want one token evicted and one healthy", status)
+	}
+}
+
+func TestTokenForbidden(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	driver := newDriver(t, s.Config(1024, "1", "2"))
+	s.Deny("2")
+
+	// Missing access to one channel does not take the only token out of rotation
+	var messages []ddrv.Message
+	var statusErr *ddrv.StatusError
+	if err := driver.Rest.GetMessages("2", 0, "", &messages); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusForbidden {
+		t.Fatalf("GetMessages() error = %v, want status 403", err)
+	}
+	if status := driver.Rest.TokenStatus(); status[0].State != ddrv.TokenHealthy {
+		t.Fatalf("TokenStatus() = %+v, want token healthy", status)
+	}
+	if err := driver.Rest.GetMessages("1", 0, "", &messages); err != nil {
+		t.Errorf("GetMessages() of accessible channel error = %v", err)
+	}
+
+	// A rejected token is not evicted either if it is the only one
+	s.Revoke(s.Token)
+	if err := driver.Rest.GetMessages("1", 0, "", &messages); errors.Is(err, ddrv.ErrNoToken) {
+		t.Fatalf("GetMessages() error = %v, want the request sent", err)
+	}
+	s.Restore(s.Token)
+	if err := driver.Rest.GetMessages("1", 0, "", &messages); err != nil {
+		t.Errorf("GetMessages() with restored token error = %v", err)
+	}
+}
+
+func TestTokenFailoverUpload(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	s.Token = "" // accept any token
+	cfg := s.Config(1024, "1")
+	cfg.Tokens = []string{"token-bad", "token-good"}
+	// Uploads are not buffered for retries
+	cfg.Retry = ddrv.RetryPolicy{MaxAttempts: 1}
+	driver := newDriver(t, cfg)
+	s.Revoke("token-bad")
+
+	// Uploads rejected by the first token are sent again in full with the second one
+	data := randBytes(t, 4000)
+	var nodes []ddrv.Node
+	write(t, driver.NewWriter(func(chunk ddrv.Node) { nodes = append(nodes, chunk) }), data)
+	if status := driver.Rest.TokenStatus(); status[0].State != ddrv.TokenEvicted {
+		t.Fatalf("TokenStatus() = %+v, want first token evicted", status)
+	}
+	for i, node := range nodes {
+		if want := len(data) - i*1024; node.Size != 1024 && node.Size != want {
+			t.Errorf("chunk %d has %d bytes", i, node.Size)
+		}
+	}
+	if got := read(t, driver, nodes, 0); !bytes.Equal(got, data) {
+		t.Errorf("read returned %d bytes, want %d equal bytes", len(got), len(data))
+	}
+}
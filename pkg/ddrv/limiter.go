@@ -1,7 +1,9 @@
 package ddrv
 
-// Simple version of https://github.com/diamondburned/arikawa/blob/v3/api/rate/rate.go
+// Discord rate limits, see https://discord.com/developers/docs/topics/rate-limits
+// Based on https://github.com/diamondburned/arikawa/blob/v3/api/rate/rate.go
 import (
+	"context"
 	"net/http"
 	"strconv"
 	"sync"
@@ -10,61 +12,148 @@ import (
 
 const ExtraDelay = 250 * time.Millisecond
 
+// Limiter keeps requests within discord rate limits. Requests are grouped into buckets by token,
+// route and major parameter (channel or webhook id). Once discord reports the X-RateLimit-Bucket hash
+// of a route, routes sharing the hash share the bucket. Requests of a bucket are sent one at a time,
+// and a global rate limit only holds back requests of the token it was reported for.
 type Limiter struct {
-	lock    sync.Mutex
-	global  time.Time
-	buckets map[string]*bucket
+	mu      sync.Mutex           // guards everything below and rate limit state of buckets
+	hashes  map[string]string    // route -> bucket hash reported by discord
+	buckets map[string]*bucket   // token, route or bucket hash, major -> bucket
+	global  map[string]time.Time // token -> end of global rate limit
+	stats   LimiterStats
 }
 
 type bucket struct {
-	lock      sync.Mutex
+	lock      sync.Mutex // held from acquire till release
 	reset     time.Time
 	remaining uint64
+	moved     *bucket // shared bucket the route was merged into, guarded by Limiter.mu
+}
+
+// LimiterStats reports how long requests were held back by the Limiter
+type LimiterStats struct {
+	Requests    int64         `json:"requests"`     // Requests sent through the limiter
+	Waited      int64         `json:"waited"`       // Requests delayed by rate limits or other requests of the same bucket
+	WaitTime    time.Duration `json:"wait_time"`    // Total delay of requests
+	MaxWait     time.Duration `json:"max_wait"`     // Longest delay of a single request
+	RateLimited int64         `json:"rate_limited"` // Responses with 429 status
+	Global      int64         `json:"global"`       // Responses with 429 status caused by a global rate limit
 }
 
 func NewLimiter() *Limiter {
-	return &Limiter{buckets: map[string]*bucket{}}
+	return &Limiter{
+		hashes:  map[string]string{},
+		buckets: map[string]*bucket{},
+		global:  map[string]time.Time{},
+	}
 }
 
-func (l *Limiter) getBucket(path string, store bool) *bucket {
-	l.lock.Lock()
-	defer l.lock.Unlock()
+func (l *Limiter) getBucket(token, route, major string) *bucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
-	b, ok := l.buckets[path]
-	if !ok && store {
+	key := bucketKey(token, route, major)
+	if hash, ok := l.hashes[route]; ok {
+		key = bucketKey(token, hash, major)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
 		b = &bucket{remaining: 1}
-		l.buckets[path] = b
+		l.buckets[key] = b
 	}
 	return b
 }
 
-func (l *Limiter) Acquire(path string) {
-	now := time.Now()
-	// Check global rate limit
-	if l.global.After(now) {
-		time.Sleep(l.global.Sub(now) + ExtraDelay)
+// Acquire waits until a request to route, e.g. "POST /channels/{id}/messages", may be sent with token.
+// The returned function releases the bucket and must be called with headers of the response,
+// or nil if no response was received.
+func (l *Limiter) Acquire(token, route, major string) func(headers http.Header) {
+	release, _ := l.AcquireContext(context.Background(), token, route, major)
+	return release
+}
+
+// AcquireContext is like Acquire but stops waiting for the rate limit when ctx is done.
+// The bucket is only held if AcquireContext returns nil error.
+func (l *Limiter) AcquireContext(ctx context.Context, token, route, major string) (func(headers http.Header), error) {
+	start := time.Now()
+	b := l.getBucket(token, route, major)
+
+	// Lock bucket until released, requests waiting for a bucket which moved to a shared one wait for that one
+	waited := false
+	for {
+		if !b.lock.TryLock() {
+			waited = true
+			b.lock.Lock()
+		}
+		shared := l.sharedBucket(b)
+		if shared == nil {
+			break
+		}
+		b.lock.Unlock()
+		b = shared
+	}
+	for {
+		d := l.wait(token, b)
+		if d <= 0 {
+			break
+		}
+		waited = true
+		if err := sleep(ctx, d); err != nil {
+			b.lock.Unlock()
+			return nil, err
+		}
 	}
 
-	b := l.getBucket(path, true)
+	l.mu.Lock()
+	l.stats.Requests++
+	if waited {
+		elapsed := time.Since(start)
+		l.stats.Waited++
+		l.stats.WaitTime += elapsed
+		if elapsed > l.stats.MaxWait {
+			l.stats.MaxWait = elapsed
+		}
+	}
+	l.mu.Unlock()
+
+	return func(headers http.Header) { l.release(b, token, route, major, headers) }, nil
+}
+
+// sharedBucket returns the bucket b moved to, or nil if b did not move
+func (l *Limiter) sharedBucket(b *bucket) *bucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b.moved == nil {
+		return nil
+	}
+	for b.moved != nil {
+		b = b.moved
+	}
+	return b
+}
 
-	// Lock bucket until released
-	b.lock.Lock()
+// wait returns how long the request must wait for global and bucket rate limits,
+// it takes a request from the bucket if it does not have to wait.
+func (l *Limiter) wait(token string, b *bucket) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	// Check global rate limit of the token
+	if global := l.global[token]; global.After(now) {
+		return global.Sub(now) + ExtraDelay
+	}
 	// Check bucket-specific rate limit
 	if b.remaining == 0 && b.reset.After(now) {
-		time.Sleep(b.reset.Sub(now) + ExtraDelay)
+		return b.reset.Sub(now) + ExtraDelay
 	}
-
 	if b.remaining > 0 {
 		b.remaining--
 	}
+	return 0
 }
 
-func (l *Limiter) Release(path string, headers http.Header) {
-	b := l.getBucket(path, false)
-	// Continue if no specific bucket was found
-	if b == nil {
-		return
-	}
+func (l *Limiter) release(b *bucket, token, route, major string, headers http.Header) {
 	// Release bucket for next request
 	defer b.lock.Unlock()
 	// Request failed due to network error
@@ -72,45 +161,91 @@ func (l *Limiter) Release(path string, headers http.Header) {
 		return
 	}
 	var (
-		global     = headers.Get("X-RateLimit-Global") // boolean
+		hash       = headers.Get("X-RateLimit-Bucket")
+		global     = headers.Get("X-RateLimit-Global") != "" || headers.Get("X-RateLimit-Scope") == "global"
 		remaining  = headers.Get("X-RateLimit-Remaining")
-		reset      = headers.Get("X-RateLimit-Reset") // float
-		retryAfter = headers.Get("Retry-After")
+		resetAfter = headers.Get("X-RateLimit-Reset-After") // float, seconds
+		reset      = headers.Get("X-RateLimit-Reset")       // float, unix seconds
+		retryAfter = headers.Get("Retry-After")             // float, seconds, only sent with 429
 	)
 
-	switch {
-	case retryAfter != "":
-		i, err := strconv.Atoi(retryAfter)
-		if err != nil {
-			return
-		}
-
-		at := time.Now().Add(time.Duration(i) * time.Second)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
 
-		// probably "true"
-		if global != "" {
-			l.global = at
-		} else {
-			b.reset = at
+	// Bucket of a newly mapped route may already be known through another route sharing the hash,
+	// the state is kept on that bucket then. Requests waiting for the bucket of the route move on to it,
+	// so only one request of the shared bucket is in flight.
+	if hash != "" && l.hashes[route] != hash {
+		unmapped := l.hashes[route] == ""
+		l.hashes[route] = hash
+		key := bucketKey(token, hash, major)
+		if shared, ok := l.buckets[key]; ok && shared != b {
+			if unmapped {
+				b.moved = shared
+				delete(l.buckets, bucketKey(token, route, major))
+			}
+			b = shared
+		} else if !ok {
+			l.buckets[key] = b
 		}
+	}
 
-	case reset != "":
-		unix, err := strconv.ParseFloat(reset, 64)
-		if err != nil {
-			return
-		}
-		sec := int64(unix)
-		nsec := int64((unix - float64(sec)) * float64(time.Second))
-		b.reset = time.Unix(sec, nsec).Add(ExtraDelay)
+	if sec, err := strconv.ParseFloat(resetAfter, 64); err == nil {
+		// Relative reset is not affected by clock skew
+		b.reset = now.Add(seconds(sec))
+	} else if unix, err := strconv.ParseFloat(reset, 64); err == nil {
+		b.reset = time.Unix(0, int64(unix*float64(time.Second)))
+	}
+	if u, err := strconv.ParseUint(remaining, 10, 64); err == nil {
+		b.remaining = u
 	}
 
-	if remaining != "" {
-		u, err := strconv.ParseUint(remaining, 10, 64)
-		if err != nil {
-			return
+	if retryAfter == "" {
+		return
+	}
+	l.stats.RateLimited++
+	sec, err := strconv.ParseFloat(retryAfter, 64)
+	if err != nil {
+		return
+	}
+	at := now.Add(seconds(sec))
+	if global {
+		l.stats.Global++
+		if at.After(l.global[token]) {
+			l.global[token] = at
 		}
-		b.remaining = u
+		return
 	}
+	b.remaining = 0
+	if at.After(b.reset) {
+		b.reset = at
+	}
+}
+
+// Stats returns wait-time statistics of requests sent through the limiter
+func (l *Limiter) Stats() LimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stats
+}
+
+func bucketKey(token, id, major string) string {
+	return token + ":" + id + ":" + major
+}
 
-	return
+func seconds(sec float64) time.Duration {
+	return time.Duration(sec * float64(time.Second))
+}
+
+// sleep pauses for d or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
 }
@@ -0,0 +1,123 @@
+package ddrv_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/forscht/ddrv/pkg/ddrv"
+	"github.com/forscht/ddrv/pkg/ddrv/ddrvtest"
+)
+
+func TestLimiter(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	s.RateLimit(2, 500*time.Millisecond)
+	driver := newDriver(t, s.Config(512))
+
+	var nodes []ddrv.Node
+	write(t, driver.NewWriter(func(chunk ddrv.Node) { nodes = append(nodes, chunk) }), randBytes(t, 512*5))
+	if len(nodes) != 5 {
+		t.Fatalf("got %d chunks, want 5", len(nodes))
+	}
+	if stats := s.Stats(); stats.RateLimited != 0 {
+		t.Errorf("limiter let %d requests hit the rate limit", stats.RateLimited)
+	}
+	if stats := driver.Rest.LimiterStats(); stats.Requests != 5 || stats.Waited == 0 || stats.WaitTime == 0 {
+		t.Errorf("LimiterStats() = %+v, want 5 requests and waits for the rate limit", stats)
+	}
+}
+
+func TestSharedBucket(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	s.RateLimit(3, 500*time.Millisecond)
+	s.ShareBucket("GET /channels/{id}/messages", "DELETE /channels/{id}/messages/{id}")
+	driver := newDriver(t, s.Config(512, "1", "2"))
+
+	// Routes sharing the bucket hash are limited together once the hash is known,
+	// channels have buckets of their own
+	for i := 0; i < 4; i++ {
+		for _, channel := range []string{"1", "2"} {
+			var messages []ddrv.Message
+			if err := driver.Rest.GetMessages(channel, 0, "", &messages); err != nil {
+				t.Fatalf("GetMessages() error = %v", err)
+			}
+			if err := driver.Rest.DeleteMessage(channel, int64(i+1)); err != nil {
+				t.Fatalf("DeleteMessage() error = %v", err)
+			}
+		}
+	}
+	if stats := s.Stats(); stats.RateLimited != 0 {
+		t.Errorf("limiter let %d requests hit the rate limit of the shared bucket", stats.RateLimited)
+	}
+}
+
+func TestLimiterSharedHash(t *testing.T) {
+	l := ddrv.NewLimiter()
+	const get, del = "GET /channels/{id}/messages", "DELETE /channels/{id}/messages/{id}"
+	shared := http.Header{"X-Ratelimit-Bucket": {"h"}, "X-Ratelimit-Remaining": {"5"}}
+	l.Acquire("a", del, "1")(shared)
+
+	// A request of the shared bucket is in flight while the other route learns the hash
+	releaseDel := l.Acquire("a", del, "1")
+	releaseGet := l.Acquire("a", get, "1")
+	acquired := make(chan func(http.Header))
+	go func() { acquired <- l.Acquire("a", get, "1") }()
+	time.Sleep(50 * time.Millisecond)
+	releaseGet(shared)
+
+	// The waiting request moved on to the shared bucket
+	select {
+	case release := <-acquired:
+		release(shared)
+		t.Fatal("request was sent while another request of the shared bucket is in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	releaseDel(shared)
+	select {
+	case release := <-acquired:
+		release(shared)
+	case <-time.After(time.Second):
+		t.Fatal("request waiting for the shared bucket was not sent")
+	}
+}
+
+func TestLimiterGlobal(t *testing.T) {
+	l := ddrv.NewLimiter()
+	const route = "GET /channels/{id}/messages"
+	l.Acquire("a", route, "1")(http.Header{
+		"Retry-After":       {"0.3"},
+		"X-Ratelimit-Scope": {"global"},
+	})
+
+	// Global limit holds back requests of the limited token only
+	start := time.Now()
+	l.Acquire("b", route, "1")(http.Header{})
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("request of another token waited %s for the global limit", elapsed)
+	}
+	start = time.Now()
+	l.Acquire("a", route, "2")(http.Header{})
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("request of limited token waited %s, want at least 300ms", elapsed)
+	}
+	if stats := l.Stats(); stats.RateLimited != 1 || stats.Global != 1 || stats.Waited != 1 {
+		t.Errorf("Stats() = %+v, want one global 429 and one delayed request", stats)
+	}
+}
+
+func TestGlobalLimit(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	driver := newDriver(t, s.Config(512))
+
+	s.GlobalLimit(time.Second)
+	var messages []ddrv.Message
+	if err := driver.Rest.GetMessages("1", 0, "", &messages); err != nil {
+		t.Fatalf("GetMessages() error = %v", err)
+	}
+	if stats := s.Stats(); stats.RateLimited == 0 {
+		t.Error("expected request to hit the global rate limit")
+	}
+}
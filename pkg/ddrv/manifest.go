@@ -0,0 +1,195 @@
+package ddrv
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ManifestPrefix starts the content of messages carrying a manifest
+const ManifestPrefix = "ddrv:"
+
+// maxContent is the maximum length of discord message content
+const maxContent = 2000
+
+// Manifest describes the chunks held by a message. Writers embed it in the message content when their context
+// is created by WithManifest, so files can be rebuilt from channel history if the dataprovider is lost.
+// Manifests of encrypted chunks are sealed with the key of the first chunk.
+type Manifest struct {
+	File   string `json:"f"`           // Id of the file
+	Path   string `json:"p,omitempty"` // Path of the file when the chunk was written, dropped if it does not fit
+	Size   int64  `json:"s,omitempty"` // Size of the file after the write, 0 if it was not known
+	Write  int64  `json:"w"`           // Id of the write, writes are ordered by their start time
+	Base   int64  `json:"b,omitempty"` // Position the write started at, upload sessions continue previous writes
+	Index  int    `json:"i"`           // Index of the chunk in the write, or of the first chunk of the stripe of a parity shard
+	Offset int64  `json:"o"`           // Position of the chunk in the file
+	Parity int    `json:"q,omitempty"` // 1-based index of the parity shard, 0 for data chunks
+	Shards int    `json:"k,omitempty"` // Number of data shards of the stripe of a parity shard
+	Count  int    `json:"n,omitempty"` // Number of chunks held by the message if it holds more than one
+	// Files are the manifests of the chunks held by a packfile, a packfile has no manifest of its own
+	Files []Manifest `json:"m,omitempty"`
+	At    int        `json:"a,omitempty"` // Position of the chunk in its packfile
+	Len   int        `json:"l,omitempty"` // Size of the chunk in its packfile
+}
+
+type manifestKey struct{}
+
+// WithManifest returns a context which makes writers embed a manifest in every chunk message they create.
+// offset is the position the write starts at in the file, size the size of the file after the write or 0 if
+// it is not known yet.
+func WithManifest(ctx context.Context, file, path string, offset, size int64) context.Context {
+	m := &Manifest{File: file, Path: path, Size: size, Write: time.Now().UnixNano(), Base: offset}
+	return context.WithValue(ctx, manifestKey{}, m)
+}
+
+func manifestOf(ctx context.Context) *Manifest {
+	m, _ := ctx.Value(manifestKey{}).(*Manifest)
+	return m
+}
+
+// withChunk returns ctx whose manifest describes the chunk with given index and offset in the write
+func withChunk(ctx context.Context, index int, offset int64) context.Context {
+	m := manifestOf(ctx)
+	if m == nil {
+		return ctx
+	}
+	chunk := *m
+	chunk.Index, chunk.Offset = index, m.Base+offset
+	return context.WithValue(ctx, manifestKey{}, &chunk)
+}
+
+// withParity returns ctx whose manifest describes a parity shard of the stripe starting at data chunk first
+func withParity(ctx context.Context, first int, offset int64, parity, shards int) context.Context {
+	m := manifestOf(ctx)
+	if m == nil {
+		return ctx
+	}
+	chunk := *m
+	chunk.Index, chunk.Offset, chunk.Parity, chunk.Shards = first, m.Base+offset, parity, shards
+	return context.WithValue(ctx, manifestKey{}, &chunk)
+}
+
+// content returns the message content carrying the manifest of ctx for chunks with given ivs, or empty string
+// if ctx has none. Plain manifests are stored as json, manifests of encrypted chunks are prefixed with the chunk ivs.
+func (r *Rest) content(ctx context.Context, ivs []string) (string, error) {
+	m := manifestOf(ctx)
+	if m == nil {
+		return "", nil
+	}
+	chunk := *m
+	if len(ivs) > 1 {
+		chunk.Count = len(ivs)
+	}
+	content, err := r.encodeManifest(chunk, ivs)
+	if err != nil || len(content) <= maxContent {
+		return content, err
+	}
+	// Long paths do not fit into a message, the file id is enough to group chunks
+	chunk.Path = ""
+	return r.encodeManifest(chunk, ivs)
+}
+
+// manifestSize returns the length of the content carrying the manifest of a single chunk
+func (r *Rest) manifestSize(m Manifest) int {
+	data, _ := json.Marshal(m)
+	if r.crypt == nil {
+		return len(ManifestPrefix) + len(data)
+	}
+	return len(ManifestPrefix) + 2*ivSize + 1 + base64.RawStdEncoding.EncodedLen(len(data)+r.crypt.overhead())
+}
+
+func (r *Rest) encodeManifest(m Manifest, ivs []string) (string, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	if ivs[0] == "" {
+		return ManifestPrefix + string(data), nil
+	}
+	sealed, err := r.crypt.sealManifest(ivs[0], data)
+	if err != nil {
+		return "", err
+	}
+	return ManifestPrefix + strings.Join(ivs, ",") + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Chunks returns the chunks held by the message and their manifests, or nil if the message has no manifest.
+// Manifests of encrypted chunks can only be read with the passphrase they were written with. Chunks of packfiles
+// are returned as ranges of the packfile.
+func (r *Rest) Chunks(m *Message) ([]Node, []Manifest, error) {
+	payload, ok := strings.CutPrefix(m.Content, ManifestPrefix)
+	if !ok || len(m.Attachments) == 0 {
+		return nil, nil, nil
+	}
+	var ivs []string
+	data := []byte(payload)
+	if !strings.HasPrefix(payload, "{") {
+		var list, sealed string
+		if list, sealed, ok = strings.Cut(payload, ":"); !ok {
+			return nil, nil, fmt.Errorf("message %s : invalid manifest", m.Id)
+		}
+		ivs = strings.Split(list, ",")
+		if r.crypt == nil {
+			return nil, nil, ErrNoPassphrase
+		}
+		raw, err := base64.RawStdEncoding.DecodeString(sealed)
+		if err != nil {
+			return nil, nil, fmt.Errorf("message %s : invalid manifest : %w", m.Id, err)
+		}
+		if data, err = r.crypt.openManifest(ivs[0], raw); err != nil {
+			return nil, nil, fmt.Errorf("message %s : %w", m.Id, err)
+		}
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, nil, fmt.Errorf("message %s : invalid manifest : %w", m.Id, err)
+	}
+	count := manifest.Count
+	if count == 0 {
+		count = 1
+	}
+	if count != len(m.Attachments) || (ivs != nil && len(ivs) != count) {
+		return nil, nil, fmt.Errorf("message %s : manifest describes %d chunks of %d attachments", m.Id, count, len(m.Attachments))
+	}
+	mid, _ := strconv.ParseInt(m.Id, 10, 64)
+	attachment := func(i int) Node {
+		chunk := m.Attachments[i]
+		chunk.URL, chunk.Ex, chunk.Is, chunk.Hm = DecodeAttachmentURL(chunk.URL)
+		chunk.MId, chunk.Att = mid, i
+		if ivs != nil {
+			r.sealed(&chunk, ivs[i])
+		}
+		return chunk
+	}
+	if manifest.Files != nil {
+		return packChunks(m.Id, attachment(0), manifest.Files)
+	}
+	chunks := make([]Node, count)
+	manifests := make([]Manifest, count)
+	offset := manifest.Offset
+	for i := range chunks {
+		chunk := attachment(i)
+		// Chunks following the first one are the next chunks of the write
+		chunks[i], manifests[i] = chunk, manifest
+		manifests[i].Index, manifests[i].Offset, manifests[i].Count = manifest.Index+i, offset, 0
+		offset += int64(chunk.Size)
+	}
+	return chunks, manifests, nil
+}
+
+// packChunks returns the chunks of the packfile described by files
+func packChunks(id string, pack Node, files []Manifest) ([]Node, []Manifest, error) {
+	chunks := make([]Node, len(files))
+	for i, f := range files {
+		if f.At < 0 || f.Len < 0 || f.At+f.Len > pack.Size {
+			return nil, nil, fmt.Errorf("message %s : manifest describes chunk beyond the end of the packfile", id)
+		}
+		chunks[i] = pack
+		chunks[i].Size, chunks[i].Pack = f.Len, &Pack{Offset: f.At, Size: pack.Size}
+	}
+	return chunks, files, nil
+}
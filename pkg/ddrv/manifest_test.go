@@ -0,0 +1,84 @@
+package ddrv_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/forscht/ddrv/pkg/ddrv"
+	"github.com/forscht/ddrv/pkg/ddrv/ddrvtest"
+)
+
+func TestManifest(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	channels := []string{"1", "2", "3", "4"}
+
+	for name, passphrase := range map[string]string{"plain": "", "encrypted": "secret"} {
+		t.Run(name, func(t *testing.T) {
+			cfg := s.Config(1024, channels...)
+			cfg.Passphrase = passphrase
+			cfg.DataShards, cfg.ParityShards = 2, 1
+			driver := newDriver(t, cfg)
+			seen := make(map[string]bool)
+			for _, channel := range channels {
+				for _, m := range s.Messages(channel) {
+					seen[m.Id] = true
+				}
+			}
+
+			ctx := ddrv.WithManifest(context.Background(), "f1", "/docs/a.bin", 100, 0)
+			var nodes []ddrv.Node
+			write(t, driver.NewNWriterContext(ctx, func(chunk ddrv.Node) { nodes = append(nodes, chunk) }), randBytes(t, 3000))
+			if len(nodes) != 3 {
+				t.Fatalf("got %d chunks, want 3", len(nodes))
+			}
+			written, parity := make(map[int64]ddrv.Manifest), 0
+			found := make(map[int64]ddrv.Node)
+			for _, channel := range channels {
+				for _, m := range s.Messages(channel) {
+					if seen[m.Id] {
+						continue
+					}
+					if passphrase != "" && strings.Contains(m.Content, "/docs/a.bin") {
+						t.Errorf("manifest of encrypted chunk shows the path: %s", m.Content)
+					}
+					msg := ddrv.Message{Id: m.Id, Content: m.Content, Attachments: []ddrv.Node{{URL: m.Attachments[0].URL, Size: m.Attachments[0].Size}}}
+					if !msg.IsChunk() {
+						t.Errorf("message with manifest %q is not a chunk", m.Content)
+					}
+					chunks, manifests, err := driver.Rest.Chunks(&msg)
+					if err != nil || len(chunks) != 1 {
+						t.Fatalf("Chunks() = %v, %v", chunks, err)
+					}
+					chunk, manifest := chunks[0], manifests[0]
+					if manifest.File != "f1" || manifest.Path != "/docs/a.bin" || manifest.Base != 100 {
+						t.Errorf("manifest = %+v, want file f1 at /docs/a.bin written from 100", manifest)
+					}
+					if manifest.Parity > 0 {
+						parity++
+						continue
+					}
+					written[chunk.MId], found[chunk.MId] = manifest, chunk
+					if passphrase != "" {
+						if _, _, err = newDriver(t, s.Config(1024, channels...)).Rest.Chunks(&msg); err != ddrv.ErrNoPassphrase {
+							t.Errorf("Chunks() without passphrase error = %v, want %v", err, ddrv.ErrNoPassphrase)
+						}
+					}
+				}
+			}
+			if parity != 2 {
+				t.Errorf("%d parity shards with manifest, want 2", parity)
+			}
+			for i, node := range nodes {
+				m, ok := written[node.MId]
+				if !ok || m.Index != i || m.Offset != 100+int64(i)*int64(driver.ChunkSize) {
+					t.Errorf("chunk %d has manifest %+v, want index %d at %d", i, m, i, 100+i*driver.ChunkSize)
+				}
+				if got := found[node.MId]; got.Size != node.Size || got.Iv != node.Iv || got.URL != node.URL {
+					t.Errorf("Chunks() = %+v, want chunk %+v", got, node)
+				}
+			}
+		})
+	}
+}
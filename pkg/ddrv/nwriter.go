@@ -1,39 +1,51 @@
 package ddrv
 
 import (
-	"bytes"
+	"context"
 	"io"
-	"sort"
 	"sync"
-	"sync/atomic"
 
 	"github.com/forscht/ddrv/pkg/breader"
 )
 
 // NWriter buffers bytes into memory and writes data to discord in parallel at the cost of high-memory usage.
-// Expected memory usage - (chunkSize * number of channels) + 20% bytes
+// Expected memory usage - (chunkSize * chunks per message * number of channels or webhooks) + 20% bytes
+// Chunks are passed to onChunk in order, as soon as all chunks before them are uploaded.
 type NWriter struct {
-	rest      *Rest
+	ctx       context.Context
+	store     ChunkStore
 	chunkSize int // The maximum size of a chunk
 	onChunk   func(chunk Node)
+	lookup    LookupFunc // Optional chunk index used to deduplicate chunks
 
-	mu sync.Mutex
-	wg sync.WaitGroup
+	mu  sync.Mutex // guards chunks and emitted
+	rmu sync.Mutex // serializes reading a chunk and numbering it
+	wg  sync.WaitGroup
 
 	closed       bool // Whether the Writer has been closed
 	err          error
-	chunks       []Node
+	chunks       map[int64]Node // Uploaded chunks waiting for the chunks before them
+	emitted      int64          // Number of chunks passed to onChunk
 	pwriter      *io.PipeWriter
+	preader      *io.PipeReader
 	chunkCounter int64
 }
 
-func NewNWriter(onChunk func(chunk Node), chunkSize int, rest *Rest) io.WriteCloser {
+func NewNWriter(onChunk func(chunk Node), chunkSize int, store ChunkStore) io.WriteCloser {
+	return newNWriter(context.Background(), onChunk, chunkSize, store, nil)
+}
+
+func newNWriter(ctx context.Context, onChunk func(chunk Node), chunkSize int, store ChunkStore, lookup LookupFunc) io.WriteCloser {
 	reader, writer := io.Pipe()
 	w := &NWriter{
-		rest:      rest,
+		ctx:       ctx,
+		store:     store,
+		lookup:    lookup,
 		onChunk:   onChunk,
 		chunkSize: chunkSize,
+		chunks:    make(map[int64]Node),
 		pwriter:   writer,
+		preader:   reader,
 	}
 	go w.startWorkers(breader.New(reader))
 
@@ -47,6 +59,9 @@ func (w *NWriter) Write(p []byte) (int, error) {
 	if w.err != nil {
 		return 0, w.err
 	}
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
 	return w.pwriter.Write(p)
 }
 
@@ -61,40 +76,79 @@ func (w *NWriter) Close() error {
 		}
 	}
 	w.wg.Wait()
-	if w.onChunk != nil {
-		sort.SliceStable(w.chunks, func(i, j int) bool {
-			return w.chunks[i].Start < w.chunks[j].Start
-		})
-		for _, chunk := range w.chunks {
-			w.onChunk(chunk)
+	return w.err
+}
+
+// done records the uploaded chunk with index idx and passes every chunk that is
+// no longer waiting for an earlier one to onChunk, so chunks are emitted in order
+// as soon as possible.
+func (w *NWriter) done(idx int64, chunk Node) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.chunks[idx] = chunk
+	for {
+		next, ok := w.chunks[w.emitted+1]
+		if !ok {
+			return
+		}
+		delete(w.chunks, w.emitted+1)
+		w.emitted++
+		if w.onChunk != nil {
+			w.onChunk(next)
 		}
 	}
-	return w.err
 }
 
 func (w *NWriter) startWorkers(reader io.Reader) {
-	concurrency := len(w.rest.channels)
+	concurrency := concurrency(w.store)
+	pack := packing(w.store)
 	w.wg.Add(concurrency)
 	for i := 0; i < concurrency; i++ {
 		go func() {
 			defer w.wg.Done()
-			buff := make([]byte, w.chunkSize)
+			// Every worker uploads pack chunks at once
+			buffs := make([][]byte, pack)
+			for i := range buffs {
+				buffs[i] = make([]byte, w.chunkSize)
+			}
 			for {
 				if w.err != nil {
 					return
 				}
-				n, err := reader.Read(buff)
-				if n > 0 {
-					cIdx := atomic.AddInt64(&w.chunkCounter, 1)
-					attachment, werr := w.rest.CreateAttachment(bytes.NewReader(buff[:n]))
+				// Chunks must be numbered in the order they are read
+				w.rmu.Lock()
+				var data [][]byte
+				var first int64
+				var err error
+				for len(data) < pack && err == nil {
+					var n int
+					n, err = reader.Read(buffs[len(data)])
+					if n > 0 {
+						w.chunkCounter++
+						if len(data) == 0 {
+							first = w.chunkCounter
+						}
+						data = append(data, buffs[len(data)][:n])
+					}
+				}
+				w.rmu.Unlock()
+				if len(data) > 0 {
+					ctxs := make([]context.Context, len(data))
+					for j := range ctxs {
+						cIdx := first + int64(j)
+						ctxs[j] = withChunk(w.ctx, int(cIdx-1), (cIdx-1)*int64(w.chunkSize))
+					}
+					readers, hashes := sections(data)
+					attachments, werr := createChunks(ctxs, w.store, w.lookup, readers, hashes)
 					if werr != nil {
 						w.err = werr
+						// Unblock w.pwriter.Write, nobody reads the pipe anymore
+						_ = w.preader.CloseWithError(werr)
 						return
 					}
-					w.mu.Lock()
-					attachment.Start = cIdx
-					w.chunks = append(w.chunks, *attachment)
-					w.mu.Unlock()
+					for j, attachment := range attachments {
+						w.done(first+int64(j), attachment)
+					}
 				}
 				if err != nil {
 					if err != io.EOF {
@@ -0,0 +1,368 @@
+package ddrv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// DefaultPackDelay is how long an open packfile waits for another file before it is uploaded
+const DefaultPackDelay = 500 * time.Millisecond
+
+// packer appends small files to the open packfile shared by writers of a Driver. The packfile is uploaded
+// as a single chunk once the next file or its manifest entry does not fit, no file was appended for the delay,
+// or the packer is flushed.
+type packer struct {
+	store     ChunkStore
+	threshold int           // Files smaller than threshold bytes are packed
+	size      int           // Maximum size of a packfile
+	delay     time.Duration // How long an open packfile waits for another file
+
+	mu      sync.Mutex
+	open    *packfile      // Packfile files are appended to, nil if there is none
+	uploads sync.WaitGroup // Packfiles being uploaded or committed
+}
+
+// packfile is a packfile which is filled or uploaded
+type packfile struct {
+	data    []byte
+	files   []Manifest    // Manifest entries of packed files
+	commits []packCommit  // Files whose writers returned before the upload
+	timer   *time.Timer   // Uploads the packfile once no file was appended for the delay
+	done    chan struct{} // Closed once the packfile is uploaded
+	chunk   *Node         // Uploaded packfile
+	err     error
+}
+
+// packCommit is a packed file committed by its callback once the packfile is uploaded
+type packCommit struct {
+	offset, size int
+	hash         string
+	commit       func(chunk Node, err error)
+}
+
+type commitKey struct{}
+
+// WithCommit returns a context which makes writers of packed files return from Close as soon as the file is
+// appended to the open packfile, instead of waiting for the packfile to be uploaded. Close calls pending before
+// it appends the file and fails with its error. pending returns the callback called with the node of the file
+// in place of onChunk once the packfile is uploaded, or with the error of the upload. Until then the file
+// can not be read, pending is meant to record it as an upload in progress which the callback commits.
+// Files which are not packed are written and passed to onChunk as usual.
+func WithCommit(ctx context.Context, pending func() (func(chunk Node, err error), error)) context.Context {
+	return context.WithValue(ctx, commitKey{}, pending)
+}
+
+func pendingOf(ctx context.Context) func() (func(chunk Node, err error), error) {
+	pending, _ := ctx.Value(commitKey{}).(func() (func(chunk Node, err error), error))
+	return pending
+}
+
+func newPacker(store ChunkStore, threshold, size int, delay time.Duration) *packer {
+	if delay <= 0 {
+		delay = DefaultPackDelay
+	}
+	return &packer{store: store, threshold: threshold, size: size, delay: delay}
+}
+
+// add appends data to the open packfile and waits until the packfile is uploaded, it returns the range of the
+// packfile holding data. m describes data in the manifest of the packfile unless it is nil or does not fit.
+// If ctx is done before the upload started, data is dropped from the packfile.
+func (p *packer) add(ctx context.Context, data []byte, m *Manifest) (*Node, error) {
+	f, offset := p.append(data, m, nil)
+	select {
+	case <-ctx.Done():
+		p.remove(f, offset, len(data))
+		return nil, ctx.Err()
+	case <-f.done:
+	}
+	return f.rangeOf(offset, len(data))
+}
+
+// addAsync appends data to the open packfile like add but returns right away, commit is called with the range
+// of the packfile holding data once the packfile is uploaded. hash is the checksum of data.
+func (p *packer) addAsync(data []byte, m *Manifest, hash string, commit func(chunk Node, err error)) {
+	p.append(data, m, &packCommit{size: len(data), hash: hash, commit: commit})
+}
+
+// append appends data to the open packfile and returns the packfile and the offset of data in it,
+// the packfile is uploaded right away once it is full.
+func (p *packer) append(data []byte, m *Manifest, c *packCommit) (*packfile, int) {
+	if m != nil {
+		m = p.entry(*m, len(data))
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if f := p.open; f != nil && (len(f.data)+len(data) > p.size || (m != nil && !p.fits(f, *m))) {
+		p.upload()
+	}
+	if p.open == nil {
+		f := &packfile{done: make(chan struct{})}
+		f.timer = time.AfterFunc(p.delay, func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if p.open == f {
+				p.upload()
+			}
+		})
+		p.open = f
+	} else {
+		// The packfile waits for the delay after its last file
+		p.open.timer.Reset(p.delay)
+	}
+	f := p.open
+	offset := len(f.data)
+	f.data = append(f.data, data...)
+	if m != nil {
+		m.At = offset
+		f.files = append(f.files, *m)
+	}
+	if c != nil {
+		c.offset = offset
+		f.commits = append(f.commits, *c)
+	}
+	if len(f.data) == p.size {
+		p.upload()
+	}
+	return f, offset
+}
+
+// rangeOf returns the node of size bytes at offset of the uploaded packfile
+func (f *packfile) rangeOf(offset, size int) (*Node, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	chunk := *f.chunk
+	chunk.Size, chunk.Pack = size, &Pack{Offset: offset, Size: f.chunk.Size}
+	return &chunk, nil
+}
+
+// remove drops the manifest entry of the file at offset from packfile f unless f is uploaded already,
+// its bytes are cut off if they are the last ones. Bytes of a file followed by other files stay in the packfile
+// unreferenced, as ranges of the following files are fixed already.
+func (p *packer) remove(f *packfile, offset, size int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.open != f {
+		return
+	}
+	for i := range f.files {
+		if f.files[i].At == offset {
+			f.files = append(f.files[:i], f.files[i+1:]...)
+			break
+		}
+	}
+	if offset+size == len(f.data) {
+		f.data = f.data[:offset]
+	}
+	// Nothing is left to upload
+	if len(f.data) == 0 {
+		f.timer.Stop()
+		p.open = nil
+	}
+}
+
+// entry returns the manifest entry of a packed file of given size, the path is dropped if the entry does not fit
+// into an empty packfile. It returns nil if the entry does not fit without path either.
+func (p *packer) entry(m Manifest, size int) *Manifest {
+	m.Len = size
+	m.At = p.size
+	if !manifestFits(p.store, Manifest{Files: []Manifest{m}}) {
+		m.Path = ""
+	}
+	if !manifestFits(p.store, Manifest{Files: []Manifest{m}}) {
+		return nil
+	}
+	return &m
+}
+
+// fits reports whether the manifest of packfile f still fits into its message with entry m appended
+func (p *packer) fits(f *packfile, m Manifest) bool {
+	m.At = len(f.data)
+	files := append(f.files[:len(f.files):len(f.files)], m)
+	return manifestFits(p.store, Manifest{Files: files})
+}
+
+// upload starts uploading the open packfile, the caller holds p.mu. Writers of every packed file
+// wait for the upload or are committed after it, so it is not cancelled along with any of them.
+func (p *packer) upload() {
+	f := p.open
+	p.open = nil
+	f.timer.Stop()
+	ctx := context.Background()
+	if len(f.files) > 0 {
+		ctx = context.WithValue(ctx, manifestKey{}, &Manifest{Files: f.files})
+	}
+	p.uploads.Add(1)
+	go func() {
+		defer p.uploads.Done()
+		f.chunk, f.err = p.store.Put(ctx, bytes.NewReader(f.data))
+		close(f.done)
+		for _, c := range f.commits {
+			chunk, err := f.rangeOf(c.offset, c.size)
+			if err != nil {
+				c.commit(Node{}, err)
+				continue
+			}
+			chunk.Hash = c.hash
+			c.commit(*chunk, nil)
+		}
+	}()
+}
+
+// flush uploads the open packfile and waits until every packfile is uploaded and its files are committed
+func (p *packer) flush() {
+	p.mu.Lock()
+	if p.open != nil {
+		p.upload()
+	}
+	p.mu.Unlock()
+	p.uploads.Wait()
+}
+
+// packWriter buffers a file until it reaches the pack threshold. Files closed below the threshold
+// are appended to the open packfile, larger files are written by the writer created by newWriter.
+// Files closed below the threshold are committed by the callback of WithCommit if ctx carries one.
+type packWriter struct {
+	ctx       context.Context
+	packer    *packer
+	lookup    LookupFunc
+	onChunk   func(chunk Node)
+	newWriter func() io.WriteCloser
+
+	buf    []byte
+	w      io.WriteCloser // Writer of a file which reached the threshold
+	closed bool
+}
+
+func newPackWriter(ctx context.Context, onChunk func(chunk Node), p *packer, lookup LookupFunc, newWriter func() io.WriteCloser) io.WriteCloser {
+	return &packWriter{ctx: ctx, packer: p, lookup: lookup, onChunk: onChunk, newWriter: newWriter}
+}
+
+func (w *packWriter) Write(p []byte) (int, error) {
+	if w.w != nil {
+		return w.w.Write(p)
+	}
+	if w.closed {
+		return 0, ErrClosed
+	}
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if len(w.buf)+len(p) < w.packer.threshold {
+		w.buf = append(w.buf, p...)
+		return len(p), nil
+	}
+	// The file is too large to be packed, buffered bytes are written first
+	w.w = w.newWriter()
+	if len(w.buf) > 0 {
+		if _, err := w.w.Write(w.buf); err != nil {
+			return 0, err
+		}
+		w.buf = nil
+	}
+	return w.w.Write(p)
+}
+
+func (w *packWriter) Close() error {
+	if w.w != nil {
+		return w.w.Close()
+	}
+	if w.closed {
+		return ErrAlreadyClosed
+	}
+	w.closed = true
+	// Nothing was written
+	if len(w.buf) == 0 {
+		return nil
+	}
+	hash := checksum(w.buf)
+	chunk, err := reusableChunk(w.packer.store, w.lookup, hash, len(w.buf))
+	if err != nil {
+		return err
+	}
+	if pending := pendingOf(w.ctx); chunk == nil && pending != nil {
+		if err = w.ctx.Err(); err != nil {
+			return err
+		}
+		commit, err := pending()
+		if err != nil {
+			return err
+		}
+		w.packer.addAsync(w.buf, manifestOf(withChunk(w.ctx, 0, 0)), hash, commit)
+		return nil
+	}
+	if chunk == nil {
+		if chunk, err = w.packer.add(w.ctx, w.buf, manifestOf(withChunk(w.ctx, 0, 0))); err != nil {
+			return err
+		}
+		chunk.Hash = hash
+	}
+	if w.onChunk != nil {
+		w.onChunk(*chunk)
+	}
+	return nil
+}
+
+// Repack copies chunks of a packfile into a new packfile and returns the copies in the same order, chunks sharing
+// a range of the packfile share its copy. Manifest entries of the copied chunks are carried over to the new packfile,
+// so their files can still be recovered. It is meant to compact packfiles whose other ranges are not used anymore.
+func (d *Driver) Repack(ctx context.Context, chunks []Node) ([]Node, error) {
+	if len(chunks) == 0 {
+		return nil, nil
+	}
+	for _, chunk := range chunks {
+		if chunk.Pack == nil || chunk.MId != chunks[0].MId {
+			return nil, fmt.Errorf("repack : chunk %d is not a range of packfile %d", chunk.MId, chunks[0].MId)
+		}
+	}
+	entries, err := d.packEntries(ctx, chunks[0])
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	var files []Manifest
+	offsets := make(map[int]int) // Offset in the packfile -> offset in the new packfile
+	for _, chunk := range chunks {
+		if _, ok := offsets[chunk.Pack.Offset]; ok {
+			continue
+		}
+		// Ranges are verified against their checksum, damaged data is not carried over silently
+		b, err := readShard(ctx, d.Store, chunk)
+		if err != nil {
+			return nil, err
+		}
+		offsets[chunk.Pack.Offset] = len(data)
+		if m, ok := entries[chunk.Pack.Offset]; ok {
+			m.At, m.Len = len(data), len(b)
+			files = append(files, m)
+		}
+		data = append(data, b...)
+	}
+	if files != nil {
+		ctx = context.WithValue(ctx, manifestKey{}, &Manifest{Files: files})
+	}
+	pack, err := d.Store.Put(ctx, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	copies := make([]Node, len(chunks))
+	for i, chunk := range chunks {
+		c := *pack
+		c.Size, c.Hash, c.Pack = chunk.Size, chunk.Hash, &Pack{Offset: offsets[chunk.Pack.Offset], Size: pack.Size}
+		copies[i] = c
+	}
+	return copies, nil
+}
+
+// packEntries returns manifest entries of the packfile holding chunk by offset, entries are only read from stores
+// which keep manifests
+func (d *Driver) packEntries(ctx context.Context, chunk Node) (map[int]Manifest, error) {
+	if r, ok := d.Store.(PackReader); ok {
+		return r.PackEntries(ctx, chunk)
+	}
+	return make(map[int]Manifest), nil
+}
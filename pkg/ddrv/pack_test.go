@@ -0,0 +1,375 @@
+package ddrv_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/forscht/ddrv/pkg/ddrv"
+	"github.com/forscht/ddrv/pkg/ddrv/ddrvtest"
+)
+
+func TestPackfiles(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+
+	for name, passphrase := range map[string]string{"plain": "", "encrypted": "secret"} {
+		var mu sync.Mutex
+		var ranges []string
+		cfg := s.Config(1024, "1")
+		cfg.Passphrase = passphrase
+		cfg.PackThreshold = 512
+		cfg.Transport = transportFunc(func(req *http.Request) (*http.Response, error) {
+			if r := req.Header.Get("Range"); r != "" {
+				mu.Lock()
+				ranges = append(ranges, r)
+				mu.Unlock()
+			}
+			return http.DefaultTransport.RoundTrip(req)
+		})
+		driver := newDriver(t, cfg)
+
+		for wname, writer := range map[string]func(ctx context.Context, onChunk func(ddrv.Node)) io.WriteCloser{
+			"writer":  driver.NewWriterContext,
+			"nwriter": driver.NewNWriterContext,
+		} {
+			t.Run(name+"/"+wname, func(t *testing.T) {
+				seen := make(map[string]bool)
+				for _, m := range s.Messages("1") {
+					seen[m.Id] = true
+				}
+				// Files written together share a packfile
+				files := make([][]byte, 6)
+				nodes := make([]ddrv.Node, len(files))
+				errs := make([]error, len(files))
+				var wg sync.WaitGroup
+				for i := range files {
+					files[i] = randBytes(t, 150)
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						ctx := ddrv.WithManifest(context.Background(), "f"+strconv.Itoa(i), "/small/"+strconv.Itoa(i), 0, 150)
+						w := writer(ctx, func(chunk ddrv.Node) { nodes[i] = chunk })
+						if _, err := w.Write(files[i]); err != nil {
+							errs[i] = err
+							return
+						}
+						errs[i] = w.Close()
+					}(i)
+				}
+				wg.Wait()
+				for i, err := range errs {
+					if err != nil {
+						t.Fatalf("write of file %d error = %v", i, err)
+					}
+				}
+				var added []ddrv.Message
+				for _, m := range s.Messages("1") {
+					if seen[m.Id] {
+						continue
+					}
+					msg := ddrv.Message{Id: m.Id, Content: m.Content}
+					for _, a := range m.Attachments {
+						msg.Attachments = append(msg.Attachments, ddrv.Node{URL: a.URL, Size: a.Size})
+					}
+					added = append(added, msg)
+				}
+				if len(added) != 1 {
+					t.Fatalf("small files were uploaded in %d messages, want 1", len(added))
+				}
+				offsets := make(map[int]bool)
+				for i, node := range nodes {
+					if node.Pack == nil || node.MId != nodes[0].MId || node.Size != 150 || node.Pack.Size != 900 {
+						t.Fatalf("file %d was written to %+v, want a range of a packfile of 900 bytes", i, node)
+					}
+					offsets[node.Pack.Offset] = true
+				}
+				if len(offsets) != len(files) {
+					t.Errorf("files were written to %d ranges, want %d", len(offsets), len(files))
+				}
+
+				// Only the range of a file is read
+				mu.Lock()
+				ranges = nil
+				mu.Unlock()
+				for i, node := range nodes {
+					if got := read(t, driver, []ddrv.Node{node}, 0); !bytes.Equal(got, files[i]) {
+						t.Errorf("read of packed file %d returned different data", i)
+					}
+					if got := read(t, driver, []ddrv.Node{node}, 10); !bytes.Equal(got, files[i][10:]) {
+						t.Errorf("read of packed file %d from 10 returned different data", i)
+					}
+				}
+				if passphrase == "" {
+					mu.Lock()
+					want := fmt.Sprintf("bytes=%d-%d", nodes[0].Pack.Offset, nodes[0].Pack.Offset+149)
+					if len(ranges) == 0 || ranges[0] != want {
+						t.Errorf("first read requested ranges %v, want %s", ranges, want)
+					}
+					mu.Unlock()
+				}
+				for _, full := range []bool{false, true} {
+					if err := driver.VerifyNode(context.Background(), nodes[0], full); err != nil {
+						t.Errorf("VerifyNode(full=%v) error = %v", full, err)
+					}
+				}
+
+				// The manifest of the packfile describes every file
+				chunks, manifests, err := driver.Rest.Chunks(&added[0])
+				if err != nil || len(chunks) != len(files) {
+					t.Fatalf("Chunks() = %d chunks, %v, want %d chunks", len(chunks), err, len(files))
+				}
+				for i, node := range nodes {
+					for j, chunk := range chunks {
+						if chunk.Pack.Offset != node.Pack.Offset {
+							continue
+						}
+						if m := manifests[j]; m.File != "f"+strconv.Itoa(i) || chunk.Size != node.Size {
+							t.Errorf("range of file %d has manifest %+v", i, m)
+						}
+					}
+				}
+
+				// Larger files are not packed
+				var large []ddrv.Node
+				write(t, writer(context.Background(), func(chunk ddrv.Node) { large = append(large, chunk) }), randBytes(t, 2000))
+				for _, node := range large {
+					if node.Pack != nil {
+						t.Errorf("chunk of a large file is a range of a packfile")
+					}
+				}
+
+				// Repacked files are copied into a new packfile
+				copies, err := driver.Repack(context.Background(), nodes[:2])
+				if err != nil || len(copies) != 2 {
+					t.Fatalf("Repack() = %v, %v", copies, err)
+				}
+				for i, c := range copies {
+					if c.MId == nodes[0].MId || c.Pack == nil || c.Pack.Size != 300 || c.Hash != nodes[i].Hash {
+						t.Errorf("copy %d = %+v, want a range of a new packfile of 300 bytes", i, c)
+					}
+					if got := read(t, driver, []ddrv.Node{c}, 0); !bytes.Equal(got, files[i]) {
+						t.Errorf("read of repacked file %d returned different data", i)
+					}
+				}
+			})
+		}
+	}
+
+	for name, cfg := range map[string]*ddrv.Config{
+		"threshold above chunk size": func() *ddrv.Config { c := s.Config(1024, "1"); c.PackThreshold = 2048; return c }(),
+		"erasure coding": func() *ddrv.Config {
+			c := s.Config(1024, "1")
+			c.PackThreshold, c.DataShards, c.ParityShards = 512, 2, 1
+			return c
+		}(),
+	} {
+		if _, err := ddrv.New(cfg); err == nil {
+			t.Errorf("New() with %s succeeded", name)
+		}
+	}
+}
+
+func TestPackfilesCancel(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	cfg := s.Config(1024, "1")
+	cfg.PackThreshold = 512
+	cfg.PackDelay = 300 * time.Millisecond
+	driver := newDriver(t, cfg)
+
+	for name, tc := range map[string]struct {
+		last     bool // Whether the cancelled file is appended after the other one
+		packSize int
+	}{
+		"last file":      {last: true, packSize: 150},
+		"followed files": {last: false, packSize: 250},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(ddrv.WithManifest(context.Background(), "cancelled", "/cancelled", 0, 100))
+			defer cancel()
+			cancelled := make(chan error, 1)
+			var node ddrv.Node
+			written := make(chan error, 1)
+			writeCancelled := func() {
+				w := driver.NewWriterContext(ctx, nil)
+				if _, err := w.Write(randBytes(t, 100)); err != nil {
+					cancelled <- err
+					return
+				}
+				cancelled <- w.Close()
+			}
+			writeOther := func() {
+				w := driver.NewWriterContext(ddrv.WithManifest(context.Background(), "other", "/other", 0, 150), func(chunk ddrv.Node) { node = chunk })
+				if _, err := w.Write(randBytes(t, 150)); err != nil {
+					written <- err
+					return
+				}
+				written <- w.Close()
+			}
+			first, second := writeCancelled, writeOther
+			if tc.last {
+				first, second = writeOther, writeCancelled
+			}
+			go first()
+			time.Sleep(50 * time.Millisecond)
+			go second()
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+			if err := <-cancelled; !errors.Is(err, context.Canceled) {
+				t.Fatalf("cancelled write error = %v, want %v", err, context.Canceled)
+			}
+			if err := <-written; err != nil {
+				t.Fatalf("write error = %v", err)
+			}
+			if node.Pack == nil || node.Pack.Size != tc.packSize {
+				t.Fatalf("file was written to %+v, want a range of a packfile of %d bytes", node, tc.packSize)
+			}
+
+			// The manifest of the packfile only describes the written file
+			for _, m := range s.Messages("1") {
+				if m.Id != strconv.FormatInt(node.MId, 10) {
+					continue
+				}
+				msg := ddrv.Message{Id: m.Id, Content: m.Content}
+				for _, a := range m.Attachments {
+					msg.Attachments = append(msg.Attachments, ddrv.Node{URL: a.URL, Size: a.Size})
+				}
+				_, manifests, err := driver.Rest.Chunks(&msg)
+				if err != nil || len(manifests) != 1 || manifests[0].File != "other" {
+					t.Errorf("Chunks() = %+v, %v, want the manifest of the written file only", manifests, err)
+				}
+			}
+		})
+	}
+}
+
+func TestPackfilesDedup(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	cfg := s.Config(1024, "1")
+	cfg.PackThreshold = 512
+	driver := newDriver(t, cfg)
+	data := randBytes(t, 100)
+	var first []ddrv.Node
+	write(t, driver.NewWriter(func(chunk ddrv.Node) { first = append(first, chunk) }), data)
+	driver.Lookup = func(hash string, size int) (*ddrv.Node, error) {
+		if hash == first[0].Hash {
+			return &first[0], nil
+		}
+		return nil, nil
+	}
+	before := len(s.Messages("1"))
+	var second []ddrv.Node
+	write(t, driver.NewWriter(func(chunk ddrv.Node) { second = append(second, chunk) }), data)
+	if got := len(s.Messages("1")) - before; got != 0 {
+		t.Errorf("second write created %d messages, want 0", got)
+	}
+	if len(second) != 1 || second[0].Pack == nil || *second[0].Pack != *first[0].Pack {
+		t.Fatalf("second write = %+v, want the range %+v", second, first[0].Pack)
+	}
+	if got := read(t, driver, second, 0); !bytes.Equal(got, data) {
+		t.Error("read of deduplicated packed file returned different data")
+	}
+}
+
+func TestPackfilesSequential(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	cfg := s.Config(1024, "1")
+	cfg.PackThreshold = 512
+	cfg.PackDelay = time.Second
+	driver := newDriver(t, cfg)
+
+	// Files written one after another share a packfile, their writers do not wait for the upload
+	type result struct {
+		i    int
+		node ddrv.Node
+		err  error
+	}
+	committed := make(chan result, 5)
+	files := make([][]byte, cap(committed))
+	pending := 0
+	start := time.Now()
+	for i := range files {
+		files[i] = randBytes(t, 150)
+		i := i
+		ctx := ddrv.WithCommit(context.Background(), func() (func(chunk ddrv.Node, err error), error) {
+			pending++
+			return func(chunk ddrv.Node, err error) { committed <- result{i, chunk, err} }, nil
+		})
+		w := driver.NewWriterContext(ctx, func(chunk ddrv.Node) { t.Errorf("onChunk called for packed file %d", i) })
+		write(t, w, files[i])
+	}
+	if elapsed := time.Since(start); elapsed >= cfg.PackDelay {
+		t.Errorf("sequential writes took %v, want less than the pack delay %v", elapsed, cfg.PackDelay)
+	}
+	if got := len(s.Messages("1")); got != 0 || pending != len(files) {
+		t.Fatalf("%d messages and %d pending files before the pack delay passed, want 0 and %d", got, pending, len(files))
+	}
+
+	nodes := make([]ddrv.Node, len(files))
+	for range files {
+		select {
+		case r := <-committed:
+			if r.err != nil {
+				t.Fatalf("commit of file %d error = %v", r.i, r.err)
+			}
+			nodes[r.i] = r.node
+		case <-time.After(5 * time.Second):
+			t.Fatal("packfile was not committed")
+		}
+	}
+	if got := len(s.Messages("1")); got >= len(files) {
+		t.Errorf("%d sequential files were uploaded in %d messages, want fewer", len(files), got)
+	}
+	for i, node := range nodes {
+		if node.Pack == nil || node.MId != nodes[0].MId || node.Pack.Offset != i*150 || node.Hash == "" {
+			t.Errorf("file %d was committed as %+v, want range %d of a packfile", i, node, i)
+		}
+		if got := read(t, driver, []ddrv.Node{node}, 0); !bytes.Equal(got, files[i]) {
+			t.Errorf("read of packed file %d returned different data", i)
+		}
+	}
+
+	// Close uploads the open packfile and waits for its files to be committed
+	cfg.PackDelay = time.Hour
+	driver = newDriver(t, cfg)
+	for i := 0; i < 3; i++ {
+		i := i
+		ctx := ddrv.WithCommit(context.Background(), func() (func(chunk ddrv.Node, err error), error) {
+			return func(chunk ddrv.Node, err error) { committed <- result{i, chunk, err} }, nil
+		})
+		write(t, driver.NewWriterContext(ctx, nil), randBytes(t, 100))
+	}
+	before := len(s.Messages("1"))
+	if err := driver.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if got := len(s.Messages("1")) - before; got != 1 || len(committed) != 3 {
+		t.Errorf("Close() uploaded %d messages and committed %d files, want 1 and 3", got, len(committed))
+	}
+	for len(committed) > 0 {
+		if r := <-committed; r.err != nil || r.node.Pack == nil || r.node.Pack.Size != 300 {
+			t.Errorf("commit of file %d = %+v, %v, want a range of the flushed packfile", r.i, r.node, r.err)
+		}
+	}
+
+	// Pending errors fail the write before the file is packed
+	perr := errors.New("no session")
+	ctx := ddrv.WithCommit(context.Background(), func() (func(chunk ddrv.Node, err error), error) { return nil, perr })
+	w := driver.NewWriterContext(ctx, nil)
+	if _, err := w.Write(randBytes(t, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); !errors.Is(err, perr) {
+		t.Errorf("Close() error = %v, want %v", err, perr)
+	}
+}
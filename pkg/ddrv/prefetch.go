@@ -0,0 +1,80 @@
+package ddrv
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+)
+
+// DefaultPrefetchMemory is the default cap of memory used by prefetched chunks of all readers of a Driver
+const DefaultPrefetchMemory = 256 * 1024 * 1024
+
+// budget limits the number of bytes buffered by prefetching readers.
+type budget struct {
+	mu   sync.Mutex
+	used int
+	max  int
+}
+
+func newBudget(max int) *budget {
+	return &budget{max: max}
+}
+
+// tryAcquire reserves n bytes if they fit into the budget, it never blocks.
+func (b *budget) tryAcquire(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used+n > b.max {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+func (b *budget) release(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+}
+
+// fetch is a chunk downloaded in background
+type fetch struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// prefetch starts downloading the whole chunk into memory.
+func prefetch(ctx context.Context, store ChunkStore, chunk Node, stripe []Node) *fetch {
+	f := &fetch{done: make(chan struct{})}
+	go func() {
+		defer close(f.done)
+		reader, err := readChunk(ctx, store, chunk, stripe, 0, chunk.Size-1)
+		if err != nil {
+			f.err = err
+			return
+		}
+		defer reader.Close()
+		buf := bytes.NewBuffer(make([]byte, 0, chunk.Size))
+		if _, err = io.Copy(buf, reader); err != nil {
+			f.err = err
+			return
+		}
+		f.data = buf.Bytes()
+	}()
+	return f
+}
+
+// wait returns reader of the downloaded chunk
+func (f *fetch) wait(ctx context.Context) (io.ReadCloser, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-f.done:
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return io.NopCloser(bytes.NewReader(f.data)), nil
+}
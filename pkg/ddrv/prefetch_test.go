@@ -0,0 +1,47 @@
+package ddrv_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/forscht/ddrv/pkg/ddrv"
+	"github.com/forscht/ddrv/pkg/ddrv/ddrvtest"
+)
+
+func TestPrefetch(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+
+	for _, memory := range []int{0, 5000} {
+		cfg := s.Config(4096, "1", "2", "3")
+		cfg.Prefetch = 3
+		cfg.PrefetchMemory = memory
+		driver := newDriver(t, cfg)
+		data := randBytes(t, 4096*6+100)
+		var nodes []ddrv.Node
+		write(t, driver.NewNWriter(func(chunk ddrv.Node) { nodes = append(nodes, chunk) }), data)
+
+		for _, pos := range []int64{0, 100, 4096, 4096*5 + 50} {
+			reads := s.Stats().CDNReads
+			if got := read(t, driver, nodes, pos); !bytes.Equal(got, data[pos:]) {
+				t.Errorf("memory %d read at %d: got %d bytes, want %d equal bytes", memory, pos, len(got), len(data[pos:]))
+			}
+			if got, want := s.Stats().CDNReads-reads, len(nodes)-int(pos/4096); got != want {
+				t.Errorf("memory %d read at %d: fetched %d chunks, want %d", memory, pos, got, want)
+			}
+		}
+
+		// Closing reader early releases prefetched chunks
+		for i := 0; i < 3; i++ {
+			r, err := driver.NewReader(nodes, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = io.ReadFull(r, make([]byte, 5000)); err != nil {
+				t.Fatal(err)
+			}
+			_ = r.Close()
+		}
+	}
+}
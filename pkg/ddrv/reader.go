@@ -1,21 +1,42 @@
 package ddrv
 
-import "io"
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
 
 // Reader is a structure that manages the reading of a sequence of Chunks.
 // It reads chunks in order, closing each one after it's Read and moving on to the next.
 type Reader struct {
+	ctx    context.Context
+	cancel context.CancelFunc
 	chunks []Node        // The list of chunks to be Read.
+	nodes  []Node        // All chunks of the file, erasure coded chunks are reconstructed from their stripe
+	first  int           // Index of chunks[0] in nodes
 	curIdx int           // Index of the chunk that is currently being Read.
 	closed bool          // Indicates whether the Reader has been closed.
-	rest   *Rest         // rest object provides access to the chunks.
+	store  ChunkStore    // Storage the chunks are read from.
 	reader io.ReadCloser // The reader that is reading the current chunk.
 	pos    int64
+
+	window  int      // Number of chunks to download ahead of the current chunk
+	budget  *budget  // Memory budget shared by prefetching readers
+	fetches []*fetch // Chunks downloaded in background, indexed like chunks
 }
 
 // NewReader creates new Reader instance which implements io.ReadCloser.
-func NewReader(chunks []Node, pos int64, rest *Rest) (io.ReadCloser, error) {
-	r := &Reader{chunks: chunks, pos: pos, rest: rest}
+func NewReader(chunks []Node, pos int64, store ChunkStore) (io.ReadCloser, error) {
+	return newReader(context.Background(), chunks, pos, store, 0, nil)
+}
+
+func newReader(ctx context.Context, chunks []Node, pos int64, store ChunkStore, window int, budget *budget) (io.ReadCloser, error) {
+	r := &Reader{chunks: chunks, nodes: chunks, pos: pos, store: store, window: window, budget: budget}
 	// Calculate Start and End for each part
 	var offset int64
 	for i := range r.chunks {
@@ -27,6 +48,7 @@ func NewReader(chunks []Node, pos int64, rest *Rest) (io.ReadCloser, error) {
 	if r.pos > offset {
 		return nil, io.EOF
 	}
+	r.ctx, r.cancel = context.WithCancel(ctx)
 	// Find starting chunk and drop all the chunks that are completely before 'pos'
 	var start int
 	for i, chunk := range r.chunks {
@@ -34,9 +56,13 @@ func NewReader(chunks []Node, pos int64, rest *Rest) (io.ReadCloser, error) {
 		if start > int(r.pos) {
 			// Drop extra chunks to save memory
 			r.chunks = r.chunks[i:]
+			r.first = i
 			break
 		}
 	}
+	if r.window > 0 && r.budget != nil {
+		r.fetches = make([]*fetch, len(r.chunks))
+	}
 
 	return r, nil
 }
@@ -91,6 +117,13 @@ func (r *Reader) Close() error {
 	if r.reader != nil {
 		_ = r.reader.Close()
 	}
+	r.cancel()
+	for i, f := range r.fetches {
+		if f != nil {
+			r.budget.release(r.chunks[i].Size)
+			r.fetches[i] = nil
+		}
+	}
 	r.closed = true
 	return nil
 }
@@ -110,11 +143,104 @@ func (r *Reader) next() error {
 		start = int(r.pos - chunk.Start)
 	}
 
-	reader, err := r.rest.ReadAttachment(&chunk, start, chunk.Size-1)
+	var reader io.ReadCloser
+	var err error
+	r.prefetch()
+	if r.fetches != nil && r.fetches[r.curIdx] != nil {
+		reader, err = r.fetches[r.curIdx].wait(r.ctx)
+	} else {
+		reader, err = readChunk(r.ctx, r.store, chunk, r.stripe(r.curIdx), start, chunk.Size-1)
+	}
 	if err != nil {
 		return err
 	}
+	// Chunk is read in full, verify it against the checksum
+	if start == 0 && chunk.Hash != "" {
+		reader = &verifier{ReadCloser: reader, hash: sha256.New(), want: chunk.Hash, mid: chunk.MId}
+	}
 	r.reader = reader
 
 	return nil
 }
+
+// prefetch releases memory of the previous prefetched chunk and starts downloading
+// the chunks in window after the current chunk, as long as they fit into memory budget.
+func (r *Reader) prefetch() {
+	if r.fetches == nil {
+		return
+	}
+	if prev := r.curIdx - 1; prev >= 0 && r.fetches[prev] != nil {
+		r.budget.release(r.chunks[prev].Size)
+		r.fetches[prev] = nil
+	}
+	for i := r.curIdx + 1; i < len(r.chunks) && i <= r.curIdx+r.window; i++ {
+		if r.fetches[i] != nil {
+			continue
+		}
+		if !r.budget.tryAcquire(r.chunks[i].Size) {
+			return
+		}
+		r.fetches[i] = prefetch(r.ctx, r.store, r.chunks[i], r.stripe(i))
+	}
+}
+
+// stripe returns the data chunks of the stripe of chunks[i], or nil if the chunk is not erasure coded.
+func (r *Reader) stripe(i int) []Node {
+	s := r.chunks[i].Stripe
+	if s == nil {
+		return nil
+	}
+	first := r.first + i - s.Index
+	if first < 0 || first+s.Data > len(r.nodes) {
+		return nil
+	}
+	return r.nodes[first : first+s.Data]
+}
+
+// readChunk reads the bytes from start to end of the chunk. If the chunk can not be read,
+// for example because its message was deleted, its replicas are read in order instead.
+// Erasure coded chunks are reconstructed from the other chunks of stripe and the parity shards.
+// Only the range of the chunk is read from packfiles.
+func readChunk(ctx context.Context, store ChunkStore, chunk Node, stripe []Node, start, end int) (io.ReadCloser, error) {
+	if chunk.Stripe != nil {
+		// The whole chunk is needed to tell if it is damaged
+		data, err := readShard(ctx, store, chunk)
+		if err != nil && ctx.Err() == nil && !errors.Is(err, ErrNoPassphrase) {
+			data, err = reconstruct(ctx, store, chunk, stripe)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(data[start : end+1])), nil
+	}
+	reader, err := getChunk(ctx, store, chunk, start, end)
+	for i := range chunk.Replicas {
+		// Replicas share the iv, so they fail without passphrase as well
+		if err == nil || ctx.Err() != nil || errors.Is(err, ErrNoPassphrase) {
+			break
+		}
+		replica := chunk.replica(i)
+		reader, err = getChunk(ctx, store, replica, start, end)
+	}
+	return reader, err
+}
+
+// verifier computes the checksum of the data read from a chunk and returns ErrChecksum
+// instead of io.EOF if it does not match the expected checksum.
+type verifier struct {
+	io.ReadCloser
+	hash hash.Hash
+	want string
+	mid  int64
+}
+
+func (v *verifier) Read(p []byte) (int, error) {
+	n, err := v.ReadCloser.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF {
+		if got := hex.EncodeToString(v.hash.Sum(nil)); got != v.want {
+			return n, fmt.Errorf("read chunk %d : %w : expected %s but received %s", v.mid, ErrChecksum, v.want, got)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,122 @@
+package ddrv_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/forscht/ddrv/pkg/ddrv"
+	"github.com/forscht/ddrv/pkg/ddrv/ddrvtest"
+)
+
+func TestReaderEOF(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	driver := newDriver(t, s.Config(1024))
+
+	var nodes []ddrv.Node
+	write(t, driver.NewWriter(func(chunk ddrv.Node) { nodes = append(nodes, chunk) }), randBytes(t, 2000))
+	if _, err := driver.NewReader(nodes, 2001); err != io.EOF {
+		t.Errorf("NewReader() past the end error = %v, want %v", err, io.EOF)
+	}
+	if got := read(t, driver, nil, 0); len(got) != 0 {
+		t.Errorf("read empty file got %d bytes", len(got))
+	}
+}
+
+func TestReplicas(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	cfg := s.Config(1024, "1", "2", "3")
+	cfg.Replicas = 2
+	driver := newDriver(t, cfg)
+	cfg.Prefetch = 2
+	prefetching := newDriver(t, cfg)
+
+	data := randBytes(t, 4000)
+	var nodes []ddrv.Node
+	write(t, driver.NewNWriter(func(chunk ddrv.Node) { nodes = append(nodes, chunk) }), data)
+	messages := len(s.Messages("1")) + len(s.Messages("2")) + len(s.Messages("3"))
+	if messages != 2*len(nodes) {
+		t.Fatalf("%d messages for %d chunks, want 2 copies of every chunk", messages, len(nodes))
+	}
+	// Attachment URLs look like http://host/attachments/{channel}/...
+	channel := func(url string) string { return strings.Split(url, "/")[4] }
+	for i, node := range nodes {
+		if len(node.Replicas) != 1 || node.Replicas[0].MId == node.MId {
+			t.Fatalf("chunk %d has replicas %+v, want one replica", i, node.Replicas)
+		}
+		if channel(node.URL) == channel(node.Replicas[0].URL) {
+			t.Errorf("chunk %d and its replica are stored in the same channel %s", i, channel(node.URL))
+		}
+	}
+
+	// Expired links of replicas are refreshed too
+	expired := make([]*ddrv.Node, len(nodes))
+	for i := range nodes {
+		nodes[i].Replicas[0].Ex = 0
+		expired[i] = &nodes[i]
+	}
+	if err := driver.UpdateNodes(expired); err != nil {
+		t.Fatalf("UpdateNodes() error = %v", err)
+	}
+	for i, node := range nodes {
+		if node.Expired(int(time.Now().Unix())) {
+			t.Errorf("replica of chunk %d was not refreshed", i)
+		}
+	}
+
+	// Readers fall back to replicas once messages of chunks are deleted
+	primaries := make([]ddrv.Node, len(nodes))
+	for i, node := range nodes {
+		primaries[i] = node
+		primaries[i].Replicas = nil
+	}
+	if err := driver.DeleteNodes(primaries); err != nil {
+		t.Fatalf("DeleteNodes() error = %v", err)
+	}
+	for name, d := range map[string]*ddrv.Driver{"reader": driver, "prefetch": prefetching} {
+		if got := read(t, d, nodes, 0); !bytes.Equal(got, data) {
+			t.Errorf("%s read without chunk messages returned different data", name)
+		}
+	}
+
+	// Deduplicated chunks keep their replicas
+	index := make(map[string]ddrv.Node)
+	for _, node := range nodes {
+		index[node.Hash] = node
+	}
+	dedup := newDriver(t, s.Config(1024, "1", "2", "3"))
+	dedup.Lookup = func(hash string, size int) (*ddrv.Node, error) {
+		if node, ok := index[hash]; ok {
+			return &node, nil
+		}
+		return nil, nil
+	}
+	var reused []ddrv.Node
+	write(t, dedup.NewWriter(func(chunk ddrv.Node) { reused = append(reused, chunk) }), data)
+	for i, node := range reused {
+		if len(node.Replicas) != 1 || node.Replicas[0].MId != nodes[i].Replicas[0].MId {
+			t.Errorf("deduplicated chunk %d has replicas %+v, want %+v", i, node.Replicas, nodes[i].Replicas)
+		}
+	}
+	if got := read(t, dedup, reused, 0); !bytes.Equal(got, data) {
+		t.Error("read of deduplicated chunks without chunk messages returned different data")
+	}
+
+	// Replicas are deleted with chunks
+	if err := driver.DeleteNodes(nodes); err != nil {
+		t.Fatalf("DeleteNodes() error = %v", err)
+	}
+	if messages = len(s.Messages("1")) + len(s.Messages("2")) + len(s.Messages("3")); messages != 0 {
+		t.Errorf("%d messages left after DeleteNodes(), want 0", messages)
+	}
+
+	cfg = s.Config(1024, "1", "2")
+	cfg.Replicas = 3
+	if _, err := ddrv.New(cfg); err == nil {
+		t.Errorf("New() with more replicas than channels succeeded")
+	}
+}
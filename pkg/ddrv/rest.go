@@ -1,10 +1,15 @@
 package ddrv
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -14,99 +19,636 @@ import (
 )
 
 const (
-	baseURL    = "https://discord.com/api/v10"
-	UserAgent  = "PostmanRuntime/7.35.0"
-	ReqTimeout = 60 * time.Second
+	DefaultAPIURL = "https://discord.com/api/v10"
+	UserAgent     = "PostmanRuntime/7.35.0"
+	ReqTimeout    = 60 * time.Second
 )
 
+// DefaultCDNHosts are the hosts discord serves attachments from
+var DefaultCDNHosts = []string{"cdn.discordapp.com", "media.discordapp.net"}
+
+// MaxBulkDelete is the maximum number of messages deleted by a single bulk delete request
+const MaxBulkDelete = 100
+
+// MaxAttachments is the maximum number of attachments of a message
+const MaxAttachments = 10
+
+// MaxRefreshURLs is the maximum number of attachment URLs refreshed by a single refresh-urls request
+const MaxRefreshURLs = 50
+
+// BulkDeleteMaxAge is the age up to which messages are deleted in bulk. Discord rejects messages
+// older than 2 weeks, an hour is left for clock skew.
+const BulkDeleteMaxAge = 14*24*time.Hour - time.Hour
+
 type Rest struct {
-	channels     []string
-	nitro        bool
-	limiter      *Limiter
-	client       *http.Client
-	tokens       []string
-	mutex        *sync.Mutex
-	lastChIdx    int
-	lastTokenIdx int
-	chunkSize    int
-}
-
-func NewRest(tokens []string, channels []string, chunkSize int, nitro bool) *Rest {
+	baseURL     string
+	cdnHosts    map[string]bool
+	channels    []string
+	webhooks    []webhook // upload targets used instead of channels when set
+	nitro       bool
+	limiter     *Limiter
+	client      *http.Client // client for API requests, bounded by ReqTimeout
+	cdn         *http.Client // client for attachment transfers, shares transport with client
+	tokens      *tokenPool
+	mutex       *sync.Mutex
+	lastChIdx   int
+	lastHookIdx int
+	replicas    int  // number of copies of every chunk, each in a different channel or webhook
+	attachments int  // number of chunks writers pack into a message
+	bulkDelete  bool // delete messages younger than BulkDeleteMaxAge in bulk
+	chunkSize   int
+	crypt       *crypter // nil if encryption is disabled
+	retry       RetryPolicy
+}
+
+// NewRest creates a Rest client from cfg. cfg.ChunkSize must already be adjusted for cfg.TokenType.
+func NewRest(cfg *Config) (*Rest, error) {
+	transport, err := newTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
+	baseURL := cfg.APIURL
+	if baseURL == "" {
+		baseURL = DefaultAPIURL
+	}
+	hosts := cfg.CDNHosts
+	if len(hosts) == 0 {
+		hosts = DefaultCDNHosts
+	}
+	cdnHosts := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		cdnHosts[strings.ToLower(host)] = true
+	}
+	webhooks := make([]webhook, 0, len(cfg.Webhooks))
+	for _, hookURL := range cfg.Webhooks {
+		hook, err := parseWebhook(hookURL)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, hook)
+	}
+	// Webhooks can not create attachments from upload URLs
+	if len(webhooks) > 0 && cfg.Nitro {
+		return nil, fmt.Errorf("webhooks can not be used with nitro uploads")
+	}
+	replicas := cfg.Replicas
+	if replicas <= 0 {
+		replicas = 1
+	}
+	targets := len(cfg.Channels)
+	if len(webhooks) > 0 {
+		targets = len(webhooks)
+	}
+	if replicas > targets {
+		return nil, fmt.Errorf("not enough channels or webhooks for %d replicas : %d upload targets", replicas, targets)
+	}
+	attachments := cfg.Attachments
+	if attachments <= 0 {
+		attachments = 1
+	}
+	if attachments > MaxAttachments {
+		return nil, fmt.Errorf("a message holds up to %d attachments : %d attachments", MaxAttachments, attachments)
+	}
+	if attachments > 1 && cfg.ParityShards > 0 {
+		return nil, fmt.Errorf("attachments can not be packed with erasure coding, a lost message would lose several chunks of a stripe")
+	}
+	// Every chunk of a message counts towards the upload limit of the token type
+	if limit, _ := parseChunkSize(0, cfg.TokenType); attachments*cfg.ChunkSize > limit {
+		return nil, fmt.Errorf("%d attachments of %d bytes exceed the upload limit of %d bytes", attachments, cfg.ChunkSize, limit)
+	}
+	if cfg.BulkDelete && cfg.TokenType != TokenBot {
+		return nil, fmt.Errorf("bulk delete is only available to bot tokens")
+	}
+	var crypt *crypter
+	if cfg.Passphrase != "" {
+		salt := cfg.Salt
+		if salt == "" && cfg.SaltFile != "" {
+			data, err := os.ReadFile(cfg.SaltFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read salt file : %w", err)
+			}
+			salt = strings.TrimSpace(string(data))
+		}
+		if crypt, err = newCrypter(cfg.Passphrase, cfg.Cipher, salt); err != nil {
+			return nil, err
+		}
+	}
 	return &Rest{
-		client:       &http.Client{Timeout: ReqTimeout},
-		channels:     channels,
-		nitro:        nitro,
-		limiter:      NewLimiter(),
-		tokens:       tokens,
-		mutex:        &sync.Mutex{},
-		lastTokenIdx: 0,
-		lastChIdx:    0,
-		chunkSize:    chunkSize,
+		crypt:       crypt,
+		retry:       cfg.Retry.withDefaults(),
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+		cdnHosts:    cdnHosts,
+		client:      &http.Client{Timeout: ReqTimeout, Transport: transport},
+		cdn:         &http.Client{Transport: transport},
+		channels:    cfg.Channels,
+		webhooks:    webhooks,
+		nitro:       cfg.Nitro,
+		limiter:     NewLimiter(),
+		tokens:      newTokenPool(cfg.Tokens, cfg.TokenCooldown),
+		mutex:       &sync.Mutex{},
+		lastChIdx:   0,
+		replicas:    replicas,
+		attachments: attachments,
+		bulkDelete:  cfg.BulkDelete,
+		chunkSize:   cfg.ChunkSize,
+	}, nil
+}
+
+// newTransport returns the RoundTripper shared by every request Rest makes.
+func newTransport(cfg *Config) (http.RoundTripper, error) {
+	if cfg.Transport != nil {
+		return cfg.Transport, nil
 	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.Proxy != "" {
+		proxyURL, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url %s : %v", cfg.Proxy, err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %s", proxyURL.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	return transport, nil
 }
 
-// token returns the next token in a round-robin fashion.
-func (r *Rest) token() string {
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
-	token := r.tokens[r.lastTokenIdx]
-	r.lastTokenIdx = (r.lastTokenIdx + 1) % len(r.tokens)
-	return token
+// TokenStatus returns the health of every token, in the order they are configured.
+func (r *Rest) TokenStatus() []TokenStatus {
+	return r.tokens.status()
+}
+
+// LimiterStats returns wait-time statistics of the rate limiter.
+func (r *Rest) LimiterStats() LimiterStats {
+	return r.limiter.Stats()
+}
+
+// Channels returns ids of the configured channels
+func (r *Rest) Channels() []string {
+	return append([]string(nil), r.channels...)
+}
+
+// WebhookChannels returns ids of the channels the configured webhooks post to, in the order of the webhooks.
+func (r *Rest) WebhookChannels() ([]string, error) {
+	return r.WebhookChannelsContext(context.Background())
+}
+
+// WebhookChannelsContext is like WebhookChannels but cancels the requests when ctx is done.
+// The channel of a webhook can be changed on discord, so it is looked up every time.
+func (r *Rest) WebhookChannelsContext(ctx context.Context) ([]string, error) {
+	const op = "get webhook"
+	channels := make([]string, 0, len(r.webhooks))
+	for _, hook := range r.webhooks {
+		resp, err := r.doWebhookReq(ctx, op, "GET /webhooks/{id}/{token}", hook.id, jsonReq(ctx, http.MethodGet, hook.url, ""), true)
+		if err != nil {
+			return nil, err
+		}
+		var body struct {
+			ChannelId string `json:"channel_id"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, &StatusError{Op: op, Expected: http.StatusOK, StatusCode: resp.StatusCode}
+		}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		channels = append(channels, body.ChannelId)
+	}
+	return channels, nil
+}
+
+// Put uploads the chunk as an attachment, it implements ChunkStore.
+func (r *Rest) Put(ctx context.Context, reader io.Reader) (*Node, error) {
+	return r.CreateAttachmentContext(ctx, reader)
+}
+
+// Get reads the chunk attachment, it implements ChunkStore.
+func (r *Rest) Get(ctx context.Context, chunk *Node, start, end int) (io.ReadCloser, error) {
+	return r.ReadAttachmentContext(ctx, chunk, start, end)
+}
+
+// Delete deletes the message holding the chunk, it implements ChunkStore.
+func (r *Rest) Delete(ctx context.Context, chunk Node) error {
+	return r.DeleteMessageContext(ctx, extractChannelId(chunk.URL), chunk.MId)
+}
+
+// Refresh updates signed attachment URLs of expired chunks, it implements ChunkStore. URLs are refreshed
+// up to MaxRefreshURLs per request with the refresh-urls endpoint. Messages of URLs which could not be refreshed
+// that way are fetched in pages instead, so one request refreshes the chunks of up to 100 consecutive messages.
+// Expired attachments of a message are always refreshed by the same request.
+func (r *Rest) Refresh(ctx context.Context, chunks []*Node) error {
+	return r.refresh(ctx, chunks, int(time.Now().Unix()))
+}
+
+// RefreshBefore is like Refresh but refreshes links which expire before the time as well, it implements Refresher.
+func (r *Rest) RefreshBefore(ctx context.Context, chunks []*Node, before time.Time) error {
+	return r.refresh(ctx, chunks, int(before.Unix()))
+}
+
+// PutBatch uploads the chunks as attachments of a single message, it implements BatchPutter.
+func (r *Rest) PutBatch(ctx context.Context, readers []io.Reader) ([]*Node, error) {
+	return r.CreateAttachmentsContext(ctx, readers)
+}
+
+// BatchSize returns the number of chunks uploaded as attachments of a message, it implements BatchPutter.
+func (r *Rest) BatchSize() int {
+	return r.attachments
+}
+
+// DeleteBatch deletes messages of the chunks, in bulk if it is enabled, it implements BatchDeleter.
+func (r *Rest) DeleteBatch(ctx context.Context, chunks []Node) error {
+	return r.deleteMessages(ctx, chunks)
+}
+
+// Concurrency returns the number of upload targets, it implements Uploader.
+func (r *Rest) Concurrency() int {
+	return r.targets()
+}
+
+// Replays reports whether a chunk is read more than once to upload it, it implements Uploader.
+func (r *Rest) Replays() bool {
+	return r.replays()
+}
+
+// Encrypts reports whether chunks are encrypted, it implements Uploader.
+func (r *Rest) Encrypts() bool {
+	return r.crypt != nil
+}
+
+// ManifestFits reports whether the manifest fits into the content of a message, it implements Uploader.
+func (r *Rest) ManifestFits(m Manifest) bool {
+	return r.manifestSize(m) <= maxContent
+}
+
+// PackEntries returns manifest entries of the packfile holding chunk by offset, it implements PackReader.
+func (r *Rest) PackEntries(ctx context.Context, chunk Node) (map[int]Manifest, error) {
+	entries := make(map[int]Manifest)
+	var messages []Message
+	if err := r.GetMessagesContext(ctx, extractChannelId(chunk.URL), chunk.MId-1, "after", &messages); err != nil {
+		return nil, err
+	}
+	for i := range messages {
+		if messages[i].Id != strconv.FormatInt(chunk.MId, 10) {
+			continue
+		}
+		// A manifest which can not be read describes no chunk, the copies are written without it
+		chunks, manifests, _ := r.Chunks(&messages[i])
+		for j := range chunks {
+			if chunks[j].Pack != nil {
+				entries[chunks[j].Pack.Offset] = manifests[j]
+			}
+		}
+	}
+	return entries, nil
+}
+
+// refresh updates links of chunks which expire before unix time before
+func (r *Rest) refresh(ctx context.Context, chunks []*Node, before int) error {
+	// Expired links of chunks and replicas by message id and attachment index
+	type link struct {
+		url    string
+		update func(url string)
+	}
+	// A message can hold several chunks, and an attachment can be linked by several chunks,
+	// e.g. parity shards by every chunk of the stripe
+	expired := make(map[int64]map[int][]link)
+	channels := make(map[int64]string)
+	add := func(mid int64, att int, url string, ex, is int, hm string, update func(url string)) {
+		if expired[mid] == nil {
+			expired[mid] = make(map[int][]link)
+			channels[mid] = extractChannelId(url)
+		}
+		expired[mid][att] = append(expired[mid][att], link{EncodeAttachmentURL(url, ex, is, hm), update})
+	}
+	for _, chunk := range chunks {
+		chunk := chunk
+		if before > chunk.Ex {
+			add(chunk.MId, chunk.Att, chunk.URL, chunk.Ex, chunk.Is, chunk.Hm, func(url string) {
+				chunk.URL, chunk.Ex, chunk.Is, chunk.Hm = DecodeAttachmentURL(url)
+			})
+		}
+		for i := range chunk.Replicas {
+			replica := &chunk.Replicas[i]
+			if before > replica.Ex {
+				add(replica.MId, replica.Att, replica.URL, replica.Ex, replica.Is, replica.Hm, func(url string) {
+					replica.URL, replica.Ex, replica.Is, replica.Hm = DecodeAttachmentURL(url)
+				})
+			}
+		}
+		if chunk.Stripe != nil {
+			for i := range chunk.Stripe.Parity {
+				parity := &chunk.Stripe.Parity[i]
+				if before > parity.Ex {
+					add(parity.MId, parity.Att, parity.URL, parity.Ex, parity.Is, parity.Hm, func(url string) {
+						parity.URL, parity.Ex, parity.Is, parity.Hm = DecodeAttachmentURL(url)
+					})
+				}
+			}
+		}
+	}
+	mids := make([]int64, 0, len(expired))
+	for mid := range expired {
+		mids = append(mids, mid)
+	}
+	sort.Slice(mids, func(i, j int) bool { return mids[i] < mids[j] })
+	updated := make(map[int64]bool)
+	// refreshURLs refreshes links of the messages with a single request, it reports false if the endpoint failed
+	refreshURLs := func(batch []int64) (bool, error) {
+		var urls []string
+		for _, mid := range batch {
+			for _, links := range expired[mid] {
+				urls = append(urls, links[0].url)
+			}
+		}
+		refreshed, err := r.RefreshURLsContext(ctx, urls)
+		if err != nil {
+			return false, ctx.Err()
+		}
+		for _, mid := range batch {
+			done := true
+			for _, links := range expired[mid] {
+				url, ok := refreshed[links[0].url]
+				if !ok {
+					done = false
+					continue
+				}
+				for _, l := range links {
+					l.update(url)
+				}
+			}
+			updated[mid] = done
+		}
+		return true, nil
+	}
+	var batch []int64
+	size := 0
+	for _, mid := range mids {
+		if n := len(expired[mid]); size+n > MaxRefreshURLs {
+			ok, err := refreshURLs(batch)
+			if err != nil {
+				return err
+			}
+			// The endpoint is not available, messages of every link are fetched instead
+			if !ok {
+				batch = nil
+				break
+			}
+			batch, size = batch[:0], 0
+		}
+		batch = append(batch, mid)
+		size += len(expired[mid])
+	}
+	if len(batch) > 0 {
+		if _, err := refreshURLs(batch); err != nil {
+			return err
+		}
+	}
+	var messages []Message
+	for _, mid := range mids {
+		if updated[mid] {
+			continue
+		}
+		if err := r.GetMessagesContext(ctx, channels[mid], mid-1, "after", &messages); err != nil {
+			return err
+		}
+		for _, msg := range messages {
+			id, _ := strconv.ParseInt(msg.Id, 10, 64)
+			if updated[id] {
+				continue
+			}
+			for att, links := range expired[id] {
+				if att >= len(msg.Attachments) {
+					continue
+				}
+				for _, l := range links {
+					l.update(msg.Attachments[att].URL)
+				}
+			}
+			if expired[id] != nil {
+				updated[id] = true
+			}
+		}
+	}
+	return nil
+}
+
+// RefreshURLs returns newly signed URLs of attachments by given URLs, up to MaxRefreshURLs at once.
+// URLs of attachments which do not exist anymore are missing from the result.
+func (r *Rest) RefreshURLs(urls []string) (map[string]string, error) {
+	return r.RefreshURLsContext(context.Background(), urls)
+}
+
+// RefreshURLsContext is like RefreshURLs but cancels the request when ctx is done.
+func (r *Rest) RefreshURLsContext(ctx context.Context, urls []string) (map[string]string, error) {
+	if len(urls) > MaxRefreshURLs {
+		return nil, fmt.Errorf("refresh urls : %d urls exceed the limit of %d", len(urls), MaxRefreshURLs)
+	}
+	body, err := json.Marshal(map[string][]string{"attachment_urls": urls})
+	if err != nil {
+		return nil, err
+	}
+
+	const op = "refresh urls"
+	resp, err := r.doReq(ctx, op, "POST /attachments/refresh-urls", "", jsonReq(ctx, http.MethodPost, r.baseURL+"/attachments/refresh-urls", string(body)), true)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{Op: op, Expected: http.StatusOK, StatusCode: resp.StatusCode}
+	}
+	var result struct {
+		RefreshedURLs []struct {
+			Original  string `json:"original"`
+			Refreshed string `json:"refreshed"`
+		} `json:"refreshed_urls"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	refreshed := make(map[string]string, len(result.RefreshedURLs))
+	for _, u := range result.RefreshedURLs {
+		if u.Refreshed != "" {
+			refreshed[u.Original] = u.Refreshed
+		}
+	}
+	return refreshed, nil
+}
+
+type channelKey struct{}
+
+// WithChannel returns a context which makes Rest upload chunks to the channel instead of the configured
+// channels and webhooks, without replicas. It keeps chunks which are not file data apart, e.g. metadata backups.
+func WithChannel(ctx context.Context, channelId string) context.Context {
+	return context.WithValue(ctx, channelKey{}, channelId)
+}
+
+func channelOf(ctx context.Context) string {
+	channelId, _ := ctx.Value(channelKey{}).(string)
+	return channelId
 }
 
 // channel returns the next channel in a round-robin fashion.
 func (r *Rest) channel() string {
+	return r.nextChannels(1)[0]
+}
+
+// nextChannels returns the next n distinct channels in a round-robin fashion.
+func (r *Rest) nextChannels(n int) []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	channels := make([]string, n)
+	for i := range channels {
+		channels[i] = r.channels[r.lastChIdx]
+		r.lastChIdx = (r.lastChIdx + 1) % len(r.channels)
+	}
+	return channels
+}
+
+// nextWebhooks returns the next n distinct webhooks in a round-robin fashion.
+func (r *Rest) nextWebhooks(n int) []webhook {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
-	channel := r.channels[r.lastChIdx]
-	r.lastChIdx = (r.lastChIdx + 1) % len(r.channels)
-	return channel
+	hooks := make([]webhook, n)
+	for i := range hooks {
+		hooks[i] = r.webhooks[r.lastHookIdx]
+		r.lastHookIdx = (r.lastHookIdx + 1) % len(r.webhooks)
+	}
+	return hooks
 }
 
-func (r *Rest) doReq(bucketId string, req *http.Request, retry bool) (*http.Response, error) {
+// targets returns the number of upload targets, chunks can be uploaded to each of them in parallel.
+func (r *Rest) targets() int {
+	if len(r.webhooks) > 0 {
+		return len(r.webhooks)
+	}
+	return len(r.channels)
+}
 
-	token := r.token()
-	bucketId = token + bucketId
-	req.Header.Add("User-Agent", UserAgent)
-	req.Header.Add("Authorization", token)
+// doReq sends the request built by newReq with authorization and rate limiting. newReq is called for
+// every attempt, so that the request body can be sent again when the request is retried.
+// route and major identify the rate limit bucket, see Limiter.Acquire.
+// A request rejected with 401, or 403 for another reason than a missing permission, is sent again with the next healthy token.
+func (r *Rest) doReq(ctx context.Context, op, route, major string, newReq func() (*http.Request, error), retry bool) (*http.Response, error) {
+	return r.withRetry(ctx, op, retry, func() (*http.Response, error) {
+		for attempt := 1; ; attempt++ {
+			token, err := r.tokens.next()
+			if err != nil {
+				return nil, err
+			}
+			req, err := newReq()
+			if err != nil {
+				r.tokens.report(token, 0, 0)
+				return nil, err
+			}
+			req.Header.Add("Authorization", token)
+			resp, err := r.limited(ctx, token, route, major, req)
+			if err != nil {
+				r.tokens.report(token, 0, 0)
+				return nil, err
+			}
+			if r.tokens.report(token, resp.StatusCode, errorCode(resp)) && attempt < r.tokens.len() && r.tokens.available() {
+				_ = resp.Body.Close()
+				continue
+			}
+			return resp, nil
+		}
+	})
+}
+
+// errorCode returns the discord error code of a 403 response, or 0. The body is kept for the caller.
+func errorCode(resp *http.Response) int {
+	if resp.StatusCode != http.StatusForbidden {
+		return 0
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	_ = resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return 0
+	}
+	var discordErr struct {
+		Code int `json:"code"`
+	}
+	_ = json.Unmarshal(body, &discordErr)
+	return discordErr.Code
+}
+
+// doWebhookReq is like doReq but for webhook requests, which are authorized by the webhook URL
+// and rate limited per webhook.
+func (r *Rest) doWebhookReq(ctx context.Context, op, route, major string, newReq func() (*http.Request, error), retry bool) (*http.Response, error) {
+	return r.withRetry(ctx, op, retry, func() (*http.Response, error) {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+		return r.limited(ctx, "", route, major, req)
+	})
+}
 
-	r.limiter.Acquire(bucketId)
+// limited sends req once the rate limit bucket allows it
+func (r *Rest) limited(ctx context.Context, token, route, major string, req *http.Request) (*http.Response, error) {
+	req.Header.Add("User-Agent", UserAgent)
+	release, err := r.limiter.AcquireContext(ctx, token, route, major)
+	if err != nil {
+		return nil, err
+	}
 
 	// Here make HTTP call
 	resp, err := r.client.Do(req)
 	// Release lock
 	if resp != nil && resp.Header != nil {
-		r.limiter.Release(bucketId, resp.Header)
-		if retry &&
-			(resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode > http.StatusInternalServerError) {
-			return r.doReq(bucketId, req, retry)
-		}
+		release(resp.Header)
 	} else {
-		r.limiter.Release(bucketId, nil)
+		release(nil)
 	}
 	return resp, err
 }
 
+// jsonReq returns request factory for doReq with given JSON body
+func jsonReq(ctx context.Context, method, url, body string) func() (*http.Request, error) {
+	return func() (*http.Request, error) {
+		var reader io.Reader
+		if body != "" {
+			reader = strings.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, url, reader)
+		if err != nil {
+			return nil, err
+		}
+		if body != "" {
+			req.Header.Add("Content-Type", "application/json")
+		}
+		return req, nil
+	}
+}
+
 func (r *Rest) GetMessages(channelId string, messageId int64, query string, messages *[]Message) error {
+	return r.GetMessagesContext(context.Background(), channelId, messageId, query, messages)
+}
+
+// GetMessagesContext is like GetMessages but cancels the request when ctx is done.
+func (r *Rest) GetMessagesContext(ctx context.Context, channelId string, messageId int64, query string, messages *[]Message) error {
 	var path string
 	if messageId != 0 && query != "" {
 		path = fmt.Sprintf("/channels/%s/messages?limit=100&%s=%d", channelId, query, messageId)
 	} else {
 		path = fmt.Sprintf("/channels/%s/messages?limit=100", channelId)
 	}
-	bucketId := fmt.Sprintf("/%s/messages", channelId)
 
-	// Create request
-	req, err := http.NewRequest(http.MethodGet, baseURL+path, nil)
-	if err != nil {
-		return err
-	}
-	resp, err := r.doReq(bucketId, req, true)
+	const op = "get messages"
+	resp, err := r.doReq(ctx, op, "GET /channels/{id}/messages", channelId, jsonReq(ctx, http.MethodGet, r.baseURL+path, ""), true)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("rest getmessages: expected status code %d - received %d", http.StatusOK, resp.StatusCode)
+		return &StatusError{Op: op, Expected: http.StatusOK, StatusCode: resp.StatusCode}
 	}
 	// read and parse the response body
 	respBody, err := io.ReadAll(resp.Body)
@@ -119,31 +661,256 @@ func (r *Rest) GetMessages(channelId string, messageId int64, query string, mess
 	return nil
 }
 
+// DeleteMessage deletes the message with given id from the channel. Messages which are already deleted are ignored.
+func (r *Rest) DeleteMessage(channelId string, messageId int64) error {
+	return r.DeleteMessageContext(context.Background(), channelId, messageId)
+}
+
+// DeleteMessageContext is like DeleteMessage but cancels the request when ctx is done.
+func (r *Rest) DeleteMessageContext(ctx context.Context, channelId string, messageId int64) error {
+	path := fmt.Sprintf("/channels/%s/messages/%d", channelId, messageId)
+
+	const op = "delete message"
+	resp, err := r.doReq(ctx, op, "DELETE /channels/{id}/messages/{id}", channelId, jsonReq(ctx, http.MethodDelete, r.baseURL+path, ""), true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return &StatusError{Op: op, Expected: http.StatusNoContent, StatusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+// BulkDeleteMessages deletes 2 to 100 messages of the channel with a single request.
+// Only bots with Manage Messages permission can use it, and discord rejects messages older than 2 weeks.
+func (r *Rest) BulkDeleteMessages(channelId string, messageIds []int64) error {
+	return r.BulkDeleteMessagesContext(context.Background(), channelId, messageIds)
+}
+
+// BulkDeleteMessagesContext is like BulkDeleteMessages but stops when ctx is done.
+func (r *Rest) BulkDeleteMessagesContext(ctx context.Context, channelId string, messageIds []int64) error {
+	ids := make([]string, len(messageIds))
+	for i, mid := range messageIds {
+		ids[i] = strconv.FormatInt(mid, 10)
+	}
+	body, err := json.Marshal(map[string][]string{"messages": ids})
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf("/channels/%s/messages/bulk-delete", channelId)
+
+	const op = "bulk delete messages"
+	resp, err := r.doReq(ctx, op, "POST /channels/{id}/messages/bulk-delete", channelId, jsonReq(ctx, http.MethodPost, r.baseURL+path, string(body)), true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return &StatusError{Op: op, Expected: http.StatusNoContent, StatusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+// deleteMessages deletes messages of chunks. If bulk delete is enabled, messages younger than
+// BulkDeleteMaxAge are deleted up to 100 per request, older messages are deleted one by one.
+func (r *Rest) deleteMessages(ctx context.Context, chunks []Node) error {
+	var channels []string
+	bulk := make(map[string][]int64)
+	for _, chunk := range chunks {
+		channelId := extractChannelId(chunk.URL)
+		if r.bulkDelete && time.Since(SnowflakeTime(chunk.MId)) < BulkDeleteMaxAge {
+			if _, ok := bulk[channelId]; !ok {
+				channels = append(channels, channelId)
+			}
+			bulk[channelId] = append(bulk[channelId], chunk.MId)
+			continue
+		}
+		if err := r.DeleteMessageContext(ctx, channelId, chunk.MId); err != nil {
+			return err
+		}
+	}
+	for _, channelId := range channels {
+		ids := bulk[channelId]
+		for len(ids) > 0 {
+			n := len(ids)
+			if n > MaxBulkDelete {
+				n = MaxBulkDelete
+			}
+			var err error
+			// Bulk delete needs at least 2 messages
+			if n == 1 {
+				err = r.DeleteMessageContext(ctx, channelId, ids[0])
+			} else {
+				err = r.BulkDeleteMessagesContext(ctx, channelId, ids[:n])
+			}
+			if err != nil {
+				return err
+			}
+			ids = ids[n:]
+		}
+	}
+	return nil
+}
+
 // CreateAttachment uploads a file to the Discord channel using the webhook.
 func (r *Rest) CreateAttachment(reader io.Reader) (*Node, error) {
-	// If nitro enabled, use another method to create the attachment
-	if r.nitro {
-		return r.CreateAttachmentNitro(reader)
+	return r.CreateAttachmentContext(context.Background(), reader)
+}
+
+// CreateAttachmentContext is like CreateAttachment but cancels the upload when ctx is done.
+// If replication is enabled, the chunk is uploaded to a different channel or webhook for every replica.
+// Replicas are uploaded one after another, the chunk fails if any of them fails.
+// Chunks of a context created by WithChannel are uploaded once to its channel.
+func (r *Rest) CreateAttachmentContext(ctx context.Context, reader io.Reader) (*Node, error) {
+	nodes, err := r.CreateAttachmentsContext(ctx, []io.Reader{reader})
+	if err != nil {
+		return nil, err
 	}
-	channelId := r.channel()
-	path := fmt.Sprintf("/channels/%s/messages", channelId)
-	bucketId := fmt.Sprintf("/%s/messages", channelId)
+	return nodes[0], nil
+}
 
-	// Prepare request
-	contentType, body := mbody(reader)
-	req, err := http.NewRequest(http.MethodPost, baseURL+path, body)
+// CreateAttachmentsContext is like CreateAttachmentContext but uploads up to MaxAttachments chunks as attachments
+// of a single message, nodes are returned in the order of readers. The manifest of ctx describes the first chunk,
+// the following chunks are the next chunks of the write. Replicas hold the chunks in the same order.
+func (r *Rest) CreateAttachmentsContext(ctx context.Context, readers []io.Reader) ([]*Node, error) {
+	if len(readers) == 0 || len(readers) > MaxAttachments {
+		return nil, fmt.Errorf("create attachment : a message holds 1 to %d attachments : %d chunks", MaxAttachments, len(readers))
+	}
+	files := make([]attachmentFile, len(readers))
+	ivs := make([]string, len(readers))
+	for i, reader := range readers {
+		open, iv, err := r.body(reader)
+		if err != nil {
+			return nil, err
+		}
+		files[i] = attachmentFile{name: uuid.New().String(), open: open, iv: iv}
+		ivs[i] = iv
+	}
+	// Copies of the chunks share the manifest
+	content, err := r.content(ctx, ivs)
+	if err != nil {
+		return nil, err
+	}
+	var uploads []func() ([]*Node, error)
+	if channelId := channelOf(ctx); channelId != "" {
+		uploads = append(uploads, func() ([]*Node, error) {
+			if r.nitro {
+				return r.createAttachmentNitro(ctx, channelId, files, content)
+			}
+			return r.createAttachment(ctx, channelId, files, content)
+		})
+	} else if len(r.webhooks) > 0 {
+		for _, hook := range r.nextWebhooks(r.replicas) {
+			hook := hook
+			uploads = append(uploads, func() ([]*Node, error) { return r.createAttachmentWebhook(ctx, hook, files, content) })
+		}
+	} else {
+		for _, channelId := range r.nextChannels(r.replicas) {
+			channelId := channelId
+			uploads = append(uploads, func() ([]*Node, error) {
+				// If nitro enabled, use another method to create the attachment
+				if r.nitro {
+					return r.createAttachmentNitro(ctx, channelId, files, content)
+				}
+				return r.createAttachment(ctx, channelId, files, content)
+			})
+		}
+	}
+
+	nodes, err := uploads[0]()
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Add("Content-Type", contentType)
+	for _, upload := range uploads[1:] {
+		replicas, err := upload()
+		if err != nil {
+			// Copies of chunks which are not returned are never referenced, remove them
+			_ = r.deleteCopies(*nodes[0])
+			return nil, err
+		}
+		for i, replica := range replicas {
+			nodes[i].Replicas = append(nodes[i].Replicas, Replica{URL: replica.URL, MId: replica.MId, Att: replica.Att, Ex: replica.Ex, Is: replica.Is, Hm: replica.Hm})
+		}
+	}
+	return nodes, nil
+}
+
+// attachmentFile is a chunk uploaded as an attachment
+type attachmentFile struct {
+	name string                    // Random file name, the attachment is found in the created message by it
+	open func() (io.Reader, error) // Opens the chunk for every upload attempt
+	iv   string                    // Iv of the chunk, empty if it is not encrypted
+}
+
+// deleteCopies deletes messages of the chunk and its replicas, it is not cancelled with the upload.
+func (r *Rest) deleteCopies(chunk Node) error {
+	ctx := context.Background()
+	if err := r.DeleteMessageContext(ctx, extractChannelId(chunk.URL), chunk.MId); err != nil {
+		return err
+	}
+	for _, replica := range chunk.Replicas {
+		if err := r.DeleteMessageContext(ctx, extractChannelId(replica.URL), replica.MId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createAttachment uploads a copy of the chunks to the channel, content is the message content.
+func (r *Rest) createAttachment(ctx context.Context, channelId string, files []attachmentFile, content string) ([]*Node, error) {
+	path := fmt.Sprintf("/channels/%s/messages", channelId)
 
 	// Here make HTTP call
-	resp, err := r.doReq(bucketId, req, false)
+	const op = "create attachment"
+	resp, err := r.doReq(ctx, op, "POST /channels/{id}/messages", channelId, multipartReq(ctx, r.baseURL+path, files, content), true)
 	if err != nil {
 		return nil, err
 	}
+	return r.attachmentsOf(op, resp, files)
+}
+
+// createAttachmentWebhook uploads a copy of the chunks by executing the webhook,
+// the message is created in the channel of the webhook.
+func (r *Rest) createAttachmentWebhook(ctx context.Context, hook webhook, files []attachmentFile, content string) ([]*Node, error) {
+	// wait=true makes discord respond with the created message
+	path := hook.url + "?wait=true"
+
+	const op = "create attachment"
+	resp, err := r.doWebhookReq(ctx, op, "POST /webhooks/{id}/{token}", hook.id, multipartReq(ctx, path, files, content), true)
+	if err != nil {
+		return nil, err
+	}
+	return r.attachmentsOf(op, resp, files)
+}
+
+// multipartReq returns request factory for doReq which uploads the chunks
+func multipartReq(ctx context.Context, url string, files []attachmentFile, content string) func() (*http.Request, error) {
+	return func() (*http.Request, error) {
+		names := make([]string, len(files))
+		readers := make([]io.Reader, len(files))
+		for i, f := range files {
+			reader, err := f.open()
+			if err != nil {
+				return nil, err
+			}
+			names[i], readers[i] = f.name, reader
+		}
+		contentType, body := mbody(names, readers, content)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Content-Type", contentType)
+		return req, nil
+	}
+}
+
+// attachmentsOf reads the created message from resp and returns the attachments of files in their order
+func (r *Rest) attachmentsOf(op string, resp *http.Response, files []attachmentFile) ([]*Node, error) {
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("create attachment : expected status code %d but recevied %d", http.StatusOK, resp.StatusCode)
+		return nil, &StatusError{Op: op, Expected: http.StatusOK, StatusCode: resp.StatusCode}
 	}
 	// read and parse the response body
 	respBody, err := io.ReadAll(resp.Body)
@@ -155,12 +922,25 @@ func (r *Rest) CreateAttachment(reader io.Reader) (*Node, error) {
 	if err = json.Unmarshal(respBody, &m); err != nil {
 		return nil, err
 	}
-	// clean url and extract ex,is and hm
-	att := m.Attachments[0]
-	att.URL, att.Ex, att.Is, att.Hm = DecodeAttachmentURL(att.URL)
-	att.MId, _ = strconv.ParseInt(m.Id, 10, 64)
-	// Return the first attachment from the response
-	return &att, nil
+	mid, _ := strconv.ParseInt(m.Id, 10, 64)
+	nodes := make([]*Node, len(files))
+	for i, f := range files {
+		for j := range m.Attachments {
+			if attachmentName(m.Attachments[j].URL) != f.name {
+				continue
+			}
+			// clean url and extract ex,is and hm
+			att := m.Attachments[j]
+			att.URL, att.Ex, att.Is, att.Hm = DecodeAttachmentURL(att.URL)
+			att.MId, att.Att = mid, j
+			r.sealed(&att, f.iv)
+			nodes[i] = &att
+		}
+		if nodes[i] == nil {
+			return nil, fmt.Errorf("%s : message %s has no attachment %s", op, m.Id, f.name)
+		}
+	}
+	return nodes, nil
 }
 
 type AttachmentResp struct {
@@ -171,24 +951,52 @@ type AttachmentResp struct {
 }
 
 func (r *Rest) CreateAttachmentNitro(reader io.Reader) (*Node, error) {
-	// 1. Request to get upload URL
-	fname := uuid.New().String()
-	channelId := r.channel()
-	bucketId := fmt.Sprintf("/%s/messages", channelId)
+	return r.CreateAttachmentNitroContext(context.Background(), reader)
+}
+
+// CreateAttachmentNitroContext is like CreateAttachmentNitro but cancels the upload when ctx is done.
+// The chunk is uploaded to the next channel without replicas.
+func (r *Rest) CreateAttachmentNitroContext(ctx context.Context, reader io.Reader) (*Node, error) {
+	open, iv, err := r.body(reader)
+	if err != nil {
+		return nil, err
+	}
+	content, err := r.content(ctx, []string{iv})
+	if err != nil {
+		return nil, err
+	}
+	channelId := channelOf(ctx)
+	if channelId == "" {
+		channelId = r.channel()
+	}
+	nodes, err := r.createAttachmentNitro(ctx, channelId, []attachmentFile{{name: uuid.New().String(), open: open, iv: iv}}, content)
+	if err != nil {
+		return nil, err
+	}
+	return nodes[0], nil
+}
 
+// createAttachmentNitro uploads a copy of the chunks to upload URLs of the channel
+// and creates a message with them.
+func (r *Rest) createAttachmentNitro(ctx context.Context, channelId string, files []attachmentFile, content string) ([]*Node, error) {
+	// 1. Request to get upload URLs
+	const op = "create attachment"
 	path := fmt.Sprintf("/channels/%s/attachments", channelId)
-	body := fmt.Sprintf(`{"files":[{"filename":"%s","file_size": %d}]}`, fname, r.chunkSize)
-	req, err := http.NewRequest(http.MethodPost, baseURL+path, strings.NewReader(body))
+	uploads := make([]map[string]interface{}, len(files))
+	for i, f := range files {
+		uploads[i] = map[string]interface{}{"id": strconv.Itoa(i), "filename": f.name, "file_size": r.chunkSize}
+	}
+	body, err := json.Marshal(map[string]interface{}{"files": uploads})
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Add("Content-Type", "application/json")
-	resp, err := r.doReq(bucketId, req, true)
+	resp, err := r.doReq(ctx, op, "POST /channels/{id}/attachments", channelId, jsonReq(ctx, http.MethodPost, r.baseURL+path, string(body)), true)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("create attachment : expected status code %d but recevied %d", http.StatusOK, resp.StatusCode)
+		return nil, &StatusError{Op: op, Expected: http.StatusOK, StatusCode: resp.StatusCode}
 	}
 
 	respBody, err := io.ReadAll(resp.Body)
@@ -199,93 +1007,197 @@ func (r *Rest) CreateAttachmentNitro(reader io.Reader) (*Node, error) {
 	if err = json.Unmarshal(respBody, &ar); err != nil {
 		return nil, err
 	}
-	a := ar.Attachments[0]
-
-	// 2. Request to upload binary data
-	req, err = http.NewRequest(http.MethodPut, a.UploadUrl, reader)
-	if err != nil {
-		return nil, err
+	if len(ar.Attachments) != len(files) {
+		return nil, fmt.Errorf("%s : got %d upload urls for %d chunks", op, len(ar.Attachments), len(files))
 	}
-	resp, err = http.DefaultClient.Do(req)
-	if err != nil || resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to upload chunk to upload url : %v", err)
+
+	// 2. Request to upload binary data of every chunk
+	attachments := make([]map[string]string, len(files))
+	for i, f := range files {
+		a := ar.Attachments[i]
+		resp, err = r.withRetry(ctx, "upload chunk", true, func() (*http.Response, error) {
+			reader, err := f.open()
+			if err != nil {
+				return nil, err
+			}
+			req, err := http.NewRequestWithContext(ctx, http.MethodPut, a.UploadUrl, reader)
+			if err != nil {
+				return nil, err
+			}
+			return r.cdn.Do(req)
+		})
+		if err != nil {
+			return nil, err
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, &StatusError{Op: "upload chunk", Expected: http.StatusOK, StatusCode: resp.StatusCode}
+		}
+		attachments[i] = map[string]string{"id": strconv.Itoa(i), "filename": f.name, "uploaded_filename": a.UploadFileName}
 	}
 
 	// 3. Request to create a message in channel
 	path = fmt.Sprintf("/channels/%s/messages", channelId)
-	body = fmt.Sprintf(`{"attachments":[{"id":"0","filename":"%s","uploaded_filename":"%s"}]}`, fname, a.UploadFileName)
-	req, err = http.NewRequest(http.MethodPost, baseURL+path, strings.NewReader(body))
+	message, err := json.Marshal(map[string]interface{}{
+		"content":     content,
+		"attachments": attachments,
+	})
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Add("Content-Type", "application/json")
-	resp, err = r.doReq(bucketId, req, true)
+	resp, err = r.doReq(ctx, op, "POST /channels/{id}/messages", channelId, jsonReq(ctx, http.MethodPost, r.baseURL+path, string(message)), true)
 	if err != nil {
 		return nil, err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("create attachment : expected status code %d but recevied %d", http.StatusOK, resp.StatusCode)
+	return r.attachmentsOf(op, resp, files)
+}
+
+// ReadAttachment reads the bytes from start to end of the attachment. Positions are in plaintext,
+// encrypted attachments are fetched from the enclosing sealed blocks and decrypted.
+func (r *Rest) ReadAttachment(att *Node, start int, end int) (io.ReadCloser, error) {
+	return r.ReadAttachmentContext(context.Background(), att, start, end)
+}
+
+// ReadAttachmentContext is like ReadAttachment but cancels the download when ctx is done.
+func (r *Rest) ReadAttachmentContext(ctx context.Context, att *Node, start int, end int) (io.ReadCloser, error) {
+	if att.Iv == "" {
+		return r.readAttachment(ctx, att, start, end)
 	}
-	// read and parse the response body
-	respBody, err = io.ReadAll(resp.Body)
+	if r.crypt == nil {
+		return nil, ErrNoPassphrase
+	}
+	cstart, cend, first, skip := r.crypt.sealedRange(start, end, att.Size)
+	body, err := r.readAttachment(ctx, att, cstart, cend)
 	if err != nil {
 		return nil, err
 	}
-	var m Message
-	if err = json.Unmarshal(respBody, &m); err != nil {
+	reader, err := r.crypt.decrypt(body, att.Iv, first, lastBlock(att.Size), skip, end-start+1)
+	if err != nil {
+		_ = body.Close()
 		return nil, err
 	}
-	// clean url and extract ex,is and hm
-	node := m.Attachments[0]
-	node.URL, node.Ex, node.Is, node.Hm = DecodeAttachmentURL(node.URL)
-	node.MId, _ = strconv.ParseInt(m.Id, 10, 64)
-
-	// Return the first attachment from the response
-	return &node, nil
+	return reader, nil
 }
 
-func (r *Rest) ReadAttachment(att *Node, start int, end int) (io.ReadCloser, error) {
+func (r *Rest) readAttachment(ctx context.Context, att *Node, start int, end int) (io.ReadCloser, error) {
 	path := EncodeAttachmentURL(att.URL, att.Ex, att.Is, att.Hm)
-	req, err := http.NewRequest(http.MethodGet, path, nil)
+	const op = "read attachment"
+	// A host outside the allowlist is rejected once, retrying it can not succeed
+	u, err := url.Parse(path)
 	if err != nil {
 		return nil, err
 	}
-	// Set the Range header to specify the range of data to fetch
-	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
-
-	resp, err := http.DefaultClient.Do(req)
+	if !r.cdnHosts[strings.ToLower(u.Hostname())] {
+		return nil, fmt.Errorf("read attachment : host %s is not in cdn allowlist", u.Host)
+	}
+	resp, err := r.withRetry(ctx, op, true, func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+		if err != nil {
+			return nil, err
+		}
+		// Set the Range header to specify the range of data to fetch
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+		return r.cdn.Do(req)
+	})
 	if err != nil {
 		return nil, err
 	}
-	if resp.StatusCode > http.StatusInternalServerError {
-		return r.ReadAttachment(att, start, end)
-	}
 	if resp.StatusCode != http.StatusPartialContent {
-		return nil, fmt.Errorf("read attachment : expected code %d but received %d", http.StatusPartialContent, resp.StatusCode)
+		_ = resp.Body.Close()
+		return nil, &StatusError{Op: op, Expected: http.StatusPartialContent, StatusCode: resp.StatusCode}
 	}
 	// Return the body of the response, which contains the requested data
 	return resp.Body, nil
 }
 
-// mbody creates the multipart form-data body to upload a file to the Discord channel using the webhook.
-func mbody(reader io.Reader) (string, io.Reader) {
+// replays reports whether a chunk is read more than once to upload it, to retry the upload,
+// to upload replicas or to send it again with the next token
+func (r *Rest) replays() bool {
+	return r.retry.MaxAttempts > 1 || r.replicas > 1 || r.tokens.len() > 1
+}
+
+// body returns a function which opens the chunk read from reader for every upload attempt,
+// encrypted if encryption is enabled, and the chunk iv. If the chunk is replayed, readers which can seek
+// are rewound and others are copied into memory. Writers pass their buffer, so only other callers pay the copy.
+func (r *Rest) body(reader io.Reader) (func() (io.Reader, error), string, error) {
+	open := func() (io.Reader, error) { return reader, nil }
+	if r.replays() {
+		if rs, ok := reader.(io.ReadSeeker); ok {
+			start, err := rs.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, "", err
+			}
+			open = func() (io.Reader, error) {
+				_, err := rs.Seek(start, io.SeekStart)
+				return rs, err
+			}
+		} else {
+			data, err := io.ReadAll(reader)
+			if err != nil {
+				return nil, "", err
+			}
+			open = func() (io.Reader, error) { return bytes.NewReader(data), nil }
+		}
+	}
+	if r.crypt == nil {
+		return open, "", nil
+	}
+	iv, err := r.crypt.newIv()
+	if err != nil {
+		return nil, "", err
+	}
+	return func() (io.Reader, error) {
+		src, err := open()
+		if err != nil {
+			return nil, err
+		}
+		return r.crypt.encrypt(src, iv)
+	}, iv, nil
+}
+
+// sealed records the iv and plaintext size of an uploaded encrypted chunk.
+func (r *Rest) sealed(node *Node, iv string) {
+	if iv == "" {
+		return
+	}
+	node.Iv = iv
+	node.Size = r.crypt.plainSize(node.Size)
+}
+
+// mbody creates the multipart form-data body to upload files to the Discord channel using the webhook.
+// Every reader is sent as a file part named by names, content is sent as message content if it is not empty.
+func mbody(names []string, readers []io.Reader, content string) (string, io.Reader) {
 	boundary := "disgosucks"
 	// Set the content type including the boundary
 	contentType := fmt.Sprintf("multipart/form-data; boundary=%s", boundary)
 
 	CRLF := "\r\n"
-	fname := uuid.New().String()
 
 	// Assemble all the parts of the multipart form-data
-	parts := []io.Reader{
-		strings.NewReader("--" + boundary + CRLF),
-		strings.NewReader(fmt.Sprintf(`Content-Disposition: form-data; name="%s"; filename="%s"`, fname, fname) + CRLF),
-		strings.NewReader(fmt.Sprintf(`Content-Type: %s`, "application/octet-stream") + CRLF),
-		strings.NewReader(CRLF),
-		reader,
-		strings.NewReader(CRLF),
-		strings.NewReader("--" + boundary + "--" + CRLF),
+	var parts []io.Reader
+	// Message content is sent in payload_json part
+	if content != "" {
+		payload, _ := json.Marshal(map[string]string{"content": content})
+		parts = append(parts,
+			strings.NewReader("--"+boundary+CRLF),
+			strings.NewReader(`Content-Disposition: form-data; name="payload_json"`+CRLF),
+			strings.NewReader(`Content-Type: application/json`+CRLF),
+			strings.NewReader(CRLF),
+			bytes.NewReader(payload),
+			strings.NewReader(CRLF),
+		)
+	}
+	for i, reader := range readers {
+		parts = append(parts,
+			strings.NewReader("--"+boundary+CRLF),
+			strings.NewReader(fmt.Sprintf(`Content-Disposition: form-data; name="%s"; filename="%s"`, names[i], names[i])+CRLF),
+			strings.NewReader(fmt.Sprintf(`Content-Type: %s`, "application/octet-stream")+CRLF),
+			strings.NewReader(CRLF),
+			reader,
+			strings.NewReader(CRLF),
+		)
 	}
+	parts = append(parts, strings.NewReader("--"+boundary+"--"+CRLF))
 
 	// Return the content type and the combined reader of all parts
 	return contentType, io.MultiReader(parts...)
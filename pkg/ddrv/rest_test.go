@@ -0,0 +1,199 @@
+package ddrv_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/forscht/ddrv/pkg/ddrv"
+	"github.com/forscht/ddrv/pkg/ddrv/ddrvtest"
+)
+
+func TestProxy(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	for proxy, ok := range map[string]bool{
+		"http://127.0.0.1:8080":   true,
+		"https://127.0.0.1:8443":  true,
+		"socks5://127.0.0.1:1080": true,
+		"ftp://127.0.0.1:21":      false,
+		"127.0.0.1:8080":          false,
+	} {
+		cfg := s.Config(1024, "1")
+		cfg.Proxy = proxy
+		_, err := ddrv.New(cfg)
+		if ok && err != nil {
+			t.Errorf("New() with proxy %s error = %v", proxy, err)
+		}
+		if !ok && (err == nil || !strings.Contains(err.Error(), "proxy")) {
+			t.Errorf("New() with proxy %s error = %v, want a proxy error", proxy, err)
+		}
+	}
+}
+
+func TestCDNAllowlist(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	var nodes []ddrv.Node
+	write(t, newDriver(t, s.Config(1024, "1")).NewWriter(func(chunk ddrv.Node) { nodes = append(nodes, chunk) }), randBytes(t, 100))
+
+	// Attachments outside the allowlist are never requested
+	cfg := s.Config(1024, "1")
+	cfg.CDNHosts = nil
+	driver := newDriver(t, cfg)
+	reads := s.Stats().CDNReads
+	r, err := driver.NewReader(nodes, 0)
+	if err == nil {
+		_, err = io.ReadAll(r)
+		_ = r.Close()
+	}
+	if err == nil || !strings.Contains(err.Error(), "not in cdn allowlist") {
+		t.Errorf("read error = %v, want host not in cdn allowlist", err)
+	}
+	if got := s.Stats().CDNReads - reads; got != 0 {
+		t.Errorf("read requested %d attachments, want 0", got)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	cfg := s.Config(1024)
+	cfg.Channels = nil
+	cfg.Webhooks = []string{s.Webhook("10"), s.Webhook("11")}
+	driver := newDriver(t, cfg)
+
+	data := randBytes(t, 4000)
+	var nodes []ddrv.Node
+	write(t, driver.NewNWriter(func(chunk ddrv.Node) { nodes = append(nodes, chunk) }), data)
+	if got := s.Stats().Webhooks; got != len(nodes) {
+		t.Errorf("%d messages created by webhooks, want %d", got, len(nodes))
+	}
+	if got := len(s.Messages("10")) + len(s.Messages("11")); got != len(nodes) {
+		t.Errorf("%d messages in webhook channels, want %d", got, len(nodes))
+	}
+	if channels, err := driver.Rest.WebhookChannels(); err != nil || strings.Join(channels, ",") != "10,11" {
+		t.Errorf("WebhookChannels() = %v, %v, want [10 11]", channels, err)
+	}
+
+	// Expired links are refreshed with tokens
+	for i := range nodes {
+		nodes[i].Ex = 0
+	}
+	expired := make([]*ddrv.Node, len(nodes))
+	for i := range nodes {
+		expired[i] = &nodes[i]
+	}
+	if err := driver.UpdateNodes(expired); err != nil {
+		t.Fatalf("UpdateNodes() error = %v", err)
+	}
+	if got := read(t, driver, nodes, 0); !bytes.Equal(got, data) {
+		t.Errorf("read returned %d bytes, want %d equal bytes", len(got), len(data))
+	}
+
+	cfg = s.Config(1024)
+	cfg.Webhooks = []string{"https://discord.com/api/channels/1"}
+	if _, err := ddrv.New(cfg); err == nil {
+		t.Errorf("New() with invalid webhook url succeeded")
+	}
+}
+
+func TestBulkDelete(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	cfg := s.Config(1024, "1", "2")
+	cfg.BulkDelete = true
+	if _, err := ddrv.New(cfg); err == nil {
+		t.Fatalf("New() with bulk delete and a user token succeeded")
+	}
+	cfg = s.Config(1024, "1", "2")
+	cfg.TokenType, cfg.BulkDelete = ddrv.TokenBot, true
+	driver := newDriver(t, cfg)
+
+	var nodes []ddrv.Node
+	write(t, driver.NewWriter(func(chunk ddrv.Node) { nodes = append(nodes, chunk) }), randBytes(t, 5000))
+	msg := s.AddMessage("1", "", ddrvtest.File{Name: "file", Data: []byte("data")})
+	mid, _ := strconv.ParseInt(msg.Id, 10, 64)
+	nodes = append(nodes, ddrv.Node{URL: msg.Attachments[0].URL, MId: mid})
+	// Discord rejects messages older than 2 weeks in bulk, they are deleted one by one
+	nodes = append(nodes, ddrv.Node{URL: msg.Attachments[0].URL, MId: mid - (15*24*time.Hour).Milliseconds()<<22})
+
+	requests := s.Stats().Requests
+	if err := driver.DeleteNodes(nodes); err != nil {
+		t.Fatalf("DeleteNodes() error = %v", err)
+	}
+	if n := len(s.Messages("1")) + len(s.Messages("2")); n != 0 {
+		t.Errorf("%d messages left after DeleteNodes(), want 0", n)
+	}
+	// Messages of each channel are deleted by a single bulk delete, the old one is deleted alone
+	stats := s.Stats()
+	if stats.BulkDeletes != 2 || stats.Requests-requests != 3 {
+		t.Errorf("DeleteNodes() sent %d requests with %d bulk deletes, want 3 with 2 bulk deletes", stats.Requests-requests, stats.BulkDeletes)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+
+	policy := ddrv.RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+	tests := []struct {
+		name   string
+		nitro  bool
+		writer func(d *ddrv.Driver, onChunk func(ddrv.Node)) io.WriteCloser
+	}{
+		{"writer", false, (*ddrv.Driver).NewWriter},
+		{"nwriter", false, (*ddrv.Driver).NewNWriter},
+		{"writer nitro", true, (*ddrv.Driver).NewWriter},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := s.Config(1024, "1", "2")
+			cfg.Nitro = tt.nitro
+			cfg.Passphrase = "secret"
+			cfg.Retry = policy
+			driver := newDriver(t, cfg)
+			data := randBytes(t, 3000)
+
+			// Failed uploads are resent with the same body
+			s.FailNext(http.StatusInternalServerError, 2)
+			var nodes []ddrv.Node
+			write(t, tt.writer(driver, func(chunk ddrv.Node) { nodes = append(nodes, chunk) }), data)
+			s.FailNext(http.StatusBadGateway, 2)
+			if got := read(t, driver, nodes, 0); !bytes.Equal(got, data) {
+				t.Error("read after retries returned different data")
+			}
+		})
+	}
+
+	t.Run("exhausted", func(t *testing.T) {
+		cfg := s.Config(1024)
+		cfg.Retry = policy
+		driver := newDriver(t, cfg)
+		s.FailNext(http.StatusServiceUnavailable, 3)
+		var messages []ddrv.Message
+		err := driver.Rest.GetMessages("1", 0, "", &messages)
+		var rerr *ddrv.RetryError
+		var serr *ddrv.StatusError
+		if !errors.As(err, &rerr) || rerr.Attempts != 3 || !errors.As(err, &serr) || serr.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("GetMessages() error = %v, want RetryError after 3 attempts with status 503", err)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		cfg := s.Config(1024)
+		cfg.Retry = ddrv.RetryPolicy{MaxAttempts: 1}
+		driver := newDriver(t, cfg)
+		s.FailNext(http.StatusInternalServerError, 1)
+		_, err := driver.Rest.CreateAttachment(bytes.NewReader(randBytes(t, 100)))
+		var serr *ddrv.StatusError
+		if !errors.As(err, &serr) || serr.StatusCode != http.StatusInternalServerError {
+			t.Errorf("CreateAttachment() error = %v, want StatusError with status 500", err)
+		}
+	})
+}
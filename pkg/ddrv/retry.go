@@ -0,0 +1,152 @@
+package ddrv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how requests failed with network errors, 429 or 5xx responses are retried.
+// Zero values are replaced by values from DefaultRetryPolicy.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts per request including the first one.
+	// Chunks must be resent on retries, so Writer buffers a message worth of chunks in memory,
+	// chunk size times chunks per message, instead of streaming them. NWriter buffers them anyway.
+	// Set MaxAttempts to 1 to stream chunks without retries, if there are no replicas and a single token.
+	MaxAttempts int `mapstructure:"max_attempts"`
+	// MinBackoff is the base delay between attempts, it doubles with every attempt.
+	MinBackoff time.Duration `mapstructure:"min_backoff"`
+	// MaxBackoff caps the delay between attempts.
+	MaxBackoff time.Duration `mapstructure:"max_backoff"`
+}
+
+// DefaultRetryPolicy is used for zero fields of Config.Retry
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	MinBackoff:  500 * time.Millisecond,
+	MaxBackoff:  30 * time.Second,
+}
+
+// StatusError is returned when discord responds with an unexpected status code.
+type StatusError struct {
+	Op         string        // Operation which failed, e.g. "create attachment"
+	Expected   int           // Expected status code, 0 if any non 429 or 5xx status was expected
+	StatusCode int           // Received status code
+	RetryAfter time.Duration // Delay requested by discord on 429 responses
+}
+
+func (e *StatusError) Error() string {
+	if e.Expected == 0 {
+		return fmt.Sprintf("%s : received status code %d", e.Op, e.StatusCode)
+	}
+	return fmt.Sprintf("%s : expected status code %d but received %d", e.Op, e.Expected, e.StatusCode)
+}
+
+// Temporary reports whether the request may succeed if retried.
+func (e *StatusError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= http.StatusInternalServerError
+}
+
+// RetryError is returned when a request still fails after all attempts of the RetryPolicy.
+type RetryError struct {
+	Attempts int   // Number of attempts made
+	Err      error // Error of the last attempt
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("giving up after %d attempts : %v", e.Attempts, e.Err)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = DefaultRetryPolicy.MaxAttempts
+	}
+	if p.MinBackoff <= 0 {
+		p.MinBackoff = DefaultRetryPolicy.MinBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = DefaultRetryPolicy.MaxBackoff
+	}
+	if p.MaxBackoff < p.MinBackoff {
+		p.MaxBackoff = p.MinBackoff
+	}
+	return p
+}
+
+// backoff returns jittered delay before the attempt after given attempt, counted from 0.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.MaxBackoff
+	if attempt < 32 && p.MinBackoff<<attempt < p.MaxBackoff {
+		d = p.MinBackoff << attempt
+	}
+	// Full jitter, but never less than half of the delay
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// withRetry calls do until it returns a response which is not 429 or 5xx, ctx is done or attempts
+// are exhausted. do must build a new request on every call. Retryable responses are
+// reported as *StatusError with op, wrapped into *RetryError when no attempts are left.
+func (r *Rest) withRetry(ctx context.Context, op string, retry bool, do func() (*http.Response, error)) (*http.Response, error) {
+	attempts := 1
+	if retry {
+		attempts = r.retry.MaxAttempts
+	}
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		resp, err := do()
+		if err != nil {
+			// Evicted tokens are not probed before the cool-down passes, retrying would only delay the error
+			if ctx.Err() != nil || errors.Is(err, ErrNoToken) {
+				return nil, err
+			}
+			lastErr = err
+		} else if serr := retryable(op, resp); serr != nil {
+			lastErr = serr
+		} else {
+			return resp, nil
+		}
+		if attempt == attempts-1 {
+			break
+		}
+		wait := r.retry.backoff(attempt)
+		if serr, ok := lastErr.(*StatusError); ok && serr.RetryAfter > wait {
+			wait = serr.RetryAfter
+		}
+		if err = sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+	if attempts == 1 {
+		return nil, lastErr
+	}
+	return nil, &RetryError{Attempts: attempts, Err: lastErr}
+}
+
+// retryable returns StatusError and closes the response body if the response is 429 or 5xx.
+func retryable(op string, resp *http.Response) *StatusError {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < http.StatusInternalServerError {
+		return nil
+	}
+	defer resp.Body.Close()
+	serr := &StatusError{Op: op, StatusCode: resp.StatusCode}
+	// Discord sends precise retry_after in body, Retry-After header is rounded up to seconds
+	var body struct {
+		RetryAfter float64 `json:"retry_after"`
+	}
+	if data, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024)); err == nil && json.Unmarshal(data, &body) == nil && body.RetryAfter > 0 {
+		serr.RetryAfter = time.Duration(body.RetryAfter * float64(time.Second))
+	} else if sec, err := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64); err == nil {
+		serr.RetryAfter = time.Duration(sec * float64(time.Second))
+	}
+	return serr
+}
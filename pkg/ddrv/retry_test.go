@@ -0,0 +1,110 @@
+package ddrv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDefaults(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 2, MinBackoff: time.Second, MaxBackoff: time.Millisecond}.withDefaults()
+	if p.MaxAttempts != 2 || p.MinBackoff != time.Second || p.MaxBackoff != time.Second {
+		t.Errorf("withDefaults() = %+v, want MaxBackoff raised to MinBackoff", p)
+	}
+	if p = (RetryPolicy{}).withDefaults(); p != DefaultRetryPolicy {
+		t.Errorf("withDefaults() of zero policy = %+v, want %+v", p, DefaultRetryPolicy)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := RetryPolicy{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for attempt, base := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		base *= time.Millisecond
+		for i := 0; i < 100; i++ {
+			if d := p.backoff(attempt); d < base/2 || d > base {
+				t.Fatalf("backoff(%d) = %s, want between %s and %s", attempt, d, base/2, base)
+			}
+		}
+	}
+	// Shifts past the size of a duration are capped
+	if d := p.backoff(100); d < p.MaxBackoff/2 || d > p.MaxBackoff {
+		t.Errorf("backoff(100) = %s, want at most %s", d, p.MaxBackoff)
+	}
+}
+
+func response(status int, header http.Header, body string) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{StatusCode: status, Header: header, Body: io.NopCloser(strings.NewReader(body))}
+}
+
+func TestRetryable(t *testing.T) {
+	if serr := retryable("op", response(http.StatusNotFound, nil, "")); serr != nil {
+		t.Errorf("retryable() of 404 = %v, want nil", serr)
+	}
+	serr := retryable("op", response(http.StatusTooManyRequests, http.Header{"Retry-After": {"2"}}, `{"retry_after": 0.25}`))
+	if serr == nil || !serr.Temporary() || serr.RetryAfter != 250*time.Millisecond {
+		t.Errorf("retryable() of 429 = %+v, want retry after 250ms from body", serr)
+	}
+	serr = retryable("op", response(http.StatusTooManyRequests, http.Header{"Retry-After": {"2"}}, "rate limited"))
+	if serr == nil || serr.RetryAfter != 2*time.Second {
+		t.Errorf("retryable() of 429 = %+v, want retry after 2s from header", serr)
+	}
+	if serr = retryable("op", response(http.StatusBadGateway, nil, "")); serr == nil || serr.StatusCode != http.StatusBadGateway {
+		t.Errorf("retryable() of 502 = %+v, want StatusError", serr)
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	r := &Rest{retry: RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}}
+	errNet := errors.New("connection reset")
+	// do returns the responses in order, and then 200
+	do := func(calls *int, errs ...error) func() (*http.Response, error) {
+		return func() (*http.Response, error) {
+			*calls++
+			if *calls > len(errs) {
+				return response(http.StatusOK, nil, ""), nil
+			}
+			if serr, ok := errs[*calls-1].(*StatusError); ok {
+				return response(serr.StatusCode, nil, ""), nil
+			}
+			return nil, errs[*calls-1]
+		}
+	}
+	unavailable := &StatusError{StatusCode: http.StatusServiceUnavailable}
+
+	var calls int
+	if resp, err := r.withRetry(context.Background(), "op", true, do(&calls, errNet, unavailable)); err != nil || resp.StatusCode != http.StatusOK || calls != 3 {
+		t.Errorf("withRetry() = %v after %d calls, want success on the third attempt", err, calls)
+	}
+
+	calls = 0
+	_, err := r.withRetry(context.Background(), "op", true, do(&calls, unavailable, errNet, unavailable))
+	var rerr *RetryError
+	var serr *StatusError
+	if !errors.As(err, &rerr) || rerr.Attempts != 3 || !errors.As(err, &serr) || serr.Op != "op" || calls != 3 {
+		t.Errorf("withRetry() = %v after %d calls, want RetryError with the last StatusError", err, calls)
+	}
+
+	calls = 0
+	if _, err = r.withRetry(context.Background(), "op", false, do(&calls, errNet)); err != errNet || calls != 1 {
+		t.Errorf("withRetry() without retries = %v after %d calls, want the error of the single attempt", err, calls)
+	}
+
+	// Missing tokens and cancelled requests are not retried
+	calls = 0
+	if _, err = r.withRetry(context.Background(), "op", true, do(&calls, ErrNoToken)); !errors.Is(err, ErrNoToken) || calls != 1 {
+		t.Errorf("withRetry() = %v after %d calls, want %v after 1 call", err, calls, ErrNoToken)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls = 0
+	if _, err = r.withRetry(ctx, "op", true, do(&calls, context.Canceled)); !errors.Is(err, context.Canceled) || calls != 1 {
+		t.Errorf("withRetry() = %v after %d calls, want %v after 1 call", err, calls, context.Canceled)
+	}
+}
@@ -0,0 +1,65 @@
+package ddrv
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// spool holds the chunks a Writer buffers until they fill a message. Chunks are written to a temporary file
+// of dir, or kept in memory if mem is set. The file is created on the first write and reused for every message.
+type spool struct {
+	dir  string   // Directory of the temporary file, the default directory for temporary files if empty
+	mem  bool     // Whether chunks are kept in memory instead of a temporary file
+	buf  []byte   // Buffered chunks if they are kept in memory
+	file *os.File // Temporary file of buffered chunks
+	size int64    // Number of buffered bytes
+}
+
+// Write appends p to the buffered chunks
+func (s *spool) Write(p []byte) (int, error) {
+	if s.mem {
+		s.buf = append(s.buf, p...)
+		s.size += int64(len(p))
+		return len(p), nil
+	}
+	if s.file == nil {
+		file, err := os.CreateTemp(s.dir, "ddrv-spool-*")
+		if err != nil {
+			return 0, err
+		}
+		s.file = file
+	}
+	n, err := s.file.WriteAt(p, s.size)
+	s.size += int64(n)
+	return n, err
+}
+
+// section returns a reader of n buffered bytes from off, it reads the bytes until the next Write after reset
+func (s *spool) section(off, n int64) *io.SectionReader {
+	if s.mem {
+		return io.NewSectionReader(bytes.NewReader(s.buf), off, n)
+	}
+	return io.NewSectionReader(s.file, off, n)
+}
+
+// reset drops the buffered chunks, the next Write overwrites them
+func (s *spool) reset() {
+	s.buf = s.buf[:0]
+	s.size = 0
+}
+
+// Close removes the temporary file
+func (s *spool) Close() error {
+	s.buf = nil
+	if s.file == nil {
+		return nil
+	}
+	name := s.file.Name()
+	err := s.file.Close()
+	if rerr := os.Remove(name); err == nil {
+		err = rerr
+	}
+	s.file = nil
+	return err
+}
@@ -0,0 +1,174 @@
+package ddrv
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// DefaultConcurrency is the number of chunks NWriter uploads at once to stores other than Rest
+const DefaultConcurrency = 4
+
+// ChunkStore is the storage backend of chunks. Writers, readers and the Driver only talk to the store,
+// so the chunking pipeline - deduplication, checksums, prefetching and erasure coding - works with any backend.
+// Rest stores chunks as discord attachments, DirStore stores them as files of a local directory.
+// Stores may implement BatchPutter, BatchDeleter, Refresher, Uploader and PackReader, writers and
+// the Driver use them when they are available.
+type ChunkStore interface {
+	// Put stores the chunk read from reader and returns its node, the caller sets Hash.
+	Put(ctx context.Context, reader io.Reader) (*Node, error)
+	// Get reads the bytes from start to end of the chunk, both inclusive.
+	Get(ctx context.Context, chunk *Node, start, end int) (io.ReadCloser, error)
+	// Delete deletes the chunk, deleting a chunk which does not exist is not an error.
+	// Replicas and parity shards of the chunk are deleted by separate calls.
+	Delete(ctx context.Context, chunk Node) error
+	// Refresh updates expired links of chunks, their replicas and parity shards in place.
+	Refresh(ctx context.Context, chunks []*Node) error
+}
+
+// BatchPutter is implemented by stores which store several chunks at once, Rest uploads them as attachments
+// of a single message.
+type BatchPutter interface {
+	// PutBatch stores the chunks read from readers, up to BatchSize of them, and returns their nodes in order.
+	PutBatch(ctx context.Context, readers []io.Reader) ([]*Node, error)
+	// BatchSize is the number of chunks writers store at once.
+	BatchSize() int
+}
+
+// BatchDeleter is implemented by stores which delete several chunks at once, Rest deletes messages in bulk.
+type BatchDeleter interface {
+	// DeleteBatch deletes the chunks like Delete does.
+	DeleteBatch(ctx context.Context, chunks []Node) error
+}
+
+// Refresher is implemented by stores whose links expire, Rest refreshes signed attachment URLs.
+type Refresher interface {
+	// RefreshBefore is like Refresh but updates links which expire before the time as well,
+	// so links can be refreshed ahead of their expiry.
+	RefreshBefore(ctx context.Context, chunks []*Node, before time.Time) error
+}
+
+// Uploader is implemented by stores which tell writers how chunks are uploaded. Chunks of other stores are
+// uploaded DefaultConcurrency at once, read once and not encrypted, and manifests are not stored.
+type Uploader interface {
+	// Concurrency is the number of chunks NWriter uploads at once.
+	Concurrency() int
+	// Replays reports whether a chunk is read more than once to upload it.
+	Replays() bool
+	// Encrypts reports whether new chunks are encrypted.
+	Encrypts() bool
+	// ManifestFits reports whether the manifest fits into the message of a chunk.
+	ManifestFits(m Manifest) bool
+}
+
+// PackReader is implemented by stores which keep manifests of packfiles, see Uploader.
+type PackReader interface {
+	// PackEntries returns manifest entries of the packfile holding chunk by offset.
+	PackEntries(ctx context.Context, chunk Node) (map[int]Manifest, error)
+}
+
+// concurrency returns the number of chunks NWriter uploads at once to store
+func concurrency(store ChunkStore) int {
+	if u, ok := store.(Uploader); ok {
+		return u.Concurrency()
+	}
+	return DefaultConcurrency
+}
+
+// packing returns the number of chunks writers upload to store at once
+func packing(store ChunkStore) int {
+	if b, ok := store.(BatchPutter); ok {
+		return b.BatchSize()
+	}
+	return 1
+}
+
+// replays reports whether store reads a chunk more than once to upload it, writers then upload chunks
+// from their buffer, so store does not need to copy them
+func replays(store ChunkStore) bool {
+	u, ok := store.(Uploader)
+	return ok && u.Replays()
+}
+
+// putChunks stores chunks read from readers, at once if store is a BatchPutter
+func putChunks(ctx context.Context, store ChunkStore, readers []io.Reader) ([]*Node, error) {
+	if b, ok := store.(BatchPutter); ok {
+		return b.PutBatch(ctx, readers)
+	}
+	chunks := make([]*Node, len(readers))
+	for i, reader := range readers {
+		chunk, err := store.Put(ctx, reader)
+		if err != nil {
+			return nil, err
+		}
+		chunks[i] = chunk
+	}
+	return chunks, nil
+}
+
+// getChunk reads the bytes from start to end of the chunk from store, chunks of packfiles are read
+// from their range of the packfile
+func getChunk(ctx context.Context, store ChunkStore, chunk Node, start, end int) (io.ReadCloser, error) {
+	if chunk.Pack == nil {
+		return store.Get(ctx, &chunk, start, end)
+	}
+	pack := chunk.packfile()
+	return store.Get(ctx, &pack, chunk.Pack.Offset+start, chunk.Pack.Offset+end)
+}
+
+// manifestFits reports whether the manifest fits into the message of a chunk of store
+func manifestFits(store ChunkStore, m Manifest) bool {
+	u, ok := store.(Uploader)
+	return !ok || u.ManifestFits(m)
+}
+
+// encrypted reports whether store encrypts new chunks
+func encrypted(store ChunkStore) bool {
+	u, ok := store.(Uploader)
+	return ok && u.Encrypts()
+}
+
+// deleteChunks deletes chunks from store, at once if store is a BatchDeleter
+func deleteChunks(ctx context.Context, store ChunkStore, chunks []Node) error {
+	if b, ok := store.(BatchDeleter); ok {
+		return b.DeleteBatch(ctx, chunks)
+	}
+	for _, chunk := range chunks {
+		if err := store.Delete(ctx, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyChunk checks that the chunk can be read from store. Unless full is set only the end of the chunk
+// is read. One byte past the end of plain chunks is requested, so a larger stored chunk is noticed,
+// encrypted chunks are authenticated by their last sealed block instead. The end of the packfile is read
+// for chunks of packfiles.
+func verifyChunk(ctx context.Context, store ChunkStore, chunk Node, full bool) error {
+	if full || chunk.Size == 0 {
+		_, err := readShard(ctx, store, chunk)
+		return err
+	}
+	if chunk.Pack != nil {
+		chunk = chunk.packfile()
+	}
+	start, end := chunk.Size-1, chunk.Size-1
+	if chunk.Iv == "" {
+		end++
+	}
+	reader, err := store.Get(ctx, &chunk, start, end)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	n, err := io.Copy(io.Discard, reader)
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return fmt.Errorf("verify chunk %d : stored chunk size does not match %d bytes", chunk.MId, chunk.Size)
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package ddrv
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// StripeWriter erasure codes data written through Writer or NWriter. Every DataShards chunks form
+// a stripe, parity shards of the stripe are computed while the data is written and uploaded as chunks
+// of their own once the stripe is complete. Chunks are passed to onChunk after the parity shards
+// of their stripe are uploaded. Expected memory usage - chunkSize * parity shards on top of the writer.
+type StripeWriter struct {
+	ctx       context.Context
+	store     ChunkStore
+	coder     *coder
+	chunkSize int
+	writer    io.WriteCloser // Writer or NWriter uploading data shards
+	onChunk   func(chunk Node)
+
+	pos    int      // Position in the current stripe
+	first  int      // Index of the first chunk of the current stripe
+	parity [][]byte // Parity shards of the current stripe
+	closed bool
+
+	mu      sync.Mutex // guards stripes
+	stripes []*stripe  // Stripes whose chunks are not passed to onChunk yet, oldest first
+}
+
+type stripe struct {
+	chunks []Node
+	data   int    // Number of chunks, 0 while the stripe is written
+	size   int    // Size of parity shards
+	parity []Node // Uploaded parity shards, nil while the stripe is written
+}
+
+func newStripeWriter(ctx context.Context, onChunk func(chunk Node), chunkSize int, store ChunkStore, c *coder,
+	newWriter func(onChunk func(chunk Node)) io.WriteCloser) io.WriteCloser {
+	w := &StripeWriter{
+		ctx:       ctx,
+		store:     store,
+		coder:     c,
+		chunkSize: chunkSize,
+		onChunk:   onChunk,
+		stripes:   []*stripe{{}},
+	}
+	w.parity = w.newParity()
+	w.writer = newWriter(w.uploaded)
+	return w
+}
+
+func (w *StripeWriter) newParity() [][]byte {
+	parity := make([][]byte, w.coder.m)
+	for i := range parity {
+		parity[i] = make([]byte, w.chunkSize)
+	}
+	return parity
+}
+
+// Write writes p to the data shards and adds it to the parity of the current stripe.
+// Parity shards are uploaded by the Write call that completes the stripe.
+func (w *StripeWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, ErrClosed
+	}
+	total := len(p)
+	stripeSize := w.coder.k * w.chunkSize
+	for len(p) > 0 {
+		shard, off := w.pos/w.chunkSize, w.pos%w.chunkSize
+		n := w.chunkSize - off
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := w.writer.Write(p[:n]); err != nil {
+			return total - len(p), err
+		}
+		w.coder.encode(w.parity, shard, off, p[:n])
+		w.pos += n
+		p = p[n:]
+		if w.pos == stripeSize {
+			if err := w.finish(); err != nil {
+				return total - len(p), err
+			}
+		}
+	}
+	return total, nil
+}
+
+// Close waits for the data shards to be uploaded and uploads parity of the last stripe.
+func (w *StripeWriter) Close() error {
+	if w.closed {
+		return ErrAlreadyClosed
+	}
+	w.closed = true
+	if err := w.writer.Close(); err != nil {
+		return err
+	}
+	if w.pos > 0 {
+		if err := w.finish(); err != nil {
+			return err
+		}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.stripes) > 1 || len(w.stripes[0].chunks) > 0 {
+		return fmt.Errorf("stripe writer : %d stripes were not completed", len(w.stripes))
+	}
+	return nil
+}
+
+// finish uploads parity shards of the current stripe and starts the next stripe.
+func (w *StripeWriter) finish() error {
+	// The first chunk is the largest one
+	size := w.pos
+	if size > w.chunkSize {
+		size = w.chunkSize
+	}
+	data := (w.pos + w.chunkSize - 1) / w.chunkSize
+	parity := make([]Node, 0, len(w.parity))
+	for j, shard := range w.parity {
+		sum := sha256.Sum256(shard[:size])
+		ctx := withParity(w.ctx, w.first, int64(w.first)*int64(w.chunkSize), j+1, w.coder.k)
+		chunk, err := w.store.Put(ctx, bytes.NewReader(shard[:size]))
+		if err != nil {
+			return err
+		}
+		chunk.Hash = hex.EncodeToString(sum[:])
+		parity = append(parity, *chunk)
+	}
+	w.pos = 0
+	w.first += data
+	w.parity = w.newParity()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := w.stripes[len(w.stripes)-1]
+	s.data, s.size, s.parity = data, size, parity
+	w.stripes = append(w.stripes, &stripe{})
+	w.emit()
+	return nil
+}
+
+// uploaded receives data shards from the writer in order.
+func (w *StripeWriter) uploaded(chunk Node) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// Chunks arrive in order, the chunk belongs to the first stripe which is not complete
+	for _, s := range w.stripes {
+		if s.data == 0 || len(s.chunks) < s.data {
+			s.chunks = append(s.chunks, chunk)
+			break
+		}
+	}
+	w.emit()
+}
+
+// emit passes chunks of completed stripes to onChunk.
+func (w *StripeWriter) emit() {
+	for len(w.stripes) > 1 {
+		s := w.stripes[0]
+		if s.parity == nil || len(s.chunks) < s.data {
+			return
+		}
+		for i, chunk := range s.chunks {
+			chunk.Stripe = &Stripe{Index: i, Data: s.data, Shards: w.coder.k, Size: s.size, Parity: s.parity}
+			if w.onChunk != nil {
+				w.onChunk(chunk)
+			}
+		}
+		w.stripes = w.stripes[1:]
+	}
+}
+
+// reconstruct rebuilds the chunk from other chunks of its stripe and parity shards.
+// stripe holds the chunks of the stripe in order, missing or damaged chunks are skipped.
+// The rebuilt chunk is verified against its checksum, so chunks of another stripe do not pass as its data.
+func reconstruct(ctx context.Context, store ChunkStore, chunk Node, stripe []Node) ([]byte, error) {
+	s := chunk.Stripe
+	if len(stripe) != s.Data || s.Index >= s.Data {
+		return nil, fmt.Errorf("reconstruct chunk %d : %w : stripe has %d of %d chunks", chunk.MId, ErrStripeLost, len(stripe), s.Data)
+	}
+	c, err := newCoder(s.Shards, len(s.Parity))
+	if err != nil {
+		return nil, err
+	}
+	shards := make([][]byte, s.Shards+len(s.Parity))
+	present := 0
+	// Data shards missing at the end of a short stripe are zeros
+	for i := s.Data; i < s.Shards; i++ {
+		shards[i] = make([]byte, s.Size)
+		present++
+	}
+	candidates := make([]int, 0, len(shards))
+	for i := range stripe {
+		if i != s.Index {
+			candidates = append(candidates, i)
+		}
+	}
+	for j := range s.Parity {
+		candidates = append(candidates, s.Shards+j)
+	}
+	for _, i := range candidates {
+		if present == s.Shards {
+			break
+		}
+		var shard Node
+		if i < s.Data {
+			shard = stripe[i]
+		} else {
+			shard = s.Parity[i-s.Shards]
+		}
+		data, err := readShard(ctx, store, shard)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			continue
+		}
+		padded := make([]byte, s.Size)
+		copy(padded, data)
+		shards[i] = padded
+		present++
+	}
+	if present < s.Shards {
+		return nil, fmt.Errorf("reconstruct chunk %d : %w", chunk.MId, ErrStripeLost)
+	}
+	data, err := c.reconstruct(shards, s.Index)
+	if err != nil {
+		return nil, err
+	}
+	data = data[:chunk.Size]
+	if chunk.Hash != "" {
+		sum := sha256.Sum256(data)
+		if got := hex.EncodeToString(sum[:]); got != chunk.Hash {
+			return nil, fmt.Errorf("reconstruct chunk %d : %w : expected %s but rebuilt %s", chunk.MId, ErrChecksum, chunk.Hash, got)
+		}
+	}
+	return data, nil
+}
+
+// readShard reads the whole chunk into memory and verifies its checksum
+func readShard(ctx context.Context, store ChunkStore, chunk Node) ([]byte, error) {
+	reader, err := getChunk(ctx, store, chunk, 0, chunk.Size-1)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data := make([]byte, 0, chunk.Size)
+	buf := bytes.NewBuffer(data)
+	if _, err = io.Copy(buf, reader); err != nil {
+		return nil, err
+	}
+	data = buf.Bytes()
+	if len(data) != chunk.Size {
+		return nil, fmt.Errorf("read chunk %d : expected %d bytes but received %d", chunk.MId, chunk.Size, len(data))
+	}
+	if chunk.Hash != "" {
+		sum := sha256.Sum256(data)
+		if got := hex.EncodeToString(sum[:]); got != chunk.Hash {
+			return nil, fmt.Errorf("read chunk %d : %w : expected %s but received %s", chunk.MId, ErrChecksum, chunk.Hash, got)
+		}
+	}
+	return data, nil
+}
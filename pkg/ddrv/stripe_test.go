@@ -0,0 +1,143 @@
+package ddrv_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/forscht/ddrv/pkg/ddrv"
+	"github.com/forscht/ddrv/pkg/ddrv/ddrvtest"
+)
+
+func TestErasure(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	cfg := s.Config(1024, "1", "2", "3", "4", "5")
+	cfg.DataShards, cfg.ParityShards = 3, 2
+	driver := newDriver(t, cfg)
+	cfg.Prefetch = 2
+	prefetching := newDriver(t, cfg)
+	messages := func() (n int) {
+		for _, channel := range []string{"1", "2", "3", "4", "5"} {
+			n += len(s.Messages(channel))
+		}
+		return n
+	}
+
+	// 5 chunks form a full stripe of 3 chunks and a short one of 2 chunks
+	data := randBytes(t, 5000)
+	for name, newWriter := range map[string]func(func(ddrv.Node)) io.WriteCloser{"writer": driver.NewWriter, "nwriter": driver.NewNWriter} {
+		t.Run(name, func(t *testing.T) {
+			var nodes []ddrv.Node
+			before := messages()
+			write(t, newWriter(func(chunk ddrv.Node) { nodes = append(nodes, chunk) }), data)
+			if len(nodes) != 5 {
+				t.Fatalf("got %d chunks, want 5", len(nodes))
+			}
+			for i, node := range nodes {
+				if node.Stripe == nil || node.Stripe.Index != i%3 || len(node.Stripe.Parity) != 2 {
+					t.Fatalf("chunk %d has stripe %+v", i, node.Stripe)
+				}
+			}
+			if got := messages() - before; got != 5+2*2 {
+				t.Errorf("%d messages for 5 chunks, want 5 chunks and 4 parity shards", got)
+			}
+
+			// Up to 2 chunks of every stripe can be rebuilt
+			lost := []ddrv.Node{nodes[0], nodes[1], nodes[3], nodes[4]}
+			for i := range lost {
+				lost[i].Stripe = nil // keep the parity shards
+			}
+			if err := driver.DeleteNodes(lost); err != nil {
+				t.Fatalf("DeleteNodes() error = %v", err)
+			}
+			for name, d := range map[string]*ddrv.Driver{"reader": driver, "prefetch": prefetching} {
+				if got := read(t, d, nodes, 0); !bytes.Equal(got, data) {
+					t.Errorf("%s read without chunk messages returned different data", name)
+				}
+				if got := read(t, d, nodes, 4000); !bytes.Equal(got, data[4000:]) {
+					t.Errorf("%s read from 4000 without chunk messages returned different data", name)
+				}
+			}
+
+			// The first stripe is lost with its third chunk
+			lost = []ddrv.Node{nodes[2]}
+			lost[0].Stripe = nil
+			if err := driver.DeleteNodes(lost); err != nil {
+				t.Fatalf("DeleteNodes() error = %v", err)
+			}
+			r, err := driver.NewReader(nodes, 0)
+			if err != nil {
+				t.Fatalf("NewReader() error = %v", err)
+			}
+			defer r.Close()
+			if _, err = io.ReadAll(r); !errors.Is(err, ddrv.ErrStripeLost) {
+				t.Errorf("read of a lost stripe error = %v, want %v", err, ddrv.ErrStripeLost)
+			}
+
+			// Parity shards are deleted with chunks
+			if err = driver.DeleteNodes(nodes); err != nil {
+				t.Fatalf("DeleteNodes() error = %v", err)
+			}
+			if got := messages(); got != before {
+				t.Errorf("%d messages left after DeleteNodes(), want %d", got, before)
+			}
+		})
+	}
+
+	cfg = s.Config(1024, "1", "2", "3")
+	cfg.DataShards, cfg.ParityShards, cfg.Replicas = 3, 2, 2
+	if _, err := ddrv.New(cfg); err == nil {
+		t.Errorf("New() with erasure coding and replicas succeeded")
+	}
+}
+
+func TestErasureReuse(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	cfg := s.Config(1024, "1", "2", "3", "4", "5")
+	cfg.DataShards, cfg.ParityShards = 3, 2
+	driver := newDriver(t, cfg)
+
+	data, other := randBytes(t, 3000), randBytes(t, 3000)
+	var nodes, others []ddrv.Node
+	write(t, driver.NewWriter(func(chunk ddrv.Node) { nodes = append(nodes, chunk) }), data)
+	write(t, driver.NewWriter(func(chunk ddrv.Node) { others = append(others, chunk) }), other)
+
+	// Chunks reused by a file without erasure coding do not carry the stripe of their file
+	plain := newDriver(t, s.Config(1024, "1"))
+	plain.Lookup = func(hash string, size int) (*ddrv.Node, error) {
+		for i := range nodes {
+			if nodes[i].Hash == hash {
+				return &nodes[i], nil
+			}
+		}
+		return nil, nil
+	}
+	var reused []ddrv.Node
+	write(t, plain.NewWriter(func(chunk ddrv.Node) { reused = append(reused, chunk) }), data[1024:2048])
+	if len(reused) != 1 || reused[0].MId != nodes[1].MId || reused[0].Stripe != nil {
+		t.Fatalf("reused chunk = %+v, want chunk %d without stripe", reused, nodes[1].MId)
+	}
+
+	// A chunk rebuilt from chunks of another stripe does not pass as its data
+	lost := nodes[0]
+	lost.Stripe = nil // keep the parity shards
+	if err := driver.DeleteNodes([]ddrv.Node{lost}); err != nil {
+		t.Fatalf("DeleteNodes() error = %v", err)
+	}
+	if got := read(t, driver, nodes, 0); !bytes.Equal(got, data) {
+		t.Fatal("read without the first chunk message returned different data")
+	}
+	// Range reads are not verified by the reader
+	mixed := []ddrv.Node{nodes[0], others[1], others[2]}
+	r, err := driver.NewReader(mixed, 10)
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	defer r.Close()
+	if _, err = io.ReadAll(r); !errors.Is(err, ddrv.ErrChecksum) {
+		t.Errorf("read of chunk rebuilt from another stripe error = %v, want %v", err, ddrv.ErrChecksum)
+	}
+}
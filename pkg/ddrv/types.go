@@ -1,6 +1,13 @@
 package ddrv
 
-import "errors"
+import (
+	"errors"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/google/uuid"
+)
 
 // ErrClosed is returned when a writer or reader is
 // closed and caller is trying to read or write
@@ -9,6 +16,9 @@ var ErrClosed = errors.New("is closed")
 // ErrAlreadyClosed is returned when the reader/writer is already closed
 var ErrAlreadyClosed = errors.New("already closed")
 
+// ErrChecksum is returned when the data read from a chunk does not match its checksum
+var ErrChecksum = errors.New("chunk checksum mismatch")
+
 // Node represents a Discord attachment URL and Size
 type Node struct {
 	NId   int64  // not used in ddrv package itself but for data providers
@@ -20,14 +30,140 @@ type Node struct {
 	Ex    int    `json:"ex"`  // Node link expiry time
 	Is    int    `json:"is"`  // Node link issued time
 	Hm    string `json:"hm"`  // Node link signature
+	Iv    string // Encryption iv of the chunk, empty if the chunk is not encrypted
+	Hash  string // Hex encoded SHA-256 of the chunk data, empty for chunks written without checksum
+	// Att is the index of the attachment in the message, a message holds up to MaxAttachments chunks
+	Att int `json:"att,omitempty"`
+	// Replicas are copies of the chunk in messages of other channels, read when the chunk itself can not be read
+	Replicas []Replica `json:"replicas,omitempty"`
+	// Stripe is set if the chunk is a data shard of an erasure coded stripe
+	Stripe *Stripe `json:"stripe,omitempty"`
+	// Pack is set if the chunk is a range of a packfile, an attachment shared by small files
+	Pack *Pack `json:"pack,omitempty"`
+	// Leased is set on nodes whose message was leased by the LookupFunc that found them, and on chunks reusing them.
+	// The write which references the chunk releases the lease, data providers do not store it.
+	Leased bool `json:"-"`
+}
+
+// Pack locates a chunk in its packfile. The chunk shares message, iv and links with the packfile,
+// its Size and Hash describe the range of the packfile.
+type Pack struct {
+	Offset int `json:"offset"` // Position of the chunk in the packfile
+	Size   int `json:"size"`   // Size of the packfile
+}
+
+// Stripe describes the erasure coded stripe a chunk belongs to. Every chunk of the stripe
+// carries the parity shards, so a missing chunk can be reconstructed from the other chunks.
+type Stripe struct {
+	Index  int    `json:"index"`  // Index of the chunk among data shards of the stripe
+	Data   int    `json:"data"`   // Number of chunks in the stripe, the last stripe of a file may be shorter
+	Shards int    `json:"shards"` // Number of data shards parity was computed for
+	Size   int    `json:"size"`   // Size of parity shards, shorter chunks are padded with zeros
+	Parity []Node `json:"parity"` // Parity shards
+}
+
+// Replica is a copy of a chunk, it shares size, iv and checksum with the chunk
+type Replica struct {
+	URL string `json:"url"`           // URL where the copy is stored
+	MId int64  `json:"mid"`           // Replica message id
+	Att int    `json:"att,omitempty"` // Index of the attachment in the replica message
+	Ex  int    `json:"ex"`            // Replica link expiry time
+	Is  int    `json:"is"`            // Replica link issued time
+	Hm  string `json:"hm"`            // Replica link signature
+}
+
+// Expired reports whether the link of the chunk or of any of its replicas is expired at unix time now
+func (n *Node) Expired(now int) bool {
+	if now > n.Ex {
+		return true
+	}
+	for _, replica := range n.Replicas {
+		if now > replica.Ex {
+			return true
+		}
+	}
+	if n.Stripe != nil {
+		for _, parity := range n.Stripe.Parity {
+			if now > parity.Ex {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MessageIds returns ids of the messages holding the chunk, its replicas and the parity shards of its stripe
+func (n *Node) MessageIds() []int64 {
+	ids := []int64{n.MId}
+	for _, replica := range n.Replicas {
+		ids = append(ids, replica.MId)
+	}
+	if n.Stripe != nil {
+		for _, parity := range n.Stripe.Parity {
+			ids = append(ids, parity.MId)
+		}
+	}
+	return ids
+}
+
+// replica returns the chunk as stored in the i-th replica
+func (n *Node) replica(i int) Node {
+	chunk := *n
+	r := n.Replicas[i]
+	chunk.URL, chunk.MId, chunk.Att, chunk.Ex, chunk.Is, chunk.Hm = r.URL, r.MId, r.Att, r.Ex, r.Is, r.Hm
+	chunk.Replicas = nil
+	return chunk
+}
+
+// packfile returns the packfile holding the chunk as a node of its own
+func (n *Node) packfile() Node {
+	pack := *n
+	pack.Size, pack.Hash, pack.Pack = n.Pack.Size, "", nil
+	return pack
+}
+
+// Copies returns the chunk followed by its replicas, each as a node of its own
+func (n *Node) Copies() []Node {
+	copies := make([]Node, 0, len(n.Replicas)+1)
+	chunk := *n
+	chunk.Replicas = nil
+	copies = append(copies, chunk)
+	for i := range n.Replicas {
+		copies = append(copies, n.replica(i))
+	}
+	return copies
 }
 
 // Message represents a Discord message and contains attachments (files uploaded within the message).
 type Message struct {
 	Id          string `json:"id"`
+	Content     string `json:"content"`
 	Attachments []Node `json:"attachments"`
 }
 
+// IsChunk reports whether the message looks like chunks uploaded by ddrv, a message without content
+// or with a manifest holding up to MaxAttachments attachments named by random uuids.
+func (m *Message) IsChunk() bool {
+	if (m.Content != "" && !strings.HasPrefix(m.Content, ManifestPrefix)) || len(m.Attachments) == 0 || len(m.Attachments) > MaxAttachments {
+		return false
+	}
+	for _, att := range m.Attachments {
+		if _, err := uuid.Parse(attachmentName(att.URL)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// attachmentName returns the file name of the attachment URL
+func attachmentName(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return path.Base(u.Path)
+}
+
 const (
 	TokenBot = iota
 	TokenUser
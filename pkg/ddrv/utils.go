@@ -1,15 +1,46 @@
 package ddrv
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"log"
 	"net/url"
 	"regexp"
 	"strconv"
+	"time"
 )
 
-// This pattern matches the entire 'https://cdn.discordapp.com/attachments/' part
-// and then captures a sequence of digits
-var discordCDNRe = regexp.MustCompile(`https://cdn\.discordapp\.com/attachments/(\d+)/`)
+// discordEpoch is the first second of 2015 in milliseconds, snowflake ids count from it
+const discordEpoch = 1420070400000
+
+// This pattern matches the '/attachments/' part of the attachment URL path
+// and then captures a sequence of digits, CDN host is not part of the pattern,
+// so it works with any configured CDN host
+var discordCDNRe = regexp.MustCompile(`^/attachments/(\d+)/`)
+
+// This pattern matches the '/webhooks/{id}/{token}' suffix of the webhook URL path
+var webhookRe = regexp.MustCompile(`/webhooks/(\d+)/[\w-]+$`)
+
+// webhook is a discord webhook chunks are uploaded through
+type webhook struct {
+	url string // Webhook URL without query
+	id  string // Webhook id, each webhook has its own rate limit
+}
+
+// parseWebhook validates webhook URL of form https://discord.com/api/webhooks/{id}/{token}
+func parseWebhook(hookURL string) (webhook, error) {
+	parsedURL, err := url.Parse(hookURL)
+	if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") {
+		return webhook{}, fmt.Errorf("invalid webhook url %s", hookURL)
+	}
+	matches := webhookRe.FindStringSubmatch(parsedURL.Path)
+	if len(matches) < 2 {
+		return webhook{}, fmt.Errorf("invalid webhook url %s", hookURL)
+	}
+	parsedURL.RawQuery = ""
+	return webhook{url: parsedURL.String(), id: matches[1]}, nil
+}
 
 // DecodeAttachmentURL parses the input URL and extracts the query parameters.
 // It returns the cleaned URL, `ex` and `is` as integers, `hm` as a string, and an error if any.
@@ -68,13 +99,36 @@ func EncodeAttachmentURL(baseURL string, ex int, is int, hm string) string {
 	return encodedURL
 }
 
-func extractChannelId(url string) string {
+func extractChannelId(attachmentURL string) string {
+	parsedURL, err := url.Parse(attachmentURL)
+	if err != nil {
+		log.Fatalf("extractChannelId : failed to parse attachmentURL : URL -> %s", attachmentURL)
+	}
 	// Find the first match and extract the captured group
-	matches := discordCDNRe.FindStringSubmatch(url)
+	matches := discordCDNRe.FindStringSubmatch(parsedURL.Path)
 	if len(matches) < 2 {
-		log.Fatalf("extractChannelId : failed to extract channelId : URL -> %s", url)
+		log.Fatalf("extractChannelId : failed to extract channelId : URL -> %s", attachmentURL)
 	}
 
 	// The channelId should be the second last part of the URL
 	return matches[1]
 }
+
+// ChunkDigest returns the hex encoded SHA-256 of the chunk checksums of a file. It is not the SHA-256 of the content,
+// it is recomputed by hashing the hex encoded SHA-256 of every chunk, concatenated in file order. It changes whenever
+// content of any chunk changes. ChunkDigest returns an empty string if any chunk was written without checksum.
+func ChunkDigest(chunks []Node) string {
+	h := sha256.New()
+	for _, chunk := range chunks {
+		if chunk.Hash == "" {
+			return ""
+		}
+		h.Write([]byte(chunk.Hash))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// SnowflakeTime returns the creation time of a discord snowflake id
+func SnowflakeTime(id int64) time.Time {
+	return time.UnixMilli(id>>22 + discordEpoch)
+}
@@ -1,30 +1,59 @@
 package ddrv
 
-import "io"
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+)
 
 // Writer implements io.WriteCloser.
-// It streams data in chunks to Discord server channels using webhook
+// It streams data in chunks to Discord server channels using webhook. If the store packs several chunks
+// into a message, reads chunks more than once to retry, replicate or fail over uploads, or chunks are
+// deduplicated, they are buffered until the message is full instead. Chunks are buffered in a temporary
+// file unless the Driver buffers them in memory, see Config.MemoryBuffer. The buffer holds chunk size
+// times chunks per message bytes and is reused for every message of the Writer.
 type Writer struct {
-	rest      *Rest // Manager where Writer writes data
-	chunkSize int   // The maximum Size of a chunk
+	ctx       context.Context
+	store     ChunkStore // Storage the Writer writes chunks to
+	chunkSize int        // The maximum Size of a chunk
 	onChunk   func(chunk Node)
+	lookup    LookupFunc // Optional chunk index used to deduplicate chunks
+	pack      int        // Number of chunks uploaded at once
+	buffered  bool       // Whether chunks are buffered instead of streamed
+	spool     *spool     // Buffered chunks
+	hash      hash.Hash  // Checksum of the buffered chunk being written
+	hashes    []string   // Checksums of the completed buffered chunks
 
 	idx     int            // Current position in the current chunk
+	count   int            // Number of started chunks
 	closed  bool           // Whether the Writer has been closed
 	errCh   chan error     // Channel to send any errors that occur during writing
 	chunkCh chan Node      // Channel to send chunks after they're written
 	pwriter *io.PipeWriter // PipeWriter for writing the current chunk
 }
 
-// NewWriter writes data to discord
-func NewWriter(onChunk func(chunk Node), chunkSize int, rest *Rest) io.WriteCloser {
+// NewWriter writes data to discord, chunks which need to be buffered are buffered in temporary files
+func NewWriter(onChunk func(chunk Node), chunkSize int, store ChunkStore) io.WriteCloser {
+	return newWriter(context.Background(), onChunk, chunkSize, store, nil, &spool{})
+}
+
+func newWriter(ctx context.Context, onChunk func(chunk Node), chunkSize int, store ChunkStore, lookup LookupFunc, spool *spool) io.WriteCloser {
 	w := &Writer{
-		rest:      rest,
-		errCh:     make(chan error),
-		chunkCh:   make(chan Node),
+		ctx:       ctx,
+		store:     store,
+		lookup:    lookup,
+		errCh:     make(chan error, 1),
+		chunkCh:   make(chan Node, 1),
 		onChunk:   onChunk,
 		chunkSize: chunkSize,
+		pack:      packing(store),
+		spool:     spool,
+		hash:      sha256.New(),
 	}
+	w.buffered = w.pack > 1 || lookup != nil || replays(store)
 	return w
 }
 
@@ -35,6 +64,12 @@ func (w *Writer) Write(p []byte) (int, error) {
 	if w.closed {
 		return 0, ErrClosed
 	}
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if w.buffered {
+		return w.writeBuffered(p)
+	}
 	if w.pwriter == nil {
 		w.next()
 	}
@@ -68,9 +103,91 @@ func (w *Writer) Close() error {
 		return ErrAlreadyClosed
 	}
 	w.closed = true
+	if w.buffered {
+		err := w.upload()
+		if cerr := w.spool.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+	// Nothing was written
+	if w.pwriter == nil {
+		return nil
+	}
 	return w.flush(false)
 }
 
+// writeBuffered buffers p and uploads the buffered chunks whenever they fill a message.
+// Chunks are hashed as they are buffered, so they are only read again to upload them.
+func (w *Writer) writeBuffered(p []byte) (int, error) {
+	chunkSize := int64(w.chunkSize)
+	if w.spool.mem && w.spool.buf == nil {
+		w.spool.buf = make([]byte, 0, int64(w.pack)*chunkSize)
+	}
+	written := 0
+	for len(p) > 0 {
+		n := int(chunkSize - w.spool.size%chunkSize)
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := w.spool.Write(p[:n]); err != nil {
+			return written, err
+		}
+		w.hash.Write(p[:n])
+		p = p[n:]
+		written += n
+		if w.spool.size%chunkSize != 0 {
+			continue
+		}
+		w.hashes = append(w.hashes, hex.EncodeToString(w.hash.Sum(nil)))
+		w.hash.Reset()
+		if w.spool.size < int64(w.pack)*chunkSize {
+			continue
+		}
+		if err := w.upload(); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// upload uploads the buffered chunks and passes them to onChunk
+func (w *Writer) upload() error {
+	size, chunkSize := w.spool.size, int64(w.chunkSize)
+	if size == 0 {
+		return nil
+	}
+	if size%chunkSize != 0 {
+		w.hashes = append(w.hashes, hex.EncodeToString(w.hash.Sum(nil)))
+		w.hash.Reset()
+	}
+	var ctxs []context.Context
+	var data []*io.SectionReader
+	for start := int64(0); start < size; start += chunkSize {
+		n := chunkSize
+		if start+n > size {
+			n = size - start
+		}
+		ctxs = append(ctxs, withChunk(w.ctx, w.count, int64(w.count)*chunkSize))
+		data = append(data, w.spool.section(start, n))
+		w.count++
+	}
+	// Chunks of a failed upload are not uploaded again by Close
+	hashes := w.hashes
+	w.spool.reset()
+	w.hashes = nil
+	chunks, err := createChunks(ctxs, w.store, w.lookup, data, hashes)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		if w.onChunk != nil {
+			w.onChunk(chunk)
+		}
+	}
+	return nil
+}
+
 // flush closes the current chunk, waits for it to be written to storage,
 // and starts a new chunk if next is true.
 func (w *Writer) flush(next bool) error {
@@ -96,12 +213,14 @@ func (w *Writer) next() {
 	if !w.closed {
 		reader, writer := io.Pipe()
 		w.pwriter = writer
+		ctx := withChunk(w.ctx, w.count, int64(w.count)*int64(w.chunkSize))
+		w.count++
 		go func() {
-			chunk, err := w.rest.CreateAttachment(reader)
+			chunk, err := w.create(ctx, reader)
 			if err != nil {
-				// Read everything from reader,
+				// Fail pending and future writes to the chunk,
 				// so w.pwriter.Write can be unblocked
-				_, _ = io.Copy(io.Discard, reader)
+				_ = reader.CloseWithError(err)
 				w.errCh <- err
 			} else {
 				w.idx = 0
@@ -110,3 +229,138 @@ func (w *Writer) next() {
 		}()
 	}
 }
+
+// create uploads the chunk streamed from reader
+func (w *Writer) create(ctx context.Context, reader io.Reader) (*Node, error) {
+	h := sha256.New()
+	chunk, err := w.store.Put(ctx, io.TeeReader(reader, h))
+	if err != nil {
+		return nil, err
+	}
+	chunk.Hash = hex.EncodeToString(h.Sum(nil))
+	return chunk, nil
+}
+
+// createChunk uploads data as a new chunk, unless lookup finds an
+// existing chunk with the same content which can be reused.
+func createChunk(ctx context.Context, store ChunkStore, lookup LookupFunc, data []byte) (*Node, error) {
+	hash := checksum(data)
+	node, err := reusableChunk(store, lookup, hash, len(data))
+	if err != nil || node != nil {
+		return node, err
+	}
+	chunk, err := store.Put(ctx, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	chunk.Hash = hash
+	return chunk, nil
+}
+
+// createChunks is like createChunk for consecutive chunks of a write read from data, ctxs hold the context
+// and hashes the checksum of every chunk. Chunks which are uploaded one after another are packed into messages,
+// chunks reused in between split them.
+func createChunks(ctxs []context.Context, store ChunkStore, lookup LookupFunc, data []*io.SectionReader, hashes []string) ([]Node, error) {
+	chunks := make([]Node, len(data))
+	var pending []int // Chunks waiting for upload
+	upload := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		readers := make([]io.Reader, len(pending))
+		for i, idx := range pending {
+			readers[i] = data[idx]
+		}
+		// The manifest of the first chunk describes the message
+		nodes, err := putChunks(ctxs[pending[0]], store, readers)
+		if err != nil {
+			return err
+		}
+		for i, idx := range pending {
+			chunks[idx] = *nodes[i]
+			chunks[idx].Hash = hashes[idx]
+		}
+		pending = pending[:0]
+		return nil
+	}
+	for i := range data {
+		node, err := reusableChunk(store, lookup, hashes[i], int(data[i].Size()))
+		if err != nil {
+			return nil, err
+		}
+		if node == nil {
+			pending = append(pending, i)
+			continue
+		}
+		if err = upload(); err != nil {
+			return nil, err
+		}
+		chunks[i] = *node
+	}
+	if err := upload(); err != nil {
+		return nil, err
+	}
+	return chunks, nil
+}
+
+// reusableChunk returns the existing chunk found by lookup if it can be reused for data with given checksum,
+// or nil if there is none.
+func reusableChunk(store ChunkStore, lookup LookupFunc, hash string, size int) (*Node, error) {
+	if lookup == nil {
+		return nil, nil
+	}
+	node, err := lookup(hash, size)
+	if err != nil {
+		return nil, err
+	}
+	// Chunk can only be reused if it is stored the same way. Its stripe is not carried over, as stripe
+	// neighbours are the chunks around it in the file, StripeWriter sets the stripe of the new file instead.
+	if node != nil && node.Size == size && (node.Iv != "") == encrypted(store) {
+		return &Node{URL: node.URL, Size: node.Size, MId: node.MId, Att: node.Att, Ex: node.Ex, Is: node.Is, Hm: node.Hm, Iv: node.Iv, Hash: hash,
+			Replicas: node.Replicas, Pack: node.Pack, Leased: node.Leased}, nil
+	}
+	return nil, nil
+}
+
+// sections returns readers and checksums of chunks held in memory, for createChunks
+func sections(data [][]byte) ([]*io.SectionReader, []string) {
+	readers := make([]*io.SectionReader, len(data))
+	hashes := make([]string, len(data))
+	for i := range data {
+		readers[i] = io.NewSectionReader(bytes.NewReader(data[i]), 0, int64(len(data[i])))
+		hashes[i] = checksum(data[i])
+	}
+	return readers, hashes
+}
+
+// checksum returns the hex encoded SHA-256 of data
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Digester is implemented by writers of a Driver
+type Digester interface {
+	// Digest returns the hex encoded SHA-256 of every byte written so far
+	Digest() string
+}
+
+// digestWriter computes the SHA-256 of the bytes written to the underlying writer
+type digestWriter struct {
+	io.WriteCloser
+	hash hash.Hash
+}
+
+func newDigestWriter(w io.WriteCloser) io.WriteCloser {
+	return &digestWriter{WriteCloser: w, hash: sha256.New()}
+}
+
+func (w *digestWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.hash.Write(p[:n])
+	return n, err
+}
+
+func (w *digestWriter) Digest() string {
+	return hex.EncodeToString(w.hash.Sum(nil))
+}
@@ -0,0 +1,329 @@
+package ddrv_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/forscht/ddrv/pkg/ddrv"
+	"github.com/forscht/ddrv/pkg/ddrv/ddrvtest"
+)
+
+func TestChecksum(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	driver := newDriver(t, s.Config(1024, "1", "2"))
+
+	for name, writer := range map[string]func(d *ddrv.Driver, onChunk func(ddrv.Node)) io.WriteCloser{
+		"writer":  (*ddrv.Driver).NewWriter,
+		"nwriter": (*ddrv.Driver).NewNWriter,
+	} {
+		t.Run(name, func(t *testing.T) {
+			data := randBytes(t, 3000)
+			var nodes []ddrv.Node
+			write(t, writer(driver, func(chunk ddrv.Node) { nodes = append(nodes, chunk) }), data)
+			for i, node := range nodes {
+				sum := sha256.Sum256(data[i*1024 : i*1024+node.Size])
+				if node.Hash != hex.EncodeToString(sum[:]) {
+					t.Fatalf("chunk %d hash = %s, want %x", i, node.Hash, sum)
+				}
+			}
+			if got := read(t, driver, nodes, 0); !bytes.Equal(got, data) {
+				t.Fatal("read returned different data")
+			}
+
+			// Record wrong checksum as if the attachment was swapped
+			nodes[0].Hash = nodes[1].Hash
+			r, err := driver.NewReader(nodes, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = io.ReadAll(r); !errors.Is(err, ddrv.ErrChecksum) {
+				t.Errorf("read with mismatched checksum error = %v, want %v", err, ddrv.ErrChecksum)
+			}
+			// Partial reads of the first chunk are not verified
+			if got := read(t, driver, nodes, 10); !bytes.Equal(got, data[10:]) {
+				t.Error("partial read returned different data")
+			}
+		})
+	}
+}
+
+func TestDedup(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+
+	for name, writer := range map[string]func(d *ddrv.Driver, onChunk func(ddrv.Node)) io.WriteCloser{
+		"writer":  (*ddrv.Driver).NewWriter,
+		"nwriter": (*ddrv.Driver).NewNWriter,
+	} {
+		t.Run(name, func(t *testing.T) {
+			// Lookup and onChunk are called from workers of NWriter
+			var mu sync.Mutex
+			index := make(map[string]ddrv.Node)
+			driver := newDriver(t, s.Config(1024, "1", "2"))
+			driver.Lookup = func(hash string, size int) (*ddrv.Node, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				if node, ok := index[hash]; ok {
+					return &node, nil
+				}
+				return nil, nil
+			}
+			data := randBytes(t, 3000)
+			var first []ddrv.Node
+			write(t, writer(driver, func(chunk ddrv.Node) {
+				mu.Lock()
+				defer mu.Unlock()
+				index[chunk.Hash] = chunk
+				first = append(first, chunk)
+			}), data)
+
+			uploads := s.Stats().Uploads
+			var second []ddrv.Node
+			write(t, writer(driver, func(chunk ddrv.Node) { second = append(second, chunk) }), data)
+			if got := s.Stats().Uploads - uploads; got != 0 {
+				t.Errorf("second write uploaded %d chunks, want 0", got)
+			}
+			for i := range second {
+				if second[i].MId != first[i].MId {
+					t.Errorf("chunk %d was not reused", i)
+				}
+			}
+			if got := read(t, driver, second, 0); !bytes.Equal(got, data) {
+				t.Error("read of deduplicated chunks returned different data")
+			}
+
+			// Encrypted driver must not reuse plain chunks
+			cfg := s.Config(1024, "1", "2")
+			cfg.Passphrase = "secret"
+			encrypted := newDriver(t, cfg)
+			encrypted.Lookup = driver.Lookup
+			uploads = s.Stats().Uploads
+			write(t, writer(encrypted, nil), data[:1000])
+			if got := s.Stats().Uploads - uploads; got != 1 {
+				t.Errorf("encrypted write uploaded %d chunks, want 1", got)
+			}
+		})
+	}
+}
+
+func TestAttachments(t *testing.T) {
+	for _, refresh := range []bool{true, false} {
+		s := ddrvtest.NewServer()
+		defer s.Close()
+		if !refresh {
+			s.DisableRefreshURLs()
+		}
+		messages := func() int { return len(s.Messages("1")) + len(s.Messages("2")) }
+
+		for name, passphrase := range map[string]string{"plain": "", "encrypted": "secret"} {
+			cfg := s.Config(1024, "1", "2")
+			cfg.Passphrase = passphrase
+			cfg.Attachments = 4
+			driver := newDriver(t, cfg)
+			data := randBytes(t, 10*driver.ChunkSize+100)
+
+			for wname, writer := range map[string]func(ctx context.Context, onChunk func(ddrv.Node)) io.WriteCloser{
+				"writer":  driver.NewWriterContext,
+				"nwriter": driver.NewNWriterContext,
+			} {
+				t.Run(name+"/"+wname, func(t *testing.T) {
+					before := messages()
+					seen := make(map[string]bool)
+					for _, channel := range []string{"1", "2"} {
+						for _, m := range s.Messages(channel) {
+							seen[m.Id] = true
+						}
+					}
+					// Issue already expired attachment URLs
+					s.SetTTL(-time.Second)
+					var nodes []ddrv.Node
+					ctx := ddrv.WithManifest(context.Background(), "f1", "/a.bin", 0, 0)
+					write(t, writer(ctx, func(chunk ddrv.Node) { nodes = append(nodes, chunk) }), data)
+					s.SetTTL(time.Hour)
+
+					// 11 chunks are packed into messages of 4, 4 and 3 attachments
+					if len(nodes) != 11 || messages()-before != 3 {
+						t.Fatalf("got %d chunks in %d messages, want 11 chunks in 3 messages", len(nodes), messages()-before)
+					}
+					for i, node := range nodes {
+						if node.Att != i%4 || node.MId != nodes[i-i%4].MId {
+							t.Errorf("chunk %d is attachment %d of message %d, want attachment %d of message %d", i, node.Att, node.MId, i%4, nodes[i-i%4].MId)
+						}
+					}
+
+					// Manifests describe every chunk of the message
+					type attachment struct {
+						mid int64
+						att int
+					}
+					manifests := make(map[attachment]ddrv.Manifest)
+					for _, channel := range []string{"1", "2"} {
+						for _, m := range s.Messages(channel) {
+							if seen[m.Id] {
+								continue
+							}
+							msg := ddrv.Message{Id: m.Id, Content: m.Content}
+							for _, a := range m.Attachments {
+								msg.Attachments = append(msg.Attachments, ddrv.Node{URL: a.URL, Size: a.Size})
+							}
+							if !msg.IsChunk() {
+								t.Errorf("message with %d attachments is not a chunk", len(msg.Attachments))
+							}
+							chunks, found, err := driver.Rest.Chunks(&msg)
+							if err != nil {
+								t.Fatalf("Chunks() error = %v", err)
+							}
+							for i, chunk := range chunks {
+								manifests[attachment{chunk.MId, chunk.Att}] = found[i]
+							}
+						}
+					}
+					for i, node := range nodes {
+						m, ok := manifests[attachment{node.MId, node.Att}]
+						if !ok || m.Index != i || m.Offset != int64(i)*int64(driver.ChunkSize) {
+							t.Errorf("chunk %d has manifest %+v, want index %d at %d", i, m, i, i*driver.ChunkSize)
+						}
+					}
+
+					// Attachments of a message are refreshed together
+					expired := make([]*ddrv.Node, len(nodes))
+					for i := range nodes {
+						expired[i] = &nodes[i]
+					}
+					stats := s.Stats()
+					if err := driver.UpdateNodes(expired); err != nil {
+						t.Fatalf("UpdateNodes() error = %v", err)
+					}
+					if requests := s.Stats().Requests - stats.Requests; refresh && requests != 1 {
+						t.Errorf("UpdateNodes() sent %d requests, want a single refresh", requests)
+					}
+					if got := read(t, driver, nodes, 0); !bytes.Equal(got, data) {
+						t.Error("read of packed chunks returned different data")
+					}
+
+					// Deleting the chunks deletes each message once
+					if err := driver.DeleteNodes(nodes); err != nil {
+						t.Fatalf("DeleteNodes() error = %v", err)
+					}
+					if got := messages(); got != before {
+						t.Errorf("%d messages left after DeleteNodes(), want %d", got, before)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestAttachmentsDedup(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+	cfg := s.Config(1024, "1")
+	cfg.Attachments = 4
+	driver := newDriver(t, cfg)
+	data := randBytes(t, 8*1024)
+	var first []ddrv.Node
+	write(t, driver.NewWriter(func(chunk ddrv.Node) { first = append(first, chunk) }), data)
+
+	// Chunks reused in between split the packed messages
+	index := make(map[string]ddrv.Node)
+	for i, chunk := range first {
+		if i%2 == 0 {
+			index[chunk.Hash] = chunk
+		}
+	}
+	driver.Lookup = func(hash string, size int) (*ddrv.Node, error) {
+		if node, ok := index[hash]; ok {
+			return &node, nil
+		}
+		return nil, nil
+	}
+	before := len(s.Messages("1"))
+	var second []ddrv.Node
+	write(t, driver.NewWriter(func(chunk ddrv.Node) { second = append(second, chunk) }), data)
+	if got := len(s.Messages("1")) - before; got != 4 {
+		t.Errorf("second write created %d messages, want 4", got)
+	}
+	for i := 0; i < len(second); i += 2 {
+		if second[i].MId != first[i].MId || second[i].Att != first[i].Att {
+			t.Errorf("chunk %d was not reused", i)
+		}
+	}
+	if got := read(t, driver, second, 0); !bytes.Equal(got, data) {
+		t.Error("read of partly deduplicated chunks returned different data")
+	}
+
+	for name, cfg := range map[string]*ddrv.Config{
+		"too many attachments": func() *ddrv.Config { c := s.Config(1024, "1"); c.Attachments = 11; return c }(),
+		"upload limit":         func() *ddrv.Config { c := s.Config(ddrv.MaxChunkSize/2, "1"); c.Attachments = 3; return c }(),
+		"erasure coding": func() *ddrv.Config {
+			c := s.Config(1024, "1")
+			c.Attachments, c.DataShards, c.ParityShards = 2, 2, 1
+			return c
+		}(),
+	} {
+		if _, err := ddrv.New(cfg); err == nil {
+			t.Errorf("New() with %s succeeded", name)
+		}
+	}
+}
+
+func TestSpool(t *testing.T) {
+	s := ddrvtest.NewServer()
+	defer s.Close()
+
+	for _, memory := range []bool{false, true} {
+		dir := t.TempDir()
+		cfg := s.Config(1024, "1", "2")
+		cfg.Attachments = 3
+		cfg.Retry = ddrv.RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+		cfg.SpoolDir = dir
+		cfg.MemoryBuffer = memory
+		driver := newDriver(t, cfg)
+		spooled := func() int {
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return len(entries)
+		}
+
+		data := randBytes(t, 5000)
+		var nodes []ddrv.Node
+		w := driver.NewWriter(func(chunk ddrv.Node) { nodes = append(nodes, chunk) })
+		if _, err := w.Write(data[:2000]); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		want := 1
+		if memory {
+			want = 0
+		}
+		if got := spooled(); got != want {
+			t.Errorf("memory %v: %d files in spool dir while buffering, want %d", memory, got, want)
+		}
+		// Failed uploads are resent from the buffer
+		s.FailNext(http.StatusInternalServerError, 2)
+		write(t, w, data[2000:])
+		if got := spooled(); got != 0 {
+			t.Errorf("memory %v: %d files in spool dir after Close, want 0", memory, got)
+		}
+		for i, node := range nodes {
+			sum := sha256.Sum256(data[i*1024 : i*1024+node.Size])
+			if node.Hash != hex.EncodeToString(sum[:]) {
+				t.Errorf("memory %v: chunk %d hash = %s, want %x", memory, i, node.Hash, sum)
+			}
+		}
+		if got := read(t, driver, nodes, 0); !bytes.Equal(got, data) {
+			t.Errorf("memory %v: read returned different data", memory)
+		}
+	}
+}
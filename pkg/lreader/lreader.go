@@ -9,6 +9,7 @@ import "io"
 type lreader struct {
 	r      io.ReadCloser // underlying reader
 	remain int           // remaining bytes
+	closed bool          // whether the underlying reader is closed
 }
 
 // New initializes a new instance of lreader with the provided ReadCloser and limit,
@@ -39,7 +40,7 @@ func (l *lreader) Read(p []byte) (int, error) {
 	l.remain -= n
 
 	if err == io.EOF {
-		_ = l.r.Close()
+		_ = l.Close()
 		l.remain = 0
 	}
 
@@ -53,3 +54,13 @@ func (l *lreader) Read(p []byte) (int, error) {
 
 	return n, err
 }
+
+// Close closes the underlying ReadCloser if it is not closed yet. It lets callers
+// release the underlying reader when they stop reading before the limit is reached.
+func (l *lreader) Close() error {
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	return l.r.Close()
+}